@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -15,13 +17,15 @@ import (
 )
 
 var serviceName = os.Getenv("FLYNN_POSTGRES")
-var serviceHost string
+var serviceHost, poolerHost, readOnlyHost string
 
 func init() {
 	if serviceName == "" {
 		serviceName = "postgres"
 	}
 	serviceHost = fmt.Sprintf("leader.%s.discoverd", serviceName)
+	poolerHost = fmt.Sprintf("%s-pooler.discoverd", serviceName)
+	readOnlyHost = fmt.Sprintf("%s-readonly.discoverd", serviceName)
 }
 
 func main() {
@@ -60,7 +64,21 @@ type resource struct {
 	Env map[string]string `json:"env"`
 }
 
-func createDatabase(db *postgres.DB, r render.Render) {
+// databaseConfig is the provider config of a database resource.
+type databaseConfig struct {
+	// Pooler sets PGHOST to the connection pooler rather than the primary,
+	// which requires the pooler process of the postgres app to be running.
+	Pooler bool `json:"pooler"`
+}
+
+func createDatabase(db *postgres.DB, req *http.Request, r render.Render) {
+	var config databaseConfig
+	if err := json.NewDecoder(req.Body).Decode(&config); err != nil && err != io.EOF {
+		log.Println(err)
+		r.JSON(400, struct{}{})
+		return
+	}
+
 	username, password, database := random.Hex(16), random.Hex(16), random.Hex(16)
 
 	if err := db.Exec(fmt.Sprintf(`CREATE USER "%s" WITH PASSWORD '%s'`, username, password)); err != nil {
@@ -75,14 +93,19 @@ func createDatabase(db *postgres.DB, r render.Render) {
 		return
 	}
 
+	host := serviceHost
+	if config.Pooler {
+		host = poolerHost
+	}
 	r.JSON(200, &resource{
 		ID: fmt.Sprintf("/databases/%s:%s", username, database),
 		Env: map[string]string{
-			"FLYNN_POSTGRES": serviceName,
-			"PGHOST":         serviceHost,
-			"PGUSER":         username,
-			"PGPASSWORD":     password,
-			"PGDATABASE":     database,
+			"FLYNN_POSTGRES":  serviceName,
+			"PGHOST":          host,
+			"PGHOST_READONLY": readOnlyHost,
+			"PGUSER":          username,
+			"PGPASSWORD":      password,
+			"PGDATABASE":      database,
 		},
 	})
 }
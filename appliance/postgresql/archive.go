@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/flynn/flynn/appliance/postgresql/backup"
+	"github.com/flynn/flynn/pkg/sirenia/state"
+)
+
+var ErrNotPrimary = errors.New("postgres is not running as primary")
+
+// Restore configures a new cluster to be restored from the base backup and
+// archived WAL of another cluster.
+type Restore struct {
+	Store  *backup.Store
+	Backup *backup.Backup
+	Target *backup.Target
+
+	// Command is the postgres restore_command which fetches archived WAL
+	// files from Store.
+	Command string
+}
+
+// Backup takes a base backup of the running primary and stores it.
+func (p *Postgres) Backup(store *backup.Store) (*backup.Backup, error) {
+	p.backupMtx.Lock()
+	defer p.backupMtx.Unlock()
+
+	log := p.log.New("fn", "Backup")
+
+	if config := p.config(); !p.running() || config == nil || config.Role != state.RolePrimary {
+		return nil, ErrNotPrimary
+	}
+
+	startXLog, err := p.XLogPosition()
+	if err != nil {
+		log.Error("error getting xlog position", "err", err)
+		return nil, err
+	}
+	b := &backup.Backup{
+		StartXLog: startXLog,
+		StartTime: time.Now().UTC(),
+	}
+	b.ID = backup.NewID(b.StartTime)
+	log = log.New("id", b.ID)
+	log.Info("starting base backup")
+
+	cmd := exec.Command(
+		p.binPath("pg_basebackup"),
+		"--pgdata", "-",
+		"--format=tar",
+		"--gzip",
+		"--xlog-method=fetch",
+		"--checkpoint=fast",
+		"--dbname", fmt.Sprintf("host=127.0.0.1 port=%s user=flynn password=%s", p.port, p.password),
+	)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Error("error starting pg_basebackup", "err", err)
+		return nil, err
+	}
+	b.Size, err = store.PutBackup(b.ID, out)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		log.Error("error storing base backup", "err", err)
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		log.Error("error running pg_basebackup", "err", err)
+		return nil, err
+	}
+
+	b.EndXLog, err = p.XLogPosition()
+	if err != nil {
+		log.Error("error getting xlog position", "err", err)
+		return nil, err
+	}
+	b.EndTime = time.Now().UTC()
+	if err := store.AddBackup(b); err != nil {
+		log.Error("error adding base backup to index", "err", err)
+		return nil, err
+	}
+	log.Info("base backup complete", "size", b.Size, "end_xlog", b.EndXLog)
+	return b, nil
+}
+
+// RunBackups takes a base backup every interval while running as primary.
+func (p *Postgres) RunBackups(store *backup.Store, interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := p.Backup(store); err != nil && err != ErrNotPrimary {
+			p.log.Error("error taking periodic base backup", "fn", "RunBackups", "err", err)
+		}
+	}
+}
+
+// initialized returns whether the data directory contains a cluster.
+func (p *Postgres) initialized() bool {
+	_, err := os.Stat(p.dataPath("PG_VERSION"))
+	return err == nil
+}
+
+// restoreBackup populates the data directory from the configured base backup
+// and writes a recovery.conf which replays archived WAL up to the recovery
+// target.
+func (p *Postgres) restoreBackup() error {
+	log := p.log.New("fn", "restoreBackup", "backup", p.restore.Backup.ID, "target", p.restore.Target)
+	log.Info("restoring base backup")
+
+	body, err := p.restore.Store.GetBackup(p.restore.Backup.ID)
+	if err != nil {
+		log.Error("error getting base backup", "err", err)
+		return err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(p.dataDir, 0700); err != nil {
+		return err
+	}
+	cmd := exec.Command("tar", "--extract", "--gzip", "--file", "-", "--directory", p.dataDir)
+	cmd.Stdin = body
+	if err := p.runCmd(cmd); err != nil {
+		log.Error("error extracting base backup", "err", err)
+		return err
+	}
+
+	if err := p.writeHBAConf(); err != nil {
+		return err
+	}
+	if err := p.writeRestoreConf(); err != nil {
+		log.Error("error writing recovery.conf", "path", p.recoveryConfPath(), "err", err)
+		return err
+	}
+	return nil
+}
+
+// waitForRecovery waits for postgres to replay archived WAL up to the
+// recovery target and finish recovery.
+func (p *Postgres) waitForRecovery() error {
+	log := p.log.New("fn", "waitForRecovery")
+	log.Info("waiting for recovery to complete")
+	for {
+		var recovering bool
+		if err := p.db.QueryRow("SELECT pg_is_in_recovery()").Scan(&recovering); err != nil {
+			log.Error("error checking recovery status", "err", err)
+			return err
+		}
+		if !recovering {
+			log.Info("recovery complete")
+			return nil
+		}
+		time.Sleep(checkInterval)
+	}
+}
+
+func (p *Postgres) writeRestoreConf() error {
+	data := restoreData{RestoreCommand: p.restore.Command}
+	if t := p.restore.Target; t != nil && !t.Time.IsZero() {
+		data.TargetTime = t.Time.Format("2006-01-02 15:04:05.999999-07")
+	}
+
+	f, err := os.Create(p.recoveryConfPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return restoreConfTemplate.Execute(f, data)
+}
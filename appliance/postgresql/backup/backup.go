@@ -0,0 +1,343 @@
+// Package backup stores continuously archived WAL segments and periodic base
+// backups of a postgres cluster in the blobstore, and finds the base backup to
+// restore from when recovering the cluster to a point in time.
+//
+// The files of a cluster are stored under a per-service prefix:
+//
+//	wal/<segment>          archived WAL segments and timeline history files
+//	base/<id>.tar.gz       base backups, as written by pg_basebackup -Ft -z
+//	backups.json           an index of the base backups
+//
+// The blobstore doesn't support listing files, so the index is maintained by
+// the primary, which is the only member of the cluster that takes backups.
+//
+// If the blobstore requires signed URLs, requests are signed with a key for
+// the prefix of the cluster (see pkg/signedurl.PrefixKey), which the
+// controller issues, so that a cluster can only access its own backups.
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/appliance/postgresql/pgxlog"
+	"github.com/flynn/flynn/pkg/signedurl"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
+)
+
+// DefaultURL is the blobstore URL under which backups are stored by default.
+const DefaultURL = "http://blobstore.discoverd/postgres-backups"
+
+// KeyMethods are the methods of the key a cluster stores its backups with, and
+// ReadKeyMethods those of the key a cluster being restored reads the backups
+// of another cluster with.
+var (
+	KeyMethods     = []string{"GET", "PUT"}
+	ReadKeyMethods = []string{"GET"}
+)
+
+var (
+	ErrNotFound = errors.New("backup: not found")
+	ErrNoBackup = errors.New("backup: no base backup before the recovery target")
+)
+
+// Backup is a base backup of a cluster.
+type Backup struct {
+	ID string `json:"id"`
+
+	// StartXLog and EndXLog are the xlog positions of the primary immediately
+	// before and after taking the backup, so the backup is consistent at
+	// EndXLog and any later position.
+	StartXLog xlog.Position `json:"start_xlog"`
+	EndXLog   xlog.Position `json:"end_xlog"`
+
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Size      int64     `json:"size"`
+}
+
+// Target is the point in time to recover a cluster to. A Target with neither
+// field set recovers to the latest archived state.
+type Target struct {
+	Time time.Time
+	XLog xlog.Position
+}
+
+// ParseTarget parses a recovery target, which is either an xlog position (for
+// example "0/17BB660") or an RFC 3339 timestamp. An empty string is the
+// latest archived state.
+func ParseTarget(s string) (*Target, error) {
+	if s == "" {
+		return &Target{}, nil
+	}
+	if strings.Contains(s, "/") {
+		pos := xlog.Position(s)
+		if _, err := pgxlog.Compare(pos, pgxlog.Zero); err != nil {
+			return nil, err
+		}
+		return &Target{XLog: pos}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("backup: invalid recovery target %q, expected an xlog position or RFC 3339 timestamp", s)
+	}
+	return &Target{Time: t.UTC()}, nil
+}
+
+func (t *Target) String() string {
+	switch {
+	case t.XLog != "":
+		return string(t.XLog)
+	case !t.Time.IsZero():
+		return t.Time.Format(time.RFC3339)
+	default:
+		return "latest"
+	}
+}
+
+// Before returns whether the backup b is consistent before the target, so
+// that recovering from it can reach the target.
+func (t *Target) Before(b *Backup) bool {
+	switch {
+	case t.XLog != "":
+		cmp, err := pgxlog.Compare(b.EndXLog, t.XLog)
+		return err == nil && cmp <= 0
+	case !t.Time.IsZero():
+		return !b.EndTime.After(t.Time)
+	default:
+		return true
+	}
+}
+
+// Store stores the backups of a cluster.
+type Store struct {
+	// URL is the blobstore URL of the files of the cluster.
+	URL  string
+	HTTP *http.Client
+
+	// Key signs requests to the blobstore if it is set. It is a prefix key
+	// for the path of URL and Methods, see pkg/signedurl.PrefixKey.
+	Key     string
+	Methods []string
+}
+
+// NewStore returns a Store for the backups of the service stored under
+// baseURL, signing requests with key, a key for Prefix(baseURL, service) and
+// KeyMethods, if it is set.
+func NewStore(baseURL, service, key string) *Store {
+	return &Store{
+		URL:     storeURL(baseURL, service),
+		HTTP:    http.DefaultClient,
+		Key:     key,
+		Methods: KeyMethods,
+	}
+}
+
+// NewReadStore is like NewStore, but key is for ReadKeyMethods, so the
+// backups can only be read.
+func NewReadStore(baseURL, service, key string) *Store {
+	s := NewStore(baseURL, service, key)
+	s.Methods = ReadKeyMethods
+	return s
+}
+
+// Prefix returns the blobstore path that the backups of the service stored
+// under baseURL are stored under, which the keys of a Store are issued for.
+func Prefix(baseURL, service string) (string, error) {
+	u, err := url.Parse(storeURL(baseURL, service))
+	if err != nil {
+		return "", err
+	}
+	return u.Path, nil
+}
+
+func storeURL(baseURL, service string) string {
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + service
+}
+
+// PutWAL stores the archived WAL segment or history file with the given name.
+func (s *Store) PutWAL(name string, r io.Reader) error {
+	return s.put("/wal/"+name, r)
+}
+
+// GetWAL returns the archived WAL file with the given name, or ErrNotFound if
+// it hasn't been archived.
+func (s *Store) GetWAL(name string) (io.ReadCloser, error) {
+	return s.get("/wal/" + name)
+}
+
+// PutBackup stores the base backup with the given ID read from r, returning
+// the number of bytes stored. The backup isn't listed until it is added to the
+// index with AddBackup.
+func (s *Store) PutBackup(id string, r io.Reader) (int64, error) {
+	cr := &countReader{r: r}
+	err := s.put(backupPath(id), cr)
+	return cr.n, err
+}
+
+// AddBackup adds the stored base backup b to the index.
+func (s *Store) AddBackup(b *Backup) error {
+	backups, err := s.List()
+	if err != nil {
+		return err
+	}
+	backups = append(backups, b)
+	data, err := json.Marshal(backups)
+	if err != nil {
+		return err
+	}
+	return s.put("/backups.json", bytes.NewReader(data))
+}
+
+// GetBackup returns the contents of the base backup with the given ID.
+func (s *Store) GetBackup(id string) (io.ReadCloser, error) {
+	return s.get(backupPath(id))
+}
+
+// List returns the base backups of the cluster, oldest first.
+func (s *Store) List() ([]*Backup, error) {
+	body, err := s.get("/backups.json")
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var backups []*Backup
+	if err := json.NewDecoder(body).Decode(&backups); err != nil {
+		return nil, err
+	}
+	sort.Sort(backupsByTime(backups))
+	return backups, nil
+}
+
+// Find returns the latest base backup from which the cluster can be recovered
+// to the target.
+func (s *Store) Find(target *Target) (*Backup, error) {
+	backups, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if target.Before(backups[i]) {
+			return backups[i], nil
+		}
+	}
+	return nil, ErrNoBackup
+}
+
+func (s *Store) put(path string, r io.Reader) error {
+	u, err := s.url("PUT", path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", u, r)
+	if err != nil {
+		return err
+	}
+	res, err := s.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("backup: unexpected status %d storing %s", res.StatusCode, path)
+	}
+	return nil
+}
+
+func (s *Store) get(path string) (io.ReadCloser, error) {
+	u, err := s.url("GET", path)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.HTTP.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case 200:
+		return res.Body, nil
+	case 404:
+		res.Body.Close()
+		return nil, ErrNotFound
+	default:
+		res.Body.Close()
+		return nil, fmt.Errorf("backup: unexpected status %d getting %s", res.StatusCode, path)
+	}
+}
+
+// url returns the URL of path, signed for method if s.Key is set.
+func (s *Store) url(method, path string) (string, error) {
+	if s.Key == "" {
+		return s.URL + path, nil
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return "", err
+	}
+	return signedurl.SignPrefix(s.Key, u.Path, s.Methods, s.URL+path, []string{method}, time.Now().Add(time.Minute))
+}
+
+func backupPath(id string) string {
+	return "/base/" + id + ".tar.gz"
+}
+
+// NewID returns the ID of a base backup started at t, which sorts in the
+// order backups are taken.
+func NewID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// SegmentNeeded returns whether the archived WAL file with the given name may
+// be replayed when recovering to the xlog position target.
+//
+// Postgres 9.4 can't stop recovery at an xlog position, so recovery to one
+// stops at the end of the WAL segment containing it by not restoring any
+// later segments. This assumes the default segment size of 16MB. Files other
+// than segments, such as timeline history files, are always needed.
+func SegmentNeeded(name string, target xlog.Position) bool {
+	if len(name) != 24 {
+		return true
+	}
+	log, err := strconv.ParseUint(name[8:16], 16, 32)
+	if err != nil {
+		return true
+	}
+	seg, err := strconv.ParseUint(name[16:24], 16, 32)
+	if err != nil {
+		return true
+	}
+	start := xlog.Position(fmt.Sprintf("%X/%08X", log, seg<<24))
+	cmp, err := pgxlog.Compare(start, target)
+	return err != nil || cmp <= 0
+}
+
+type backupsByTime []*Backup
+
+func (b backupsByTime) Len() int           { return len(b) }
+func (b backupsByTime) Less(i, j int) bool { return b[i].StartTime.Before(b[j].StartTime) }
+func (b backupsByTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
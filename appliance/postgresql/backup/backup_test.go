@@ -0,0 +1,212 @@
+package backup
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/appliance/postgresql/pgxlog"
+	"github.com/flynn/flynn/pkg/signedurl"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type BackupSuite struct{}
+
+var _ = Suite(&BackupSuite{})
+
+// blobstore is an in-memory implementation of the blobstore HTTP API, which
+// requires requests to be signed if key is set.
+type blobstore struct {
+	mtx   sync.Mutex
+	files map[string][]byte
+	key   []byte
+}
+
+func (b *blobstore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.key != nil {
+		if err := signedurl.Verify(b.key, req, time.Now()); err != nil {
+			w.WriteHeader(403)
+			return
+		}
+	}
+	switch req.Method {
+	case "GET":
+		data, ok := b.files[req.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(data)
+	case "PUT":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		b.files[req.URL.Path] = data
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func newStore(c *C) (*Store, *blobstore, func()) {
+	b := &blobstore{files: make(map[string][]byte)}
+	srv := httptest.NewServer(b)
+	return NewStore(srv.URL+"/postgres-backups", "pg", ""), b, srv.Close
+}
+
+func (BackupSuite) TestSignedStore(c *C) {
+	key := []byte("blobstore-key")
+	b := &blobstore{files: make(map[string][]byte), key: key}
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	baseURL := srv.URL + "/postgres-backups"
+
+	prefix, err := Prefix(baseURL, "pg")
+	c.Assert(err, IsNil)
+	c.Assert(prefix, Equals, "/postgres-backups/pg")
+	s := NewStore(baseURL, "pg", signedurl.PrefixKey(key, prefix, KeyMethods))
+	c.Assert(s.PutWAL("000000010000000000000001", strings.NewReader("wal")), IsNil)
+	r, err := s.GetWAL("000000010000000000000001")
+	c.Assert(err, IsNil)
+	r.Close()
+
+	// the key doesn't give access to the backups of other clusters
+	other := NewStore(baseURL, "other", s.Key)
+	c.Assert(other.PutWAL("000000010000000000000001", strings.NewReader("wal")), NotNil)
+	c.Assert(b.files, HasLen, 1)
+
+	// a read key can't be used to store backups
+	read := NewReadStore(baseURL, "pg", signedurl.PrefixKey(key, prefix, ReadKeyMethods))
+	r, err = read.GetWAL("000000010000000000000001")
+	c.Assert(err, IsNil)
+	r.Close()
+	c.Assert(read.PutWAL("000000010000000000000002", strings.NewReader("wal")), NotNil)
+	read.Methods = KeyMethods
+	c.Assert(read.PutWAL("000000010000000000000002", strings.NewReader("wal")), NotNil)
+	c.Assert(b.files, HasLen, 1)
+}
+
+func (BackupSuite) TestWAL(c *C) {
+	s, b, done := newStore(c)
+	defer done()
+
+	_, err := s.GetWAL("000000010000000000000001")
+	c.Assert(err, Equals, ErrNotFound)
+
+	c.Assert(s.PutWAL("000000010000000000000001", strings.NewReader("wal")), IsNil)
+	c.Assert(string(b.files["/postgres-backups/pg/wal/000000010000000000000001"]), Equals, "wal")
+
+	r, err := s.GetWAL("000000010000000000000001")
+	c.Assert(err, IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "wal")
+}
+
+func (BackupSuite) TestBackups(c *C) {
+	s, _, done := newStore(c)
+	defer done()
+
+	backups, err := s.List()
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, 0)
+	_, err = s.Find(&Target{})
+	c.Assert(err, Equals, ErrNoBackup)
+
+	start := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, end := range []xlog.Position{"0/3000000", "0/5000000", "1/1000000"} {
+		t := start.Add(time.Duration(i) * time.Hour)
+		b := &Backup{
+			ID:        NewID(t),
+			StartXLog: pgxlog.Zero,
+			EndXLog:   end,
+			StartTime: t,
+			EndTime:   t.Add(time.Minute),
+		}
+		size, err := s.PutBackup(b.ID, strings.NewReader(strings.Repeat("x", i+1)))
+		c.Assert(err, IsNil)
+		c.Assert(size, Equals, int64(i+1))
+		b.Size = size
+		c.Assert(s.AddBackup(b), IsNil)
+	}
+
+	backups, err = s.List()
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, 3)
+	c.Assert(backups[0].ID, Equals, "20150601T000000Z")
+	c.Assert(backups[2].ID, Equals, "20150601T020000Z")
+
+	r, err := s.GetBackup(backups[1].ID)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "xx")
+
+	for _, t := range []struct {
+		target string
+		id     string
+	}{
+		{"", "20150601T020000Z"},
+		{"0/5000000", "20150601T010000Z"},
+		{"0/FFFFFFF", "20150601T010000Z"},
+		{"1/1000000", "20150601T020000Z"},
+		{"2015-06-01T00:30:00Z", "20150601T000000Z"},
+		{"2015-06-01T01:01:00Z", "20150601T010000Z"},
+		{"2015-06-01T03:30:00+01:00", "20150601T020000Z"},
+		{"0/1000000", ""},
+		{"2015-05-31T00:00:00Z", ""},
+	} {
+		target, err := ParseTarget(t.target)
+		c.Assert(err, IsNil)
+		b, err := s.Find(target)
+		if t.id == "" {
+			c.Assert(err, Equals, ErrNoBackup, Commentf("target = %s", t.target))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf("target = %s", t.target))
+		c.Assert(b.ID, Equals, t.id, Commentf("target = %s", t.target))
+	}
+}
+
+func (BackupSuite) TestParseTarget(c *C) {
+	for _, s := range []string{"0/", "yesterday", "2015-06-01"} {
+		_, err := ParseTarget(s)
+		c.Assert(err, NotNil, Commentf("target = %s", s))
+	}
+	target, err := ParseTarget("2015-06-01T02:00:00+02:00")
+	c.Assert(err, IsNil)
+	c.Assert(target.String(), Equals, "2015-06-01T00:00:00Z")
+}
+
+func (BackupSuite) TestSegmentNeeded(c *C) {
+	for _, t := range []struct {
+		name   string
+		target xlog.Position
+		needed bool
+	}{
+		{"000000010000000000000001", "0/1000000", true},
+		{"000000010000000000000001", "0/1FFFFFF", true},
+		{"000000010000000000000002", "0/1FFFFFF", false},
+		{"00000002000000000000001F", "0/1F000028", true},
+		{"000000020000000000000020", "0/1F000028", false},
+		{"0000000100000001000000FF", "0/FF000000", false},
+		{"000000010000000000000002", "1/0", true},
+		{"00000002.history", "0/0", true},
+		{"000000010000000000000002.00000028.backup", "0/0", true},
+	} {
+		c.Assert(SegmentNeeded(t.name, t.target), Equals, t.needed, Commentf("name = %s, target = %s", t.name, t.target))
+	}
+}
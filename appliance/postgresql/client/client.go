@@ -6,15 +6,17 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/flynn/flynn/appliance/postgresql/state"
+	"github.com/flynn/flynn/appliance/postgresql/backup"
 	"github.com/flynn/flynn/pkg/httpclient"
+	"github.com/flynn/flynn/pkg/sirenia/state"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
 )
 
 type PostgresInfo struct {
-	Config   *state.PgConfig `json:"config"`
-	Running  bool            `json:"running"`
-	XLog     string          `json:"xlog,omitempty"`
-	Replicas []*Replica      `json:"replicas,omitempty"`
+	Config   *state.Config `json:"config"`
+	Running  bool          `json:"running"`
+	XLog     string        `json:"xlog,omitempty"`
+	Replicas []*Replica    `json:"replicas,omitempty"`
 }
 
 type Replica struct {
@@ -34,11 +36,44 @@ type Status struct {
 	Postgres *PostgresInfo   `json:"postgres"`
 }
 
+// ClusterState is the cluster state along with the status of each peer.
+type ClusterState struct {
+	State *state.State  `json:"state"`
+	Peers []*PeerStatus `json:"peers"`
+}
+
+type PeerStatus struct {
+	ID   string     `json:"id"`
+	Addr string     `json:"addr"`
+	Role state.Role `json:"role"`
+	XLog string     `json:"xlog,omitempty"`
+
+	// Lag is the number of bytes of WAL that the peer is behind the primary.
+	Lag *int64 `json:"lag,omitempty"`
+
+	// Error is set if the status of the peer could not be determined.
+	Error string `json:"error,omitempty"`
+}
+
+type FreezeRequest struct {
+	Reason string `json:"reason"`
+}
+
+type TakeoverRequest struct {
+	MinWAL xlog.Position `json:"min_wal"`
+}
+
 type Client struct {
 	c *httpclient.Client
 }
 
 func NewClient(addr string) *Client {
+	return NewClientWithKey(addr, "")
+}
+
+// NewClientWithKey returns a client which authenticates with key, which is
+// required by the endpoints that inspect or change the cluster state.
+func NewClientWithKey(addr, key string) *Client {
 	// remove port, if any
 	host, _, _ := net.SplitHostPort(addr)
 	if host == "" {
@@ -48,6 +83,7 @@ func NewClient(addr string) *Client {
 	return &Client{
 		c: &httpclient.Client{
 			URL:  fmt.Sprintf("http://%s:5433", host),
+			Key:  key,
 			HTTP: http.DefaultClient,
 		},
 	}
@@ -57,3 +93,42 @@ func (c *Client) Status() (*Status, error) {
 	res := &Status{}
 	return res, c.c.Get("/status", res)
 }
+
+// Backups returns the base backups of the cluster, oldest first.
+func (c *Client) Backups() ([]*backup.Backup, error) {
+	var res []*backup.Backup
+	return res, c.c.Get("/backups", &res)
+}
+
+// Backup takes a base backup of the cluster, it must be called on the primary.
+func (c *Client) Backup() (*backup.Backup, error) {
+	res := &backup.Backup{}
+	return res, c.c.Post("/backups", nil, res)
+}
+
+// ClusterState returns the cluster state and the status of each peer.
+func (c *Client) ClusterState() (*ClusterState, error) {
+	res := &ClusterState{}
+	return res, c.c.Get("/state", res)
+}
+
+// Freeze freezes the cluster, preventing any changes to the cluster state.
+func (c *Client) Freeze(reason string) error {
+	return c.c.Post("/freeze", &FreezeRequest{Reason: reason}, nil)
+}
+
+// Unfreeze unfreezes the cluster.
+func (c *Client) Unfreeze() error {
+	return c.c.Delete("/freeze")
+}
+
+// Takeover makes the sync take over as primary once it has replayed the WAL
+// of the primary up to minWAL, it must be called on the sync.
+func (c *Client) Takeover(minWAL xlog.Position) error {
+	return c.c.Post("/takeover", &TakeoverRequest{MinWAL: minWAL}, nil)
+}
+
+// Switchover makes the sync take over from the current primary, deposing it.
+func (c *Client) Switchover() error {
+	return c.c.Post("/switchover", nil, nil)
+}
@@ -7,12 +7,13 @@ import (
 	"os"
 	"strings"
 
-	"github.com/flynn/flynn/appliance/postgresql/simulator"
+	"github.com/flynn/flynn/appliance/postgresql/pgxlog"
+	"github.com/flynn/flynn/pkg/sirenia/simulator"
 	"github.com/tiborvass/uniline"
 )
 
 func main() {
-	sim := simulator.New(false, os.Stdout, os.Stdout)
+	sim := simulator.New(false, pgxlog.PgXLog{}, os.Stdout, os.Stdout)
 	scanner := uniline.DefaultScanner()
 	for scanner.Scan("> ") {
 		line := scanner.Text()
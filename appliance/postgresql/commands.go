@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flynn/flynn/appliance/postgresql/backup"
+	"github.com/flynn/flynn/appliance/postgresql/client"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
+)
+
+// commands are run by postgres to archive and restore WAL files, and in jobs
+// started by the CLI to list backups and manage the cluster.
+var commands = map[string]func(args []string) error{
+	"wal-push":   runWALPush,
+	"wal-fetch":  runWALFetch,
+	"backups":    runBackups,
+	"status":     runStatus,
+	"freeze":     runFreeze,
+	"unfreeze":   runUnfreeze,
+	"switchover": runSwitchover,
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return cmd(args)
+}
+
+func storeFlags(name string, args []string) (*flag.FlagSet, *string, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	url := flags.String("url", os.Getenv("BACKUP_URL"), "blobstore URL of backups")
+	service := flags.String("service", postgresService(), "service name of the cluster")
+	return flags, url, service
+}
+
+// runWALPush stores the WAL file at path with the given name, it is the
+// archive_command of clusters which have archiving enabled.
+func runWALPush(args []string) error {
+	flags, url, service := storeFlags("wal-push", args)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("usage: wal-push [-url <url>] [-service <service>] <path> <name>")
+	}
+	path, name := flags.Arg(0), flags.Arg(1)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return backup.NewStore(*url, *service, os.Getenv("BACKUP_KEY")).PutWAL(name, f)
+}
+
+// runWALFetch fetches the archived WAL file with the given name to path, it is
+// the restore_command of clusters being restored from a backup.
+//
+// Segments after the one containing the -until xlog position are treated as
+// missing so that recovery stops there.
+func runWALFetch(args []string) error {
+	flags, url, service := storeFlags("wal-fetch", args)
+	until := flags.String("until", "", "xlog position to stop recovery at")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("usage: wal-fetch [-url <url>] [-service <service>] [-until <xlog>] <name> <path>")
+	}
+	name, path := flags.Arg(0), flags.Arg(1)
+
+	if *until != "" && !backup.SegmentNeeded(name, xlog.Position(*until)) {
+		return backup.ErrNotFound
+	}
+	body, err := backup.NewReadStore(*url, *service, os.Getenv("RESTORE_KEY")).GetWAL(name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// runBackups lists the base backups of a cluster.
+func runBackups(args []string) error {
+	flags, url, service := storeFlags("backups", args)
+	flags.Parse(args)
+
+	backups, err := backup.NewStore(*url, *service, os.Getenv("BACKUP_KEY")).List()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 1, 2, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "ID\tSTARTED\tFINISHED\tSTART XLOG\tEND XLOG\tSIZE")
+	for _, b := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n",
+			b.ID,
+			b.StartTime.Format(time.RFC3339),
+			b.EndTime.Format(time.RFC3339),
+			b.StartXLog,
+			b.EndXLog,
+			b.Size,
+		)
+	}
+	return nil
+}
+
+// newRestore returns the configuration to restore a new cluster from the
+// backups of the from cluster up to target.
+func newRestore(url, from, target string) (*Restore, error) {
+	t, err := backup.ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		url = backup.DefaultURL
+	}
+	store := backup.NewReadStore(url, from, os.Getenv("RESTORE_KEY"))
+	b, err := store.Find(t)
+	if err != nil {
+		return nil, err
+	}
+	cmd := fmt.Sprintf("%s wal-fetch -url %s -service %s", os.Args[0], url, from)
+	if t.XLog != "" {
+		cmd += " -until " + string(t.XLog)
+	}
+	return &Restore{
+		Store:   store,
+		Backup:  b,
+		Target:  t,
+		Command: cmd + ` "%f" "%p"`,
+	}, nil
+}
+
+// peerClient returns a client for a peer of the cluster, preferring the
+// primary, authenticated with the password of the flynn superuser.
+func peerClient(service string) (*pgmanager.Client, error) {
+	s := discoverd.DefaultClient.Service(service)
+	inst, err := s.Leader()
+	if err != nil {
+		insts, err := s.Instances()
+		if err != nil {
+			return nil, err
+		}
+		if len(insts) == 0 {
+			return nil, fmt.Errorf("no instances of %s found", service)
+		}
+		inst = insts[0]
+	}
+	return pgmanager.NewClientWithKey(inst.Addr, os.Getenv("PGPASSWORD")), nil
+}
+
+func peerFlags(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	service := flags.String("service", postgresService(), "service name of the cluster")
+	return flags, service
+}
+
+// runStatus prints the cluster state and the replication status of each peer.
+func runStatus(args []string) error {
+	flags, service := peerFlags("status")
+	flags.Parse(args)
+	client, err := peerClient(*service)
+	if err != nil {
+		return err
+	}
+	cs, err := client.ClusterState()
+	if err != nil {
+		return err
+	}
+	if cs.State == nil {
+		fmt.Println("cluster has not been set up")
+		return nil
+	}
+
+	fmt.Println("generation:", cs.State.Generation)
+	fmt.Println("init wal:  ", cs.State.InitWAL)
+	if cs.State.Singleton {
+		fmt.Println("singleton:  true")
+	}
+	if f := cs.State.Freeze; f != nil {
+		fmt.Printf("frozen:     %s (at %s)\n", f.Reason, f.FrozenAt.Format(time.RFC3339))
+	} else {
+		fmt.Println("frozen:     false")
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 2, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "ROLE\tID\tADDR\tXLOG\tLAG\tERROR")
+	for _, p := range cs.Peers {
+		lag := ""
+		if p.Lag != nil {
+			lag = strconv.FormatInt(*p.Lag, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Role, p.ID, p.Addr, p.XLog, lag, p.Error)
+	}
+	return nil
+}
+
+// runFreeze freezes the cluster with an optional reason.
+func runFreeze(args []string) error {
+	flags, service := peerFlags("freeze")
+	flags.Parse(args)
+	client, err := peerClient(*service)
+	if err != nil {
+		return err
+	}
+	return client.Freeze(flags.Arg(0))
+}
+
+func runUnfreeze(args []string) error {
+	flags, service := peerFlags("unfreeze")
+	flags.Parse(args)
+	client, err := peerClient(*service)
+	if err != nil {
+		return err
+	}
+	return client.Unfreeze()
+}
+
+// runSwitchover makes the sync take over from the primary.
+func runSwitchover(args []string) error {
+	flags, service := peerFlags("switchover")
+	flags.Parse(args)
+	client, err := peerClient(*service)
+	if err != nil {
+		return err
+	}
+	return client.Switchover()
+}
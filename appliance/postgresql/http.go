@@ -1,30 +1,60 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
 	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/appliance/postgresql/backup"
 	"github.com/flynn/flynn/appliance/postgresql/client"
-	"github.com/flynn/flynn/appliance/postgresql/state"
+	"github.com/flynn/flynn/appliance/postgresql/pgxlog"
+	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/sirenia/state"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
 )
 
-func ServeHTTP(pg *Postgres, peer *state.Peer, log log15.Logger) error {
+func ServeHTTP(pg *Postgres, peer *state.Peer, backups *backup.Store, log log15.Logger) error {
 	api := &HTTP{
-		pg:   pg,
-		peer: peer,
-		log:  log,
+		pg:      pg,
+		peer:    peer,
+		backups: backups,
+		log:     log,
 	}
 	r := httprouter.New()
 	r.GET("/status", api.GetStatus)
+	r.GET("/state", api.auth(api.GetClusterState))
+	r.POST("/freeze", api.auth(api.Freeze))
+	r.DELETE("/freeze", api.auth(api.Unfreeze))
+	r.POST("/takeover", api.auth(api.Takeover))
+	r.POST("/switchover", api.auth(api.Switchover))
+	r.GET("/backups", api.auth(api.GetBackups))
+	r.POST("/backups", api.auth(api.CreateBackup))
 	return http.ListenAndServe(":5433", r)
 }
 
 type HTTP struct {
-	pg   *Postgres
-	peer *state.Peer
-	log  log15.Logger
+	pg      *Postgres
+	peer    *state.Peer
+	backups *backup.Store
+	log     log15.Logger
+}
+
+// auth requires requests to authenticate with the password of the flynn
+// superuser, which is known to the postgres release. All requests are
+// rejected if there is no password.
+func (h *HTTP) auth(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		_, password, _ := req.BasicAuth()
+		if h.pg.password == "" || len(password) != len(h.pg.password) || subtle.ConstantTimeCompare([]byte(password), []byte(h.pg.password)) != 1 {
+			w.WriteHeader(401)
+			return
+		}
+		handle(w, req, params)
+	}
 }
 
 func (h *HTTP) GetStatus(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -40,3 +70,208 @@ func (h *HTTP) GetStatus(w http.ResponseWriter, req *http.Request, _ httprouter.
 	}
 	httphelper.JSON(w, 200, res)
 }
+
+func (h *HTTP) GetBackups(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if h.backups == nil {
+		httphelper.ObjectNotFoundError(w, "backups are not enabled")
+		return
+	}
+	backups, err := h.backups.List()
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, backups)
+}
+
+func (h *HTTP) CreateBackup(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if h.backups == nil {
+		httphelper.ObjectNotFoundError(w, "backups are not enabled")
+		return
+	}
+	b, err := h.pg.Backup(h.backups)
+	if err == ErrNotPrimary {
+		httphelper.Error(w, httphelper.PreconditionFailedErr(err.Error()))
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, b)
+}
+
+func (h *HTTP) GetClusterState(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	info := h.peer.Info()
+	res := &pgmanager.ClusterState{State: info.State}
+	if info.State == nil {
+		httphelper.JSON(w, 200, res)
+		return
+	}
+
+	// list the peers in the order of the replication chain, followed by the
+	// deposed and unassigned peers
+	peers := []*discoverd.Instance{info.State.Primary}
+	if info.State.Sync != nil {
+		peers = append(peers, info.State.Sync)
+	}
+	peers = append(peers, info.State.Async...)
+	peers = append(peers, info.State.Deposed...)
+	seen := make(map[string]struct{}, len(peers))
+	for _, inst := range peers {
+		seen[inst.ID] = struct{}{}
+	}
+	for _, inst := range info.Peers {
+		if _, ok := seen[inst.ID]; !ok {
+			peers = append(peers, inst)
+		}
+	}
+
+	for _, inst := range peers {
+		status := &pgmanager.PeerStatus{ID: inst.ID, Addr: inst.Addr}
+		res.Peers = append(res.Peers, status)
+
+		var pg *pgmanager.PostgresInfo
+		if inst.ID == info.ID {
+			status.Role = info.Role
+			pg, _ = h.pg.Info()
+		} else {
+			s, err := pgmanager.NewClient(inst.Addr).Status()
+			if err != nil {
+				status.Error = err.Error()
+				continue
+			}
+			status.Role = s.Peer.Role
+			pg = s.Postgres
+		}
+		if pg != nil {
+			status.XLog = pg.XLog
+		}
+	}
+
+	// the lag of each peer is computed by the local postgres, if it is running
+	if primary := res.Peers[0]; primary.XLog != "" {
+		for _, status := range res.Peers[1:] {
+			if status.XLog == "" {
+				continue
+			}
+			lag, err := h.pg.XLogDiff(xlog.Position(primary.XLog), xlog.Position(status.XLog))
+			if err != nil {
+				h.log.Error("error computing replication lag", "peer", status.ID, "err", err)
+				break
+			}
+			status.Lag = &lag
+		}
+	}
+
+	httphelper.JSON(w, 200, res)
+}
+
+func (h *HTTP) Freeze(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data pgmanager.FreezeRequest
+	if err := httphelper.DecodeJSON(req, &data); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if data.Reason == "" {
+		data.Reason = "frozen by operator"
+	}
+	if err := h.peer.Freeze(data.Reason); err != nil {
+		h.stateError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (h *HTTP) Unfreeze(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := h.peer.Unfreeze(); err != nil {
+		h.stateError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// takeoverTimeout is how long the sync waits to catch up with the primary
+// when a takeover is requested.
+const takeoverTimeout = 30 * time.Second
+
+func (h *HTTP) Takeover(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data pgmanager.TakeoverRequest
+	if err := httphelper.DecodeJSON(req, &data); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if data.MinWAL == "" {
+		data.MinWAL = pgxlog.Zero
+	}
+	start := time.Now()
+	for {
+		err := h.peer.Takeover(data.MinWAL)
+		if err == state.ErrPeerNotCaughtUp && time.Since(start) < takeoverTimeout {
+			time.Sleep(checkInterval)
+			continue
+		}
+		if err != nil {
+			h.stateError(w, err)
+			return
+		}
+		break
+	}
+	w.WriteHeader(200)
+}
+
+// Switchover makes the sync take over from the primary once it has caught up
+// with the current position of the primary. It may be requested from any peer.
+func (h *HTTP) Switchover(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	info := h.peer.Info()
+	if info.State == nil {
+		h.stateError(w, state.ErrNoClusterState)
+		return
+	}
+	if info.State.Freeze != nil {
+		h.stateError(w, state.ErrClusterFrozen)
+		return
+	}
+	if info.State.Sync == nil {
+		h.stateError(w, errors.New("cluster has no sync"))
+		return
+	}
+
+	var minWAL xlog.Position
+	if info.State.Primary.ID == info.ID {
+		var err error
+		minWAL, err = h.pg.XLogPosition()
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	} else {
+		s, err := pgmanager.NewClient(info.State.Primary.Addr).Status()
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		if s.Postgres == nil || s.Postgres.XLog == "" {
+			h.stateError(w, errors.New("primary is offline"))
+			return
+		}
+		minWAL = xlog.Position(s.Postgres.XLog)
+	}
+
+	h.log.Info("requesting switchover", "sync", info.State.Sync.ID, "min_wal", minWAL)
+	if err := pgmanager.NewClientWithKey(info.State.Sync.Addr, h.pg.password).Takeover(minWAL); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// stateError responds with an error from the state machine, errors caused by
+// the state of the cluster are precondition failures.
+func (h *HTTP) stateError(w http.ResponseWriter, err error) {
+	switch err {
+	case state.ErrPeerStopped:
+		httphelper.Error(w, err)
+	default:
+		httphelper.Error(w, httphelper.PreconditionFailedErr(err.Error()))
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+)
+
+type HTTPSuite struct{}
+
+var _ = Suite(&HTTPSuite{})
+
+func (s *HTTPSuite) TestAuth(c *C) {
+	for _, t := range []struct {
+		password string
+		auth     string
+		status   int
+	}{
+		{password: "secret", auth: "secret", status: 200},
+		{password: "secret", auth: "wrong", status: 401},
+		{password: "secret", auth: "", status: 401},
+		{password: "", auth: "", status: 401},
+		{password: "", auth: "secret", status: 401},
+	} {
+		api := &HTTP{pg: &Postgres{password: t.password}}
+		handler := api.auth(func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+			w.WriteHeader(200)
+		})
+		req, err := http.NewRequest("GET", "/state", nil)
+		c.Assert(err, IsNil)
+		req.SetBasicAuth("", t.auth)
+		w := httptest.NewRecorder()
+		handler(w, req, nil)
+		c.Assert(w.Code, Equals, t.status, Commentf("password %q, auth %q", t.password, t.auth))
+	}
+}
@@ -1,23 +1,62 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
-	"github.com/flynn/flynn/appliance/postgresql/state"
+	"github.com/flynn/flynn/appliance/postgresql/backup"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/shutdown"
+	"github.com/flynn/flynn/pkg/sirenia/state"
 )
 
 func main() {
-	serviceName := os.Getenv("FLYNN_POSTGRES")
-	if serviceName == "" {
-		serviceName = "postgres"
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			if err != backup.ErrNotFound {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		return
 	}
+
+	serviceName := postgresService()
 	singleton := os.Getenv("SINGLETON") == "true"
 	password := os.Getenv("PGPASSWORD")
 
+	// WAL archiving and base backups are enabled by setting BACKUP_URL to
+	// the blobstore URL to store them under, e.g.
+	// http://blobstore.discoverd/postgres-backups, along with BACKUP_KEY, a
+	// key for the backups of the cluster issued by the controller, if the
+	// blobstore requires signed requests (see `flynn pg backups --enable`)
+	backupURL := os.Getenv("BACKUP_URL")
+	var backups *backup.Store
+	var archiveCommand string
+	if backupURL != "" {
+		backups = backup.NewStore(backupURL, serviceName, os.Getenv("BACKUP_KEY"))
+		archiveCommand = fmt.Sprintf(`%s wal-push -url %s -service %s "%%p" "%%f"`, os.Args[0], backupURL, serviceName)
+	}
+
+	// A new cluster is restored from the backups of the cluster named by
+	// RESTORE_FROM, up to RESTORE_TARGET (an RFC 3339 timestamp or xlog
+	// position) or the latest archived state, reading them with
+	// RESTORE_KEY if the blobstore requires signed requests. RESTORE_FROM stays set in the
+	// release of the restored cluster, so it is ignored once the data
+	// directory has been initialized.
+	var restore *Restore
+	if from := os.Getenv("RESTORE_FROM"); from != "" && !dataInitialized() {
+		var err error
+		restore, err = newRestore(backupURL, from, os.Getenv("RESTORE_TARGET"))
+		if err != nil {
+			shutdown.Fatal(err)
+		}
+	}
+
 	err := discoverd.DefaultClient.AddService(serviceName, &discoverd.ServiceConfig{
 		LeaderType: discoverd.LeaderTypeManual,
 	})
@@ -42,14 +81,52 @@ func main() {
 		ExtWhitelist: true,
 		WaitUpstream: true,
 		// TODO(titanous) investigate this:
-		SHMType: "sysv", // the default on 9.4, 'posix' is not currently supported in our containers
+		SHMType:        "sysv", // the default on 9.4, 'posix' is not currently supported in our containers
+		ArchiveCommand: archiveCommand,
+		Restore:        restore,
 	})
-	dd := NewDiscoverd(discoverd.DefaultClient.Service(serviceName), log.New("component", "discoverd"))
+	dd := state.NewDiscoverd(discoverd.DefaultClient.Service(serviceName), log.New("component", "discoverd"))
 
 	peer := state.NewPeer(inst, singleton, dd, pg, log.New("component", "peer"))
 	shutdown.BeforeExit(func() { peer.Close() })
 
 	go peer.Run()
-	shutdown.Fatal(ServeHTTP(pg.(*Postgres), peer, log.New("component", "http")))
+
+	// standbys which are no more than READONLY_MAX_LAG bytes of WAL behind
+	// the primary are registered in the read-only service
+	maxLag := int64(DefaultMaxReadOnlyLag)
+	if s := os.Getenv("READONLY_MAX_LAG"); s != "" {
+		maxLag, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			shutdown.Fatal(err)
+		}
+	}
+	readOnly := NewReadOnly(serviceName+"-readonly", maxLag, pg.(*Postgres), peer, log.New("component", "readonly"))
+	shutdown.BeforeExit(readOnly.Close)
+	go readOnly.Run(5 * time.Second)
+
+	if backups != nil {
+		interval := 24 * time.Hour
+		if s := os.Getenv("BACKUP_INTERVAL"); s != "" {
+			interval, err = time.ParseDuration(s)
+			if err != nil {
+				shutdown.Fatal(err)
+			}
+		}
+		go pg.(*Postgres).RunBackups(backups, interval)
+	}
+	shutdown.Fatal(ServeHTTP(pg.(*Postgres), peer, backups, log.New("component", "http")))
 	// TODO(titanous): clean shutdown of postgres
 }
+
+func dataInitialized() bool {
+	_, err := os.Stat("/data/PG_VERSION")
+	return err == nil
+}
+
+func postgresService() string {
+	if name := os.Getenv("FLYNN_POSTGRES"); name != "" {
+		return name
+	}
+	return "postgres"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/shutdown"
+)
+
+func main() {
+	defer shutdown.Exit()
+
+	serviceName := os.Getenv("FLYNN_POSTGRES")
+	if serviceName == "" {
+		serviceName = "postgres"
+	}
+	log := log15.New("app", serviceName+"-pooler")
+
+	poolSize := 20
+	if s := os.Getenv("POOL_SIZE"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			shutdown.Fatal(fmt.Errorf("invalid POOL_SIZE %q", s))
+		}
+		poolSize = n
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "5432"
+	}
+	addr := ":" + port
+
+	// the flynn superuser looks up the password hashes of clients
+	password := os.Getenv("PGPASSWORD")
+	if password == "" {
+		shutdown.Fatal("PGPASSWORD must be set")
+	}
+
+	pooler := NewPooler(poolSize, log)
+	pooler.AuthUser = "flynn"
+	pooler.AuthPassword = password
+	shutdown.BeforeExit(pooler.Close)
+	go followPrimary(pooler, discoverd.NewService(serviceName), log)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+
+	hb, err := discoverd.AddServiceAndRegister(serviceName+"-pooler", addr)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	shutdown.BeforeExit(func() { hb.Close() })
+
+	log.Info("accepting connections", "addr", addr, "pool_size", poolSize)
+	shutdown.Fatal(pooler.Serve(l))
+}
+
+// followPrimary points the pooler at the leader of the postgres service, which
+// is the primary, reconnecting to discoverd if the stream of leaders fails.
+func followPrimary(pooler *Pooler, srv discoverd.Service, log log15.Logger) {
+	for {
+		leaders := make(chan *discoverd.Instance)
+		stream, err := srv.Leaders(leaders)
+		if err != nil {
+			log.Error("error watching for leader", "fn", "followPrimary", "err", err)
+		} else {
+			for leader := range leaders {
+				pooler.SetPrimary(leader.Addr)
+			}
+			if err := stream.Err(); err != nil {
+				log.Error("leader stream failed", "fn", "followPrimary", "err", err)
+			}
+			stream.Close()
+		}
+		time.Sleep(time.Second)
+	}
+}
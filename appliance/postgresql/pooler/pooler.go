@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+var (
+	ErrNoPrimary      = errors.New("pooler: no primary available")
+	ErrAcquireTimeout = errors.New("pooler: timed out waiting for a server connection")
+	ErrClosed         = errors.New("pooler: closed")
+)
+
+// startupParams are the startup parameters of clients which are passed on to
+// servers. Clients with different values for them use separate pools, all
+// other parameters are ignored as server connections are shared.
+var startupParams = []string{"client_encoding", "DateStyle", "TimeZone", "IntervalStyle", "extra_float_digits"}
+
+// Pooler is a transaction-level connection pooler for the primary of a
+// postgres cluster.
+//
+// Clients are assigned a server connection from the pool of their user and
+// database for the duration of each transaction, and the connection is
+// returned to the pool once the server reports it is idle. Session state such
+// as prepared statements, SET and LISTEN does not persist between
+// transactions.
+//
+// When the primary changes, idle server connections are closed and new ones
+// are made to the new primary, so clients which are not in the middle of a
+// transaction keep their connection to the pooler.
+type Pooler struct {
+	// PoolSize is the maximum number of server connections of each pool.
+	PoolSize int
+
+	// AcquireTimeout is how long a client waits for a server connection
+	// when all of the connections of its pool are in use.
+	AcquireTimeout time.Duration
+
+	// AuthUser and AuthPassword are the credentials of a superuser which
+	// the pooler uses to look up the password hashes of roles, so that
+	// clients can authenticate with MD5 rather than sending their password
+	// in clear text.
+	AuthUser     string
+	AuthPassword string
+
+	mtx      sync.Mutex
+	primary  string
+	gen      int
+	pools    map[string]*pool
+	sessions map[int32]*session
+	lastPID  int32
+	closed   bool
+
+	log log15.Logger
+}
+
+func NewPooler(poolSize int, log log15.Logger) *Pooler {
+	return &Pooler{
+		PoolSize:       poolSize,
+		AcquireTimeout: 2 * time.Minute,
+		pools:          make(map[string]*pool),
+		sessions:       make(map[int32]*session),
+		log:            log,
+	}
+}
+
+// SetPrimary sets the address of the primary which new server connections
+// are made to.
+func (p *Pooler) SetPrimary(addr string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if addr == p.primary {
+		return
+	}
+	p.log.Info("primary changed", "fn", "SetPrimary", "from", p.primary, "to", addr)
+	p.primary = addr
+	p.gen++
+	for _, pl := range p.pools {
+		pl.closeIdle()
+	}
+}
+
+// Serve accepts client connections on l until it is closed.
+func (p *Pooler) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+// Close closes all idle server connections and stops new ones being made.
+func (p *Pooler) Close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.closed = true
+	for _, pl := range p.pools {
+		pl.closeIdle()
+	}
+}
+
+func (p *Pooler) handle(conn net.Conn) {
+	log := p.log.New("fn", "handle", "client", conn.RemoteAddr())
+	s := &session{
+		p:    p,
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+	defer s.close()
+
+	params, ok := s.startup()
+	if !ok {
+		return
+	}
+	user, database := params["user"], params["database"]
+	if database == "" {
+		database = user
+	}
+	if user == "" {
+		s.fatal(codeInvalidAuthorization, "no user specified in startup message")
+		return
+	}
+	log = log.New("user", user, "database", database)
+
+	// authenticate the client with MD5 as the server would, checking the
+	// response against the password hash of the role, which is also what
+	// server connections are authenticated with.
+	salt := random.Bytes(4)
+	if err := s.write(authMessage(authMD5Password, salt)); err != nil {
+		return
+	}
+	m, err := readMessage(s.r)
+	if err != nil {
+		return
+	}
+	if m.Type != msgPassword {
+		s.fatal(codeProtocolViolation, "expected password response")
+		return
+	}
+	b := readBuf(m.Data)
+	response := b.string()
+
+	s.pool, err = p.getPool(user, database, response, salt, params)
+	if err != nil {
+		if e, ok := err.(*serverError); ok {
+			s.write(e.msg)
+		} else {
+			log.Error("error connecting to primary", "err", err)
+			s.fatal(codeCannotConnectNow, err.Error())
+		}
+		return
+	}
+
+	s.pid, s.key = p.addSession(s)
+	defer p.removeSession(s.pid)
+
+	if err := s.write(authMessage(authOK, nil)); err != nil {
+		return
+	}
+	for _, m := range s.pool.status() {
+		if err := s.write(m); err != nil {
+			return
+		}
+	}
+	if err := s.write(backendKeyData(s.pid, s.key)); err != nil {
+		return
+	}
+	if err := s.write(readyForQuery(txIdle)); err != nil {
+		return
+	}
+	s.serve()
+}
+
+// getPool returns the pool of the user and database, authenticating the MD5
+// response of the client against it. If the response doesn't match the
+// password hash of an existing pool, it is checked against the current hash
+// of the role, which may have changed.
+func (p *Pooler) getPool(user, database, response string, salt []byte, params map[string]string) (*pool, error) {
+	key := poolKey(user, database, params)
+
+	p.mtx.Lock()
+	pl, ok := p.pools[key]
+	p.mtx.Unlock()
+	if ok && pl.checkResponse(response, salt) {
+		return pl, nil
+	}
+
+	hash, err := p.lookupHash(user)
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" || subtle.ConstantTimeCompare([]byte(response), []byte(md5Response(hash, salt))) != 1 {
+		return nil, newServerError(errorMessage("FATAL", codeInvalidPassword, fmt.Sprintf("password authentication failed for user %q", user)))
+	}
+
+	if !ok {
+		pl = &pool{
+			p:        p,
+			user:     user,
+			database: database,
+			params:   make(map[string]string),
+			sem:      make(chan struct{}, p.PoolSize),
+		}
+		for _, name := range startupParams {
+			if v, ok := params[name]; ok {
+				pl.params[name] = v
+			}
+		}
+	}
+	srv, err := pl.dial(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if existing, ok := p.pools[key]; ok {
+		pl = existing
+	} else {
+		p.pools[key] = pl
+	}
+	pl.setHash(hash, srv.status)
+	pl.put(srv)
+	return pl, nil
+}
+
+// lookupHash returns the MD5 password hash of the role user, or an empty string
+// if the role doesn't exist or has no password. It connects to the primary as
+// AuthUser, and errors from doing so are not returned as server errors since
+// they are not the client's.
+func (p *Pooler) lookupHash(user string) (string, error) {
+	addr, gen, err := p.primaryAddr()
+	if err != nil {
+		return "", err
+	}
+	srv, err := dialServer(addr, gen, p.AuthUser, "postgres", md5Hash(p.AuthUser, p.AuthPassword), nil)
+	if err != nil {
+		return "", fmt.Errorf("pooler: error connecting as %s: %s", p.AuthUser, err)
+	}
+	defer srv.close()
+	passwd, err := srv.queryValue(hashQuery(user))
+	if err != nil {
+		return "", fmt.Errorf("pooler: error looking up password hash: %s", err)
+	}
+	if passwd == "" || strings.HasPrefix(passwd, "md5") && len(passwd) == 35 {
+		return passwd, nil
+	}
+	// the password is stored in clear text
+	return md5Hash(user, passwd), nil
+}
+
+// hashQuery returns a query for the stored password of the role user.
+func hashQuery(user string) string {
+	quoted := strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(user)
+	return `SELECT passwd FROM pg_catalog.pg_shadow WHERE usename = E'` + quoted + `'`
+}
+
+// primaryAddr returns the address and generation of the current primary.
+func (p *Pooler) primaryAddr() (string, int, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return "", 0, ErrClosed
+	}
+	if p.primary == "" {
+		return "", 0, ErrNoPrimary
+	}
+	return p.primary, p.gen, nil
+}
+
+func poolKey(user, database string, params map[string]string) string {
+	fields := []string{user, database}
+	for _, name := range startupParams {
+		if v, ok := params[name]; ok {
+			fields = append(fields, name+"="+v)
+		}
+	}
+	sort.Strings(fields[2:])
+	return strings.Join(fields, "\x00")
+}
+
+// addSession returns a process ID and secret key for the session which
+// clients use to cancel its queries.
+func (p *Pooler) addSession(s *session) (int32, int32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for {
+		p.lastPID++
+		if p.lastPID <= 0 {
+			p.lastPID = 1
+		}
+		if _, ok := p.sessions[p.lastPID]; !ok {
+			p.sessions[p.lastPID] = s
+			return p.lastPID, int32(binary.BigEndian.Uint32(random.Bytes(4)))
+		}
+	}
+}
+
+func (p *Pooler) removeSession(pid int32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.sessions, pid)
+}
+
+// cancel forwards a cancel request to the server the session with the given
+// process ID is currently using.
+func (p *Pooler) cancel(pid, key int32) {
+	p.mtx.Lock()
+	s, ok := p.sessions[pid]
+	p.mtx.Unlock()
+	if !ok || s.key != key {
+		return
+	}
+	if srv := s.currentServer(); srv != nil {
+		srv.cancel()
+	}
+}
+
+// pool is the pool of server connections of a user, database and set of
+// startup parameters.
+type pool struct {
+	p        *Pooler
+	user     string
+	database string
+	params   map[string]string
+
+	// sem limits the number of server connections in use.
+	sem chan struct{}
+
+	// the following fields are protected by p.mtx
+	hash       string
+	statusMsgs []*message
+	idle       []*server
+}
+
+// checkResponse checks the response of a client to an MD5 password request
+// with salt against the password hash of the pool.
+func (pl *pool) checkResponse(response string, salt []byte) bool {
+	pl.p.mtx.Lock()
+	defer pl.p.mtx.Unlock()
+	if pl.hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(response), []byte(md5Response(pl.hash, salt))) == 1
+}
+
+// setHash sets the password hash used for new server connections, closing
+// idle connections if it has changed. p.mtx must be held.
+func (pl *pool) setHash(hash string, status []*message) {
+	if hash != pl.hash {
+		pl.closeIdle()
+	}
+	pl.hash = hash
+	pl.statusMsgs = status
+}
+
+// status returns the ParameterStatus messages sent to clients on startup.
+func (pl *pool) status() []*message {
+	pl.p.mtx.Lock()
+	defer pl.p.mtx.Unlock()
+	return pl.statusMsgs
+}
+
+// acquire returns a server connection to the current primary, waiting for
+// one to be released if all are in use.
+func (pl *pool) acquire() (*server, error) {
+	select {
+	case pl.sem <- struct{}{}:
+	case <-time.After(pl.p.AcquireTimeout):
+		return nil, ErrAcquireTimeout
+	}
+
+	pl.p.mtx.Lock()
+	for len(pl.idle) > 0 {
+		srv := pl.idle[len(pl.idle)-1]
+		pl.idle = pl.idle[:len(pl.idle)-1]
+		if srv.gen == pl.p.gen {
+			pl.p.mtx.Unlock()
+			return srv, nil
+		}
+		srv.conn.Close()
+	}
+	hash := pl.hash
+	pl.p.mtx.Unlock()
+
+	srv, err := pl.dial(hash)
+	if err != nil {
+		<-pl.sem
+		return nil, err
+	}
+	return srv, nil
+}
+
+// release returns a server connection which is idle to the pool.
+func (pl *pool) release(srv *server) {
+	pl.p.mtx.Lock()
+	pl.put(srv)
+	pl.p.mtx.Unlock()
+	<-pl.sem
+}
+
+// discard closes a server connection which can't be reused.
+func (pl *pool) discard(srv *server) {
+	srv.conn.Close()
+	<-pl.sem
+}
+
+// put adds srv to the idle connections if it is connected to the current
+// primary, and otherwise closes it. p.mtx must be held.
+func (pl *pool) put(srv *server) {
+	if srv.gen != pl.p.gen || pl.p.closed || len(pl.idle) >= cap(pl.sem) {
+		srv.conn.Close()
+		return
+	}
+	pl.idle = append(pl.idle, srv)
+}
+
+// closeIdle closes all idle connections. p.mtx must be held.
+func (pl *pool) closeIdle() {
+	for _, srv := range pl.idle {
+		srv.conn.Close()
+	}
+	pl.idle = nil
+}
+
+func (pl *pool) dial(hash string) (*server, error) {
+	addr, gen, err := pl.p.primaryAddr()
+	if err != nil {
+		return nil, err
+	}
+	return dialServer(addr, gen, pl.user, pl.database, hash, pl.params)
+}
+
+// session is a client connection.
+type session struct {
+	p    *Pooler
+	pool *pool
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// pid and key identify the session in cancel requests.
+	pid int32
+	key int32
+
+	mtx sync.Mutex
+	// server is the connection assigned to the session while it is in a
+	// transaction or waiting for query results.
+	server *server
+	// pending is the number of ReadyForQuery messages the server will send
+	// in response to queries and syncs sent by the client.
+	pending int
+	// failed is set when a server connection could not be acquired for an
+	// extended query, the remaining messages are discarded until the next
+	// sync.
+	failed error
+	closed bool
+}
+
+// startup handles the startup message of the session, returning the startup
+// parameters. It returns false if the session should be closed.
+func (s *session) startup() (map[string]string, bool) {
+	for {
+		b, err := readStartup(s.r)
+		if err != nil {
+			return nil, false
+		}
+		switch code := b.int32(); code {
+		case sslRequestCode:
+			// SSL is not supported, clients continue with an
+			// unencrypted startup message or disconnect
+			if _, err := s.conn.Write([]byte{'N'}); err != nil {
+				return nil, false
+			}
+		case cancelRequestCode:
+			s.p.cancel(b.int32(), b.int32())
+			return nil, false
+		case protocolVersion:
+			params := make(map[string]string)
+			for {
+				name := b.string()
+				if name == "" {
+					break
+				}
+				params[name] = b.string()
+			}
+			return params, true
+		default:
+			s.fatal(codeProtocolViolation, "unsupported frontend protocol")
+			return nil, false
+		}
+	}
+}
+
+// serve forwards messages from the client to the server assigned to the
+// session, acquiring one from the pool if necessary.
+func (s *session) serve() {
+	for {
+		m, err := readMessage(s.r)
+		if err != nil || m.Type == msgTerminate {
+			return
+		}
+		if err := s.send(m); err != nil {
+			return
+		}
+	}
+}
+
+func (s *session) send(m *message) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	if s.failed != nil {
+		if m.Type != msgSync {
+			return nil
+		}
+		err := s.failed
+		s.failed = nil
+		return s.queryFailed(err)
+	}
+
+	if s.server == nil {
+		// acquiring may block while holding the lock, but forward isn't
+		// running without a server so only cancel requests wait on it
+		srv, err := s.pool.acquire()
+		if err != nil {
+			s.p.log.Error("error acquiring server connection", "fn", "send", "err", err)
+			if m.Type == msgQuery || m.Type == msgSync {
+				return s.queryFailed(err)
+			}
+			s.failed = err
+			return nil
+		}
+		s.server = srv
+		go s.forward(srv)
+	}
+
+	if m.Type == msgQuery || m.Type == msgSync {
+		s.pending++
+	}
+	if err := writeMessage(s.server.w, m); err != nil {
+		return err
+	}
+	if s.r.Buffered() == 0 {
+		return s.server.w.Flush()
+	}
+	return nil
+}
+
+// queryFailed responds to a query which could not be sent to a server as if
+// the server had returned an error, so that the client can retry it.
+func (s *session) queryFailed(err error) error {
+	if err := s.write(errorMessage("ERROR", codeCannotConnectNow, err.Error())); err != nil {
+		return err
+	}
+	return s.write(readyForQuery(txIdle))
+}
+
+// forward forwards messages from srv to the client until the server is idle,
+// at which point it is released back to the pool.
+func (s *session) forward(srv *server) {
+	for {
+		m, err := readMessage(srv.r)
+		if err != nil {
+			// the transaction is lost along with the connection, so
+			// terminate the session as the server would have done
+			s.mtx.Lock()
+			s.server = nil
+			closed := s.closed
+			s.closed = true
+			s.mtx.Unlock()
+			s.pool.discard(srv)
+			if !closed {
+				s.p.log.Error("lost server connection", "fn", "forward", "err", err)
+				s.write(errorMessage("FATAL", codeConnectionFailure, "lost connection to the server"))
+			}
+			s.conn.Close()
+			return
+		}
+		if err := writeMessage(s.w, m); err != nil {
+			s.close()
+			continue
+		}
+		if srv.r.Buffered() == 0 {
+			if err := s.w.Flush(); err != nil {
+				s.close()
+				continue
+			}
+		}
+		if m.Type != msgReadyForQuery {
+			continue
+		}
+		s.mtx.Lock()
+		s.pending--
+		if s.pending <= 0 && len(m.Data) == 1 && m.Data[0] == txIdle && !s.closed {
+			s.pending = 0
+			s.server = nil
+			s.mtx.Unlock()
+			s.pool.release(srv)
+			return
+		}
+		s.mtx.Unlock()
+	}
+}
+
+func (s *session) currentServer() *server {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.server
+}
+
+// write writes a message to the client, it must only be called when no
+// server is assigned to the session.
+func (s *session) write(m *message) error {
+	if err := writeMessage(s.w, m); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// fatal sends a fatal error to the client and closes the session.
+func (s *session) fatal(code, msg string) {
+	s.write(errorMessage("FATAL", code, msg))
+	s.close()
+}
+
+// close closes the client connection and any server connection assigned to
+// the session, as it may be in the middle of a transaction. The server
+// connection is discarded when forward reads the resulting error.
+func (s *session) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.conn.Close()
+	if s.server != nil {
+		s.server.conn.Close()
+	}
+}
+
+// server is a connection to the primary.
+type server struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// gen is the generation of the primary the server is connected to.
+	gen int
+
+	// pid and key identify the connection in cancel requests.
+	pid int32
+	key int32
+
+	// status are the ParameterStatus messages sent on startup.
+	status []*message
+}
+
+const dialTimeout = 5 * time.Second
+
+// dialServer connects and authenticates to the server at addr with the MD5
+// password hash of user, returning a *serverError if it rejects the
+// connection.
+func dialServer(addr string, gen int, user, database, hash string, params map[string]string) (*server, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	srv := &server{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+		gen:  gen,
+	}
+	if err := srv.startup(user, database, hash, params); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+func (srv *server) startup(user, database, hash string, params map[string]string) error {
+	srv.conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer srv.conn.SetDeadline(time.Time{})
+
+	var b writeBuf
+	b.int32(protocolVersion)
+	b.string("user")
+	b.string(user)
+	b.string("database")
+	b.string(database)
+	for name, value := range params {
+		b.string(name)
+		b.string(value)
+	}
+	b.byte(0)
+	if err := writeStartup(srv.conn, b); err != nil {
+		return err
+	}
+
+	for {
+		m, err := readMessage(srv.r)
+		if err != nil {
+			return err
+		}
+		switch m.Type {
+		case msgAuthentication:
+			if err := srv.auth(m, hash); err != nil {
+				return err
+			}
+		case msgParameterStatus:
+			srv.status = append(srv.status, m)
+		case msgBackendKeyData:
+			b := readBuf(m.Data)
+			srv.pid, srv.key = b.int32(), b.int32()
+		case msgReadyForQuery:
+			return nil
+		case msgErrorResponse:
+			return newServerError(m)
+		}
+	}
+}
+
+// auth responds to an authentication request of the server. Only the password
+// hash is known, so MD5 is the only supported method.
+func (srv *server) auth(m *message, hash string) error {
+	b := readBuf(m.Data)
+	var response string
+	switch code := b.int32(); code {
+	case authOK:
+		return nil
+	case authMD5Password:
+		response = md5Response(hash, b[:4])
+	default:
+		return errors.New("pooler: unsupported authentication method requested by server")
+	}
+	var data writeBuf
+	data.string(response)
+	return writeMessage(srv.conn, &message{Type: msgPassword, Data: data})
+}
+
+// queryValue runs a simple query, returning the value of the first column of
+// its first row, or an empty string if there are no rows or it is null.
+func (srv *server) queryValue(q string) (string, error) {
+	srv.conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer srv.conn.SetDeadline(time.Time{})
+
+	var b writeBuf
+	b.string(q)
+	if err := writeMessage(srv.conn, &message{Type: msgQuery, Data: b}); err != nil {
+		return "", err
+	}
+	var value string
+	var queryErr error
+	for {
+		m, err := readMessage(srv.r)
+		if err != nil {
+			return "", err
+		}
+		switch m.Type {
+		case msgDataRow:
+			b := readBuf(m.Data)
+			if value == "" && b.int16() > 0 {
+				if n := b.int32(); n > 0 && int(n) <= len(b) {
+					value = string(b[:n])
+				}
+			}
+		case msgErrorResponse:
+			queryErr = newServerError(m)
+		case msgReadyForQuery:
+			return value, queryErr
+		}
+	}
+}
+
+// close terminates the connection.
+func (srv *server) close() {
+	writeMessage(srv.conn, &message{Type: msgTerminate})
+	srv.conn.Close()
+}
+
+// cancel sends a cancel request for the query the server is running.
+func (srv *server) cancel() {
+	conn, err := net.DialTimeout("tcp", srv.conn.RemoteAddr().String(), dialTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var b writeBuf
+	b.int32(cancelRequestCode)
+	b.int32(srv.pid)
+	b.int32(srv.key)
+	writeStartup(conn, b)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type PoolerSuite struct{}
+
+var _ = Suite(&PoolerSuite{})
+
+const (
+	testUser         = "user"
+	testPassword     = "password"
+	testAuthUser     = "flynn"
+	testAuthPassword = "secret"
+)
+
+// testRoles are the passwords of the roles of the fake server.
+var testRoles = map[string]string{
+	testUser:     testPassword,
+	testAuthUser: testAuthPassword,
+}
+
+// fakeServer implements enough of a postgres server to test the pooler. It
+// authenticates with MD5, answers password hash lookups of the auth user and
+// responds to each other query with a command tag identifying the server and
+// connection which ran it.
+type fakeServer struct {
+	name string
+	l    net.Listener
+
+	mtx   sync.Mutex
+	conns []net.Conn
+}
+
+func newFakeServer(c *C, name string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s := &fakeServer{name: name, l: l}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) Addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeServer) Close() {
+	s.l.Close()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakeServer) ConnCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.conns)
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mtx.Lock()
+		s.conns = append(s.conns, conn)
+		id := len(s.conns)
+		s.mtx.Unlock()
+		go s.handle(conn, id)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn, id int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	b, err := readStartup(r)
+	if err != nil || b.int32() != protocolVersion {
+		return
+	}
+	params := make(map[string]string)
+	for {
+		name := b.string()
+		if name == "" {
+			break
+		}
+		params[name] = b.string()
+	}
+
+	salt := []byte{1, 2, 3, 4}
+	writeMessage(conn, authMessage(authMD5Password, salt))
+	m, err := readMessage(r)
+	if err != nil {
+		return
+	}
+	b = readBuf(m.Data)
+	user := params["user"]
+	password, ok := testRoles[user]
+	if !ok || b.string() != md5Password(user, password, salt) {
+		writeMessage(conn, errorMessage("FATAL", "28P01", "password authentication failed"))
+		return
+	}
+	writeMessage(conn, authMessage(authOK, nil))
+	writeMessage(conn, parameterStatus("server_version", "9.4.4"))
+	writeMessage(conn, backendKeyData(int32(id), 0))
+	writeMessage(conn, readyForQuery(txIdle))
+
+	status := byte(txIdle)
+	for {
+		m, err := readMessage(r)
+		if err != nil {
+			return
+		}
+		switch m.Type {
+		case msgQuery:
+			b := readBuf(m.Data)
+			q := b.string()
+			if user == testAuthUser && q == hashQuery(testUser) {
+				var row writeBuf
+				row.byte(0)
+				row.byte(1)
+				hash := md5Hash(testUser, testPassword)
+				row.int32(int32(len(hash)))
+				row.bytes([]byte(hash))
+				writeMessage(conn, &message{Type: msgDataRow, Data: row})
+			}
+			switch q {
+			case "BEGIN":
+				status = 'T'
+			case "COMMIT":
+				status = txIdle
+			}
+			var tag writeBuf
+			tag.string(fmt.Sprintf("%s %d", s.name, id))
+			writeMessage(conn, &message{Type: 'C', Data: tag})
+			writeMessage(conn, readyForQuery(status))
+		case msgSync:
+			writeMessage(conn, readyForQuery(status))
+		case msgTerminate:
+			return
+		}
+	}
+}
+
+func parameterStatus(name, value string) *message {
+	var b writeBuf
+	b.string(name)
+	b.string(value)
+	return &message{Type: msgParameterStatus, Data: b}
+}
+
+// testClient is a client connection to the pooler.
+type testClient struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	params map[string]string
+}
+
+func connect(addr, password string) (*testClient, error) {
+	return connectAs(addr, testUser, password)
+}
+
+func connectAs(addr, user, password string) (*testClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &testClient{conn: conn, r: bufio.NewReader(conn), params: make(map[string]string)}
+
+	var b writeBuf
+	b.int32(protocolVersion)
+	b.string("user")
+	b.string(user)
+	b.byte(0)
+	writeStartup(conn, b)
+
+	for {
+		m, err := c.read()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		switch m.Type {
+		case msgAuthentication:
+			b := readBuf(m.Data)
+			switch b.int32() {
+			case authOK:
+			case authMD5Password:
+				var data writeBuf
+				data.string(md5Password(user, password, b[:4]))
+				writeMessage(conn, &message{Type: msgPassword, Data: data})
+			default:
+				conn.Close()
+				return nil, errors.New("unexpected authentication request")
+			}
+		case msgParameterStatus:
+			b := readBuf(m.Data)
+			c.params[b.string()] = b.string()
+		case msgReadyForQuery:
+			return c, nil
+		}
+	}
+}
+
+func (c *testClient) read() (*message, error) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	m, err := readMessage(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type == msgErrorResponse {
+		return nil, newServerError(m)
+	}
+	return m, nil
+}
+
+// query runs a simple query, returning the command tag and the transaction
+// status.
+func (c *testClient) query(q string) (string, byte, error) {
+	var b writeBuf
+	b.string(q)
+	if err := writeMessage(c.conn, &message{Type: msgQuery, Data: b}); err != nil {
+		return "", 0, err
+	}
+	var tag string
+	var queryErr error
+	for {
+		m, err := c.read()
+		if e, ok := err.(*serverError); ok {
+			queryErr = e
+			continue
+		} else if err != nil {
+			return "", 0, err
+		}
+		switch m.Type {
+		case 'C':
+			b := readBuf(m.Data)
+			tag = b.string()
+		case msgReadyForQuery:
+			return tag, m.Data[0], queryErr
+		}
+	}
+}
+
+func (c *testClient) Close() {
+	writeMessage(c.conn, &message{Type: msgTerminate})
+	c.conn.Close()
+}
+
+func newTestPooler(c *C, poolSize int) (*Pooler, string, func()) {
+	p := NewPooler(poolSize, log15.New())
+	p.AuthUser = testAuthUser
+	p.AuthPassword = testAuthPassword
+	p.log.SetHandler(log15.DiscardHandler())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go p.Serve(l)
+	return p, l.Addr().String(), func() {
+		l.Close()
+		p.Close()
+	}
+}
+
+func (PoolerSuite) TestStartup(c *C) {
+	srv := newFakeServer(c, "primary")
+	defer srv.Close()
+	p, addr, done := newTestPooler(c, 1)
+	defer done()
+	p.SetPrimary(srv.Addr())
+
+	// the password hash is looked up with a connection as the auth user
+	_, err := connect(addr, "wrong")
+	c.Assert(err, NotNil)
+	c.Assert(err.(*serverError).fields['C'], Equals, "28P01")
+	c.Assert(srv.ConnCount(), Equals, 1)
+
+	// unknown roles are rejected the same way
+	_, err = connectAs(addr, "nobody", testPassword)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*serverError).fields['C'], Equals, "28P01")
+	c.Assert(srv.ConnCount(), Equals, 2)
+
+	client, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	c.Assert(client.params["server_version"], Equals, "9.4.4")
+
+	// the connection made with the hash of the first client is reused
+	tag, status, err := client.query("SELECT 1")
+	c.Assert(err, IsNil)
+	c.Assert(tag, Equals, "primary 4")
+	c.Assert(status, Equals, byte(txIdle))
+	c.Assert(srv.ConnCount(), Equals, 4)
+
+	// a client with the same password is authenticated by the pool
+	client2, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer client2.Close()
+	c.Assert(srv.ConnCount(), Equals, 4)
+	_, err = connect(addr, "wrong")
+	c.Assert(err, NotNil)
+}
+
+func (PoolerSuite) TestHashQuery(c *C) {
+	c.Assert(hashQuery(`a'b\c`), Equals, `SELECT passwd FROM pg_catalog.pg_shadow WHERE usename = E'a''b\\c'`)
+}
+
+func (PoolerSuite) TestTransactionPooling(c *C) {
+	srv := newFakeServer(c, "primary")
+	defer srv.Close()
+	p, addr, done := newTestPooler(c, 1)
+	defer done()
+	p.SetPrimary(srv.Addr())
+
+	client1, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer client1.Close()
+	client2, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer client2.Close()
+
+	tag, status, err := client1.query("BEGIN")
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, byte('T'))
+
+	// client2 waits for the only connection of the pool until client1's
+	// transaction finishes
+	type result struct {
+		tag string
+		err error
+	}
+	done2 := make(chan result)
+	go func() {
+		tag, _, err := client2.query("SELECT 1")
+		done2 <- result{tag, err}
+	}()
+	select {
+	case <-done2:
+		c.Fatal("query ran during another client's transaction")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, status, err = client1.query("COMMIT")
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, byte(txIdle))
+	select {
+	case res := <-done2:
+		c.Assert(res.err, IsNil)
+		c.Assert(res.tag, Equals, tag)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for query")
+	}
+	// one connection looked up the password hash
+	c.Assert(srv.ConnCount(), Equals, 2)
+}
+
+func (PoolerSuite) TestAcquireTimeout(c *C) {
+	srv := newFakeServer(c, "primary")
+	defer srv.Close()
+	p, addr, done := newTestPooler(c, 1)
+	defer done()
+	p.AcquireTimeout = 50 * time.Millisecond
+	p.SetPrimary(srv.Addr())
+
+	client1, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer client1.Close()
+	client2, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer client2.Close()
+
+	_, _, err = client1.query("BEGIN")
+	c.Assert(err, IsNil)
+
+	// the query fails but the client stays connected
+	_, status, err := client2.query("SELECT 1")
+	c.Assert(err, NotNil)
+	c.Assert(err.(*serverError).fields['C'], Equals, codeCannotConnectNow)
+	c.Assert(status, Equals, byte(txIdle))
+
+	_, _, err = client1.query("COMMIT")
+	c.Assert(err, IsNil)
+	_, _, err = client2.query("SELECT 1")
+	c.Assert(err, IsNil)
+}
+
+func (PoolerSuite) TestFailover(c *C) {
+	srv1 := newFakeServer(c, "primary1")
+	defer srv1.Close()
+	srv2 := newFakeServer(c, "primary2")
+	defer srv2.Close()
+	p, addr, done := newTestPooler(c, 2)
+	defer done()
+	p.SetPrimary(srv1.Addr())
+
+	client, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	tag, _, err := client.query("SELECT 1")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(tag, "primary1 "), Equals, true)
+
+	// a client in a transaction keeps its connection to the old primary
+	// until the transaction finishes
+	inTx, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer inTx.Close()
+	_, _, err = inTx.query("BEGIN")
+	c.Assert(err, IsNil)
+
+	p.SetPrimary(srv2.Addr())
+
+	tag, _, err = client.query("SELECT 1")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(tag, "primary2 "), Equals, true)
+
+	tag, _, err = inTx.query("COMMIT")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(tag, "primary1 "), Equals, true)
+	tag, _, err = inTx.query("SELECT 1")
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(tag, "primary2 "), Equals, true)
+}
+
+func (PoolerSuite) TestLostServer(c *C) {
+	srv := newFakeServer(c, "primary")
+	p, addr, done := newTestPooler(c, 1)
+	defer done()
+	p.SetPrimary(srv.Addr())
+
+	client, err := connect(addr, testPassword)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	_, _, err = client.query("BEGIN")
+	c.Assert(err, IsNil)
+
+	// losing the server in the middle of a transaction terminates the
+	// session
+	srv.Close()
+	_, _, err = client.query("COMMIT")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	protocolVersion   = 3 << 16
+	sslRequestCode    = 80877103
+	cancelRequestCode = 80877102
+
+	// maxMessageSize limits the size of messages read from clients and
+	// servers, it is the same limit postgres imposes on a single message.
+	maxMessageSize = 1<<30 - 1
+)
+
+// Message types of the frontend/backend protocol handled by the pooler, all
+// other messages are forwarded without being inspected.
+const (
+	msgAuthentication  = 'R'
+	msgBackendKeyData  = 'K'
+	msgDataRow         = 'D'
+	msgErrorResponse   = 'E'
+	msgParameterStatus = 'S'
+	msgReadyForQuery   = 'Z'
+
+	msgPassword  = 'p'
+	msgQuery     = 'Q'
+	msgSync      = 'S'
+	msgTerminate = 'X'
+)
+
+// Authentication request codes.
+const (
+	authOK                = 0
+	authCleartextPassword = 3
+	authMD5Password       = 5
+)
+
+// txIdle is the transaction status of ReadyForQuery messages sent when not
+// in a transaction block.
+const txIdle = 'I'
+
+var errMessageTooLarge = errors.New("pooler: message too large")
+
+// message is a message of the postgres frontend/backend protocol.
+type message struct {
+	Type byte
+	Data []byte
+}
+
+func readMessage(r *bufio.Reader) (*message, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readData(r)
+	if err != nil {
+		return nil, err
+	}
+	return &message{Type: typ, Data: data}, nil
+}
+
+// readStartup reads the untyped first message of a client connection, which
+// is a startup, SSL or cancel request.
+func readStartup(r *bufio.Reader) (readBuf, error) {
+	return readData(r)
+}
+
+func readData(r *bufio.Reader) ([]byte, error) {
+	var size int32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 || size > maxMessageSize {
+		return nil, errMessageTooLarge
+	}
+	data := make([]byte, size-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeMessage(w io.Writer, m *message) error {
+	buf := make([]byte, 5, 5+len(m.Data))
+	buf[0] = m.Type
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(m.Data)+4))
+	_, err := w.Write(append(buf, m.Data...))
+	return err
+}
+
+// writeStartup writes an untyped startup or cancel request.
+func writeStartup(w io.Writer, data []byte) error {
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+4))
+	_, err := w.Write(append(buf, data...))
+	return err
+}
+
+type writeBuf []byte
+
+func (b *writeBuf) int32(n int32) {
+	*b = append(*b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32((*b)[len(*b)-4:], uint32(n))
+}
+
+func (b *writeBuf) string(s string) {
+	*b = append(*b, s...)
+	*b = append(*b, 0)
+}
+
+func (b *writeBuf) byte(c byte) {
+	*b = append(*b, c)
+}
+
+func (b *writeBuf) bytes(p []byte) {
+	*b = append(*b, p...)
+}
+
+type readBuf []byte
+
+func (b *readBuf) int32() int32 {
+	if len(*b) < 4 {
+		*b = nil
+		return 0
+	}
+	n := int32(binary.BigEndian.Uint32(*b))
+	*b = (*b)[4:]
+	return n
+}
+
+func (b *readBuf) int16() int16 {
+	if len(*b) < 2 {
+		*b = nil
+		return 0
+	}
+	n := int16(binary.BigEndian.Uint16(*b))
+	*b = (*b)[2:]
+	return n
+}
+
+func (b *readBuf) string() string {
+	for i, c := range *b {
+		if c == 0 {
+			s := string((*b)[:i])
+			*b = (*b)[i+1:]
+			return s
+		}
+	}
+	*b = nil
+	return ""
+}
+
+func (b *readBuf) byte() byte {
+	if len(*b) == 0 {
+		return 0
+	}
+	c := (*b)[0]
+	*b = (*b)[1:]
+	return c
+}
+
+func authMessage(code int32, extra []byte) *message {
+	var b writeBuf
+	b.int32(code)
+	b.bytes(extra)
+	return &message{Type: msgAuthentication, Data: b}
+}
+
+func readyForQuery(status byte) *message {
+	return &message{Type: msgReadyForQuery, Data: []byte{status}}
+}
+
+func backendKeyData(pid, key int32) *message {
+	var b writeBuf
+	b.int32(pid)
+	b.int32(key)
+	return &message{Type: msgBackendKeyData, Data: b}
+}
+
+// SQLSTATE codes of errors generated by the pooler.
+const (
+	codeProtocolViolation    = "08P01"
+	codeConnectionFailure    = "08006"
+	codeCannotConnectNow     = "57P03"
+	codeInvalidAuthorization = "28000"
+	codeInvalidPassword      = "28P01"
+)
+
+func errorMessage(severity, code, msg string) *message {
+	var b writeBuf
+	b.byte('S')
+	b.string(severity)
+	b.byte('C')
+	b.string(code)
+	b.byte('M')
+	b.string(msg)
+	b.byte(0)
+	return &message{Type: msgErrorResponse, Data: b}
+}
+
+// serverError is an ErrorResponse received from a server.
+type serverError struct {
+	msg    *message
+	fields map[byte]string
+}
+
+func newServerError(m *message) *serverError {
+	e := &serverError{msg: m, fields: make(map[byte]string)}
+	b := readBuf(m.Data)
+	for {
+		typ := b.byte()
+		if typ == 0 {
+			break
+		}
+		e.fields[typ] = b.string()
+	}
+	return e
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("pooler: server error: %s %s (%s)", e.fields['S'], e.fields['M'], e.fields['C'])
+}
+
+// md5Password returns the response to an MD5 password request, as described
+// in the "Message Flow" section of the protocol documentation.
+func md5Password(user, password string, salt []byte) string {
+	return md5Response(md5Hash(user, password), salt)
+}
+
+// md5Hash returns the MD5 hash of a password as stored in pg_shadow.
+func md5Hash(user, password string) string {
+	return "md5" + md5Hex(password+user)
+}
+
+// md5Response returns the response to an MD5 password request given the
+// stored hash of the password.
+func md5Response(hash string, salt []byte) string {
+	return "md5" + md5Hex(strings.TrimPrefix(hash, "md5")+string(salt))
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -18,10 +18,11 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/jackc/pgx"
 	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
 	"github.com/flynn/flynn/appliance/postgresql/client"
-	"github.com/flynn/flynn/appliance/postgresql/state"
-	"github.com/flynn/flynn/appliance/postgresql/xlog"
+	"github.com/flynn/flynn/appliance/postgresql/pgxlog"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/shutdown"
+	"github.com/flynn/flynn/pkg/sirenia/state"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
 )
 
 type Config struct {
@@ -37,6 +38,14 @@ type Config struct {
 	ExtWhitelist bool
 	SHMType      string
 	WaitUpstream bool
+
+	// ArchiveCommand is the postgres archive_command used to archive WAL
+	// segments, archiving is disabled if it is empty.
+	ArchiveCommand string
+
+	// Restore is set when the cluster should be restored from a backup when
+	// starting as primary with an empty data directory.
+	Restore *Restore
 }
 
 type Postgres struct {
@@ -44,25 +53,27 @@ type Postgres struct {
 	dbMtx sync.RWMutex
 	db    *pgx.ConnPool
 
-	events chan state.PostgresEvent
+	events chan state.DatabaseEvent
 
-	configVal     atomic.Value // *state.PgConfig
+	configVal     atomic.Value // *state.Config
 	runningVal    atomic.Value // bool
 	configApplied bool
 
 	// config options
-	id           string
-	log          log15.Logger
-	singleton    bool
-	port         string
-	binDir       string
-	dataDir      string
-	password     string
-	opTimeout    time.Duration
-	replTimeout  time.Duration
-	extWhitelist bool
-	shmType      string
-	waitUpstream bool
+	id             string
+	log            log15.Logger
+	singleton      bool
+	port           string
+	binDir         string
+	dataDir        string
+	password       string
+	opTimeout      time.Duration
+	replTimeout    time.Duration
+	extWhitelist   bool
+	shmType        string
+	waitUpstream   bool
+	archiveCommand string
+	restore        *Restore
 
 	// daemon is the postgres daemon command when running
 	daemon *exec.Cmd
@@ -77,11 +88,14 @@ type Postgres struct {
 
 	// mtx ensures that only one operation happens at a time
 	mtx sync.Mutex
+
+	// backupMtx ensures that only one base backup is taken at a time
+	backupMtx sync.Mutex
 }
 
 const checkInterval = 100 * time.Millisecond
 
-func NewPostgres(c Config) state.Postgres {
+func NewPostgres(c Config) state.Database {
 	p := &Postgres{
 		id:             c.ID,
 		log:            c.Logger,
@@ -95,7 +109,9 @@ func NewPostgres(c Config) state.Postgres {
 		extWhitelist:   c.ExtWhitelist,
 		shmType:        c.SHMType,
 		waitUpstream:   c.WaitUpstream,
-		events:         make(chan state.PostgresEvent, 1),
+		archiveCommand: c.ArchiveCommand,
+		restore:        c.Restore,
+		events:         make(chan state.DatabaseEvent, 1),
 		cancelSyncWait: func() {},
 	}
 	p.setRunning(false)
@@ -121,7 +137,7 @@ func NewPostgres(c Config) state.Postgres {
 	if p.replTimeout == 0 {
 		p.replTimeout = 1 * time.Minute
 	}
-	p.events <- state.PostgresEvent{}
+	p.events <- state.DatabaseEvent{}
 	return p
 }
 
@@ -133,11 +149,11 @@ func (p *Postgres) setRunning(running bool) {
 	p.runningVal.Store(running)
 }
 
-func (p *Postgres) config() *state.PgConfig {
-	return p.configVal.Load().(*state.PgConfig)
+func (p *Postgres) config() *state.Config {
+	return p.configVal.Load().(*state.Config)
 }
 
-func (p *Postgres) setConfig(config *state.PgConfig) {
+func (p *Postgres) setConfig(config *state.Config) {
 	p.configVal.Store(config)
 }
 
@@ -155,7 +171,7 @@ func (p *Postgres) Info() (*pgmanager.PostgresInfo, error) {
 	return res, err
 }
 
-func (p *Postgres) Reconfigure(config *state.PgConfig) error {
+func (p *Postgres) Reconfigure(config *state.Config) error {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
 
@@ -209,6 +225,10 @@ func (p *Postgres) Stop() error {
 	return p.stop()
 }
 
+func (p *Postgres) XLog() xlog.XLog {
+	return pgxlog.PgXLog{}
+}
+
 func (p *Postgres) XLogPosition() (xlog.Position, error) {
 	p.dbMtx.RLock()
 	defer p.dbMtx.RUnlock()
@@ -226,11 +246,25 @@ func (p *Postgres) XLogPosition() (xlog.Position, error) {
 	return xlog.Position(res), err
 }
 
-func (p *Postgres) Ready() <-chan state.PostgresEvent {
+// XLogDiff returns the number of bytes of WAL between the positions a and b.
+func (p *Postgres) XLogDiff(a, b xlog.Position) (int64, error) {
+	p.dbMtx.RLock()
+	defer p.dbMtx.RUnlock()
+
+	if !p.running() || p.db == nil {
+		return 0, errors.New("postgres is not running")
+	}
+
+	var res int64
+	err := p.db.QueryRow("SELECT pg_xlog_location_diff($1::pg_lsn, $2::pg_lsn)::bigint", string(a), string(b)).Scan(&res)
+	return res, err
+}
+
+func (p *Postgres) Ready() <-chan state.DatabaseEvent {
 	return p.events
 }
 
-func (p *Postgres) reconfigure(config *state.PgConfig) (err error) {
+func (p *Postgres) reconfigure(config *state.Config) (err error) {
 	defer func() {
 		if err == nil {
 			p.setConfig(config)
@@ -297,13 +331,20 @@ func (p *Postgres) assumePrimary(downstream *discoverd.Instance) (err error) {
 		panic(fmt.Sprintf("unexpected state running role=%s", p.config().Role))
 	}
 
-	if err := p.initDB(); err != nil {
-		return err
-	}
+	restoring := p.restore != nil && !p.initialized()
+	if restoring {
+		if err := p.restoreBackup(); err != nil {
+			return err
+		}
+	} else {
+		if err := p.initDB(); err != nil {
+			return err
+		}
 
-	if err := os.Remove(p.recoveryConfPath()); err != nil && !os.IsNotExist(err) {
-		log.Error("error removing recovery.conf", "path", p.recoveryConfPath(), "err", err)
-		return err
+		if err := os.Remove(p.recoveryConfPath()); err != nil && !os.IsNotExist(err) {
+			log.Error("error removing recovery.conf", "path", p.recoveryConfPath(), "err", err)
+			return err
+		}
 	}
 
 	if err := p.writeConfig(configData{ReadOnly: downstream != nil}); err != nil {
@@ -328,6 +369,12 @@ func (p *Postgres) assumePrimary(downstream *discoverd.Instance) (err error) {
 		}
 	}()
 
+	if restoring {
+		if err = p.waitForRecovery(); err != nil {
+			return err
+		}
+	}
+
 	tx, err = p.db.Begin()
 	if err != nil {
 		log.Error("error acquiring connection", "err", err)
@@ -584,7 +631,7 @@ func (p *Postgres) waitForSync(inst *discoverd.Instance) {
 		defer close(doneCh)
 
 		startTime := time.Now().UTC()
-		lastFlushed := xlog.Zero
+		lastFlushed := pgxlog.Zero
 		log := p.log.New(
 			"fn", "waitForSync",
 			"sync_name", inst.ID,
@@ -636,10 +683,10 @@ func (p *Postgres) waitForSync(inst *discoverd.Instance) {
 			elapsedTime := time.Now().Sub(startTime)
 			log := log.New("sent", sent, "flushed", flushed, "elapsed", elapsedTime)
 
-			if cmp, err := xlog.Compare(lastFlushed, flushed); err != nil {
+			if cmp, err := pgxlog.Compare(lastFlushed, flushed); err != nil {
 				log.Error("error parsing log locations", "err", err)
 				return
-			} else if lastFlushed == xlog.Zero || cmp == -1 {
+			} else if lastFlushed == pgxlog.Zero || cmp == -1 {
 				log.Debug("flushed row incremented, resetting startTime")
 				startTime = time.Now().UTC()
 				lastFlushed = flushed
@@ -778,6 +825,7 @@ func (p *Postgres) writeConfig(d configData) error {
 	d.Port = p.port
 	d.ExtWhitelist = p.extWhitelist
 	d.SHMType = p.shmType
+	d.ArchiveCommand = p.archiveCommand
 	f, err := os.Create(p.configPath())
 	if err != nil {
 		return err
@@ -840,6 +888,7 @@ type configData struct {
 	DisableFullPageWrites bool
 	ExtWhitelist          bool
 	SHMType               string
+	ArchiveCommand        string
 }
 
 var configTemplate = template.Must(template.New("postgresql.conf").Parse(`
@@ -855,6 +904,11 @@ fsync = on
 {{if .DisableFullPageWrites}}
 full_page_writes = off # Not necessary on ZFS, see http://www.postgresql.org/docs/current/static/wal-reliability.html
 {{end}}
+{{if .ArchiveCommand}}
+archive_mode = on
+archive_command = '{{.ArchiveCommand}}'
+archive_timeout = 60
+{{end}}
 max_wal_senders = 15
 wal_keep_segments = 1000
 synchronous_commit = remote_write
@@ -900,6 +954,20 @@ trigger_file = '{{.TriggerFile}}'
 recovery_target_timeline = 'latest'
 `[1:]))
 
+type restoreData struct {
+	RestoreCommand string
+	TargetTime     string
+}
+
+var restoreConfTemplate = template.Must(template.New("recovery.conf").Parse(`
+restore_command = '{{.RestoreCommand}}'
+{{if .TargetTime}}
+recovery_target_time = '{{.TargetTime}}'
+{{end}}
+pause_at_recovery_target = false
+recovery_target_timeline = 'latest'
+`[1:]))
+
 var hbaConf = []byte(`
 # TYPE  DATABASE        USER            ADDRESS                 METHOD
 host    all             postgres        127.0.0.1/32            trust
@@ -7,10 +7,10 @@ import (
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/jackc/pgx"
-	"github.com/flynn/flynn/appliance/postgresql/state"
-	"github.com/flynn/flynn/appliance/postgresql/xlog"
+	"github.com/flynn/flynn/appliance/postgresql/pgxlog"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/attempt"
+	"github.com/flynn/flynn/pkg/sirenia/state"
 )
 
 // Hook gocheck up to the "go test" runner
@@ -30,7 +30,7 @@ func (PostgresSuite) TestSingletonPrimary(c *C) {
 	}
 
 	pg := NewPostgres(cfg)
-	err := pg.Reconfigure(&state.PgConfig{Role: state.RolePrimary})
+	err := pg.Reconfigure(&state.Config{Role: state.RolePrimary})
 	c.Assert(err, IsNil)
 
 	err = pg.Start()
@@ -47,7 +47,7 @@ func (PostgresSuite) TestSingletonPrimary(c *C) {
 
 	// ensure that we can start a new instance from the same directory
 	pg = NewPostgres(cfg)
-	err = pg.Reconfigure(&state.PgConfig{Role: state.RolePrimary})
+	err = pg.Reconfigure(&state.Config{Role: state.RolePrimary})
 	c.Assert(err, IsNil)
 	c.Assert(pg.Start(), IsNil)
 	defer pg.Stop()
@@ -68,7 +68,7 @@ func instance(n int) *discoverd.Instance {
 	}
 }
 
-func newPostgres(c *C, n int) state.Postgres {
+func newPostgres(c *C, n int) state.Database {
 	return NewPostgres(Config{
 		ID:        fmt.Sprintf("node%d", n),
 		DataDir:   c.MkDir(),
@@ -89,15 +89,15 @@ func connect(c *C, n int, db string) *pgx.Conn {
 	return conn
 }
 
-func pgConfig(role state.Role, n int) *state.PgConfig {
+func pgConfig(role state.Role, n int) *state.Config {
 	var inst *discoverd.Instance
 	if n > 0 {
 		inst = instance(n)
 	}
 	if role == state.RolePrimary {
-		return &state.PgConfig{Role: role, Downstream: inst}
+		return &state.Config{Role: role, Downstream: inst}
 	}
-	return &state.PgConfig{Role: role, Upstream: inst}
+	return &state.Config{Role: role, Upstream: inst}
 }
 
 var queryAttempts = attempt.Strategy{
@@ -192,11 +192,11 @@ func (PostgresSuite) TestIntegration(c *C) {
 	// try to query primary until it comes up as read-write
 	waitReadWrite(c, node1Conn)
 
-	for _, n := range []state.Postgres{node1, node2} {
+	for _, n := range []state.Database{node1, node2} {
 		pos, err := n.XLogPosition()
 		c.Assert(err, IsNil)
 		c.Assert(pos, Not(Equals), "")
-		c.Assert(pos, Not(Equals), xlog.Zero)
+		c.Assert(pos, Not(Equals), pgxlog.Zero)
 	}
 
 	// make sure the sync is listed as sync and remote_write is enabled
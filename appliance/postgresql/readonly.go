@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/appliance/postgresql/client"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/sirenia/state"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
+)
+
+// DefaultMaxReadOnlyLag is the default number of bytes of WAL a standby may
+// be behind the primary and still serve read-only queries, it is the size of
+// a WAL segment.
+const DefaultMaxReadOnlyLag = 16 << 20
+
+var errNotStandby = errors.New("peer is not a standby")
+
+// ReadOnly registers a peer in the read-only service of the cluster while it
+// is a standby which is replicating from the primary with no more than MaxLag
+// bytes of lag, so that apps can send read-only queries to it.
+type ReadOnly struct {
+	Service string
+	MaxLag  int64
+
+	pg   *Postgres
+	peer standbyPeer
+	log  log15.Logger
+
+	// discoverd registers the read-only instance and lag returns the
+	// replication lag of the standby, they are replaced in tests.
+	discoverd readOnlyDiscoverd
+	lag       func() (int64, error)
+
+	mtx    sync.Mutex
+	hb     discoverd.Heartbeater
+	closed bool
+}
+
+// standbyPeer is the part of a *state.Peer used to check whether it is a
+// standby.
+type standbyPeer interface {
+	Info() *state.PeerInfo
+}
+
+type readOnlyDiscoverd interface {
+	AddServiceAndRegisterInstance(service string, inst *discoverd.Instance) (discoverd.Heartbeater, error)
+}
+
+func NewReadOnly(service string, maxLag int64, pg *Postgres, peer *state.Peer, log log15.Logger) *ReadOnly {
+	r := &ReadOnly{
+		Service:   service,
+		MaxLag:    maxLag,
+		pg:        pg,
+		peer:      peer,
+		log:       log,
+		discoverd: discoverd.DefaultClient,
+	}
+	r.lag = r.standbyLag
+	return r
+}
+
+// Run checks the standby every interval, registering or unregistering it as
+// it becomes healthy or unhealthy.
+func (r *ReadOnly) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.check()
+	}
+}
+
+// Close unregisters the peer from the read-only service.
+func (r *ReadOnly) Close() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.closed = true
+	r.unregister()
+}
+
+func (r *ReadOnly) unregister() {
+	if r.hb != nil {
+		r.hb.Close()
+		r.hb = nil
+	}
+}
+
+func (r *ReadOnly) check() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.closed {
+		return
+	}
+	log := r.log.New("fn", "check")
+
+	lag, err := r.lag()
+	healthy := err == nil && lag <= r.MaxLag
+	switch {
+	case healthy && r.hb == nil:
+		hb, err := r.discoverd.AddServiceAndRegisterInstance(r.Service, &discoverd.Instance{Addr: ":" + r.pg.port})
+		if err != nil {
+			log.Error("error registering read-only instance", "err", err)
+			return
+		}
+		log.Info("registered read-only instance", "lag", lag)
+		r.hb = hb
+	case !healthy && r.hb != nil:
+		if err != nil {
+			log.Info("unregistering read-only instance", "err", err)
+		} else {
+			log.Info("unregistering read-only instance", "lag", lag, "max_lag", r.MaxLag)
+		}
+		r.unregister()
+	}
+}
+
+// standbyLag returns the number of bytes of WAL the standby has yet to replay
+// to reach the current position of the primary.
+func (r *ReadOnly) standbyLag() (int64, error) {
+	info := r.peer.Info()
+	if info.Role != state.RoleSync && info.Role != state.RoleAsync || info.State == nil || info.State.Primary == nil {
+		return 0, errNotStandby
+	}
+	if config := r.pg.config(); !r.pg.running() || config == nil || config.Role != info.Role {
+		return 0, errNotStandby
+	}
+
+	// read the primary's position first so that it is at or before the
+	// current position when compared with that of the standby
+	status, err := pgmanager.NewClient(info.State.Primary.Addr).Status()
+	if err != nil {
+		return 0, err
+	}
+	if status.Postgres == nil || status.Postgres.XLog == "" {
+		return 0, fmt.Errorf("primary xlog position is unknown")
+	}
+	pos, err := r.pg.XLogPosition()
+	if err != nil {
+		return 0, err
+	}
+	lag, err := r.pg.XLogDiff(xlog.Position(status.Postgres.XLog), pos)
+	if err != nil {
+		return 0, err
+	}
+	if lag < 0 {
+		lag = 0
+	}
+	return lag, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/sirenia/state"
+)
+
+type ReadOnlySuite struct{}
+
+var _ = Suite(&ReadOnlySuite{})
+
+type fakeHeartbeater struct {
+	addr   string
+	closed bool
+}
+
+func (h *fakeHeartbeater) SetMeta(map[string]string) error { return nil }
+func (h *fakeHeartbeater) Addr() string                    { return h.addr }
+
+func (h *fakeHeartbeater) Close() error {
+	h.closed = true
+	return nil
+}
+
+// fakeReadOnlyDiscoverd records the instances registered with it.
+type fakeReadOnlyDiscoverd struct {
+	err error
+	hbs []*fakeHeartbeater
+}
+
+func (d *fakeReadOnlyDiscoverd) AddServiceAndRegisterInstance(service string, inst *discoverd.Instance) (discoverd.Heartbeater, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	hb := &fakeHeartbeater{addr: inst.Addr}
+	d.hbs = append(d.hbs, hb)
+	return hb, nil
+}
+
+// registered returns whether the last registered instance is still
+// registered.
+func (d *fakeReadOnlyDiscoverd) registered() bool {
+	return len(d.hbs) > 0 && !d.hbs[len(d.hbs)-1].closed
+}
+
+type fakeStandbyPeer struct {
+	info *state.PeerInfo
+}
+
+func (p *fakeStandbyPeer) Info() *state.PeerInfo { return p.info }
+
+func newTestReadOnly(maxLag int64) *ReadOnly {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	pg := NewPostgres(Config{Port: "54325", Logger: log}).(*Postgres)
+	r := NewReadOnly("pg-readonly", maxLag, pg, nil, log)
+	r.peer = &fakeStandbyPeer{info: &state.PeerInfo{}}
+	return r
+}
+
+func (ReadOnlySuite) TestCheck(c *C) {
+	r := newTestReadOnly(100)
+	d := &fakeReadOnlyDiscoverd{}
+	r.discoverd = d
+	var lag int64
+	var lagErr error
+	r.lag = func() (int64, error) { return lag, lagErr }
+
+	// a standby within the lag limit is registered once
+	lag = 50
+	r.check()
+	c.Assert(d.hbs, HasLen, 1)
+	c.Assert(d.hbs[0].addr, Equals, ":54325")
+	c.Assert(d.registered(), Equals, true)
+	r.check()
+	c.Assert(d.hbs, HasLen, 1)
+
+	// falling behind unregisters it, and catching up registers it again
+	lag = 200
+	r.check()
+	c.Assert(d.registered(), Equals, false)
+	lag = 100
+	r.check()
+	c.Assert(d.hbs, HasLen, 2)
+	c.Assert(d.registered(), Equals, true)
+
+	// errors determining the lag unregister it
+	lagErr = errNotStandby
+	r.check()
+	c.Assert(d.registered(), Equals, false)
+
+	// failed registrations are retried on the next check
+	lagErr = nil
+	d.err = errors.New("discoverd unavailable")
+	r.check()
+	c.Assert(d.hbs, HasLen, 2)
+	d.err = nil
+	r.check()
+	c.Assert(d.hbs, HasLen, 3)
+	c.Assert(d.registered(), Equals, true)
+
+	// closing unregisters it for good
+	r.Close()
+	c.Assert(d.registered(), Equals, false)
+	r.check()
+	c.Assert(d.hbs, HasLen, 3)
+}
+
+func (ReadOnlySuite) TestStandbyLag(c *C) {
+	r := newTestReadOnly(100)
+	peer := r.peer.(*fakeStandbyPeer)
+	primary := &discoverd.Instance{Addr: "127.0.0.1:5432"}
+	withPrimary := &state.State{Primary: primary}
+
+	for _, t := range []struct {
+		desc    string
+		info    *state.PeerInfo
+		running bool
+		config  *state.Config
+	}{
+		{
+			desc: "primary",
+			info: &state.PeerInfo{Role: state.RolePrimary, State: withPrimary},
+		},
+		{
+			desc: "unassigned",
+			info: &state.PeerInfo{Role: state.RoleUnassigned, State: withPrimary},
+		},
+		{
+			desc:    "sync without cluster state",
+			info:    &state.PeerInfo{Role: state.RoleSync},
+			running: true,
+			config:  &state.Config{Role: state.RoleSync},
+		},
+		{
+			desc:    "async without primary",
+			info:    &state.PeerInfo{Role: state.RoleAsync, State: &state.State{}},
+			running: true,
+			config:  &state.Config{Role: state.RoleAsync},
+		},
+		{
+			desc:   "postgres not running",
+			info:   &state.PeerInfo{Role: state.RoleSync, State: withPrimary},
+			config: &state.Config{Role: state.RoleSync},
+		},
+		{
+			desc:    "postgres not configured",
+			info:    &state.PeerInfo{Role: state.RoleSync, State: withPrimary},
+			running: true,
+		},
+		{
+			desc:    "postgres configured with another role",
+			info:    &state.PeerInfo{Role: state.RoleSync, State: withPrimary},
+			running: true,
+			config:  &state.Config{Role: state.RoleAsync},
+		},
+	} {
+		peer.info = t.info
+		r.pg.setRunning(t.running)
+		r.pg.setConfig(t.config)
+		_, err := r.standbyLag()
+		c.Assert(err, Equals, errNotStandby, Commentf(t.desc))
+	}
+}
@@ -14,8 +14,12 @@ case $1 in
     shift
     exec /bin/flynn-postgres-api $*
     ;;
+  pooler)
+    shift
+    exec /bin/flynn-postgres-pooler $*
+    ;;
   *)
-    echo "Usage: $0 {postgres|api}"
+    echo "Usage: $0 {postgres|api|pooler}"
     exit 2
     ;;
 esac
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/martini-contrib/render"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/shutdown"
+)
+
+var serviceName = os.Getenv("FLYNN_REDIS")
+
+// controllerKey authenticates provisioning requests, the controller sends it
+// as the basic auth password included in the provider URL.
+var controllerKey = os.Getenv("CONTROLLER_KEY")
+
+func init() {
+	if serviceName == "" {
+		serviceName = "redis"
+	}
+}
+
+const redisPort = 6379
+
+func main() {
+	defer shutdown.Exit()
+
+	client, err := controller.NewClient("", controllerKey)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+
+	r := martini.NewRouter()
+	m := martini.New()
+	m.Use(martini.Logger())
+	m.Use(martini.Recovery())
+	m.Use(render.Renderer())
+	m.Action(r.Handle)
+	m.Map(client)
+
+	r.Post("/clusters", authenticate, createCluster)
+	r.Delete("/clusters", authenticate, deleteCluster)
+	r.Get("/ping", ping)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+	addr := ":" + port
+
+	hb, err := discoverd.AddServiceAndRegister(serviceName+"-api", addr)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	shutdown.BeforeExit(func() { hb.Close() })
+
+	shutdown.Fatal(http.ListenAndServe(addr, m))
+}
+
+// authenticate rejects requests which don't have the controller key as their
+// basic auth password, which stops martini calling the following handlers.
+func authenticate(req *http.Request, r render.Render) {
+	_, password, _ := req.BasicAuth()
+	if controllerKey == "" || subtle.ConstantTimeCompare([]byte(password), []byte(controllerKey)) != 1 {
+		r.JSON(401, struct{}{})
+	}
+}
+
+type resource struct {
+	ID  string            `json:"id"`
+	Env map[string]string `json:"env"`
+}
+
+// createCluster provisions a redis server which is isolated from those of
+// other resources by running it as its own app, named after the discoverd
+// service it registers, with a data volume for its append only file.
+func createCluster(client *controller.Client, r render.Render) {
+	// instances run the same image as the API
+	apiRelease, err := client.GetAppRelease(os.Getenv("FLYNN_APP_ID"))
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s", serviceName, random.UUID())
+	password := random.Hex(16)
+
+	app := &ct.App{Name: name}
+	if err := client.CreateApp(app); err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	release := &ct.Release{
+		ArtifactID: apiRelease.ArtifactID,
+		Env: map[string]string{
+			"FLYNN_REDIS":    name,
+			"REDIS_PASSWORD": password,
+		},
+		Processes: map[string]ct.ProcessType{
+			"redis": {
+				Cmd:       []string{"redis"},
+				Ports:     []ct.Port{{Port: redisPort, Proto: "tcp"}},
+				Data:      true,
+				Resurrect: true,
+			},
+		},
+	}
+	if err := createRelease(client, app, release); err != nil {
+		client.DeleteApp(app.ID)
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+
+	host := fmt.Sprintf("leader.%s.discoverd", name)
+	r.JSON(200, &resource{
+		ID: "/clusters/" + name,
+		Env: map[string]string{
+			"FLYNN_REDIS":    name,
+			"REDIS_HOST":     host,
+			"REDIS_PORT":     fmt.Sprint(redisPort),
+			"REDIS_PASSWORD": password,
+			"REDIS_URL":      fmt.Sprintf("redis://:%s@%s:%d", password, host, redisPort),
+		},
+	})
+}
+
+func createRelease(client *controller.Client, app *ct.App, release *ct.Release) error {
+	if err := client.CreateRelease(release); err != nil {
+		return err
+	}
+	if err := client.SetAppRelease(app.ID, release.ID); err != nil {
+		return err
+	}
+	return client.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"redis": 1},
+	})
+}
+
+// deleteCluster deprovisions a redis server by deleting its app, which stops
+// the server.
+func deleteCluster(client *controller.Client, req *http.Request, r render.Render) {
+	id := req.FormValue("id")
+	name := strings.TrimPrefix(id, "/clusters/")
+	if name == id || !strings.HasPrefix(name, serviceName+"-") {
+		r.JSON(400, struct{}{})
+		return
+	}
+	if err := client.DeleteApp(name); err != nil {
+		log.Println(err)
+		if err == controller.ErrNotFound {
+			r.JSON(404, struct{}{})
+		} else {
+			r.JSON(500, struct{}{})
+		}
+		return
+	}
+	r.JSON(200, struct{}{})
+}
+
+func ping(w http.ResponseWriter) {
+	w.WriteHeader(200)
+}
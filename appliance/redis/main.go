@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/shutdown"
+)
+
+func main() {
+	defer shutdown.Exit()
+
+	serviceName := os.Getenv("FLYNN_REDIS")
+	if serviceName == "" {
+		shutdown.Fatal("FLYNN_REDIS is required")
+	}
+	password := os.Getenv("REDIS_PASSWORD")
+	if password == "" {
+		shutdown.Fatal("REDIS_PASSWORD is required")
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "6379"
+	}
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "/data"
+	}
+	log := log15.New("app", serviceName)
+
+	cmd := exec.Command("redis-server", serverArgs(port, dataDir, password)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		shutdown.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	// redis saves the append only file when it receives SIGTERM
+	shutdown.BeforeExit(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		<-done
+	})
+
+	addr := "127.0.0.1:" + port
+	log.Info("waiting for redis to start", "addr", addr)
+	for {
+		err := ping(addr, password)
+		if err == nil {
+			break
+		}
+		select {
+		case err := <-done:
+			shutdown.Fatal(fmt.Errorf("redis-server exited: %v", err))
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	hb, err := discoverd.AddServiceAndRegister(serviceName, ":"+port)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	shutdown.BeforeExit(func() { hb.Close() })
+	log.Info("redis is up", "addr", addr)
+
+	err = <-done
+	shutdown.Fatal(fmt.Errorf("redis-server exited: %v", err))
+}
+
+// serverArgs returns the redis-server arguments to listen on port, persisting
+// data to an append only file in dataDir and requiring clients to
+// authenticate with password.
+func serverArgs(port, dataDir, password string) []string {
+	return []string{
+		"--port", port,
+		"--dir", dataDir,
+		"--appendonly", "yes",
+		"--appendfsync", "everysec",
+		"--requirepass", password,
+	}
+}
+
+// ping authenticates with the redis server at addr and checks that it is
+// ready to serve requests, which it is not while it is loading data from
+// disk.
+func ping(addr, password string) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := fmt.Fprintf(conn, "AUTH %s\r\nPING\r\n", password); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"+OK", "+PONG"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line = strings.TrimSpace(line); line != expected {
+			return errors.New(line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type RedisSuite struct{}
+
+var _ = Suite(&RedisSuite{})
+
+// fakeRedis responds to AUTH and PING commands with the given replies.
+func fakeRedis(c *C, authReply, pingReply string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for _, reply := range []string{authReply, pingReply} {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte(reply + "\r\n"))
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (RedisSuite) TestPing(c *C) {
+	c.Assert(ping(fakeRedis(c, "+OK", "+PONG"), "password"), IsNil)
+
+	err := ping(fakeRedis(c, "-ERR invalid password", "-NOAUTH Authentication required."), "wrong")
+	c.Assert(err, ErrorMatches, "-ERR invalid password")
+
+	err = ping(fakeRedis(c, "+OK", "-LOADING Redis is loading the dataset in memory"), "password")
+	c.Assert(strings.HasPrefix(err.Error(), "-LOADING"), Equals, true)
+}
@@ -0,0 +1,21 @@
+#!/bin/bash
+
+case $1 in
+  redis)
+    chown -R redis:redis /data
+    chmod 0700 /data
+    shift
+    exec sudo \
+      -u redis \
+      -E -H \
+      /bin/flynn-redis $*
+    ;;
+  api)
+    shift
+    exec /bin/flynn-redis-api $*
+    ;;
+  *)
+    echo "Usage: $0 {redis|api}"
+    exit 2
+    ;;
+esac
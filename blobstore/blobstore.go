@@ -1,30 +1,41 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/shutdown"
+	"github.com/flynn/flynn/pkg/signedurl"
 )
 
 var (
-	storageDir       = flag.String("s", "", "Path to store files, instead of Postgres")
+	storageDir       = flag.String("s", "", "Path to store files, instead of the backend set by BLOBSTORE_BACKEND")
 	listenPort       = flag.String("p", "3001", "Port to listen on")
 	serviceDiscovery = flag.Bool("d", true, "Register with service discovery")
 )
 
 func errorResponse(w http.ResponseWriter, err error) {
-	if err == ErrNotFound {
+	switch err {
+	case ErrNotFound:
 		http.Error(w, "NotFound", 404)
 		return
+	case ErrDigestMismatch:
+		http.Error(w, "DigestMismatch", 400)
+		return
+	case ErrInvalidOffset:
+		http.Error(w, "InvalidOffset", 409)
+		return
 	}
 	log.Println("error:", err)
 	http.Error(w, "Internal Server Error", 500)
@@ -43,14 +54,85 @@ type Filesystem interface {
 	Open(name string) (File, error)
 	Put(name string, r io.Reader, typ string) error
 	Delete(name string) error
+
+	// List returns the names of all files under the directory dir.
+	List(dir string) ([]string, error)
 }
 
 var ErrNotFound = errors.New("file not found")
 
-func handler(fs Filesystem) http.Handler {
+// dirPrefix returns the prefix of the names of files under the directory dir.
+func dirPrefix(dir string) string {
+	return strings.TrimSuffix(dir, "/") + "/"
+}
+
+// newFilesystem returns the storage backend named by backend along with a
+// description of it:
+//
+//	postgres    large objects in the database of the app (the default)
+//	s3          objects in an S3 bucket, see S3ConfigFromEnv
+//	filesystem  files under the directory dir
+func newFilesystem(backend, dir string) (Filesystem, string, error) {
+	switch backend {
+	case "", "postgres":
+		db, err := postgres.Open("", "")
+		if err != nil {
+			return nil, "", err
+		}
+		fs, err := NewPostgresFilesystem(db.DB)
+		return fs, "Postgres", err
+	case "s3":
+		conf, err := S3ConfigFromEnv()
+		if err != nil {
+			return nil, "", err
+		}
+		fs, err := NewS3Filesystem(conf)
+		return fs, "S3 bucket " + conf.Bucket, err
+	case "filesystem":
+		if dir == "" {
+			return nil, "", errors.New("a storage directory is required for the filesystem backend")
+		}
+		return NewOSFilesystem(dir), dir, nil
+	default:
+		return nil, "", fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// handler serves the files in fs. If key is set, requests must be signed with
+// it by signedurl.Sign.
+func handler(fs Filesystem, key []byte) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if key != nil {
+			if err := signedurl.Verify(key, req, time.Now()); err != nil {
+				log.Println("forbidden:", req.Method, req.URL.Path, err)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		if isUploadRequest(req) {
+			handleUpload(fs, w, req)
+			return
+		}
 		switch req.Method {
 		case "HEAD", "GET":
+			if strings.HasSuffix(req.URL.Path, "/") {
+				names, err := fs.List(req.URL.Path)
+				if err != nil {
+					errorResponse(w, err)
+					return
+				}
+				// hide the parts of resumable uploads
+				files := make([]string, 0, len(names))
+				for _, name := range names {
+					if !strings.HasPrefix(name, uploadsDir+"/") {
+						files = append(files, name)
+					}
+				}
+				log.Println("LIST", req.RequestURI)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(files)
+				return
+			}
 			file, err := fs.Open(req.URL.Path)
 			if err != nil {
 				errorResponse(w, err)
@@ -87,28 +169,26 @@ func main() {
 
 	flag.Parse()
 
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			shutdown.Fatal(err)
+		}
+		return
+	}
+
 	addr := os.Getenv("PORT")
 	if addr == "" {
 		addr = *listenPort
 	}
 	addr = ":" + addr
 
-	var fs Filesystem
-	var storageDesc string
-
+	backend := os.Getenv("BLOBSTORE_BACKEND")
 	if *storageDir != "" {
-		fs = NewOSFilesystem(*storageDir)
-		storageDesc = *storageDir
-	} else {
-		db, err := postgres.Open("", "")
-		if err != nil {
-			shutdown.Fatal(err)
-		}
-		fs, err = NewPostgresFilesystem(db.DB)
-		if err != nil {
-			shutdown.Fatal(err)
-		}
-		storageDesc = "Postgres"
+		backend = "filesystem"
+	}
+	fs, storageDesc, err := newFilesystem(backend, *storageDir)
+	if err != nil {
+		shutdown.Fatal(err)
 	}
 
 	if *serviceDiscovery {
@@ -119,6 +199,14 @@ func main() {
 		shutdown.BeforeExit(func() { hb.Close() })
 	}
 
+	// requests must be signed if a key is set, see pkg/signedurl
+	var key []byte
+	if k := os.Getenv("BLOBSTORE_SIGNING_KEY"); k != "" {
+		key = []byte(k)
+	}
+
+	go expireUploadsLoop(fs)
+
 	log.Println("Blobstore serving files on " + addr + " from " + storageDesc)
-	shutdown.Fatal(http.ListenAndServe(addr, handler(fs)))
+	shutdown.Fatal(http.ListenAndServe(addr, handler(fs, key)))
 }
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/cupcake/goamz/aws"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/cupcake/goamz/s3"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/cupcake/goamz/s3/s3test"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	_ "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/shutdown"
+	"github.com/flynn/flynn/pkg/signedurl"
 	"github.com/flynn/flynn/pkg/testutils/postgres"
 )
 
@@ -21,10 +34,179 @@ func TestOSFilesystem(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	testFilesystem(NewOSFilesystem(dir), false, t)
+	fs := NewOSFilesystem(dir)
+	testFilesystem(fs, false, t)
+	testList(fs, t)
+	testUploads(fs, false, t)
+	testExpireUploads(fs, t)
 	os.RemoveAll(dir)
 }
 
+func TestSignedURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := []byte("secret")
+	srv := httptest.NewServer(handler(NewOSFilesystem(dir), key))
+	defer srv.Close()
+
+	do := func(method, url string, status int) {
+		req, err := http.NewRequest(method, url, strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("Expected %d for %s %s, got %d", status, method, url, res.StatusCode)
+		}
+	}
+	sign := func(path string, methods ...string) string {
+		u, err := signedurl.Sign(key, srv.URL+path, methods, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	do("PUT", srv.URL+"/foo", http.StatusForbidden)
+	do("PUT", sign("/foo", "GET"), http.StatusForbidden)
+	do("PUT", sign("/foo", "PUT"), 200)
+	do("GET", srv.URL+"/foo", http.StatusForbidden)
+	do("GET", strings.Replace(sign("/foo", "GET"), "/foo", "/bar", 1), http.StatusForbidden)
+	do("GET", sign("/foo", "GET"), 200)
+	do("HEAD", sign("/foo", "GET"), 200)
+	do("DELETE", sign("/foo", "GET"), http.StatusForbidden)
+
+	// resumable upload parameters are added to a signed URL
+	u := sign("/baz", "POST", "PUT")
+	req, err := http.NewRequest("POST", u+"&uploads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 for signed upload POST, got %d", res.StatusCode)
+	}
+	var upload struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&upload); err != nil {
+		t.Fatal(err)
+	}
+	do("PUT", u+"&upload="+upload.ID+"&offset=0", 200)
+	do("POST", u+"&upload="+upload.ID, 200)
+	do("GET", sign("/baz", "GET"), 200)
+}
+
+func newTestS3Filesystem(t *testing.T) (Filesystem, func()) {
+	srv, err := s3test.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := aws.Auth{AccessKey: "access", SecretKey: "secret"}
+	region := aws.Region{Name: "test", S3Endpoint: srv.URL(), S3LocationConstraint: true}
+	if err := s3.New(auth, region).Bucket("blobstore").PutBucket(s3.Private); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewS3Filesystem(&S3Config{Bucket: "blobstore", Auth: auth, Endpoint: srv.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, srv.Quit
+}
+
+func TestS3Filesystem(t *testing.T) {
+	fs, cleanup := newTestS3Filesystem(t)
+	defer cleanup()
+	testFilesystem(fs, true, t)
+	testList(fs, t)
+	testUploads(fs, true, t)
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := NewOSFilesystem(dir)
+	dst, cleanup := newTestS3Filesystem(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"/slugs/a.tgz":     random.Hex(16),
+		"/slugs/b/c.tgz":   random.Hex(32),
+		"/backups/d.tar":   random.Hex(8),
+		"/slugs-other.tgz": random.Hex(8),
+	}
+	for name, data := range files {
+		if err := src.Put(name, strings.NewReader(data), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a file which already exists in the destination is skipped
+	if err := dst.Put("/slugs/a.tgz", strings.NewReader(files["/slugs/a.tgz"]), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := src.List("/slugs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if expected := []string{"/slugs/a.tgz", "/slugs/b/c.tgz"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected List to return %v, got %v", expected, names)
+	}
+
+	stats, err := migrate(src, dst, "/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 3 || stats.Skipped != 1 {
+		t.Errorf("expected 3 files to be copied and 1 skipped, got %+v", stats)
+	}
+
+	for name, data := range files {
+		f, err := dst.Open(name)
+		if err != nil {
+			t.Fatalf("error opening %s: %s", name, err)
+		}
+		res, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res) != data {
+			t.Errorf("expected %s to contain %q, got %q", name, data, res)
+		}
+	}
+	names, err = dst.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != len(files) {
+		t.Errorf("expected %d files in the destination, got %v", len(files), names)
+	}
+
+	names, err = src.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("expected source files to be deleted, got %v", names)
+	}
+}
+
 func TestPostgresFilesystem(t *testing.T) {
 	if err := pgtestutils.SetupPostgres("blobstoretest"); err != nil {
 		t.Fatal(err)
@@ -41,12 +223,338 @@ func TestPostgresFilesystem(t *testing.T) {
 		t.Fatal(err)
 	}
 	testFilesystem(fs, true, t)
+	testList(fs, t)
+	testChunks(fs, db, t)
+	testUploads(fs, true, t)
+	testExpireUploads(fs, t)
+	testConcat(fs, db, t)
+}
+
+// testChunks checks that files larger than a chunk are read back correctly,
+// and that identical chunks are stored once and deleted with the last file
+// referencing them.
+func testChunks(fs Filesystem, db *sql.DB, t *testing.T) {
+	countChunks := func() int { return countChunks(db, t) }
+	before := countChunks()
+
+	data := []byte(random.Hex(chunkSize + chunkSize/4))
+	for _, name := range []string{"/chunks/a", "/chunks/b"} {
+		if err := fs.Put(name, bytes.NewReader(data), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the data is a full chunk followed by a partial one
+	if n := countChunks() - before; n != 3 {
+		t.Errorf("expected 3 new chunks, got %d", n)
+	}
+
+	f, err := fs.Open("/chunks/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Error("expected to read back the data of a multi-chunk file")
+	}
+	offset := int64(chunkSize - 10)
+	if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[offset:offset+20]) {
+		t.Errorf("expected to read %q across chunks, got %q", data[offset:offset+20], buf)
+	}
+	f.Close()
+
+	if err := fs.Delete("/chunks/a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks() - before; n != 3 {
+		t.Errorf("expected chunks referenced by /chunks/b to be kept, got %d new chunks", n)
+	}
+	if err := fs.Delete("/chunks/b"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(); n != before {
+		t.Errorf("expected unreferenced chunks to be deleted, got %d chunks, want %d", n, before)
+	}
+}
+
+func countChunks(db *sql.DB, t *testing.T) int {
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM chunks").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// testConcat checks that completing an upload references the chunks of its
+// parts rather than storing them again.
+func testConcat(fs Filesystem, db *sql.DB, t *testing.T) {
+	data := []byte(random.Hex(2*chunkSize + chunkSize/2))
+	u, err := createUpload(fs, "/concat", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int{0, chunkSize + chunkSize/4} {
+		end := offset + chunkSize + chunkSize/4
+		if err := u.PutPart(int64(offset), bytes.NewReader(data[offset:end]), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := countChunks(db, t)
+
+	sum := sha512.Sum512(data)
+	if err := u.Complete(hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Delete("/concat")
+	if n := countChunks(db, t); n != before {
+		t.Errorf("expected completing an upload to store no chunks, got %d chunks, want %d", n, before)
+	}
+
+	f, err := fs.Open("/concat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Size() != int64(len(data)) {
+		t.Errorf("expected size %d, got %d", len(data), f.Size())
+	}
+	if f.ETag() != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the digest of the file as its ETag, got %s", f.ETag())
+	}
+	if f.Type() != "text/plain" {
+		t.Errorf(`expected type "text/plain", got %q`, f.Type())
+	}
+	res, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Error("expected to read back the data of the parts")
+	}
+}
+
+func testExpireUploads(fs Filesystem, t *testing.T) {
+	u, err := createUpload(fs, "/expire", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.PutPart(0, strings.NewReader("data"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// uploads written to since the expiry time are kept
+	if n, err := expireUploads(fs, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("expected no uploads to expire, got %d", n)
+	}
+	if _, err := openUpload(fs, "/expire", u.id); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := expireUploads(fs, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("expected 1 upload to expire, got %d", n)
+	}
+	if _, err := openUpload(fs, "/expire", u.id); err != ErrNotFound {
+		t.Errorf("expected expired upload to be removed, got %v", err)
+	}
+	names, err := fs.List(uploadsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("expected expired upload parts to be removed, got %v", names)
+	}
+}
+
+func testUploads(fs Filesystem, testMeta bool, t *testing.T) {
+	srv := httptest.NewServer(handler(fs, nil))
+	defer srv.Close()
+
+	path := srv.URL + "/uploads/" + random.Hex(16)
+	data := []byte(random.Hex(32))
+	digest := func(b []byte) string {
+		sum := sha512.Sum512(b)
+		return hex.EncodeToString(sum[:])
+	}
+	request := func(method, url string, body []byte, header http.Header) *http.Response {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	create := func() string {
+		res := request("POST", path+"?uploads", nil, http.Header{"Content-Type": {"text/plain"}})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected 201 for upload POST, got %d", res.StatusCode)
+		}
+		var upload struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&upload); err != nil {
+			t.Fatal(err)
+		}
+		return path + "?upload=" + upload.ID
+	}
+	putPart := func(upload string, offset int, part []byte, sum string, status int) {
+		url := fmt.Sprintf("%s&offset=%d", upload, offset)
+		res := request("PUT", url, part, http.Header{digestHeader: {sum}})
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("Expected %d for part PUT at %d, got %d", status, offset, res.StatusCode)
+		}
+	}
+	checkOffset := func(upload string, expected string) {
+		res := request("HEAD", upload, nil, nil)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Expected 200 for upload HEAD, got %d", res.StatusCode)
+		}
+		if offset := res.Header.Get(offsetHeader); offset != expected {
+			t.Errorf("Expected %s to be %s, got %s", offsetHeader, expected, offset)
+		}
+	}
+
+	upload := create()
+	putPart(upload, 0, data[:10], digest(data[:10]), 200)
+	putPart(upload, 20, data[20:], "", http.StatusConflict)
+	putPart(upload, 10, data[10:20], digest(data[:10]), http.StatusBadRequest)
+	checkOffset(upload, "10")
+	putPart(upload, 10, data[10:20], digest(data[10:20]), 200)
+	checkOffset(upload, "20")
+	// retransmitting a part replaces it
+	putPart(upload, 10, data[10:25], digest(data[10:25]), 200)
+	checkOffset(upload, "25")
+	putPart(upload, 25, data[25:], "", 200)
+	checkOffset(upload, "64")
+
+	res := request("GET", path, nil, nil)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("Expected 404 for incomplete upload GET, got %d", res.StatusCode)
+	}
+
+	res = request("POST", upload, nil, http.Header{digestHeader: {digest(data[1:])}})
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for upload POST with the wrong digest, got %d", res.StatusCode)
+	}
+	res = request("POST", upload, nil, http.Header{digestHeader: {digest(data)}})
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("Expected 200 for upload POST, got %d", res.StatusCode)
+	}
+
+	res = request("GET", path, nil, nil)
+	resData, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resData, data) {
+		t.Errorf("Expected uploaded data to be %q, got %q", data, resData)
+	}
+	if ct := res.Header.Get("Content-Type"); testMeta && ct != "text/plain" {
+		t.Errorf(`Expected Content-Type to be "text/plain", got %q`, ct)
+	}
+	res = request("HEAD", upload, nil, nil)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("Expected 404 for completed upload HEAD, got %d", res.StatusCode)
+	}
+
+	upload = create()
+	putPart(upload, 0, data, "", 200)
+	res = request("DELETE", upload, nil, nil)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("Expected 200 for upload DELETE, got %d", res.StatusCode)
+	}
+	res = request("HEAD", upload, nil, nil)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("Expected 404 for aborted upload HEAD, got %d", res.StatusCode)
+	}
+
+	names, err := fs.List(uploadsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("Expected upload parts to be removed, got %v", names)
+	}
+
+	// ids which could refer to paths outside the upload are not found
+	for _, id := range []string{"..", ".", "", "../..", strings.ToUpper(random.UUID())} {
+		upload := path + "?upload=" + id
+		for _, method := range []string{"HEAD", "DELETE"} {
+			res = request(method, upload, nil, nil)
+			res.Body.Close()
+			if res.StatusCode != 404 {
+				t.Errorf("Expected 404 for %s with upload id %q, got %d", method, id, res.StatusCode)
+			}
+		}
+		putPart(upload, 0, data, "", 404)
+	}
+	if _, err := fs.Open(strings.TrimPrefix(path, srv.URL)); err != nil {
+		t.Errorf("Expected the uploaded file to remain, got %v", err)
+	}
+	fs.Delete(strings.TrimPrefix(path, srv.URL))
+}
+
+func testList(fs Filesystem, t *testing.T) {
+	srv := httptest.NewServer(handler(fs, nil))
+	defer srv.Close()
+
+	for _, name := range []string{"/list/a", "/list/b/c", "/list-other"} {
+		if err := fs.Put(name, strings.NewReader(name), ""); err != nil {
+			t.Fatal(err)
+		}
+		defer fs.Delete(name)
+	}
+
+	res, err := http.Get(srv.URL + "/list/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected 200 for list GET, got %d", res.StatusCode)
+	}
+	var names []string
+	if err := json.NewDecoder(res.Body).Decode(&names); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if expected := []string{"/list/a", "/list/b/c"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected list GET to return %v, got %v", expected, names)
+	}
 }
 
 const concurrency = 5
 
 func testFilesystem(fs Filesystem, testMeta bool, t *testing.T) {
-	srv := httptest.NewServer(handler(fs))
+	srv := httptest.NewServer(handler(fs, nil))
 	defer srv.Close()
 
 	var wg sync.WaitGroup
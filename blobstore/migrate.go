@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+const migrateUsage = `usage: flynn-blobstore migrate [options] <from> <to>
+
+Copy all files from one storage backend to another, where <from> and <to> are
+one of postgres, s3 or filesystem (see BLOBSTORE_BACKEND). Files which already
+exist in the destination with the same size are skipped, so an interrupted
+migration can be resumed by running it again.
+
+Options:
+`
+
+// runMigrate runs the migrate command, which copies the files in one storage
+// backend to another so that blobstore can be switched between them.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromDir := flags.String("from-dir", "", "Path of the files to copy from the filesystem backend")
+	toDir := flags.String("to-dir", "", "Path to copy files to with the filesystem backend")
+	dir := flags.String("dir", "/", "Only copy files under this directory")
+	del := flags.Bool("delete", false, "Delete files from <from> once they have been copied")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if flags.Arg(0) == flags.Arg(1) && *fromDir == *toDir {
+		return errors.New("<from> and <to> must be different backends")
+	}
+
+	src, srcDesc, err := newFilesystem(flags.Arg(0), *fromDir)
+	if err != nil {
+		return err
+	}
+	dst, dstDesc, err := newFilesystem(flags.Arg(1), *toDir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Copying files under %s from %s to %s", *dir, srcDesc, dstDesc)
+	stats, err := migrate(src, dst, *dir, *del)
+	log.Printf("Copied %d files, skipped %d files", stats.Copied, stats.Skipped)
+	return err
+}
+
+type migrateStats struct {
+	Copied  int
+	Skipped int
+}
+
+// migrate copies the files under dir from src to dst, deleting them from src
+// once they have been copied if del is true.
+func migrate(src, dst Filesystem, dir string, del bool) (*migrateStats, error) {
+	stats := &migrateStats{}
+	names, err := src.List(dir)
+	if err != nil {
+		return stats, err
+	}
+	for _, name := range names {
+		copied, err := migrateFile(src, dst, name)
+		if err == ErrNotFound {
+			// the file was deleted since it was listed
+			continue
+		} else if err != nil {
+			return stats, fmt.Errorf("error copying %s: %s", name, err)
+		}
+		if copied {
+			stats.Copied++
+		} else {
+			stats.Skipped++
+		}
+		if del {
+			if err := src.Delete(name); err != nil {
+				return stats, fmt.Errorf("error deleting %s: %s", name, err)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// migrateFile copies the named file from src to dst unless it already exists
+// in dst with the same size.
+func migrateFile(src, dst Filesystem, name string) (bool, error) {
+	f, err := src.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	existing, err := dst.Open(name)
+	if err == nil {
+		size := existing.Size()
+		existing.Close()
+		if size == f.Size() {
+			return false, nil
+		}
+	} else if err != ErrNotFound {
+		return false, err
+	}
+	return true, dst.Put(name, f, f.Type())
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -37,22 +38,55 @@ func (s *OSFilesystem) Open(name string) (File, error) {
 	return &osFile{File: f, FileInfo: fi}, nil
 }
 
+// Put writes r to a temporary file which is renamed once it is complete, so
+// that the file is left as it was if reading r fails.
 func (s *OSFilesystem) Put(name string, r io.Reader, typ string) error {
 	path := s.path(name)
 	os.MkdirAll(filepath.Dir(path), 0755)
-	f, err := os.Create(path)
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, r)
-	return err
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
 
 func (s *OSFilesystem) Delete(name string) error {
 	return os.RemoveAll(s.path(name))
 }
 
+func (s *OSFilesystem) List(dir string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.path(dir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, "/"+filepath.ToSlash(name))
+		return nil
+	})
+	return names, err
+}
+
 func (s *OSFilesystem) path(name string) string {
 	return filepath.Join(s.root, name)
 }
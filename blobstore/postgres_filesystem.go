@@ -4,6 +4,7 @@ import (
 	"crypto/sha512"
 	"encoding/hex"
 	"io"
+	"os"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
@@ -12,6 +13,12 @@ import (
 	"github.com/flynn/flynn/pkg/postgres"
 )
 
+// chunkSize is the size of the chunks files are split into. Chunks are
+// content addressed and shared between all files which contain them, but as
+// they are split at fixed offsets files only share chunks with the same
+// content at the same offset (see README.md).
+const chunkSize = 4 << 20
+
 func NewPostgresFilesystem(db *sql.DB) (Filesystem, error) {
 	m := postgres.NewMigrations()
 	m.Add(1,
@@ -32,10 +39,73 @@ $$ LANGUAGE plpgsql;`,
 		`CREATE TRIGGER delete_file
     AFTER DELETE ON files
     FOR EACH ROW EXECUTE PROCEDURE delete_file();`,
+	)
+	m.Add(2,
+		`DROP TRIGGER delete_file ON files`,
+		`DROP FUNCTION delete_file()`,
+		`ALTER TABLE files RENAME TO files_v1`,
+		`ALTER INDEX files_pkey RENAME TO files_v1_pkey`,
+		`ALTER INDEX files_name_key RENAME TO files_v1_name_key`,
+		`CREATE TABLE chunks (
+	digest text PRIMARY KEY,
+	chunk_id oid NOT NULL,
+	size bigint NOT NULL,
+	refs integer NOT NULL DEFAULT 0
+);`,
+		`CREATE TABLE files (
+	file_id bigserial PRIMARY KEY,
+	name text UNIQUE NOT NULL,
+	size bigint,
+	type text,
+	digest text,
+	created_at timestamp with time zone NOT NULL DEFAULT current_timestamp
+);`,
+		`CREATE TABLE file_chunks (
+	file_id bigint NOT NULL REFERENCES files (file_id) ON DELETE CASCADE,
+	seq integer NOT NULL,
+	digest text NOT NULL REFERENCES chunks (digest),
+	PRIMARY KEY (file_id, seq)
+);`,
+		`CREATE INDEX ON file_chunks (digest)`,
+
+		// existing files become a single chunk, keeping one large object
+		// per distinct digest and removing those of incomplete uploads
+		`INSERT INTO chunks (digest, chunk_id, size)
+    SELECT DISTINCT ON (digest) digest, file_id, size FROM files_v1
+    WHERE digest IS NOT NULL ORDER BY digest, created_at`,
+		`SELECT lo_unlink(file_id) FROM files_v1 WHERE file_id NOT IN (SELECT chunk_id FROM chunks)`,
+		`INSERT INTO files (name, size, type, digest, created_at)
+    SELECT name, size, type, digest, created_at FROM files_v1 WHERE digest IS NOT NULL`,
+		`INSERT INTO file_chunks (file_id, seq, digest) SELECT file_id, 0, digest FROM files`,
+		`UPDATE chunks SET refs = (SELECT count(*) FROM file_chunks f WHERE f.digest = chunks.digest)`,
+		`DROP TABLE files_v1`,
+
+		// chunks are deleted once they are no longer referenced by a file
+		`CREATE FUNCTION update_chunk_refs() RETURNS TRIGGER AS $$
+    DECLARE
+        unreferenced oid;
+    BEGIN
+        IF TG_OP = 'INSERT' THEN
+            UPDATE chunks SET refs = refs + 1 WHERE digest = NEW.digest;
+        ELSE
+            UPDATE chunks SET refs = refs - 1 WHERE digest = OLD.digest;
+            DELETE FROM chunks WHERE digest = OLD.digest AND refs = 0 RETURNING chunk_id INTO unreferenced;
+            IF unreferenced IS NOT NULL THEN
+                PERFORM lo_unlink(unreferenced);
+            END IF;
+        END IF;
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql;`,
+		`CREATE TRIGGER update_chunk_refs
+    AFTER INSERT OR DELETE ON file_chunks
+    FOR EACH ROW EXECUTE PROCEDURE update_chunk_refs();`,
 	)
 	return &PostgresFilesystem{db: db}, m.Migrate(db)
 }
 
+// PostgresFilesystem stores files as a list of content addressed chunks, each
+// of which is a large object with a count of the files which reference it.
 type PostgresFilesystem struct {
 	db *sql.DB
 }
@@ -46,7 +116,7 @@ func (p *PostgresFilesystem) Put(name string, r io.Reader, typ string) error {
 		return err
 	}
 
-	var id oid.Oid
+	var id int64
 create:
 	err = tx.QueryRow("INSERT INTO files (name, type) VALUES ($1, $2) RETURNING file_id", name, typ).Scan(&id)
 	if postgres.IsUniquenessError(err, "") {
@@ -74,26 +144,137 @@ create:
 		tx.Rollback()
 		return err
 	}
-	obj, err := lo.Open(id, pq.LargeObjectModeWrite)
+
+	h := sha512.New()
+	var size int64
+	buf := make([]byte, chunkSize)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			tx.Rollback()
+			return err
+		}
+		chunk := buf[:n]
+		h.Write(chunk)
+		size += int64(n)
+
+		digest, err := putChunk(tx, lo, chunk)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO file_chunks (file_id, seq, digest) VALUES ($1, $2, $3)", id, seq, digest); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if n < chunkSize {
+			break
+		}
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	_, err = tx.Exec("UPDATE files SET size = $2, digest = $3 WHERE file_id = $1", id, size, digest)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	h := sha512.New()
-	size, err := io.Copy(obj, io.TeeReader(r, h))
+	return tx.Commit()
+}
+
+// putChunk stores data as a chunk unless a chunk with the same digest already
+// exists, returning the digest. The chunk is locked until tx finishes so that
+// it is not deleted before the caller references it.
+func putChunk(tx *sql.Tx, lo *pq.LargeObjects, data []byte) (string, error) {
+	sum := sha512.Sum512(data)
+	digest := hex.EncodeToString(sum[:])
+
+	var id oid.Oid
+	err := tx.QueryRow("SELECT chunk_id FROM chunks WHERE digest = $1 FOR UPDATE", digest).Scan(&id)
+	if err == nil {
+		return digest, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if _, err := tx.Exec("SAVEPOINT put_chunk"); err != nil {
+		return "", err
+	}
+	id, err = lo.Create(0)
 	if err != nil {
-		tx.Rollback()
-		return err
+		return "", err
 	}
+	obj, err := lo.Open(id, pq.LargeObjectModeWrite)
+	if err != nil {
+		return "", err
+	}
+	if _, err := obj.Write(data); err != nil {
+		return "", err
+	}
+	if err := obj.Close(); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO chunks (digest, chunk_id, size) VALUES ($1, $2, $3)", digest, id, len(data))
+	if postgres.IsUniquenessError(err, "") {
+		// the chunk was stored by a concurrent upload, use that one
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT put_chunk"); err != nil {
+			return "", err
+		}
+		return digest, tx.QueryRow("SELECT chunk_id FROM chunks WHERE digest = $1 FOR UPDATE", digest).Scan(&id)
+	} else if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("RELEASE SAVEPOINT put_chunk")
+	return digest, err
+}
 
-	digest := hex.EncodeToString(h.Sum(nil))
-	_, err = tx.Exec("UPDATE files SET size = $2, digest = $3 WHERE file_id = $1", id, size, digest)
+// Concat creates the named file from the chunks of the files in parts, so no
+// data is copied.
+func (p *PostgresFilesystem) Concat(name string, parts []string, typ, digest string) error {
+	tx, err := p.db.Begin()
 	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM files WHERE name = $1", name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var id int64
+	if err := tx.QueryRow("INSERT INTO files (name, type, digest) VALUES ($1, $2, $3) RETURNING file_id", name, typ, digest).Scan(&id); err != nil {
 		tx.Rollback()
 		return err
 	}
 
+	var size int64
+	var seq int
+	for _, part := range parts {
+		var partID, partSize int64
+		var chunks int
+		err := tx.QueryRow(`SELECT f.file_id, f.size, count(c.seq) FROM files f LEFT JOIN file_chunks c USING (file_id)
+    WHERE f.name = $1 GROUP BY f.file_id`, part).Scan(&partID, &partSize, &chunks)
+		if err != nil {
+			tx.Rollback()
+			if err == sql.ErrNoRows {
+				err = ErrNotFound
+			}
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO file_chunks (file_id, seq, digest) SELECT $1, $2 + seq, digest FROM file_chunks WHERE file_id = $3",
+			id, seq, partID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		size += partSize
+		seq += chunks
+	}
+
+	if _, err := tx.Exec("UPDATE files SET size = $2 WHERE file_id = $1", id, size); err != nil {
+		tx.Rollback()
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -102,15 +283,40 @@ func (p *PostgresFilesystem) Delete(name string) error {
 	return err
 }
 
+func (p *PostgresFilesystem) List(dir string) ([]string, error) {
+	prefix := dirPrefix(dir)
+	rows, err := p.db.Query("SELECT name FROM files WHERE left(name, $2) = $1 ORDER BY name", prefix, len(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
 func (p *PostgresFilesystem) Open(name string) (File, error) {
 	tx, err := p.db.Begin()
 	if err != nil {
 		return nil, err
 	}
+	// the chunks are read from a snapshot so that they are not affected
+	// by the file being replaced or deleted while it is being read
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
 	var f pgFile
+	var id int64
 	err = tx.QueryRow("SELECT file_id, size, type, digest, created_at FROM files WHERE name = $1",
-		name).Scan(&f.id, &f.size, &f.typ, &f.etag, &f.mtime)
+		name).Scan(&id, &f.size, &f.typ, &f.etag, &f.mtime)
 	if err != nil {
 		tx.Rollback()
 		if err == sql.ErrNoRows {
@@ -119,12 +325,29 @@ func (p *PostgresFilesystem) Open(name string) (File, error) {
 		return nil, err
 	}
 
-	lo, err := pq.NewLargeObjects(tx)
+	rows, err := tx.Query(`SELECT c.chunk_id, c.size FROM file_chunks f JOIN chunks c USING (digest)
+    WHERE f.file_id = $1 ORDER BY f.seq`, id)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
-	f.LargeObject, err = lo.Open(f.id, pq.LargeObjectModeRead)
+	var offset int64
+	for rows.Next() {
+		c := pgChunk{offset: offset}
+		if err := rows.Scan(&c.id, &c.size); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		f.chunks = append(f.chunks, c)
+		offset += c.size
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	f.lo, err = pq.NewLargeObjects(tx)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -134,14 +357,30 @@ func (p *PostgresFilesystem) Open(name string) (File, error) {
 	return &f, nil
 }
 
+type pgChunk struct {
+	id     oid.Oid
+	size   int64
+	offset int64
+}
+
+// pgFile reads a file from its chunks, opening the large object of each
+// chunk as the read offset reaches it.
 type pgFile struct {
-	*pq.LargeObject
-	id    oid.Oid
-	size  int64
-	typ   string
-	etag  string
-	mtime time.Time
+	chunks []pgChunk
+	size   int64
+	typ    string
+	etag   string
+	mtime  time.Time
+
+	offset int64
+
+	// obj is the open large object of chunks[objIndex], which is at
+	// objOffset within the chunk
+	obj       *pq.LargeObject
+	objIndex  int
+	objOffset int64
 
+	lo *pq.LargeObjects
 	tx *sql.Tx
 }
 
@@ -149,4 +388,86 @@ func (f *pgFile) Size() int64        { return f.size }
 func (f *pgFile) ModTime() time.Time { return f.mtime }
 func (f *pgFile) Type() string       { return f.typ }
 func (f *pgFile) ETag() string       { return f.etag }
-func (f *pgFile) Close() error       { return f.tx.Rollback() }
+
+func (f *pgFile) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	i := f.chunkAt(f.offset)
+	chunk := f.chunks[i]
+	offset := f.offset - chunk.offset
+
+	if f.obj == nil || f.objIndex != i {
+		if err := f.closeObj(); err != nil {
+			return 0, err
+		}
+		obj, err := f.lo.Open(chunk.id, pq.LargeObjectModeRead)
+		if err != nil {
+			return 0, err
+		}
+		f.obj = obj
+		f.objIndex = i
+		f.objOffset = 0
+	}
+	if f.objOffset != offset {
+		if _, err := f.obj.Seek(offset, os.SEEK_SET); err != nil {
+			return 0, err
+		}
+		f.objOffset = offset
+	}
+
+	if remaining := chunk.size - offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := f.obj.Read(p)
+	f.offset += int64(n)
+	f.objOffset += int64(n)
+	if err == io.EOF {
+		if n == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// chunkAt returns the index of the chunk containing offset.
+func (f *pgFile) chunkAt(offset int64) int {
+	for i := len(f.chunks) - 1; i > 0; i-- {
+		if f.chunks[i].offset <= offset {
+			return i
+		}
+	}
+	return 0
+}
+
+func (f *pgFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += f.offset
+	case os.SEEK_END:
+		offset += f.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *pgFile) closeObj() error {
+	if f.obj == nil {
+		return nil
+	}
+	err := f.obj.Close()
+	f.obj = nil
+	return err
+}
+
+func (f *pgFile) Close() error {
+	f.closeObj()
+	return f.tx.Rollback()
+}
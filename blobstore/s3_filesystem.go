@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/cupcake/goamz/aws"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/cupcake/goamz/s3"
+)
+
+// S3Config is the configuration of an S3Filesystem.
+type S3Config struct {
+	Bucket string
+	Auth   aws.Auth
+
+	// Region is the name of the AWS region of the bucket, it is ignored if
+	// Endpoint is set.
+	Region string
+
+	// Endpoint is the URL of an S3-compatible service to use instead of
+	// AWS, e.g. http://minio.example.com:9000
+	Endpoint string
+}
+
+// S3ConfigFromEnv returns the configuration of an S3Filesystem from the
+// environment:
+//
+//	BLOBSTORE_S3_BUCKET    the bucket to store files in (required)
+//	BLOBSTORE_S3_REGION    the AWS region of the bucket (default us-east-1)
+//	BLOBSTORE_S3_ENDPOINT  the URL of an S3-compatible service
+//	AWS_ACCESS_KEY_ID      the access key
+//	AWS_SECRET_ACCESS_KEY  the secret key
+func S3ConfigFromEnv() (*S3Config, error) {
+	conf := &S3Config{
+		Bucket:   os.Getenv("BLOBSTORE_S3_BUCKET"),
+		Region:   os.Getenv("BLOBSTORE_S3_REGION"),
+		Endpoint: os.Getenv("BLOBSTORE_S3_ENDPOINT"),
+	}
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("BLOBSTORE_S3_BUCKET is required")
+	}
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		return nil, err
+	}
+	conf.Auth = auth
+	return conf, nil
+}
+
+func NewS3Filesystem(conf *S3Config) (Filesystem, error) {
+	var region aws.Region
+	if conf.Endpoint != "" {
+		region = aws.Region{Name: "custom", S3Endpoint: strings.TrimSuffix(conf.Endpoint, "/")}
+	} else {
+		name := conf.Region
+		if name == "" {
+			name = aws.USEast.Name
+		}
+		var ok bool
+		if region, ok = aws.Regions[name]; !ok {
+			return nil, fmt.Errorf("unknown S3 region %q", name)
+		}
+	}
+	return &S3Filesystem{bucket: s3.New(conf.Auth, region).Bucket(conf.Bucket)}, nil
+}
+
+// S3Filesystem stores files as objects in an S3 bucket.
+type S3Filesystem struct {
+	bucket *s3.Bucket
+}
+
+func (s *S3Filesystem) Open(name string) (File, error) {
+	res, err := s.bucket.GetResponse(name)
+	if err != nil {
+		if e, ok := err.(*s3.Error); ok && e.StatusCode == 404 {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	f := &s3File{
+		bucket: s.bucket,
+		name:   name,
+		size:   res.ContentLength,
+		typ:    res.Header.Get("Content-Type"),
+		etag:   res.Header.Get("ETag"),
+		body:   res.Body,
+	}
+	if f.size < 0 {
+		res.Body.Close()
+		return nil, fmt.Errorf("missing Content-Length for %s", name)
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		f.mtime = t
+	}
+	return f, nil
+}
+
+// Put uploads r to the bucket. S3 requires the length of an object up front,
+// so it is buffered in a temporary file first.
+func (s *S3Filesystem) Put(name string, r io.Reader, typ string) error {
+	tmp, err := ioutil.TempFile("", "blobstore-s3-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	return s.bucket.PutReader(name, tmp, size, typ, s3.Private)
+}
+
+func (s *S3Filesystem) Delete(name string) error {
+	return s.bucket.Del(name)
+}
+
+func (s *S3Filesystem) List(dir string) ([]string, error) {
+	prefix := strings.TrimPrefix(dirPrefix(dir), "/")
+	var names []string
+	marker := ""
+	for {
+		res, err := s.bucket.List(prefix, "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range res.Contents {
+			names = append(names, "/"+key.Key)
+			marker = key.Key
+		}
+		if !res.IsTruncated || len(res.Contents) == 0 {
+			return names, nil
+		}
+	}
+}
+
+// s3File is an object which is read from S3 as it is consumed. Seeking is
+// done by requesting the remainder of the object from the new offset.
+type s3File struct {
+	bucket *s3.Bucket
+	name   string
+	size   int64
+	typ    string
+	etag   string
+	mtime  time.Time
+
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (f *s3File) Size() int64        { return f.size }
+func (f *s3File) ModTime() time.Time { return f.mtime }
+func (f *s3File) Type() string       { return f.typ }
+
+func (f *s3File) ETag() string {
+	// S3-compatible services do not all quote the ETag
+	if f.etag != "" && !strings.HasPrefix(f.etag, `"`) {
+		return strconv.Quote(f.etag)
+	}
+	return f.etag
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil || f.bodyOffset != f.offset {
+		if err := f.openAt(f.offset); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	f.bodyOffset = f.offset
+	return n, err
+}
+
+func (f *s3File) openAt(offset int64) error {
+	f.closeBody()
+	req, err := http.NewRequest("GET", f.bucket.SignedURL(f.name, time.Now().Add(time.Hour)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return fmt.Errorf("unexpected status %d requesting %s from offset %d", res.StatusCode, f.name, offset)
+	}
+	f.body = res.Body
+	f.bodyOffset = offset
+	return nil
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += f.offset
+	case os.SEEK_END:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) closeBody() {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+}
+
+func (f *s3File) Close() error {
+	f.closeBody()
+	return nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// Resumable uploads let large files be uploaded in parts, so that a failed
+// request only requires the part it was sending to be retried:
+//
+//	POST   /path?uploads                   create an upload, returns {"id": "<id>"}
+//	PUT    /path?upload=<id>&offset=<n>    write a part starting at byte n
+//	HEAD   /path?upload=<id>               get the Upload-Offset received so far
+//	POST   /path?upload=<id>               complete the upload, creating /path
+//	DELETE /path?upload=<id>               abort the upload
+//
+// A part may be written at the Upload-Offset, or at the offset of a part which
+// was already written, in which case it replaces that part and any after it.
+// Parts and completed files are checked against the hex encoded SHA-512
+// digest in the Content-SHA512 request header, if it is set.
+//
+// The parts are stored as files under uploadsDir in the same Filesystem as
+// the files themselves, so uploads are supported by every backend, and each
+// part is written to it by a single Put. Uploads which are not written to for
+// uploadExpiry are removed.
+const uploadsDir = "/.uploads"
+
+const (
+	uploadExpiry         = 24 * time.Hour
+	uploadExpiryInterval = time.Hour
+)
+
+const (
+	digestHeader = "Content-SHA512"
+	offsetHeader = "Upload-Offset"
+)
+
+var (
+	ErrDigestMismatch = errors.New("digest mismatch")
+	ErrInvalidOffset  = errors.New("invalid upload offset")
+)
+
+// A Concatenator is a Filesystem which can create a file from the contents of
+// other files without copying them, so that completing an upload does not
+// write the whole file again.
+type Concatenator interface {
+	// Concat creates the named file from the contents of the files in
+	// parts, in order, replacing any existing file. digest is the hex
+	// encoded SHA-512 digest of the contents.
+	Concat(name string, parts []string, typ, digest string) error
+}
+
+type uploadInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type upload struct {
+	fs   Filesystem
+	id   string
+	info uploadInfo
+}
+
+type uploadPart struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+func createUpload(fs Filesystem, name, typ string) (*upload, error) {
+	u := &upload{fs: fs, id: random.UUID(), info: uploadInfo{Name: name, Type: typ}}
+	data, err := json.Marshal(u.info)
+	if err != nil {
+		return nil, err
+	}
+	return u, fs.Put(u.path("info"), bytes.NewReader(data), "application/json")
+}
+
+// openUpload returns the upload with the given id, which must be an upload of
+// the named file.
+func openUpload(fs Filesystem, name, id string) (*upload, error) {
+	if !validUploadID(id) {
+		return nil, ErrNotFound
+	}
+	u := &upload{fs: fs, id: id}
+	f, err := fs.Open(u.path("info"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&u.info); err != nil {
+		return nil, err
+	}
+	if u.info.Name != name {
+		return nil, ErrNotFound
+	}
+	return u, nil
+}
+
+// validUploadID reports whether id has the format of the ids generated by
+// createUpload, so that it can't refer to a path outside its upload.
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *upload) path(name string) string {
+	return path.Join(uploadsDir, u.id, name)
+}
+
+// parts returns the parts which have been written, ordered by offset.
+func (u *upload) parts() ([]uploadPart, error) {
+	names, err := u.fs.List(path.Join(uploadsDir, u.id))
+	if err != nil {
+		return nil, err
+	}
+	var parts []uploadPart
+	for _, name := range names {
+		offset, err := strconv.ParseInt(path.Base(name), 10, 64)
+		if err != nil {
+			// not a part, e.g. the info file
+			continue
+		}
+		f, err := u.fs.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, uploadPart{name: name, offset: offset, size: f.Size()})
+		f.Close()
+	}
+	sort.Sort(partsByOffset(parts))
+	return parts, nil
+}
+
+type partsByOffset []uploadPart
+
+func (p partsByOffset) Len() int           { return len(p) }
+func (p partsByOffset) Less(i, j int) bool { return p[i].offset < p[j].offset }
+func (p partsByOffset) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// contiguous returns the leading parts which have no gaps between them, and
+// the number of bytes they contain.
+func contiguous(parts []uploadPart) ([]uploadPart, int64) {
+	var size int64
+	for i, p := range parts {
+		if p.offset != size {
+			return parts[:i], size
+		}
+		size += p.size
+	}
+	return parts, size
+}
+
+// Offset returns the number of bytes received so far.
+func (u *upload) Offset() (int64, error) {
+	parts, err := u.parts()
+	if err != nil {
+		return 0, err
+	}
+	_, size := contiguous(parts)
+	return size, nil
+}
+
+// PutPart writes the part starting at offset, replacing any parts written at
+// or after it.
+func (u *upload) PutPart(offset int64, r io.Reader, digest string) error {
+	parts, err := u.parts()
+	if err != nil {
+		return err
+	}
+	parts, size := contiguous(parts)
+	valid := offset == size
+	for _, p := range parts {
+		if p.offset == offset {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrInvalidOffset
+	}
+
+	if err := u.fs.Put(u.path(fmt.Sprintf("%020d", offset)), verifyDigest(r, digest), ""); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if p.offset > offset {
+			if err := u.fs.Delete(p.name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Complete writes the parts to the file being uploaded and removes the
+// upload. If the Filesystem is a Concatenator, the file is created from the
+// stored parts rather than by writing their contents again.
+func (u *upload) Complete(digest string) error {
+	parts, err := u.parts()
+	if err != nil {
+		return err
+	}
+	if p, _ := contiguous(parts); len(p) != len(parts) {
+		return ErrInvalidOffset
+	}
+	if c, ok := u.fs.(Concatenator); ok {
+		err = u.concat(c, parts, digest)
+	} else {
+		r := &partsReader{fs: u.fs, parts: parts}
+		err = u.fs.Put(u.info.Name, verifyDigest(r, digest), u.info.Type)
+		r.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return u.Abort()
+}
+
+// concat creates the file being uploaded from parts with c, after reading
+// them to calculate the digest of the file and check it against digest.
+func (u *upload) concat(c Concatenator, parts []uploadPart, digest string) error {
+	r := &partsReader{fs: u.fs, parts: parts}
+	defer r.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if digest != "" && strings.ToLower(digest) != sum {
+		return ErrDigestMismatch
+	}
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = p.name
+	}
+	return c.Concat(u.info.Name, names, u.info.Type, sum)
+}
+
+// Abort removes the upload and its parts.
+func (u *upload) Abort() error {
+	names, err := u.fs.List(path.Join(uploadsDir, u.id))
+	if err != nil {
+		return err
+	}
+	// the directory itself is deleted last for filesystems which have them
+	names = append(names, path.Join(uploadsDir, u.id))
+	for _, name := range names {
+		if err := u.fs.Delete(name); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireUploads removes the uploads which have not been written to since
+// before, returning the number removed.
+func expireUploads(fs Filesystem, before time.Time) (int, error) {
+	names, err := fs.List(uploadsDir)
+	if err != nil {
+		return 0, err
+	}
+	// the last write to an upload is the newest of its files
+	written := make(map[string]time.Time)
+	for _, name := range names {
+		id := strings.SplitN(strings.TrimPrefix(name, uploadsDir+"/"), "/", 2)[0]
+		f, err := fs.Open(name)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if mtime := f.ModTime(); mtime.After(written[id]) {
+			written[id] = mtime
+		}
+		f.Close()
+	}
+	var n int
+	for id, mtime := range written {
+		if mtime.After(before) {
+			continue
+		}
+		u := &upload{fs: fs, id: id}
+		if err := u.Abort(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// expireUploadsLoop removes expired uploads every uploadExpiryInterval.
+func expireUploadsLoop(fs Filesystem) {
+	for {
+		n, err := expireUploads(fs, time.Now().Add(-uploadExpiry))
+		if err != nil {
+			log.Println("error expiring uploads:", err)
+		} else if n > 0 {
+			log.Println("EXPIRED", n, "uploads")
+		}
+		time.Sleep(uploadExpiryInterval)
+	}
+}
+
+// partsReader reads the parts of an upload in order.
+type partsReader struct {
+	fs    Filesystem
+	parts []uploadPart
+	f     File
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.f == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			f, err := r.fs.Open(r.parts[0].name)
+			if err != nil {
+				return 0, err
+			}
+			r.f = f
+			r.parts = r.parts[1:]
+		}
+		n, err := r.f.Read(p)
+		if err == io.EOF {
+			r.f.Close()
+			r.f = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.f != nil {
+		return r.f.Close()
+	}
+	return nil
+}
+
+// verifyDigest returns a reader which fails with ErrDigestMismatch at the
+// end of r if the SHA-512 digest of r is not digest. Filesystems discard
+// files whose reader fails, so a corrupt upload is never stored.
+func verifyDigest(r io.Reader, digest string) io.Reader {
+	if digest == "" {
+		return r
+	}
+	return &digestReader{r: r, h: sha512.New(), digest: strings.ToLower(digest)}
+}
+
+type digestReader struct {
+	r      io.Reader
+	h      hash.Hash
+	digest string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(d.h.Sum(nil)) != d.digest {
+		err = ErrDigestMismatch
+	}
+	return n, err
+}
+
+// handleUpload serves the upload requests for the file at the path of req.
+func handleUpload(fs Filesystem, w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Path
+	query := req.URL.Query()
+	if _, ok := query["uploads"]; ok {
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		u, err := createUpload(fs, name, req.Header.Get("Content-Type"))
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		log.Println("UPLOAD", req.RequestURI, u.id)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", name+"?upload="+u.id)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			ID string `json:"id"`
+		}{u.id})
+		return
+	}
+
+	u, err := openUpload(fs, name, query.Get("upload"))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+	switch req.Method {
+	case "HEAD", "GET":
+		offset, err := u.Offset()
+		if err != nil {
+			errorResponse(w, err)
+			return
+		}
+		w.Header().Set(offsetHeader, strconv.FormatInt(offset, 10))
+	case "PUT":
+		offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "InvalidOffset", http.StatusBadRequest)
+			return
+		}
+		if err := u.PutPart(offset, req.Body, req.Header.Get(digestHeader)); err != nil {
+			errorResponse(w, err)
+			return
+		}
+		log.Println("PUT", req.RequestURI)
+	case "POST":
+		if err := u.Complete(req.Header.Get(digestHeader)); err != nil {
+			errorResponse(w, err)
+			return
+		}
+		log.Println("COMPLETE", req.RequestURI)
+	case "DELETE":
+		if err := u.Abort(); err != nil {
+			errorResponse(w, err)
+			return
+		}
+		log.Println("ABORT", req.RequestURI)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// isUploadRequest returns whether req is part of a resumable upload.
+func isUploadRequest(req *http.Request) bool {
+	query := req.URL.Query()
+	_, create := query["uploads"]
+	_, upload := query["upload"]
+	return create || upload
+}
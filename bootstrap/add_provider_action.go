@@ -0,0 +1,28 @@
+package bootstrap
+
+import (
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type AddProviderAction struct {
+	ID string `json:"id"`
+
+	*ct.Provider
+}
+
+func init() {
+	Register("add-provider", &AddProviderAction{})
+}
+
+func (a *AddProviderAction) Run(s *State) error {
+	client, err := s.ControllerClient()
+	if err != nil {
+		return err
+	}
+	if err := client.CreateProvider(a.Provider); err != nil {
+		return err
+	}
+	s.Providers[a.Provider.Name] = a.Provider
+	s.StepData[a.ID] = a.Provider
+	return nil
+}
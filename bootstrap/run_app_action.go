@@ -196,8 +196,9 @@ func randomHost(cc *cluster.Client) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if len(hosts) == 0 {
+	h := schedutil.PickHost(hosts)
+	if h == nil {
 		return "", cluster.ErrNoServers
 	}
-	return schedutil.PickHost(hosts).ID, nil
+	return h.ID, nil
 }
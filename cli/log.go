@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
@@ -16,17 +18,56 @@ import (
 
 func init() {
 	register("log", runLog, `
-usage: flynn log [-f] [-j <id>] [-n <lines>] [-r] [-s] [-t <type>]
+usage: flynn log [-f] [-j <id>] [-n <lines>] [-r] [-s] [-t <type>] [--host <id>] [--stream <stream>] [--since <time>] [--until <time>] [-g <text>] [-e <pattern>] [--field <key=value>...] [--json]
+       flynn log drain
+       flynn log drain add <url>
+       flynn log drain remove <id>
 
-Stream log for an app.
+Stream log for an app, or manage the app's log drains.
 
 Options:
-	-f, --follow               stream new lines after printing log buffer
+	-f, --follow               stream new lines after printing log buffer, resuming
+	                           automatically if the stream is interrupted
 	-j, --job <id>             filter logs to a specific job ID
 	-n, --number <lines>       return at most n lines from the log buffer
 	-r, --raw-output           output raw log messages with no prefix
 	-s, --split-stderr         send stderr lines to stderr
 	-t, --process-type <type>  filter logs to a specific process type
+	--host <id>                filter logs to a specific host ID
+	--stream <stream>          filter logs to a specific stream (stdout or stderr)
+	--since <time>             only return lines emitted at or after time
+	--until <time>             only return lines emitted at or before time
+	-g, --grep <text>          only return lines containing text
+	-e, --regexp <pattern>     only return lines matching a regular expression
+	--field <key=value>        only return lines with a parsed field having value
+	                           (may be repeated)
+	--json                     output messages as JSON, including their fields
+
+Times are either RFC3339 timestamps (e.g. 2015-06-01T15:04:05Z) or durations
+relative to now (e.g. 10m or 2h30m).
+
+Lines which are JSON objects or logfmt key=value pairs are parsed into fields,
+which can be filtered on with --field and are included in --json output.
+
+Commands:
+	drain         lists the app's log drains and their delivery stats
+	drain add     adds a drain which forwards the app's logs to url
+	drain remove  removes a drain
+
+Drain URLs use one of the following schemes:
+	syslog://host:port      RFC5424 messages over TCP (RFC6587 octet counting)
+	syslog+tls://host:port  as above, secured with TLS
+	https://host/path       batches of messages POSTed as JSON arrays
+
+Examples:
+
+	$ flynn log --since 1h --stream stderr
+
+	$ flynn log -e 'status=5\d\d' --since 2015-06-01T00:00:00Z --until 2015-06-02T00:00:00Z
+
+	$ flynn log --field level=error --json
+
+	$ flynn log drain add syslog+tls://logs.example.com:6514
 `)
 }
 
@@ -35,6 +76,10 @@ Options:
 const rfc3339micro = "2006-01-02T15:04:05.000000Z07:00"
 
 func runLog(args *docopt.Args, client *controller.Client) error {
+	if args.Bool["drain"] {
+		return runLogDrain(args, client)
+	}
+
 	rawOutput := args.Bool["--raw-output"]
 	opts := ct.LogOpts{
 		Follow: args.Bool["--follow"],
@@ -50,6 +95,39 @@ func runLog(args *docopt.Args, client *controller.Client) error {
 		}
 		opts.Lines = &lines
 	}
+	opts.HostID = args.String["--host"]
+	opts.Stream = args.String["--stream"]
+	opts.Search = args.String["--grep"]
+	opts.Regexp = args.String["--regexp"]
+	if opts.Stream != "" && opts.Stream != "stdout" && opts.Stream != "stderr" {
+		return fmt.Errorf("invalid stream %q, must be stdout or stderr", opts.Stream)
+	}
+	if since := args.String["--since"]; since != "" {
+		t, err := parseLogTime(since)
+		if err != nil {
+			return err
+		}
+		opts.Since = &t
+	}
+	if until := args.String["--until"]; until != "" {
+		t, err := parseLogTime(until)
+		if err != nil {
+			return err
+		}
+		opts.Until = &t
+	}
+	for _, field := range args.All["--field"].([]string) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid field %q, must be of the form key=value", field)
+		}
+		if opts.FieldFilters == nil {
+			opts.FieldFilters = make(map[string]string)
+		}
+		opts.FieldFilters[kv[0]] = kv[1]
+	}
+	jsonOutput := args.Bool["--json"]
+	opts.ParseFields = jsonOutput
 	rc, err := client.GetAppLog(mustApp(), &opts)
 	if err != nil {
 		return err
@@ -62,6 +140,7 @@ func runLog(args *docopt.Args, client *controller.Client) error {
 	}
 
 	dec := json.NewDecoder(rc)
+	enc := json.NewEncoder(os.Stdout)
 	for {
 		var msg logaggc.Message
 		err := dec.Decode(&msg)
@@ -71,6 +150,13 @@ func runLog(args *docopt.Args, client *controller.Client) error {
 			return err
 		}
 
+		if jsonOutput {
+			if err := enc.Encode(msg); err != nil {
+				return err
+			}
+			continue
+		}
+
 		var stream io.Writer = os.Stdout
 		if msg.Stream == "stderr" {
 			stream = stderr
@@ -90,6 +176,55 @@ func runLog(args *docopt.Args, client *controller.Client) error {
 	}
 }
 
+func runLogDrain(args *docopt.Args, client *controller.Client) error {
+	if args.Bool["add"] {
+		drain := &ct.LogDrain{URL: args.String["<url>"]}
+		if err := client.CreateLogDrain(mustApp(), drain); err != nil {
+			return err
+		}
+		fmt.Printf("Created log drain %s\n", drain.ID)
+		return nil
+	} else if args.Bool["remove"] {
+		id := args.String["<id>"]
+		if err := client.DeleteLogDrain(mustApp(), id); err != nil {
+			return err
+		}
+		fmt.Printf("Removed log drain %s\n", id)
+		return nil
+	}
+
+	drains, err := client.LogDrainList(mustApp())
+	if err != nil {
+		return err
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	listRec(w, "ID", "URL", "DELIVERED", "DROPPED", "FAILED", "LAST ERROR")
+	for _, d := range drains {
+		if d.Stats == nil {
+			listRec(w, d.ID, d.URL, "-", "-", "-", "")
+			continue
+		}
+		listRec(w, d.ID, d.URL, d.Stats.Delivered, d.Stats.Dropped, d.Stats.Failed, d.Stats.LastError)
+	}
+	return nil
+}
+
+// parseLogTime parses either an RFC3339 timestamp or a duration which is
+// subtracted from the current time.
+func parseLogTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, must be an RFC3339 timestamp or a duration", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
 func shorten(msg string, maxLength int) string {
 	if len(msg) > maxLength {
 		return msg[:maxLength]
@@ -50,6 +50,7 @@ Commands:
 	kill      kill a job
 	log       get app log
 	scale     change formation
+	placement list placement problems
 	run       run a job
 	env       manage env variables
 	route     manage routes
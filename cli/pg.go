@@ -1,14 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/cheggaaa/pb"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/term"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/appliance/postgresql/backup"
 	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
 )
 
 func init() {
@@ -16,16 +20,50 @@ func init() {
 usage: flynn pg psql [--] [<argument>...]
        flynn pg dump [-q] [-f <file>]
        flynn pg restore [-q] [-f <file>]
+       flynn pg restore --at <target> [-n <name>]
+       flynn pg backups [--enable [--url <url>]]
+       flynn pg status
+       flynn pg failover
+       flynn pg freeze [<reason>]
+       flynn pg unfreeze
 
 Options:
 	-f, --file <file>  name of dump file
 	-q, --quiet        don't print progress
+	--at <target>      point in time to restore to, either an RFC 3339 timestamp, an xlog position or "latest"
+	-n, --name <name>  name of the app and service of the restored cluster
+	--enable           enable backups of the app's postgres cluster
+	--url <url>        blobstore URL to store backups under
 
 Commands:
 	psql     Open a console to a Flynn postgres database. Any valid arguments to psql may be provided.
 	dump     Dump a postgres database. If file is not specified, will dump to stdout.
 	restore  Restore a database dump. If file is not specified, will restore from stdin.
 
+	         With --at, bring up a new postgres cluster as a new app, from the base
+	         backups and archived WAL of the app's cluster, recovered to the given
+	         point in time.
+	         Recovery to an xlog position stops at the end of the WAL segment
+	         containing it. The original cluster is left untouched.
+
+	backups   List the base backups of the app's postgres cluster. Backups are taken
+	          when the postgres appliance is run with BACKUP_URL set.
+
+	          With --enable, deploy the cluster with BACKUP_URL set to the given
+	          URL (default http://blobstore.discoverd/postgres-backups), along with
+	          a key which only allows the cluster to access its own backups.
+
+	status    Show the state of the app's postgres cluster, including the role and
+	          replication lag in bytes of each peer.
+
+	failover  Switch the primary of the cluster over to the sync once it has caught
+	          up with the primary. The previous primary is deposed.
+
+	freeze    Freeze the cluster, preventing any changes to its state such as
+	          failovers, for example while performing maintenance.
+
+	unfreeze  Unfreeze the cluster.
+
 Examples:
 
     $ flynn pg psql
@@ -35,6 +73,12 @@ Examples:
     $ flynn pg dump -f db.dump
 
     $ flynn pg restore -f db.dump
+
+    $ flynn pg backups
+
+    $ flynn pg backups --enable
+
+    $ flynn pg restore --at 2015-06-01T12:00:00Z
 `)
 }
 
@@ -48,8 +92,22 @@ func runPg(args *docopt.Args, client *controller.Client) error {
 		return runPsql(args, client, config)
 	case args.Bool["dump"]:
 		return runPgDump(args, client, config)
+	case args.Bool["restore"] && args.String["--at"] != "":
+		return runPgRestoreAt(args, client, config)
 	case args.Bool["restore"]:
 		return runPgRestore(args, client, config)
+	case args.Bool["backups"] && args.Bool["--enable"]:
+		return runPgEnableBackups(args, client, config)
+	case args.Bool["backups"]:
+		return runPgCommand(client, config, "backups")
+	case args.Bool["status"]:
+		return runPgCommand(client, config, "status")
+	case args.Bool["failover"]:
+		return runPgCommand(client, config, "switchover")
+	case args.Bool["freeze"]:
+		return runPgCommand(client, config, "freeze", args.String["<reason>"])
+	case args.Bool["unfreeze"]:
+		return runPgCommand(client, config, "unfreeze")
 	}
 	return nil
 }
@@ -76,7 +134,7 @@ func getPgRunConfig(client *controller.Client) (*runConfig, error) {
 		Env:        make(map[string]string),
 		DisableLog: true,
 	}
-	for _, k := range []string{"PGHOST", "PGUSER", "PGPASSWORD", "PGDATABASE"} {
+	for _, k := range []string{"FLYNN_POSTGRES", "PGHOST", "PGUSER", "PGPASSWORD", "PGDATABASE"} {
 		v := appRelease.Env[k]
 		if v == "" {
 			return nil, fmt.Errorf("missing %s in app environment", k)
@@ -153,3 +211,148 @@ func runPgRestore(args *docopt.Args, client *controller.Client, config *runConfi
 	}
 	return runJob(client, *config)
 }
+
+// runPgCommand runs a command of the postgres appliance against the app's
+// cluster. The postgres release environment configures where backups are
+// stored and the password of the superuser, which authenticates requests to
+// the cluster.
+func runPgCommand(client *controller.Client, config *runConfig, cmd string, args ...string) error {
+	config.ReleaseEnv = true
+	config.Entrypoint = []string{"/bin/flynn-postgres"}
+	config.Args = append([]string{cmd, "-service", config.Env["FLYNN_POSTGRES"]}, args...)
+	// the app's credentials would override those of the release
+	delete(config.Env, "PGUSER")
+	delete(config.Env, "PGPASSWORD")
+	return runJob(client, *config)
+}
+
+// runPgEnableBackups deploys the app's postgres cluster with backups stored
+// under the given URL. The cluster is given a key for its own backups rather
+// than the blobstore key, so it can't access any other files.
+func runPgEnableBackups(args *docopt.Args, client *controller.Client, config *runConfig) error {
+	pgApp := config.Env["FLYNN_POSTGRES"]
+	url := args.String["--url"]
+	if url == "" {
+		url = backup.DefaultURL
+	}
+	key, err := backupKey(client, url, pgApp, backup.KeyMethods)
+	if err != nil {
+		return err
+	}
+
+	release, err := client.GetAppRelease(pgApp)
+	if err != nil {
+		return fmt.Errorf("error getting postgres release: %s", err)
+	}
+	if release.Env == nil {
+		release.Env = make(map[string]string, 2)
+	}
+	release.Env["BACKUP_URL"] = url
+	if key != "" {
+		release.Env["BACKUP_KEY"] = key
+	} else {
+		delete(release.Env, "BACKUP_KEY")
+	}
+	release.ID = ""
+	if err := client.CreateRelease(release); err != nil {
+		return err
+	}
+	if err := client.DeployAppRelease(pgApp, release.ID); err != nil {
+		return err
+	}
+	fmt.Printf("Enabled backups of %s to %s.\n", pgApp, url)
+	return nil
+}
+
+// backupKey returns a blobstore key for the backups of the cluster stored
+// under url, which is empty if the blobstore does not require signed URLs.
+func backupKey(client *controller.Client, url, service string, methods []string) (string, error) {
+	prefix, err := backup.Prefix(url, service)
+	if err != nil {
+		return "", err
+	}
+	key, err := client.BlobstorePrefixKey(prefix, methods)
+	if err != nil {
+		return "", fmt.Errorf("error getting backup key: %s", err)
+	}
+	return key, nil
+}
+
+// runPgRestoreAt brings up the restored cluster as a new app running the
+// postgres process type of the app's postgres release, so that it gets a data
+// volume and is kept running by the scheduler like any other cluster.
+func runPgRestoreAt(args *docopt.Args, client *controller.Client, config *runConfig) error {
+	from := config.Env["FLYNN_POSTGRES"]
+	target := args.String["--at"]
+	if target == "latest" {
+		target = ""
+	}
+	name := args.String["--name"]
+	if name == "" {
+		name = fmt.Sprintf("%s-restore-%s", from, time.Now().UTC().Format("20060102150405"))
+	}
+
+	pgRelease, err := client.GetRelease(config.Release)
+	if err != nil {
+		return fmt.Errorf("error getting postgres release: %s", err)
+	}
+	proc, ok := pgRelease.Processes["postgres"]
+	if !ok {
+		return errors.New("missing postgres process type in postgres release")
+	}
+	env := make(map[string]string, len(proc.Env)+6)
+	for k, v := range proc.Env {
+		env[k] = v
+	}
+	env["FLYNN_POSTGRES"] = name
+	env["SINGLETON"] = "true"
+	env["RESTORE_FROM"] = from
+	env["RESTORE_TARGET"] = target
+
+	// the restored cluster can read the backups of the original cluster, and
+	// stores its own backups separately if the original cluster has backups
+	// enabled
+	backupURL := pgRelease.Env["BACKUP_URL"]
+	if u, ok := proc.Env["BACKUP_URL"]; ok {
+		backupURL = u
+	}
+	restoreKey, err := backupKey(client, backupURL, from, backup.ReadKeyMethods)
+	if err != nil {
+		return err
+	}
+	env["RESTORE_KEY"] = restoreKey
+	if backupURL != "" {
+		key, err := backupKey(client, backupURL, name, backup.KeyMethods)
+		if err != nil {
+			return err
+		}
+		env["BACKUP_KEY"] = key
+	}
+	proc.Env = env
+	proc.Data = true
+
+	app := &ct.App{Name: name}
+	if err := client.CreateApp(app); err != nil {
+		return err
+	}
+	release := &ct.Release{
+		ArtifactID: pgRelease.ArtifactID,
+		Env:        pgRelease.Env,
+		Processes:  map[string]ct.ProcessType{"postgres": proc},
+	}
+	if err := client.CreateRelease(release); err != nil {
+		return err
+	}
+	if err := client.SetAppRelease(app.ID, release.ID); err != nil {
+		return err
+	}
+	if err := client.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"postgres": 1},
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("Restoring %s to %s as the app %s, it will be available at %s.discoverd:5432 once recovery completes.\n", from, args.String["--at"], name, name)
+	return nil
+}
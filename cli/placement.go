@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+)
+
+func init() {
+	register("placement", runPlacement, `
+usage: flynn placement
+
+List recent placement problems reported by the scheduler, newest first.
+
+The scheduler reports a constraint_violation when no host satisfies the
+constraints of a process type, so a job could not be started, and an
+affinity_violation when a job had to be placed on a host which breaks the
+affinity or anti-affinity rules of its process type.
+
+Example:
+
+	$ flynn placement
+	TIME                  TYPE                  PROCESS  HOST   MESSAGE
+	2015-06-01T15:04:05Z  constraint_violation  db              scheduler: no host satisfies the constraints of process type "db"
+`)
+}
+
+func runPlacement(args *docopt.Args, client *controller.Client) error {
+	events, err := client.SchedulerEventList(mustApp())
+	if err != nil {
+		return err
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	listRec(w, "TIME", "TYPE", "PROCESS", "HOST", "MESSAGE")
+	for _, e := range events {
+		var created string
+		if e.CreatedAt != nil {
+			created = e.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		listRec(w, created, e.Type, e.ProcessType, e.HostID, e.Message)
+	}
+	return nil
+}
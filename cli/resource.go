@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
@@ -11,14 +13,24 @@ import (
 func init() {
 	register("resource", runResource, `
 usage: flynn resource
-       flynn resource add <provider>
+       flynn resource add [-c <config>] <provider>
 
 Manage resources for the app.
 
+Options:
+	-c, --config <config>  JSON config passed to the provider
+
 Commands:
 	With no arguments, shows a list of resources.
 
 	add   provisions a new resource for the app using <provider>.
+
+Examples:
+
+	Provision a database which is connected to through the connection
+	pooler (the pooler process of the postgres app must be running):
+
+	$ flynn resource add -c '{"pooler":true}' postgres
 `)
 }
 
@@ -52,7 +64,16 @@ func runResource(args *docopt.Args, client *controller.Client) error {
 func runResourceAdd(args *docopt.Args, client *controller.Client) error {
 	provider := args.String["<provider>"]
 
-	res, err := client.ProvisionResource(&ct.ResourceReq{ProviderID: provider, Apps: []string{mustApp()}})
+	req := &ct.ResourceReq{ProviderID: provider, Apps: []string{mustApp()}}
+	if c := args.String["--config"]; c != "" {
+		var v interface{}
+		if err := json.Unmarshal([]byte(c), &v); err != nil {
+			return fmt.Errorf("invalid config: %s", err)
+		}
+		config := json.RawMessage(c)
+		req.Config = &config
+	}
+	res, err := client.ProvisionResource(req)
 	if err != nil {
 		return err
 	}
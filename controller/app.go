@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
@@ -253,6 +254,30 @@ func (c *controllerAPI) UpdateApp(ctx context.Context, rw http.ResponseWriter, r
 	httphelper.JSON(rw, 200, app)
 }
 
+// parseTimeParam parses the optional RFC3339 timestamp query parameter name.
+func parseTimeParam(req *http.Request, name string) (*time.Time, error) {
+	str := req.FormValue(name)
+	if str == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return nil, ct.ValidationError{Field: name, Message: "must be an RFC3339 timestamp"}
+	}
+	return &t, nil
+}
+
+// sseLogMessage is a log message sent as an SSE event with the ID of the
+// message.
+type sseLogMessage struct {
+	sseLogChunk
+	id string
+}
+
+func (m *sseLogMessage) EventID() string {
+	return m.id
+}
+
 func (c *controllerAPI) AppLog(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -279,6 +304,43 @@ func (c *controllerAPI) AppLog(ctx context.Context, w http.ResponseWriter, req *
 		}
 		opts.Lines = &lines
 	}
+	opts.HostID = req.FormValue("host_id")
+	opts.Stream = req.FormValue("stream")
+	opts.Search = req.FormValue("search")
+	opts.Regexp = req.FormValue("regexp")
+	var err error
+	if opts.Since, err = parseTimeParam(req, "since"); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if opts.Until, err = parseTimeParam(req, "until"); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	// EventSource clients send the ID of the last event they received as
+	// Last-Event-ID when reconnecting
+	opts.After = req.FormValue("after")
+	if opts.After == "" {
+		opts.After = req.Header.Get("Last-Event-ID")
+	}
+	if opts.After != "" {
+		if _, err := strconv.ParseUint(opts.After, 10, 64); err != nil {
+			respondWithError(w, ct.ValidationError{Field: "after", Message: "must be a message ID"})
+			return
+		}
+	}
+	opts.ParseFields = req.FormValue("parse_fields") == "true"
+	for _, field := range req.Form["field"] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			respondWithError(w, ct.ValidationError{Field: "field", Message: "must be of the form key=value"})
+			return
+		}
+		if opts.FieldFilters == nil {
+			opts.FieldFilters = make(map[string]string)
+		}
+		opts.FieldFilters[kv[0]] = kv[1]
+	}
 	rc, err := c.logaggc.GetLog(c.getApp(ctx).ID, &opts)
 	if err != nil {
 		respondWithError(w, err)
@@ -310,7 +372,7 @@ func (c *controllerAPI) AppLog(ctx context.Context, w http.ResponseWriter, req *
 		return
 	}
 
-	ch := make(chan *sseLogChunk)
+	ch := make(chan interface{})
 	l, _ := ctxhelper.LoggerFromContext(ctx)
 	s := sse.NewStream(w, ch, l)
 	defer s.Close()
@@ -339,9 +401,15 @@ func (c *controllerAPI) AppLog(ctx context.Context, w http.ResponseWriter, req *
 				ch <- &sseLogChunk{Event: "eof"}
 				return
 			}
-			// write to sse
+			// write to sse, using the message ID as the event ID so
+			// that clients can resume from it
+			var chunk interface{} = &sseLogChunk{Event: "message", Data: *m}
+			var msg logaggc.Message
+			if err := json.Unmarshal(*m, &msg); err == nil && msg.ID != "" {
+				chunk = &sseLogMessage{sseLogChunk{Event: "message", Data: *m}, msg.ID}
+			}
 			select {
-			case ch <- &sseLogChunk{Event: "message", Data: *m}:
+			case ch <- chunk:
 			case <-s.Done:
 				return
 			case <-ctx.Done():
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/signedurl"
+)
+
+// defaultSignedURLExpiry is how long signed URLs are valid for if the request
+// doesn't specify an expiry.
+const defaultSignedURLExpiry = time.Hour
+
+// SignBlobstoreURL signs a blobstore URL with the blobstore key, so that
+// components which don't have the key can be given access to single files.
+func (c *controllerAPI) SignBlobstoreURL(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var signed ct.SignedURL
+	if err := httphelper.DecodeJSON(req, &signed); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	u, err := url.Parse(signed.URL)
+	if err != nil || u.Host != utils.BlobstoreHost {
+		respondWithError(w, ct.ValidationError{Field: "url", Message: "must be a blobstore URL"})
+		return
+	}
+	if len(signed.Methods) == 0 {
+		respondWithError(w, ct.ValidationError{Field: "methods", Message: "must not be empty"})
+		return
+	}
+	if signed.ExpiresAt == nil {
+		expires := time.Now().Add(defaultSignedURLExpiry)
+		signed.ExpiresAt = &expires
+	} else if signed.ExpiresAt.Before(time.Now()) {
+		respondWithError(w, ct.ValidationError{Field: "expires_at", Message: "must be in the future"})
+		return
+	}
+
+	signed.URL, err = utils.SignBlobstoreURL(c.blobstoreKey, signed.URL, signed.Methods, *signed.ExpiresAt)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &signed)
+}
+
+// CreateBlobstoreKey issues a key which allows URLs under a path prefix to be
+// signed, for components which sign their own URLs, such as hosts exporting
+// volume snapshots.
+func (c *controllerAPI) CreateBlobstoreKey(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var key ct.BlobstoreKey
+	if err := httphelper.DecodeJSON(req, &key); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if !validPrefix(key.Prefix) {
+		respondWithError(w, ct.ValidationError{Field: "prefix", Message: "must be a clean absolute path"})
+		return
+	}
+	if len(key.Methods) == 0 {
+		respondWithError(w, ct.ValidationError{Field: "methods", Message: "must not be empty"})
+		return
+	}
+	if len(c.blobstoreKey) > 0 {
+		key.Key = signedurl.PrefixKey(c.blobstoreKey, key.Prefix, key.Methods)
+	}
+	httphelper.JSON(w, 200, &key)
+}
+
+// validPrefix reports whether prefix is an absolute path with no dot segments
+// or repeated slashes, optionally ending with a slash.
+func validPrefix(prefix string) bool {
+	if !strings.HasPrefix(prefix, "/") {
+		return false
+	}
+	p := strings.TrimSuffix(prefix, "/")
+	return p == "" || path.Clean(p) == p
+}
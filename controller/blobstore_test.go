@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/signedurl"
+)
+
+const blobstoreKey = "blobstore-key"
+
+func (s *S) TestSignBlobstoreURL(c *C) {
+	expires := time.Now().Add(time.Hour)
+	u, err := s.c.SignBlobstoreURL("http://blobstore.discoverd/foo.tgz", []string{"GET"}, expires)
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("GET", u, nil)
+	c.Assert(err, IsNil)
+	c.Assert(signedurl.Verify([]byte(blobstoreKey), req, time.Now()), IsNil)
+	req.Method = "PUT"
+	c.Assert(signedurl.Verify([]byte(blobstoreKey), req, time.Now()), Equals, signedurl.ErrMethodNotAllowed)
+
+	_, err = s.c.SignBlobstoreURL("http://example.com/foo.tgz", []string{"GET"}, expires)
+	c.Assert(err, NotNil)
+	c.Assert(hh.IsValidationError(err), Equals, true)
+
+	_, err = s.c.SignBlobstoreURL("http://blobstore.discoverd/foo.tgz", nil, expires)
+	c.Assert(hh.IsValidationError(err), Equals, true)
+}
+
+func (s *S) TestCreateBlobstoreKey(c *C) {
+	methods := []string{"PUT"}
+	key, err := s.c.BlobstorePrefixKey("/backups/", methods)
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, signedurl.PrefixKey([]byte(blobstoreKey), "/backups", methods))
+
+	u, err := signedurl.SignPrefix(key, "/backups/", methods, "http://blobstore.discoverd/backups/foo", methods, time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+	req, err := http.NewRequest("PUT", u, nil)
+	c.Assert(err, IsNil)
+	c.Assert(signedurl.Verify([]byte(blobstoreKey), req, time.Now()), IsNil)
+
+	for _, prefix := range []string{"", "backups", "/backups/../foo"} {
+		_, err = s.c.BlobstorePrefixKey(prefix, methods)
+		c.Assert(hh.IsValidationError(err), Equals, true)
+	}
+	_, err = s.c.BlobstorePrefixKey("/backups", nil)
+	c.Assert(hh.IsValidationError(err), Equals, true)
+}
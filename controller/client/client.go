@@ -9,11 +9,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	ct "github.com/flynn/flynn/controller/types"
+	logaggc "github.com/flynn/flynn/logaggregator/client"
 	"github.com/flynn/flynn/pkg/attempt"
 	"github.com/flynn/flynn/pkg/httpclient"
 	"github.com/flynn/flynn/pkg/pinned"
@@ -199,6 +201,14 @@ func (c *Client) PutResource(resource *ct.Resource) error {
 	return c.Put(fmt.Sprintf("/providers/%s/resources/%s", resource.ProviderID, resource.ID), resource, resource)
 }
 
+// DeleteResource deprovisions the resource identified by resourceID under
+// providerID and removes it from the apps it was provisioned for.
+func (c *Client) DeleteResource(providerID, resourceID string) (*ct.Resource, error) {
+	res := &ct.Resource{}
+	err := c.Send("DELETE", fmt.Sprintf("/providers/%s/resources/%s", providerID, resourceID), nil, res)
+	return res, err
+}
+
 // PutFormation updates an existing formation.
 func (c *Client) PutFormation(formation *ct.Formation) error {
 	if formation.AppID == "" || formation.ReleaseID == "" {
@@ -292,8 +302,26 @@ func (c *Client) GetApp(appID string) (*ct.App, error) {
 // GetAppLog returns a ReadCloser log stream of the app with ID appID. If lines
 // is zero or above, the number of lines returned will be capped at that value.
 // Otherwise, all available logs are returned. If follow is true, new log lines
-// are streamed after the buffered log.
+// are streamed after the buffered log, and the stream is transparently resumed
+// after the last message read if it is interrupted.
 func (c *Client) GetAppLog(appID string, options *ct.LogOpts) (io.ReadCloser, error) {
+	body, err := c.getAppLog(appID, options)
+	if err != nil || options == nil || !options.Follow {
+		return body, err
+	}
+	opts := *options
+	return logaggc.NewFollowReader(body, opts.After, func(after string) (io.ReadCloser, error) {
+		// messages up to the last one read are skipped using After, so
+		// the line limit of the original request no longer applies
+		if after != "" {
+			opts.After = after
+			opts.Lines = nil
+		}
+		return c.getAppLog(appID, &opts)
+	}), nil
+}
+
+func (c *Client) getAppLog(appID string, options *ct.LogOpts) (io.ReadCloser, error) {
 	path := fmt.Sprintf("/apps/%s/log", appID)
 	if options != nil {
 		opts := *options
@@ -310,6 +338,38 @@ func (c *Client) GetAppLog(appID string, options *ct.LogOpts) (io.ReadCloser, er
 		if opts.ProcessType != nil {
 			query.Set("process_type", *opts.ProcessType)
 		}
+		if opts.HostID != "" {
+			query.Set("host_id", opts.HostID)
+		}
+		if opts.Stream != "" {
+			query.Set("stream", opts.Stream)
+		}
+		if opts.Since != nil {
+			query.Set("since", opts.Since.Format(time.RFC3339Nano))
+		}
+		if opts.Until != nil {
+			query.Set("until", opts.Until.Format(time.RFC3339Nano))
+		}
+		if opts.Search != "" {
+			query.Set("search", opts.Search)
+		}
+		if opts.Regexp != "" {
+			query.Set("regexp", opts.Regexp)
+		}
+		if opts.After != "" {
+			query.Set("after", opts.After)
+		}
+		if opts.ParseFields {
+			query.Set("parse_fields", "true")
+		}
+		fields := make([]string, 0, len(opts.FieldFilters))
+		for k, v := range opts.FieldFilters {
+			fields = append(fields, k+"="+v)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			query.Add("field", field)
+		}
 		if encodedQuery := query.Encode(); encodedQuery != "" {
 			path = fmt.Sprintf("%s?%s", path, encodedQuery)
 		}
@@ -322,6 +382,65 @@ func (c *Client) GetAppLog(appID string, options *ct.LogOpts) (io.ReadCloser, er
 	return res.Body, nil
 }
 
+// SignBlobstoreURL returns url, which must be a blobstore URL, signed so that
+// it allows requests using methods until expires.
+func (c *Client) SignBlobstoreURL(url string, methods []string, expires time.Time) (string, error) {
+	res := &ct.SignedURL{}
+	err := c.Post("/blobstore/urls", &ct.SignedURL{URL: url, Methods: methods, ExpiresAt: &expires}, res)
+	return res.URL, err
+}
+
+// BlobstorePrefixKey returns a key which allows blobstore URLs whose paths are
+// under prefix to be signed for any of methods with pkg/signedurl.SignPrefix.
+// The key is empty if the blobstore does not require signed URLs.
+func (c *Client) BlobstorePrefixKey(prefix string, methods []string) (string, error) {
+	res := &ct.BlobstoreKey{}
+	err := c.Post("/blobstore/keys", &ct.BlobstoreKey{Prefix: prefix, Methods: methods}, res)
+	return res.Key, err
+}
+
+// CreateLogDrain creates a drain which forwards the logs of the specified app
+// to drain.URL.
+func (c *Client) CreateLogDrain(appID string, drain *ct.LogDrain) error {
+	return c.Post(fmt.Sprintf("/apps/%s/drains", appID), drain, drain)
+}
+
+// GetLogDrain returns details for the drainID under the specified app,
+// including its delivery stats.
+func (c *Client) GetLogDrain(appID, drainID string) (*ct.LogDrain, error) {
+	drain := &ct.LogDrain{}
+	return drain, c.Get(fmt.Sprintf("/apps/%s/drains/%s", appID, drainID), drain)
+}
+
+// LogDrainList returns a list of all log drains of the specified app.
+func (c *Client) LogDrainList(appID string) ([]*ct.LogDrain, error) {
+	var drains []*ct.LogDrain
+	return drains, c.Get(fmt.Sprintf("/apps/%s/drains", appID), &drains)
+}
+
+// AllLogDrainList returns a list of the log drains of every app.
+func (c *Client) AllLogDrainList() ([]*ct.LogDrain, error) {
+	var drains []*ct.LogDrain
+	return drains, c.Get("/drains", &drains)
+}
+
+// DeleteLogDrain deletes a log drain under the specified app.
+func (c *Client) DeleteLogDrain(appID, drainID string) error {
+	return c.Delete(fmt.Sprintf("/apps/%s/drains/%s", appID, drainID))
+}
+
+// CreateSchedulerEvent reports a scheduler event for the specified app.
+func (c *Client) CreateSchedulerEvent(appID string, event *ct.SchedulerEvent) error {
+	return c.Post(fmt.Sprintf("/apps/%s/scheduler_events", appID), event, event)
+}
+
+// SchedulerEventList returns the most recent scheduler events of the
+// specified app, newest first.
+func (c *Client) SchedulerEventList(appID string) ([]*ct.SchedulerEvent, error) {
+	var events []*ct.SchedulerEvent
+	return events, c.Get(fmt.Sprintf("/apps/%s/scheduler_events", appID), &events)
+}
+
 // GetDeployment returns a deployment queued on the deployer.
 func (c *Client) GetDeployment(deploymentID string) (*ct.Deployment, error) {
 	res := &ct.Deployment{}
@@ -102,6 +102,8 @@ func main() {
 		rc:      rc,
 		pgxpool: pgxpool,
 		key:     os.Getenv("AUTH_KEY"),
+
+		blobstoreKey: []byte(os.Getenv("BLOBSTORE_SIGNING_KEY")),
 	})
 	shutdown.Fatal(http.ListenAndServe(addr, handler))
 }
@@ -113,6 +115,9 @@ type handlerConfig struct {
 	rc      routerc.Client
 	pgxpool *pgx.ConnPool
 	key     string
+
+	// blobstoreKey signs blobstore URLs, see pkg/signedurl
+	blobstoreKey []byte
 }
 
 // NOTE: this is temporary until httphelper supports custom errors
@@ -144,19 +149,24 @@ func appHandler(c handlerConfig) http.Handler {
 	jobRepo := NewJobRepo(c.db)
 	formationRepo := NewFormationRepo(c.db, appRepo, releaseRepo, artifactRepo)
 	deploymentRepo := NewDeploymentRepo(c.db, c.pgxpool)
+	logDrainRepo := NewLogDrainRepo(c.db)
+	schedulerEventRepo := NewSchedulerEventRepo(c.db)
 
 	api := controllerAPI{
-		appRepo:        appRepo,
-		releaseRepo:    releaseRepo,
-		providerRepo:   providerRepo,
-		formationRepo:  formationRepo,
-		artifactRepo:   artifactRepo,
-		jobRepo:        jobRepo,
-		resourceRepo:   resourceRepo,
-		deploymentRepo: deploymentRepo,
-		clusterClient:  c.cc,
-		logaggc:        c.lc,
-		routerc:        c.rc,
+		appRepo:            appRepo,
+		releaseRepo:        releaseRepo,
+		providerRepo:       providerRepo,
+		formationRepo:      formationRepo,
+		artifactRepo:       artifactRepo,
+		jobRepo:            jobRepo,
+		resourceRepo:       resourceRepo,
+		deploymentRepo:     deploymentRepo,
+		logDrainRepo:       logDrainRepo,
+		schedulerEventRepo: schedulerEventRepo,
+		clusterClient:      c.cc,
+		logaggc:            c.lc,
+		routerc:            c.rc,
+		blobstoreKey:       c.blobstoreKey,
 	}
 
 	httpRouter := httprouter.New()
@@ -170,6 +180,15 @@ func appHandler(c handlerConfig) http.Handler {
 	httpRouter.POST("/apps/:apps_id", httphelper.WrapHandler(api.UpdateApp))
 	httpRouter.GET("/apps/:apps_id/log", httphelper.WrapHandler(api.appLookup(api.AppLog)))
 
+	httpRouter.POST("/apps/:apps_id/drains", httphelper.WrapHandler(api.appLookup(api.CreateLogDrain)))
+	httpRouter.GET("/apps/:apps_id/drains", httphelper.WrapHandler(api.appLookup(api.ListLogDrains)))
+	httpRouter.GET("/apps/:apps_id/drains/:drains_id", httphelper.WrapHandler(api.appLookup(api.GetLogDrain)))
+	httpRouter.DELETE("/apps/:apps_id/drains/:drains_id", httphelper.WrapHandler(api.appLookup(api.DeleteLogDrain)))
+	httpRouter.GET("/drains", httphelper.WrapHandler(api.ListAllLogDrains))
+
+	httpRouter.POST("/apps/:apps_id/scheduler_events", httphelper.WrapHandler(api.appLookup(api.CreateSchedulerEvent)))
+	httpRouter.GET("/apps/:apps_id/scheduler_events", httphelper.WrapHandler(api.appLookup(api.ListSchedulerEvents)))
+
 	httpRouter.PUT("/apps/:apps_id/formations/:releases_id", httphelper.WrapHandler(api.appLookup(api.PutFormation)))
 	httpRouter.GET("/apps/:apps_id/formations/:releases_id", httphelper.WrapHandler(api.appLookup(api.GetFormation)))
 	httpRouter.DELETE("/apps/:apps_id/formations/:releases_id", httphelper.WrapHandler(api.appLookup(api.DeleteFormation)))
@@ -192,6 +211,7 @@ func appHandler(c handlerConfig) http.Handler {
 	httpRouter.GET("/providers/:providers_id/resources", httphelper.WrapHandler(api.GetProviderResources))
 	httpRouter.GET("/providers/:providers_id/resources/:resources_id", httphelper.WrapHandler(api.GetResource))
 	httpRouter.PUT("/providers/:providers_id/resources/:resources_id", httphelper.WrapHandler(api.PutResource))
+	httpRouter.DELETE("/providers/:providers_id/resources/:resources_id", httphelper.WrapHandler(api.DeleteResource))
 	httpRouter.GET("/apps/:apps_id/resources", httphelper.WrapHandler(api.appLookup(api.GetAppResources)))
 
 	httpRouter.POST("/apps/:apps_id/routes", httphelper.WrapHandler(api.appLookup(api.CreateRoute)))
@@ -199,6 +219,9 @@ func appHandler(c handlerConfig) http.Handler {
 	httpRouter.GET("/apps/:apps_id/routes/:routes_type/:routes_id", httphelper.WrapHandler(api.appLookup(api.GetRoute)))
 	httpRouter.DELETE("/apps/:apps_id/routes/:routes_type/:routes_id", httphelper.WrapHandler(api.appLookup(api.DeleteRoute)))
 
+	httpRouter.POST("/blobstore/urls", httphelper.WrapHandler(api.SignBlobstoreURL))
+	httpRouter.POST("/blobstore/keys", httphelper.WrapHandler(api.CreateBlobstoreKey))
+
 	return httphelper.ContextInjector("controller",
 		httphelper.NewRequestLogger(muxHandler(httpRouter, c.key)))
 }
@@ -223,17 +246,20 @@ func muxHandler(main http.Handler, authKey string) http.Handler {
 }
 
 type controllerAPI struct {
-	appRepo        *AppRepo
-	releaseRepo    *ReleaseRepo
-	providerRepo   *ProviderRepo
-	formationRepo  *FormationRepo
-	artifactRepo   *ArtifactRepo
-	jobRepo        *JobRepo
-	resourceRepo   *ResourceRepo
-	deploymentRepo *DeploymentRepo
-	clusterClient  clusterClient
-	logaggc        logaggc.Client
-	routerc        routerc.Client
+	appRepo            *AppRepo
+	releaseRepo        *ReleaseRepo
+	providerRepo       *ProviderRepo
+	formationRepo      *FormationRepo
+	artifactRepo       *ArtifactRepo
+	jobRepo            *JobRepo
+	resourceRepo       *ResourceRepo
+	deploymentRepo     *DeploymentRepo
+	logDrainRepo       *LogDrainRepo
+	schedulerEventRepo *SchedulerEventRepo
+	clusterClient      clusterClient
+	logaggc            logaggc.Client
+	routerc            routerc.Client
+	blobstoreKey       []byte
 }
 
 func (c *controllerAPI) getApp(ctx context.Context) *ct.App {
@@ -76,6 +76,8 @@ func (s *S) SetUpSuite(c *C) {
 		rc:      newFakeRouter(),
 		pgxpool: pgxpool,
 		key:     authKey,
+
+		blobstoreKey: []byte(blobstoreKey),
 	}
 	handler := appHandler(s.hc)
 	s.srv = httptest.NewServer(handler)
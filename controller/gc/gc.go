@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/signedurl"
+)
+
+// slugPattern matches the blobstore paths of slugs uploaded by the receiver.
+var slugPattern = regexp.MustCompile(`^/[0-9a-f]{32}\.tgz$`)
+
+// Collector deletes slugs from the blobstore which are not referenced by any
+// artifact or release, and which are older than the retention window.
+type Collector struct {
+	// BlobstoreURL is the base URL of the blobstore, e.g.
+	// http://blobstore.discoverd
+	BlobstoreURL string
+
+	// Retention is how long unreferenced slugs are kept for. It also stops
+	// slugs which are still being built, and so are not yet referenced by
+	// a release, from being collected.
+	Retention time.Duration
+
+	// Referenced returns the URLs of files which are referenced by the
+	// controller.
+	Referenced func() ([]string, error)
+
+	// Key signs requests to the blobstore if it is set, see pkg/signedurl.
+	Key []byte
+
+	Client *http.Client
+}
+
+// Stats are the results of a collection.
+type Stats struct {
+	Deleted int
+	Kept    int
+}
+
+// Collect runs a single collection.
+func (c *Collector) Collect() (*Stats, error) {
+	log := logger.New("fn", "Collect")
+	stats := &Stats{}
+
+	base, err := url.Parse(c.BlobstoreURL)
+	if err != nil {
+		return stats, err
+	}
+	cutoff := time.Now().Add(-c.Retention)
+
+	urls, err := c.Referenced()
+	if err != nil {
+		return stats, err
+	}
+	referenced := make(map[string]struct{}, len(urls))
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil || u.Host != base.Host {
+			continue
+		}
+		referenced[u.Path] = struct{}{}
+	}
+
+	names, err := c.list()
+	if err != nil {
+		return stats, err
+	}
+	for _, name := range names {
+		if !slugPattern.MatchString(name) {
+			continue
+		}
+		if _, ok := referenced[name]; ok {
+			stats.Kept++
+			continue
+		}
+		mtime, err := c.modTime(name)
+		if err == errNotFound {
+			continue
+		} else if err != nil {
+			return stats, err
+		}
+		if mtime.After(cutoff) {
+			stats.Kept++
+			continue
+		}
+		log.Info("deleting slug", "name", name, "modified", mtime)
+		if err := c.do("DELETE", name); err != nil && err != errNotFound {
+			return stats, err
+		}
+		stats.Deleted++
+	}
+	return stats, nil
+}
+
+var errNotFound = errors.New("not found")
+
+// list returns the names of all files in the blobstore.
+func (c *Collector) list() ([]string, error) {
+	u, err := c.url("GET", "/")
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client().Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d listing blobstore files", res.StatusCode)
+	}
+	var names []string
+	return names, json.NewDecoder(res.Body).Decode(&names)
+}
+
+func (c *Collector) modTime(name string) (time.Time, error) {
+	u, err := c.url("HEAD", name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	res, err := c.client().Head(u)
+	if err != nil {
+		return time.Time{}, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return time.Time{}, errNotFound
+	default:
+		return time.Time{}, fmt.Errorf("unexpected status %d requesting %s", res.StatusCode, name)
+	}
+	return http.ParseTime(res.Header.Get("Last-Modified"))
+}
+
+func (c *Collector) do(method, name string) error {
+	u, err := c.url(method, name)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client().Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errNotFound
+	default:
+		return fmt.Errorf("unexpected status %d for %s %s", res.StatusCode, method, name)
+	}
+}
+
+// url returns the URL of the named file, signed for method if Key is set.
+func (c *Collector) url(method, name string) (string, error) {
+	u := strings.TrimSuffix(c.BlobstoreURL, "/") + name
+	if len(c.Key) == 0 {
+		return u, nil
+	}
+	return signedurl.Sign(c.Key, u, []string{method}, time.Now().Add(time.Minute))
+}
+
+func (c *Collector) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+// referencedURLs returns the URIs of all artifacts and the slug URLs of all
+// releases which have not been deleted. Releases which are no longer in use
+// are still referenced, as apps can be rolled back to them.
+func referencedURLs(db *postgres.DB) ([]string, error) {
+	var urls []string
+
+	rows, err := db.Query("SELECT uri FROM artifacts WHERE deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		urls = append(urls, uri)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT data FROM releases WHERE deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var release ct.Release
+		if err := json.Unmarshal(data, &release); err != nil {
+			return nil, err
+		}
+		urls = append(urls, releaseSlugURLs(&release)...)
+	}
+	return urls, rows.Err()
+}
+
+// releaseSlugURLs returns the SLUG_URL values of a release, which may be set
+// for the release as a whole or for individual process types.
+func releaseSlugURLs(release *ct.Release) []string {
+	var urls []string
+	if u, ok := release.Env["SLUG_URL"]; ok {
+		urls = append(urls, u)
+	}
+	for _, proc := range release.Processes {
+		if u, ok := proc.Env["SLUG_URL"]; ok {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
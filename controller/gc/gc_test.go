@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/signedurl"
+	pgtestutils "github.com/flynn/flynn/pkg/testutils/postgres"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type GCSuite struct{}
+
+var _ = Suite(&GCSuite{})
+
+// blobstore is an in-memory blobstore which only stores modification times,
+// and requires requests to be signed with key.
+type blobstore struct {
+	mtx   sync.Mutex
+	files map[string]time.Time
+	key   []byte
+}
+
+func (b *blobstore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := signedurl.Verify(b.key, req, time.Now()); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if req.URL.Path == "/" {
+		names := make([]string, 0, len(b.files))
+		for name := range b.files {
+			names = append(names, name)
+		}
+		json.NewEncoder(w).Encode(names)
+		return
+	}
+	mtime, ok := b.files[req.URL.Path]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.Method {
+	case "HEAD":
+		w.Header().Set("Last-Modified", mtime.UTC().Format(http.TimeFormat))
+	case "DELETE":
+		delete(b.files, req.URL.Path)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (GCSuite) TestCollect(c *C) {
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	b := &blobstore{files: map[string]time.Time{
+		"/0123456789abcdef0123456789abcdef.tgz":          old,    // referenced by a release
+		"/1123456789abcdef0123456789abcdef.tgz":          old,    // referenced by an artifact
+		"/2123456789abcdef0123456789abcdef.tgz":          old,    // unreferenced
+		"/3123456789abcdef0123456789abcdef.tgz":          recent, // unreferenced but within retention
+		"/0123456789abcdef0123456789abcdef-cache.tgz":    old,
+		"/postgres-backups/wal/000000010000000000000001": old,
+	}, key: []byte("secret")}
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	collector := &Collector{
+		BlobstoreURL: srv.URL,
+		Retention:    24 * time.Hour,
+		Key:          b.key,
+		Referenced: func() ([]string, error) {
+			return []string{
+				srv.URL + "/0123456789abcdef0123456789abcdef.tgz",
+				srv.URL + "/1123456789abcdef0123456789abcdef.tgz",
+				// a slug with the same path in another blobstore
+				"http://example.com/2123456789abcdef0123456789abcdef.tgz",
+			}, nil
+		},
+	}
+	stats, err := collector.Collect()
+	c.Assert(err, IsNil)
+	c.Assert(stats, DeepEquals, &Stats{Deleted: 1, Kept: 3})
+
+	names := make([]string, 0, len(b.files))
+	for name := range b.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, []string{
+		"/0123456789abcdef0123456789abcdef-cache.tgz",
+		"/0123456789abcdef0123456789abcdef.tgz",
+		"/1123456789abcdef0123456789abcdef.tgz",
+		"/3123456789abcdef0123456789abcdef.tgz",
+		"/postgres-backups/wal/000000010000000000000001",
+	})
+}
+
+func (GCSuite) TestReleaseSlugURLs(c *C) {
+	release := &ct.Release{
+		Env: map[string]string{"SLUG_URL": "http://blobstore.discoverd/a.tgz"},
+		Processes: map[string]ct.ProcessType{
+			"web":    {Env: map[string]string{"SLUG_URL": "http://blobstore.discoverd/b.tgz"}},
+			"worker": {},
+		},
+	}
+	urls := releaseSlugURLs(release)
+	sort.Strings(urls)
+	c.Assert(urls, DeepEquals, []string{"http://blobstore.discoverd/a.tgz", "http://blobstore.discoverd/b.tgz"})
+}
+
+type ReferencedSuite struct {
+	db *postgres.DB
+}
+
+var _ = Suite(&ReferencedSuite{})
+
+func (s *ReferencedSuite) SetUpSuite(c *C) {
+	dbname := "gctest"
+	if err := pgtestutils.SetupPostgres(dbname); err != nil {
+		c.Fatal(err)
+	}
+	dsn := fmt.Sprintf("dbname=%s", dbname)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		c.Fatal(err)
+	}
+	s.db = postgres.New(db, dsn)
+
+	// the columns of the controller's tables which are queried
+	for _, q := range []string{
+		"CREATE TABLE artifacts (uri text NOT NULL, deleted_at timestamptz)",
+		"CREATE TABLE releases (data text NOT NULL, created_at timestamptz NOT NULL DEFAULT now(), deleted_at timestamptz)",
+	} {
+		if err := s.db.Exec(q); err != nil {
+			c.Fatal(err)
+		}
+	}
+}
+
+func (s *ReferencedSuite) TearDownSuite(c *C) {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+func (s *ReferencedSuite) TestReferencedURLs(c *C) {
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	addRelease := func(slugURL string, createdAt time.Time, deletedAt *time.Time) {
+		data, err := json.Marshal(&ct.Release{Env: map[string]string{"SLUG_URL": slugURL}})
+		c.Assert(err, IsNil)
+		c.Assert(s.db.Exec("INSERT INTO releases (data, created_at, deleted_at) VALUES ($1, $2, $3)", string(data), createdAt, deletedAt), IsNil)
+	}
+	c.Assert(s.db.Exec("INSERT INTO artifacts (uri) VALUES ($1)", "http://blobstore.discoverd/artifact.tgz"), IsNil)
+	c.Assert(s.db.Exec("INSERT INTO artifacts (uri, deleted_at) VALUES ($1, now())", "http://blobstore.discoverd/deleted-artifact.tgz"), IsNil)
+	addRelease("http://blobstore.discoverd/current.tgz", time.Now(), nil)
+	// an old release which is not in use by any app can still be rolled back to
+	addRelease("http://blobstore.discoverd/old.tgz", old, nil)
+	addRelease("http://blobstore.discoverd/deleted.tgz", old, &old)
+
+	urls, err := referencedURLs(s.db)
+	c.Assert(err, IsNil)
+	sort.Strings(urls)
+	c.Assert(urls, DeepEquals, []string{
+		"http://blobstore.discoverd/artifact.tgz",
+		"http://blobstore.discoverd/current.tgz",
+		"http://blobstore.discoverd/old.tgz",
+	})
+}
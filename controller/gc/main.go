@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/shutdown"
+)
+
+var logger = log15.New("app", "gc")
+
+// The collector is configured by the environment:
+//
+//	BLOBSTORE_URL   the blobstore to collect slugs from (default http://blobstore.discoverd)
+//	SLUG_RETENTION  how long to keep unreferenced slugs for (default 168h)
+//	GC_INTERVAL     how often to run a collection (default 1h)
+//
+// and signs blobstore requests with BLOBSTORE_SIGNING_KEY if it is set.
+func main() {
+	defer shutdown.Exit()
+	log := logger.New("fn", "main")
+
+	retention, err := durationEnv("SLUG_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		log.Error("error parsing SLUG_RETENTION", "err", err)
+		shutdown.Fatal(err)
+	}
+	interval, err := durationEnv("GC_INTERVAL", time.Hour)
+	if err != nil {
+		log.Error("error parsing GC_INTERVAL", "err", err)
+		shutdown.Fatal(err)
+	}
+	blobstoreURL := os.Getenv("BLOBSTORE_URL")
+	if blobstoreURL == "" {
+		blobstoreURL = "http://blobstore.discoverd"
+	}
+
+	log.Info("connecting to postgres")
+	db := postgres.Wait("", "")
+
+	c := &Collector{
+		BlobstoreURL: blobstoreURL,
+		Retention:    retention,
+		Key:          []byte(os.Getenv("BLOBSTORE_SIGNING_KEY")),
+		Referenced: func() ([]string, error) {
+			return referencedURLs(db)
+		},
+	}
+	log.Info("starting collector", "retention", retention, "interval", interval)
+	for {
+		stats, err := c.Collect()
+		if err != nil {
+			log.Error("error collecting slugs", "err", err)
+		} else {
+			log.Info("collected slugs", "deleted", stats.Deleted, "kept", stats.Kept)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/flynn/flynn/controller/schema"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/flynn/pkg/ctxhelper"
@@ -370,11 +371,12 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		respondWithError(w, err)
 		return
 	}
-	if len(hosts) == 0 {
+	h := schedutil.PickHost(hosts)
+	if h == nil {
 		respondWithError(w, errors.New("no hosts found"))
 		return
 	}
-	hostID := schedutil.PickHost(hosts).ID
+	hostID := h.ID
 
 	id := cluster.RandomJobID("")
 	app := c.getApp(ctx)
@@ -416,6 +418,10 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 	if len(newJob.Entrypoint) > 0 {
 		job.Config.Entrypoint = newJob.Entrypoint
 	}
+	if err := utils.SignJobURLs(job, c.blobstoreKey); err != nil {
+		respondWithError(w, err)
+		return
+	}
 
 	var attachClient cluster.AttachClient
 	if attach {
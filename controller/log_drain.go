@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/controller/schema"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+type LogDrainRepo struct {
+	db *postgres.DB
+}
+
+func NewLogDrainRepo(db *postgres.DB) *LogDrainRepo {
+	return &LogDrainRepo{db}
+}
+
+func (r *LogDrainRepo) Add(drain *ct.LogDrain) error {
+	if drain.ID == "" {
+		drain.ID = random.UUID()
+	}
+	err := r.db.QueryRow("INSERT INTO log_drains (drain_id, app_id, url) VALUES ($1, $2, $3) RETURNING created_at",
+		drain.ID, drain.AppID, drain.URL).Scan(&drain.CreatedAt)
+	if postgres.IsUniquenessError(err, "") {
+		return ct.ValidationError{Field: "url", Message: "drain already exists"}
+	}
+	drain.ID = postgres.CleanUUID(drain.ID)
+	return err
+}
+
+func scanLogDrain(s postgres.Scanner) (*ct.LogDrain, error) {
+	drain := &ct.LogDrain{}
+	err := s.Scan(&drain.ID, &drain.AppID, &drain.URL, &drain.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	drain.ID = postgres.CleanUUID(drain.ID)
+	drain.AppID = postgres.CleanUUID(drain.AppID)
+	return drain, err
+}
+
+func (r *LogDrainRepo) Get(appID, id string) (*ct.LogDrain, error) {
+	row := r.db.QueryRow("SELECT drain_id, app_id, url, created_at FROM log_drains WHERE app_id = $1 AND drain_id = $2 AND deleted_at IS NULL", appID, id)
+	return scanLogDrain(row)
+}
+
+func (r *LogDrainRepo) Remove(appID, id string) error {
+	return r.db.Exec("UPDATE log_drains SET deleted_at = now() WHERE app_id = $1 AND drain_id = $2 AND deleted_at IS NULL", appID, id)
+}
+
+func (r *LogDrainRepo) AppList(appID string) ([]*ct.LogDrain, error) {
+	rows, err := r.db.Query("SELECT drain_id, app_id, url, created_at FROM log_drains WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
+	if err != nil {
+		return nil, err
+	}
+	return logDrainList(rows)
+}
+
+func (r *LogDrainRepo) List() ([]*ct.LogDrain, error) {
+	rows, err := r.db.Query("SELECT drain_id, app_id, url, created_at FROM log_drains WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	return logDrainList(rows)
+}
+
+func logDrainList(rows *sql.Rows) ([]*ct.LogDrain, error) {
+	drains := []*ct.LogDrain{}
+	for rows.Next() {
+		drain, err := scanLogDrain(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		drains = append(drains, drain)
+	}
+	return drains, rows.Err()
+}
+
+func (c *controllerAPI) CreateLogDrain(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var drain ct.LogDrain
+	if err := httphelper.DecodeJSON(req, &drain); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	drain.ID = ""
+	drain.AppID = c.getApp(ctx).ID
+	drain.Stats = nil
+
+	if err := schema.Validate(drain); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	if err := c.logDrainRepo.Add(&drain); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &drain)
+}
+
+func (c *controllerAPI) GetLogDrain(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	drain, err := c.logDrainRepo.Get(c.getApp(ctx).ID, params.ByName("drains_id"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	c.addLogDrainStats([]*ct.LogDrain{drain})
+	httphelper.JSON(w, 200, drain)
+}
+
+func (c *controllerAPI) ListLogDrains(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	drains, err := c.logDrainRepo.AppList(c.getApp(ctx).ID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	c.addLogDrainStats(drains)
+	httphelper.JSON(w, 200, drains)
+}
+
+// ListAllLogDrains lists the drains of every app, which is what the log
+// aggregator polls to learn where to forward logs.
+func (c *controllerAPI) ListAllLogDrains(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	drains, err := c.logDrainRepo.List()
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, drains)
+}
+
+func (c *controllerAPI) DeleteLogDrain(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	appID := c.getApp(ctx).ID
+	id := params.ByName("drains_id")
+	if _, err := c.logDrainRepo.Get(appID, id); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := c.logDrainRepo.Remove(appID, id); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// addLogDrainStats fills in the delivery stats the log aggregator reports for
+// the given drains. Stats are informational, so they are simply left out if
+// the log aggregator can't be reached.
+func (c *controllerAPI) addLogDrainStats(drains []*ct.LogDrain) {
+	if len(drains) == 0 {
+		return
+	}
+	running, err := c.logaggc.ListDrains()
+	if err != nil {
+		return
+	}
+	stats := make(map[string]*ct.LogDrainStats, len(running))
+	for _, d := range running {
+		stats[d.ID] = d.Stats
+	}
+	for _, drain := range drains {
+		drain.Stats = stats[drain.ID]
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestLogDrains(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "log-drains-test"})
+
+	// invalid URLs are rejected
+	err := s.c.CreateLogDrain(app.ID, &ct.LogDrain{URL: "ftp://logs.example.com"})
+	c.Assert(err, NotNil)
+
+	drain := &ct.LogDrain{URL: "syslog+tls://logs.example.com:6514"}
+	c.Assert(s.c.CreateLogDrain(app.ID, drain), IsNil)
+	c.Assert(drain.ID, Not(Equals), "")
+	c.Assert(drain.AppID, Equals, app.ID)
+	c.Assert(drain.CreatedAt, NotNil)
+
+	// the same URL can't be added twice
+	c.Assert(s.c.CreateLogDrain(app.ID, &ct.LogDrain{URL: drain.URL}), NotNil)
+
+	// stats reported by the log aggregator are included
+	s.flac.drains = []*ct.LogDrain{{ID: drain.ID, AppID: app.ID, URL: drain.URL, Stats: &ct.LogDrainStats{Delivered: 10, Dropped: 2}}}
+	defer func() { s.flac.drains = nil }()
+
+	list, err := s.c.LogDrainList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, drain.ID)
+	c.Assert(list[0].Stats, NotNil)
+	c.Assert(list[0].Stats.Delivered, Equals, uint64(10))
+	c.Assert(list[0].Stats.Dropped, Equals, uint64(2))
+
+	got, err := s.c.GetLogDrain(app.ID, drain.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.URL, Equals, drain.URL)
+
+	all, err := s.c.AllLogDrainList()
+	c.Assert(err, IsNil)
+	var found bool
+	for _, d := range all {
+		if d.ID == drain.ID {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	c.Assert(s.c.DeleteLogDrain(app.ID, drain.ID), IsNil)
+	list, err = s.c.LogDrainList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+	c.Assert(s.c.DeleteLogDrain(app.ID, drain.ID), NotNil)
+}
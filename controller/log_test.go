@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,6 +21,7 @@ import (
 
 var sampleMessages = []logaggc.Message{
 	{
+		ID:          "1",
 		HostID:      "server1.flynn.local",
 		JobID:       "00000000000000000000000000000000",
 		Msg:         "a log message from a job with an empty type",
@@ -29,6 +31,7 @@ var sampleMessages = []logaggc.Message{
 		Timestamp:   time.Unix(1425688100, 000000000).UTC(),
 	},
 	{
+		ID:          "2",
 		HostID:      "server1.flynn.local",
 		JobID:       "11111111111111111111111111111111",
 		Msg:         "a stdout log message",
@@ -38,6 +41,7 @@ var sampleMessages = []logaggc.Message{
 		Timestamp:   time.Unix(1425688201, 111111111).UTC(),
 	},
 	{
+		ID:          "3",
 		HostID:      "server2.flynn.local",
 		JobID:       "22222222222222222222222222222222",
 		Msg:         "a stderr log message",
@@ -56,8 +60,9 @@ func newFakeLogAggregatorClient() *fakeLogAggregatorClient {
 }
 
 type fakeLogAggregatorClient struct {
-	logs map[string][]logaggc.Message
-	subs map[string]<-chan *logaggc.Message
+	logs   map[string][]logaggc.Message
+	subs   map[string]<-chan *logaggc.Message
+	drains []*ct.LogDrain
 }
 
 func (f *fakeLogAggregatorClient) GetLog(channelID string, options *logaggc.LogOpts) (io.ReadCloser, error) {
@@ -70,9 +75,10 @@ func (f *fakeLogAggregatorClient) GetLog(channelID string, options *logaggc.LogO
 	follow := false
 	jobID, processType := "", ""
 	filterProcType := false
+	var opts logaggc.LogOpts
 
 	if options != nil {
-		opts := *options
+		opts = *options
 		if opts.Lines != nil && *opts.Lines >= 0 {
 			lines = *opts.Lines
 		}
@@ -99,7 +105,32 @@ func (f *fakeLogAggregatorClient) GetLog(channelID string, options *logaggc.LogO
 			if filterProcType && processType != buf[i].ProcessType {
 				continue
 			}
-			if err := enc.Encode(buf[i]); err != nil {
+			if opts.HostID != "" && opts.HostID != buf[i].HostID {
+				continue
+			}
+			if opts.Stream != "" && opts.Stream != buf[i].Stream {
+				continue
+			}
+			if opts.Since != nil && buf[i].Timestamp.Before(*opts.Since) {
+				continue
+			}
+			if opts.Until != nil && buf[i].Timestamp.After(*opts.Until) {
+				continue
+			}
+			if opts.Search != "" && !strings.Contains(buf[i].Msg, opts.Search) {
+				continue
+			}
+			if opts.After != "" && !idAfter(buf[i].ID, opts.After) {
+				continue
+			}
+			if !fieldsMatch(buf[i].Fields, opts.FieldFilters) {
+				continue
+			}
+			msg := buf[i]
+			if !opts.ParseFields {
+				msg.Fields = nil
+			}
+			if err := enc.Encode(msg); err != nil {
 				pw.CloseWithError(err)
 				return
 			}
@@ -116,10 +147,33 @@ func (f *fakeLogAggregatorClient) GetLog(channelID string, options *logaggc.LogO
 	return pr, nil
 }
 
+// idAfter reports whether the message ID id follows the message ID after.
+func idAfter(id, after string) bool {
+	i, _ := strconv.ParseUint(id, 10, 64)
+	a, _ := strconv.ParseUint(after, 10, 64)
+	return i > a
+}
+
+// fieldsMatch reports whether fields has all the values in filters.
+func fieldsMatch(fields, filters map[string]string) bool {
+	for k, v := range filters {
+		if value, ok := fields[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeLogAggregatorClient) ListDrains() ([]*ct.LogDrain, error) {
+	return f.drains, nil
+}
+
 func strPtr(s string) *string { return &s }
 
 func intPtr(i int) *int { return &i }
 
+func timePtr(t time.Time) *time.Time { return &t }
+
 func (s *S) TestGetAppLog(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "get-app-log-test"})
 
@@ -146,6 +200,26 @@ func (s *S) TestGetAppLog(c *C) {
 			opts:     &ct.LogOpts{JobID: "11111111111111111111111111111111"},
 			expected: sampleMessages[1:2],
 		},
+		{
+			opts:     &ct.LogOpts{HostID: "server1.flynn.local"},
+			expected: sampleMessages[:2],
+		},
+		{
+			opts:     &ct.LogOpts{Stream: "stderr"},
+			expected: sampleMessages[2:],
+		},
+		{
+			opts:     &ct.LogOpts{Since: timePtr(time.Unix(1425688201, 0)), Until: timePtr(time.Unix(1425688300, 0))},
+			expected: sampleMessages[1:2],
+		},
+		{
+			opts:     &ct.LogOpts{Search: "stderr"},
+			expected: sampleMessages[2:],
+		},
+		{
+			opts:     &ct.LogOpts{After: "1"},
+			expected: sampleMessages[1:],
+		},
 	}
 
 	for _, test := range tests {
@@ -181,6 +255,45 @@ func (s *S) TestGetAppLog(c *C) {
 	}
 }
 
+func (s *S) TestGetAppLogFields(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "get-app-log-fields-test"})
+	msgs := []logaggc.Message{
+		{ID: "1", Msg: `{"level":"error","msg":"failed"}`, Fields: map[string]string{"level": "error", "msg": "failed"}},
+		{ID: "2", Msg: "level=info msg=started", Fields: map[string]string{"level": "info", "msg": "started"}},
+		{ID: "3", Msg: "plain text"},
+	}
+	s.flac.logs[app.ID] = msgs
+	defer delete(s.flac.logs, app.ID)
+
+	readMessages := func(opts *ct.LogOpts) []logaggc.Message {
+		rc, err := s.c.GetAppLog(app.Name, opts)
+		c.Assert(err, IsNil)
+		defer rc.Close()
+		var res []logaggc.Message
+		dec := json.NewDecoder(rc)
+		for {
+			var msg logaggc.Message
+			if err := dec.Decode(&msg); err == io.EOF {
+				return res
+			} else {
+				c.Assert(err, IsNil)
+			}
+			res = append(res, msg)
+		}
+	}
+
+	res := readMessages(&ct.LogOpts{ParseFields: true})
+	c.Assert(res, DeepEquals, msgs)
+
+	res = readMessages(&ct.LogOpts{FieldFilters: map[string]string{"level": "error"}})
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].Msg, Equals, msgs[0].Msg)
+	c.Assert(res[0].Fields, IsNil)
+
+	_, err := s.c.GetAppLog(app.Name, &ct.LogOpts{FieldFilters: map[string]string{"": "error"}})
+	c.Assert(err, NotNil)
+}
+
 func (s *S) TestGetAppLogFollow(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "get-app-log-follow-test"})
 
@@ -261,17 +374,44 @@ func (s *S) TestGetAppLogSSE(c *C) {
 	res.Body.Close()
 	c.Assert(err, IsNil)
 
-	expected := `data: {"event":"message","data":{"host_id":"server1.flynn.local","job_id":"00000000000000000000000000000000","msg":"a log message from a job with an empty type","source":"app","stream":"stdout","timestamp":"2015-03-07T00:28:20Z"}}` +
+	expected := "id: 1\n" + `data: {"event":"message","data":{"id":"1","host_id":"server1.flynn.local","job_id":"00000000000000000000000000000000","msg":"a log message from a job with an empty type","source":"app","stream":"stdout","timestamp":"2015-03-07T00:28:20Z"}}` +
 		"\n\n" +
-		`data: {"event":"message","data":{"host_id":"server1.flynn.local","job_id":"11111111111111111111111111111111","msg":"a stdout log message","process_type":"web","source":"app","stream":"stdout","timestamp":"2015-03-07T00:30:01.111111111Z"}}` +
+		"id: 2\n" + `data: {"event":"message","data":{"id":"2","host_id":"server1.flynn.local","job_id":"11111111111111111111111111111111","msg":"a stdout log message","process_type":"web","source":"app","stream":"stdout","timestamp":"2015-03-07T00:30:01.111111111Z"}}` +
 		"\n\n" +
-		`data: {"event":"message","data":{"host_id":"server2.flynn.local","job_id":"22222222222222222222222222222222","msg":"a stderr log message","process_type":"worker","source":"app","stream":"stderr","timestamp":"2015-03-07T00:35:21.222222222Z"}}` +
+		"id: 3\n" + `data: {"event":"message","data":{"id":"3","host_id":"server2.flynn.local","job_id":"22222222222222222222222222222222","msg":"a stderr log message","process_type":"worker","source":"app","stream":"stderr","timestamp":"2015-03-07T00:35:21.222222222Z"}}` +
 		"\n\n" +
 		`data: {"event":"eof"}` + "\n\n"
 
 	c.Assert(buf.String(), Equals, expected)
 }
 
+func (s *S) TestGetAppLogSSELastEventID(c *C) {
+	appName := "get-app-log-sse-last-event-id-test"
+	s.createTestApp(c, &ct.App{Name: appName})
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/log", s.srv.URL, appName), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "2")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+
+	expected := "id: 3\n" + `data: {"event":"message","data":{"id":"3","host_id":"server2.flynn.local","job_id":"22222222222222222222222222222222","msg":"a stderr log message","process_type":"worker","source":"app","stream":"stderr","timestamp":"2015-03-07T00:35:21.222222222Z"}}` +
+		"\n\n" +
+		`data: {"event":"eof"}` + "\n\n"
+	c.Assert(buf.String(), Equals, expected)
+
+	// invalid cursors are rejected
+	_, err = s.c.GetAppLog(appName, &ct.LogOpts{After: "abc"})
+	c.Assert(err, NotNil)
+}
+
 func (s *S) TestGetAppLogSSEFollow(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "get-app-log-sse-follow-test"})
 
@@ -317,11 +457,11 @@ func (s *S) TestGetAppLogSSEFollow(c *C) {
 		}
 	}()
 
-	expected := `data: {"event":"message","data":{"host_id":"server1.flynn.local","job_id":"00000000000000000000000000000000","msg":"a log message from a job with an empty type","source":"app","stream":"stdout","timestamp":"2015-03-07T00:28:20Z"}}` +
+	expected := "id: 1\n" + `data: {"event":"message","data":{"id":"1","host_id":"server1.flynn.local","job_id":"00000000000000000000000000000000","msg":"a log message from a job with an empty type","source":"app","stream":"stdout","timestamp":"2015-03-07T00:28:20Z"}}` +
 		"\n\n" +
-		`data: {"event":"message","data":{"host_id":"server1.flynn.local","job_id":"11111111111111111111111111111111","msg":"a stdout log message","process_type":"web","source":"app","stream":"stdout","timestamp":"2015-03-07T00:30:01.111111111Z"}}` +
+		"id: 2\n" + `data: {"event":"message","data":{"id":"2","host_id":"server1.flynn.local","job_id":"11111111111111111111111111111111","msg":"a stdout log message","process_type":"web","source":"app","stream":"stdout","timestamp":"2015-03-07T00:30:01.111111111Z"}}` +
 		"\n\n" +
-		`data: {"event":"message","data":{"host_id":"server2.flynn.local","job_id":"22222222222222222222222222222222","msg":"a stderr log message","process_type":"worker","source":"app","stream":"stderr","timestamp":"2015-03-07T00:35:21.222222222Z"}}` +
+		"id: 3\n" + `data: {"event":"message","data":{"id":"3","host_id":"server2.flynn.local","job_id":"22222222222222222222222222222222","msg":"a stderr log message","process_type":"worker","source":"app","stream":"stderr","timestamp":"2015-03-07T00:35:21.222222222Z"}}` +
 		"\n\n" +
 		`data: {"event":"message","data":{"host_id":"server3.flynn.local","job_id":"33333333333333333333333333333333","msg":"another stdout log message","process_type":"web","source":"app","stream":"stdout","timestamp":"2015-03-07T00:35:33.333333333Z"}}` +
 		"\n\n" +
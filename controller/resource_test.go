@@ -93,3 +93,35 @@ func (s *S) TestResourceLists(c *C) {
 	check(s.c.AppResourceList(app1.ID))
 	check(s.c.AppResourceList(app1.ID))
 }
+
+func (s *S) TestDeleteResource(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "delete-resource"})
+
+	var deprovisioned string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.URL.Path, Equals, "/things")
+		switch req.Method {
+		case "POST":
+			w.Write([]byte(`{"id":"/things/delete-resource","env":{"foo":"baz"}}`))
+		case "DELETE":
+			deprovisioned = req.FormValue("id")
+		}
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	provider := s.createTestProvider(c, &ct.Provider{URL: fmt.Sprintf("http://%s/things", srv.Listener.Addr()), Name: "delete-resource"})
+	resource, err := s.c.ProvisionResource(&ct.ResourceReq{ProviderID: provider.ID, Apps: []string{app.ID}})
+	c.Assert(err, IsNil)
+
+	deleted, err := s.c.DeleteResource(provider.ID, resource.ID)
+	c.Assert(err, IsNil)
+	c.Assert(deleted.ID, Equals, resource.ID)
+	c.Assert(deprovisioned, Equals, "/things/delete-resource")
+
+	_, err = s.c.GetResource(provider.ID, resource.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	list, err := s.c.AppResourceList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+)
+
+type DrainSuite struct{}
+
+var _ = Suite(&DrainSuite{})
+
+// newDrainContext returns a scheduler context for a cluster of the given
+// hosts, and a formation running n web jobs on the first host.
+func newDrainContext(c *C, n int, hosts ...host.Host) (*context, *tu.FakeCluster) {
+	cluster := tu.NewFakeCluster()
+	cluster.SetHosts(make(map[string]host.Host))
+	ctx := newContext(nil, cluster)
+	for _, h := range hosts {
+		cluster.AddHost(h)
+		client := tu.NewFakeHostClient(h.ID)
+		cluster.SetHostClient(h.ID, client)
+		ctx.hosts.Add(h.ID)
+		ctx.hosts.Set(h.ID, client)
+	}
+
+	f := NewFormation(ctx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: "app"},
+		Release:   &ct.Release{ID: "release", Processes: map[string]ct.ProcessType{"web": {}}},
+		Artifact:  &ct.Artifact{},
+		Processes: map[string]int{"web": n},
+	})
+	ctx.formations.Add(f)
+	f.add(n, "web", hosts[0].ID)
+	c.Assert(ctx.jobs.ListHost(hosts[0].ID), HasLen, n)
+
+	// the host is cordoned before it is drained
+	c.Assert(cluster.UpdateHostMeta(hosts[0].ID, map[string]string{
+		host.HostMetaCordon: "true",
+		host.HostMetaDrain:  "pending",
+	}), IsNil)
+	return ctx, cluster
+}
+
+func cordonedHost(id string) host.Host {
+	return host.Host{ID: id, Metadata: map[string]string{host.HostMetaCordon: "true"}}
+}
+
+// waitFor polls until fn returns true, failing the test after a few seconds.
+func waitFor(c *C, msg string, fn func() bool) {
+	timeout := time.After(5 * time.Second)
+	for !fn() {
+		select {
+		case <-timeout:
+			c.Fatalf("timed out waiting for %s", msg)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func drainStatus(cluster *tu.FakeCluster, hostID string) string {
+	return cluster.GetHost(hostID).Metadata[host.HostMetaDrain]
+}
+
+func (DrainSuite) TestDrainHost(c *C) {
+	ctx, cluster := newDrainContext(c, 2, host.Host{ID: "a"}, cordonedHost("b"), host.Host{ID: "c"})
+	ctx.leader = true
+
+	go ctx.drainHost("a")
+
+	// jobs are replaced one at a time, on the host which is not cordoned
+	for i := 0; i < 2; i++ {
+		var replacement *Job
+		waitFor(c, "replacement job", func() bool {
+			jobs := ctx.jobs.ListHost("c")
+			if len(jobs) == i+1 {
+				for _, j := range jobs {
+					select {
+					case <-j.up:
+					default:
+						replacement = j
+					}
+				}
+			}
+			return replacement != nil
+		})
+		c.Assert(ctx.jobs.ListHost("b"), HasLen, 0)
+
+		// the original is only stopped once the replacement is up
+		time.Sleep(50 * time.Millisecond)
+		c.Assert(cluster.GetHost("a").Jobs, HasLen, 2-i)
+		c.Assert(ctx.jobs.ListHost("c"), HasLen, i+1)
+		replacement.setUp()
+		waitFor(c, "original job to stop", func() bool {
+			return len(cluster.GetHost("a").Jobs) == 1-i
+		})
+	}
+
+	waitFor(c, "drain to finish", func() bool { return drainStatus(cluster, "a") == "done" })
+	c.Assert(ctx.jobs.ListHost("a"), HasLen, 0)
+	c.Assert(cluster.GetHost("c").Jobs, HasLen, 2)
+	c.Assert(cluster.GetHost("b").Jobs, HasLen, 0)
+}
+
+func (DrainSuite) TestDrainFailsWithoutSchedulableHosts(c *C) {
+	ctx, cluster := newDrainContext(c, 1, host.Host{ID: "a"}, cordonedHost("b"))
+	ctx.leader = true
+
+	ctx.drainHost("a")
+	c.Assert(drainStatus(cluster, "a"), Equals, "failed")
+
+	// the job is kept, and still tracked by the formation
+	c.Assert(cluster.GetHost("a").Jobs, HasLen, 1)
+	jobs := ctx.jobs.ListHost("a")
+	c.Assert(jobs, HasLen, 1)
+	c.Assert(jobs[0].Formation.jobs["web"], HasLen, 1)
+}
+
+func (DrainSuite) TestResumeDrains(c *C) {
+	ctx, cluster := newDrainContext(c, 1, host.Host{ID: "a"}, host.Host{ID: "b"})
+
+	// drains requested before the scheduler is the leader are not started
+	ctx.drainHost("a")
+	c.Assert(drainStatus(cluster, "a"), Equals, "pending")
+	c.Assert(ctx.jobs.ListHost("b"), HasLen, 0)
+
+	// becoming the leader resumes the pending drain
+	ctx.resumeDrains()
+	waitFor(c, "replacement job", func() bool { return len(ctx.jobs.ListHost("b")) == 1 })
+	ctx.jobs.ListHost("b")[0].setUp()
+	waitFor(c, "drain to finish", func() bool { return drainStatus(cluster, "a") == "done" })
+	c.Assert(cluster.GetHost("a").Jobs, HasLen, 0)
+	c.Assert(cluster.GetHost("b").Jobs, HasLen, 1)
+}
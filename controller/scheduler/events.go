@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+const (
+	EventTypeConstraintViolation = ct.SchedulerEventConstraintViolation
+	EventTypeAffinityViolation   = ct.SchedulerEventAffinityViolation
+)
+
+// Event is emitted by the scheduler when a placement decision could not honor
+// the rules of a process type.
+type Event struct {
+	Type      string
+	AppID     string
+	ReleaseID string
+	JobType   string
+	HostID    string
+	Message   string
+}
+
+// Subscribe returns a channel which receives scheduler events until
+// Unsubscribe is called. Events are dropped rather than blocking the
+// scheduler if the channel is not read from.
+func (c *context) Subscribe() chan *Event {
+	ch := make(chan *Event, 100)
+	c.eventMtx.Lock()
+	c.eventListeners[ch] = struct{}{}
+	c.eventMtx.Unlock()
+	return ch
+}
+
+func (c *context) Unsubscribe(ch chan *Event) {
+	c.eventMtx.Lock()
+	delete(c.eventListeners, ch)
+	c.eventMtx.Unlock()
+}
+
+func (c *context) sendEvent(e *Event) {
+	grohl.Log(grohl.Data{
+		"fn":         "sendEvent",
+		"event":      e.Type,
+		"app.id":     e.AppID,
+		"release.id": e.ReleaseID,
+		"type":       e.JobType,
+		"host.id":    e.HostID,
+		"message":    e.Message,
+	})
+	c.eventMtx.RLock()
+	defer c.eventMtx.RUnlock()
+	for ch := range c.eventListeners {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// reportEvents reports the events received on ch to the controller, which
+// records them so that operators can list them with the controller API.
+func (c *context) reportEvents(ch chan *Event) {
+	for e := range ch {
+		err := c.CreateSchedulerEvent(e.AppID, &ct.SchedulerEvent{
+			ReleaseID:   e.ReleaseID,
+			ProcessType: e.JobType,
+			HostID:      e.HostID,
+			Type:        e.Type,
+			Message:     e.Message,
+		})
+		if err != nil {
+			grohl.Log(grohl.Data{"fn": "reportEvents", "at": "error", "event": e.Type, "app.id": e.AppID, "err": err})
+		}
+	}
+}
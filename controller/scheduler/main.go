@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"sort"
 	"strings"
@@ -23,6 +24,9 @@ import (
 
 var backoffPeriod = 10 * time.Minute
 
+// blobstoreKey signs the blobstore URLs given to jobs, see utils.SignJobURLs
+var blobstoreKey = []byte(os.Getenv("BLOBSTORE_SIGNING_KEY"))
+
 func main() {
 	defer shutdown.Exit()
 
@@ -47,6 +51,7 @@ func main() {
 		shutdown.Fatal(err)
 	}
 	c := newContext(cc, cl)
+	go c.reportEvents(c.Subscribe())
 
 	c.watchHosts()
 
@@ -88,6 +93,8 @@ func newContext(cc controllerClient, cl clusterClient) *context {
 		hosts:            newHostClients(),
 		jobs:             newJobMap(),
 		omni:             make(map[*Formation]struct{}),
+		draining:         make(map[string]struct{}),
+		eventListeners:   make(map[chan *Event]struct{}),
 	}
 }
 
@@ -101,6 +108,15 @@ type context struct {
 	hosts *hostClients
 	jobs  *jobMap
 	mtx   sync.RWMutex
+
+	// draining is the set of hosts currently being drained, drains are
+	// only performed once leader is set.
+	draining map[string]struct{}
+	leader   bool
+	drainMtx sync.Mutex
+
+	eventListeners map[chan *Event]struct{}
+	eventMtx       sync.RWMutex
 }
 
 type clusterClient interface {
@@ -108,6 +124,7 @@ type clusterClient interface {
 	AddJobs(jobs map[string][]*host.Job) (map[string]host.Host, error)
 	DialHost(id string) (cluster.Host, error)
 	StreamHostEvents(ch chan<- *host.HostEvent) (stream.Stream, error)
+	UpdateHostMeta(hostID string, meta map[string]string) error
 }
 
 type controllerClient interface {
@@ -116,6 +133,7 @@ type controllerClient interface {
 	GetFormation(appID, releaseID string) (*ct.Formation, error)
 	StreamFormations(since *time.Time, output chan<- *ct.ExpandedFormation) (stream.Stream, error)
 	PutJob(job *ct.Job) error
+	CreateSchedulerEvent(appID string, event *ct.SchedulerEvent) error
 }
 
 func jobMetaFromMetadata(metadata map[string]string) map[string]string {
@@ -221,6 +239,7 @@ func (c *context) watchFormations() {
 	g := grohl.NewContext(grohl.Data{"fn": "watchFormations"})
 
 	c.syncCluster()
+	c.resumeDrains()
 
 	var attempts int
 	var lastUpdatedAt time.Time
@@ -284,6 +303,10 @@ func (c *context) watchHosts() {
 		ch := make(chan *host.HostEvent)
 		c.StreamHostEvents(ch)
 		for event := range ch {
+			if event.Event == "drain" {
+				go c.drainHost(event.HostID)
+				continue
+			}
 			if event.Event != "add" {
 				continue
 			}
@@ -419,6 +442,9 @@ func (c *context) watchHost(id string, ready chan struct{}) {
 			continue
 		}
 		j.startedAt = event.Job.StartedAt
+		if event.Job.Status == host.StatusRunning {
+			j.setUp()
+		}
 
 		if event.Event != "error" && event.Event != "stop" {
 			continue
@@ -435,6 +461,69 @@ func (c *context) watchHost(id string, ready chan struct{}) {
 	// TODO: check error/reconnect
 }
 
+// drainTimeout is how long a drain waits for each replacement job to come
+// up before giving up.
+var drainTimeout = 5 * time.Minute
+
+// resumeDrains marks the scheduler as the leader and drains any hosts which
+// had a drain requested before this scheduler became the leader.
+func (c *context) resumeDrains() {
+	c.drainMtx.Lock()
+	c.leader = true
+	c.drainMtx.Unlock()
+
+	hosts, err := c.ListHosts()
+	if err != nil {
+		grohl.Log(grohl.Data{"fn": "resumeDrains", "at": "error", "err": err})
+		return
+	}
+	for _, h := range hosts {
+		if h.Metadata[host.HostMetaDrain] == "pending" {
+			go c.drainHost(h.ID)
+		}
+	}
+}
+
+// drainHost moves the non-omni jobs on the given host to other hosts one at a
+// time, waiting for each replacement to come up before stopping the original.
+// The host is expected to already be cordoned so that replacements are not
+// placed back on it.
+func (c *context) drainHost(hostID string) {
+	c.drainMtx.Lock()
+	if _, ok := c.draining[hostID]; ok || !c.leader {
+		c.drainMtx.Unlock()
+		return
+	}
+	c.draining[hostID] = struct{}{}
+	c.drainMtx.Unlock()
+	defer func() {
+		c.drainMtx.Lock()
+		delete(c.draining, hostID)
+		c.drainMtx.Unlock()
+	}()
+
+	g := grohl.NewContext(grohl.Data{"fn": "drainHost", "host.id": hostID})
+	g.Log(grohl.Data{"at": "start"})
+
+	status := "done"
+	for _, job := range c.jobs.ListHost(hostID) {
+		// one-off jobs are left to finish, omni jobs belong on every host
+		if job.Type == "" || job.Formation.Release.Processes[job.Type].Omni {
+			continue
+		}
+		if err := job.Formation.replace(job); err != nil {
+			g.Log(grohl.Data{"at": "error", "job.id": job.ID, "err": err.Error()})
+			status = "failed"
+			break
+		}
+	}
+
+	if err := c.UpdateHostMeta(hostID, map[string]string{host.HostMetaDrain: status}); err != nil {
+		g.Log(grohl.Data{"at": "update_meta_error", "err": err.Error()})
+	}
+	g.Log(grohl.Data{"at": status})
+}
+
 func newHostClients() *hostClients {
 	return &hostClients{hosts: make(map[string]cluster.Host)}
 }
@@ -499,6 +588,18 @@ func (m *jobMap) Get(host, job string) *Job {
 	return m.jobs[jobKey{host, job}]
 }
 
+func (m *jobMap) ListHost(hostID string) []*Job {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var jobs []*Job
+	for k, job := range m.jobs {
+		if k.hostID == hostID {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
 func (m *jobMap) Len() int {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -572,6 +673,14 @@ type Job struct {
 	timer     *time.Timer
 	timerMtx  sync.Mutex
 	startedAt time.Time
+
+	// up is closed once the job is first seen running
+	up     chan struct{}
+	upOnce sync.Once
+}
+
+func (j *Job) setUp() {
+	j.upOnce.Do(func() { close(j.up) })
 }
 
 type jobTypeMap map[string]map[jobKey]*Job
@@ -582,7 +691,7 @@ func (m jobTypeMap) Add(typ, host, id string) *Job {
 		jobs = make(map[jobKey]*Job)
 		m[typ] = jobs
 	}
-	job := &Job{ID: id, HostID: host, Type: typ}
+	job := &Job{ID: id, HostID: host, Type: typ, up: make(chan struct{})}
 	jobs[jobKey{host, id}] = job
 	return job
 }
@@ -687,6 +796,9 @@ func (f *Formation) rectify() {
 			// get job counts per host
 			hostCounts := make(map[string]int, len(hosts))
 			for _, h := range hosts {
+				if !matchConstraints(f.Release.Processes[t].Constraints, h) {
+					continue
+				}
 				hostCounts[h.ID] = 0
 				for _, job := range h.Jobs {
 					if f.jobType(job) != t {
@@ -762,6 +874,58 @@ func (f *Formation) restart(stoppedJob *Job) error {
 	return nil
 }
 
+// replace starts a copy of job on another host and stops job once the copy is
+// up. The job is untracked whilst the replacement starts so that a concurrent
+// rectify does not consider the formation to be over scaled.
+func (f *Formation) replace(job *Job) error {
+	g := grohl.NewContext(grohl.Data{"fn": "replace", "app.id": f.AppID, "release.id": f.Release.ID})
+
+	f.mtx.Lock()
+	if f.jobs.Get(job.Type, job.HostID, job.ID) == nil {
+		// the job has already gone
+		f.mtx.Unlock()
+		return nil
+	}
+	f.jobs.Remove(job)
+	f.c.jobs.Remove(job.HostID, job.ID)
+	newJob, err := f.start(job.Type, "")
+	if err != nil {
+		f.track(job)
+		f.mtx.Unlock()
+		return err
+	}
+	f.mtx.Unlock()
+	g.Log(grohl.Data{"at": "started", "old.host.id": job.HostID, "old.job.id": job.ID, "new.host.id": newJob.HostID, "new.job.id": newJob.ID})
+
+	select {
+	case <-newJob.up:
+	case <-time.After(drainTimeout):
+		// keep the original job, rectify will remove the excess
+		f.mtx.Lock()
+		f.track(job)
+		f.mtx.Unlock()
+		return fmt.Errorf("scheduler: timed out waiting for job %s to start", newJob.ID)
+	}
+
+	g.Log(grohl.Data{"at": "stop", "old.host.id": job.HostID, "old.job.id": job.ID})
+	h := f.c.hosts.Get(job.HostID)
+	if h == nil {
+		return nil
+	}
+	return h.StopJob(job.ID)
+}
+
+// track adds a previously untracked job back to the formation.
+func (f *Formation) track(job *Job) {
+	jobs, ok := f.jobs[job.Type]
+	if !ok {
+		jobs = make(map[jobKey]*Job)
+		f.jobs[job.Type] = jobs
+	}
+	jobs[jobKey{job.HostID, job.ID}] = job
+	f.c.jobs.Add(job)
+}
+
 func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 	hosts, err := f.c.ListHosts()
 	if err != nil {
@@ -780,22 +944,16 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 			}
 		}
 	} else {
-		sh := make(sortHosts, 0, len(hosts))
-		for _, host := range hosts {
-			var count int
-			for _, job := range h.Jobs {
-				if f.jobType(job) != typ {
-					continue
-				}
-				count++
-			}
-			sh = append(sh, sortHost{host, count})
+		h, err = f.pickHost(typ, hosts)
+		if err != nil {
+			return nil, err
 		}
-		sh.Sort()
-		h = sh[0].Host
 	}
 
 	config := f.jobConfig(typ, h.ID)
+	if err := utils.SignJobURLs(config, blobstoreKey); err != nil {
+		return nil, err
+	}
 
 	// Provision a data volume on the host if needed.
 	if f.Release.Processes[typ].Data {
@@ -860,11 +1018,16 @@ func (f *Formation) remove(n int, name string, hostID string) {
 		if hostID != "" && job.HostID != hostID { // remove from a specific host
 			continue
 		}
+		// Stop the job in a goroutine as the host waits for up to the
+		// process type's StopTimeout for the job to exit gracefully, and
+		// we don't want to hold the formation lock for that long.
 		// TODO: robust host handling
-		if err := f.c.hosts.Get(job.HostID).StopJob(job.ID); err != nil {
-			g.Log(grohl.Data{"at": "error", "err": err.Error()})
-			// TODO: handle error
-		}
+		go func(h cluster.Host, jobID string) {
+			if err := h.StopJob(jobID); err != nil {
+				g.Log(grohl.Data{"at": "error", "job.id": jobID, "err": err.Error()})
+				// TODO: handle error
+			}
+		}(f.c.hosts.Get(job.HostID), job.ID)
 		f.jobs.Remove(job)
 		if i++; i == n {
 			break
@@ -880,24 +1043,6 @@ func (f *Formation) jobConfig(name string, hostID string) *host.Job {
 	}, name, hostID)
 }
 
-type sortHost struct {
-	Host host.Host
-	Jobs int
-}
-
-type sortHosts []sortHost
-
-func (h sortHosts) Len() int      { return len(h) }
-func (h sortHosts) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
-func (h sortHosts) Sort()         { sort.Sort(h) }
-
-func (h sortHosts) Less(i, j int) bool {
-	if h[i].Jobs == h[j].Jobs {
-		return len(h[i].Host.Jobs) < len(h[j].Host.Jobs)
-	}
-	return h[i].Jobs < h[j].Jobs
-}
-
 type FormationEvent struct {
 	Formation *Formation
 }
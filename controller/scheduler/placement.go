@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+)
+
+// pickHost chooses the host for a new job of the given type. Cordoned hosts
+// and hosts which do not satisfy the process type's constraints are never
+// picked. The remaining hosts are ranked by the number of affinity rules
+// they would break, then by the number of jobs of the type they already
+// run, then by their total number of jobs.
+func (f *Formation) pickHost(typ string, hosts []host.Host) (host.Host, error) {
+	proc := f.Release.Processes[typ]
+	antiAffinity := proc.AntiAffinity
+	if proc.Spread {
+		antiAffinity = append(antiAffinity[:len(antiAffinity):len(antiAffinity)], ct.JobAffinity{Type: typ})
+	}
+
+	var schedulable int
+	sh := make(sortHosts, 0, len(hosts))
+	for _, h := range hosts {
+		if h.Cordoned() {
+			continue
+		}
+		schedulable++
+		if !matchConstraints(proc.Constraints, h) {
+			continue
+		}
+		var count int
+		for _, job := range h.Jobs {
+			if f.jobType(job) == typ {
+				count++
+			}
+		}
+		sh = append(sh, sortHost{
+			Host:       h,
+			Jobs:       count,
+			Violations: f.affinityViolations(h, proc.Affinity, antiAffinity),
+		})
+	}
+	if schedulable == 0 {
+		return host.Host{}, errors.New("scheduler: no schedulable hosts")
+	}
+	if len(sh) == 0 {
+		err := fmt.Errorf("scheduler: no host satisfies the constraints of process type %q", typ)
+		f.c.sendEvent(&Event{
+			Type:      EventTypeConstraintViolation,
+			AppID:     f.AppID,
+			ReleaseID: f.Release.ID,
+			JobType:   typ,
+			Message:   err.Error(),
+		})
+		return host.Host{}, err
+	}
+
+	sh.Sort()
+	if v := sh[0].Violations; v > 0 {
+		f.c.sendEvent(&Event{
+			Type:      EventTypeAffinityViolation,
+			AppID:     f.AppID,
+			ReleaseID: f.Release.ID,
+			JobType:   typ,
+			HostID:    sh[0].Host.ID,
+			Message:   fmt.Sprintf("placed job in violation of %d affinity rule(s)", v),
+		})
+	}
+	return sh[0].Host, nil
+}
+
+func matchConstraints(constraints []ct.HostConstraint, h host.Host) bool {
+	if len(constraints) == 0 {
+		return true
+	}
+	labels := h.Labels()
+	for _, c := range constraints {
+		if !c.Match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// affinityViolations returns the number of affinity rules with no matching job
+// on the host plus the number of anti-affinity rules with a matching job on
+// the host.
+func (f *Formation) affinityViolations(h host.Host, affinity, antiAffinity []ct.JobAffinity) int {
+	var n int
+	for _, a := range affinity {
+		if !f.hostRuns(h, a) {
+			n++
+		}
+	}
+	for _, a := range antiAffinity {
+		if f.hostRuns(h, a) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *Formation) hostRuns(h host.Host, a ct.JobAffinity) bool {
+	appID := a.AppID
+	if appID == "" {
+		appID = f.AppID
+	}
+	for _, job := range h.Jobs {
+		if job.Metadata["flynn-controller.app"] == appID && job.Metadata["flynn-controller.type"] == a.Type {
+			return true
+		}
+	}
+	return false
+}
+
+type sortHost struct {
+	Host       host.Host
+	Jobs       int
+	Violations int
+}
+
+type sortHosts []sortHost
+
+func (h sortHosts) Len() int      { return len(h) }
+func (h sortHosts) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h sortHosts) Sort()         { sort.Sort(h) }
+
+func (h sortHosts) Less(i, j int) bool {
+	if h[i].Violations != h[j].Violations {
+		return h[i].Violations < h[j].Violations
+	}
+	if h[i].Jobs == h[j].Jobs {
+		return len(h[i].Host.Jobs) < len(h[j].Host.Jobs)
+	}
+	return h[i].Jobs < h[j].Jobs
+}
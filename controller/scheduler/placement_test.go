@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PlacementSuite struct{}
+
+var _ = Suite(&PlacementSuite{})
+
+func newTestFormation(procs map[string]ct.ProcessType) *Formation {
+	return NewFormation(newContext(nil, nil), &ct.ExpandedFormation{
+		App:     &ct.App{ID: "app"},
+		Release: &ct.Release{ID: "release", Processes: procs},
+	})
+}
+
+func testJob(appID, typ string) *host.Job {
+	return &host.Job{Metadata: map[string]string{
+		"flynn-controller.app":     appID,
+		"flynn-controller.release": "release",
+		"flynn-controller.type":    typ,
+	}}
+}
+
+func testHost(id string, labels map[string]string, jobs ...*host.Job) host.Host {
+	meta := make(map[string]string, len(labels))
+	for k, v := range labels {
+		meta[host.HostLabelPrefix+k] = v
+	}
+	return host.Host{ID: id, Metadata: meta, Jobs: jobs}
+}
+
+func (PlacementSuite) TestConstraints(c *C) {
+	f := newTestFormation(map[string]ct.ProcessType{
+		"db":     {Constraints: []ct.HostConstraint{{Label: "disk", Value: "ssd"}}},
+		"worker": {Constraints: []ct.HostConstraint{{Label: "edge", Op: ct.ConstraintOpNotExists}}},
+	})
+	hosts := []host.Host{
+		testHost("a", map[string]string{"edge": "true"}),
+		testHost("b", map[string]string{"disk": "ssd", "edge": "true"}),
+		testHost("c", nil),
+	}
+
+	h, err := f.pickHost("db", hosts)
+	c.Assert(err, IsNil)
+	c.Assert(h.ID, Equals, "b")
+
+	h, err = f.pickHost("worker", hosts)
+	c.Assert(err, IsNil)
+	c.Assert(h.ID, Equals, "c")
+
+	// an unsatisfiable constraint fails and emits an event
+	events := f.c.Subscribe()
+	defer f.c.Unsubscribe(events)
+	_, err = f.pickHost("db", hosts[2:])
+	c.Assert(err, NotNil)
+	e := <-events
+	c.Assert(e.Type, Equals, EventTypeConstraintViolation)
+	c.Assert(e.JobType, Equals, "db")
+}
+
+func (PlacementSuite) TestCordonedHostsAreSkipped(c *C) {
+	f := newTestFormation(map[string]ct.ProcessType{"web": {}})
+	cordoned := testHost("a", nil)
+	cordoned.Metadata[host.HostMetaCordon] = "true"
+
+	h, err := f.pickHost("web", []host.Host{cordoned, testHost("b", nil, testJob("app", "web"))})
+	c.Assert(err, IsNil)
+	c.Assert(h.ID, Equals, "b")
+
+	_, err = f.pickHost("web", []host.Host{cordoned})
+	c.Assert(err, NotNil)
+}
+
+func (PlacementSuite) TestAffinity(c *C) {
+	f := newTestFormation(map[string]ct.ProcessType{
+		"web":    {Affinity: []ct.JobAffinity{{AppID: "cache-app", Type: "cache"}}},
+		"worker": {AntiAffinity: []ct.JobAffinity{{Type: "web"}}},
+	})
+	hosts := []host.Host{
+		testHost("a", nil, testJob("app", "web")),
+		testHost("b", nil, testJob("cache-app", "cache"), testJob("app", "web"), testJob("app", "web")),
+	}
+
+	// affinity outweighs the number of jobs of the type on the host
+	h, err := f.pickHost("web", hosts)
+	c.Assert(err, IsNil)
+	c.Assert(h.ID, Equals, "b")
+
+	// a violation is emitted when no host can satisfy anti-affinity
+	events := f.c.Subscribe()
+	defer f.c.Unsubscribe(events)
+	_, err = f.pickHost("worker", hosts)
+	c.Assert(err, IsNil)
+	e := <-events
+	c.Assert(e.Type, Equals, EventTypeAffinityViolation)
+	c.Assert(e.JobType, Equals, "worker")
+}
+
+func (PlacementSuite) TestSpread(c *C) {
+	f := newTestFormation(map[string]ct.ProcessType{"web": {Spread: true}})
+	hosts := []host.Host{
+		testHost("a", nil, testJob("app", "web")),
+		testHost("b", nil, testJob("app", "web")),
+		testHost("c", nil, testJob("other", "x"), testJob("other", "y")),
+	}
+	events := f.c.Subscribe()
+	defer f.c.Unsubscribe(events)
+
+	h, err := f.pickHost("web", hosts)
+	c.Assert(err, IsNil)
+	c.Assert(h.ID, Equals, "c")
+	select {
+	case e := <-events:
+		c.Fatalf("unexpected event: %+v", e)
+	default:
+	}
+}
+
+// eventRecorder is a controllerClient which records the scheduler events
+// reported to it.
+type eventRecorder struct {
+	controllerClient
+	events chan *ct.SchedulerEvent
+}
+
+func (r *eventRecorder) CreateSchedulerEvent(appID string, event *ct.SchedulerEvent) error {
+	event.AppID = appID
+	r.events <- event
+	return nil
+}
+
+func (PlacementSuite) TestEventsReportedToController(c *C) {
+	recorder := &eventRecorder{events: make(chan *ct.SchedulerEvent, 1)}
+	f := newTestFormation(map[string]ct.ProcessType{
+		"db": {Constraints: []ct.HostConstraint{{Label: "disk", Value: "ssd"}}},
+	})
+	f.c.controllerClient = recorder
+	events := f.c.Subscribe()
+	defer func() {
+		f.c.Unsubscribe(events)
+		close(events)
+	}()
+	go f.c.reportEvents(events)
+
+	_, err := f.pickHost("db", []host.Host{testHost("a", nil)})
+	c.Assert(err, NotNil)
+
+	select {
+	case e := <-recorder.events:
+		c.Assert(e.AppID, Equals, "app")
+		c.Assert(e.ReleaseID, Equals, "release")
+		c.Assert(e.ProcessType, Equals, "db")
+		c.Assert(e.Type, Equals, ct.SchedulerEventConstraintViolation)
+		c.Assert(e.Message, Not(Equals), "")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for event to be reported")
+	}
+}
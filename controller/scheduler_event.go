@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/controller/schema"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// schedulerEventListLimit is the number of most recent events returned when
+// listing the scheduler events of an app.
+const schedulerEventListLimit = 100
+
+type SchedulerEventRepo struct {
+	db *postgres.DB
+}
+
+func NewSchedulerEventRepo(db *postgres.DB) *SchedulerEventRepo {
+	return &SchedulerEventRepo{db}
+}
+
+func (r *SchedulerEventRepo) Add(event *ct.SchedulerEvent) error {
+	var releaseID *string
+	if event.ReleaseID != "" {
+		releaseID = &event.ReleaseID
+	}
+	return r.db.QueryRow("INSERT INTO scheduler_events (app_id, release_id, process_type, host_id, type, message) VALUES ($1, $2, $3, $4, $5, $6) RETURNING event_id, created_at",
+		event.AppID, releaseID, event.ProcessType, event.HostID, event.Type, event.Message).Scan(&event.ID, &event.CreatedAt)
+}
+
+func scanSchedulerEvent(s postgres.Scanner) (*ct.SchedulerEvent, error) {
+	event := &ct.SchedulerEvent{}
+	var releaseID *string
+	err := s.Scan(&event.ID, &event.AppID, &releaseID, &event.ProcessType, &event.HostID, &event.Type, &event.Message, &event.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	if releaseID != nil {
+		event.ReleaseID = postgres.CleanUUID(*releaseID)
+	}
+	event.AppID = postgres.CleanUUID(event.AppID)
+	return event, err
+}
+
+// AppList returns the most recent scheduler events of an app, newest first.
+func (r *SchedulerEventRepo) AppList(appID string) ([]*ct.SchedulerEvent, error) {
+	rows, err := r.db.Query("SELECT event_id, app_id, release_id, process_type, host_id, type, message, created_at FROM scheduler_events WHERE app_id = $1 ORDER BY event_id DESC LIMIT $2", appID, schedulerEventListLimit)
+	if err != nil {
+		return nil, err
+	}
+	events := []*ct.SchedulerEvent{}
+	for rows.Next() {
+		event, err := scanSchedulerEvent(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// CreateSchedulerEvent records an event reported by the scheduler.
+func (c *controllerAPI) CreateSchedulerEvent(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var event ct.SchedulerEvent
+	if err := httphelper.DecodeJSON(req, &event); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	event.ID = 0
+	event.AppID = c.getApp(ctx).ID
+	event.CreatedAt = nil
+
+	if err := schema.Validate(event); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	if err := c.schedulerEventRepo.Add(&event); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &event)
+}
+
+func (c *controllerAPI) ListSchedulerEvents(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	events, err := c.schedulerEventRepo.AppList(c.getApp(ctx).ID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, events)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+)
+
+func (s *S) TestSchedulerEvents(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "scheduler-events-test"})
+	release := s.createTestRelease(c, &ct.Release{})
+
+	// unknown event types are rejected
+	err := s.c.CreateSchedulerEvent(app.ID, &ct.SchedulerEvent{Type: "foo"})
+	c.Assert(hh.IsValidationError(err), Equals, true)
+
+	first := &ct.SchedulerEvent{
+		ReleaseID:   release.ID,
+		ProcessType: "db",
+		Type:        ct.SchedulerEventConstraintViolation,
+		Message:     "no host satisfies the constraints",
+	}
+	c.Assert(s.c.CreateSchedulerEvent(app.ID, first), IsNil)
+	c.Assert(first.ID, Not(Equals), int64(0))
+	c.Assert(first.AppID, Equals, app.ID)
+	c.Assert(first.CreatedAt, NotNil)
+
+	second := &ct.SchedulerEvent{
+		ReleaseID:   release.ID,
+		ProcessType: "web",
+		HostID:      "host0",
+		Type:        ct.SchedulerEventAffinityViolation,
+	}
+	c.Assert(s.c.CreateSchedulerEvent(app.ID, second), IsNil)
+
+	// events are listed newest first
+	list, err := s.c.SchedulerEventList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, second.ID)
+	c.Assert(list[0].HostID, Equals, "host0")
+	c.Assert(list[1].ID, Equals, first.ID)
+	c.Assert(list[1].ReleaseID, Equals, release.ID)
+	c.Assert(list[1].ProcessType, Equals, "db")
+	c.Assert(list[1].Message, Equals, first.Message)
+
+	// events are scoped to their app
+	other := s.createTestApp(c, &ct.App{Name: "scheduler-events-test-other"})
+	list, err = s.c.SchedulerEventList(other.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
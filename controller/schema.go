@@ -199,5 +199,28 @@ $$ LANGUAGE plpgsql`,
     CONSTRAINT que_jobs_pkey PRIMARY KEY (queue, priority, run_at, job_id))`,
 		`COMMENT ON TABLE que_jobs IS '3'`,
 	)
+	m.Add(3,
+		`CREATE TABLE log_drains (
+    drain_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    url text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE UNIQUE INDEX ON log_drains (app_id, url) WHERE deleted_at IS NULL`,
+	)
+	m.Add(4,
+		`CREATE TABLE scheduler_events (
+    event_id bigserial PRIMARY KEY,
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    release_id uuid REFERENCES releases (release_id),
+    process_type text,
+    host_id text,
+    type text NOT NULL,
+    message text,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON scheduler_events (app_id, event_id)`,
+	)
 	return m.Migrate(db)
 }
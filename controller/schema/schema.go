@@ -60,6 +60,12 @@ func schemaForType(thing interface{}) *jsonschema.Schema {
 	if name == "appupdate" {
 		name = "app"
 	}
+	if name == "logdrain" {
+		name = "log_drain"
+	}
+	if name == "schedulerevent" {
+		name = "scheduler_event"
+	}
 	if name == "route" {
 		return schemaCache["https://flynn.io/schema/router/route"]
 	}
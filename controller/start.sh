@@ -4,8 +4,9 @@ case $1 in
   controller) exec /bin/flynn-controller ;;
   scheduler)  exec /bin/flynn-scheduler ;;
   deployer)  exec /bin/flynn-deployer ;;
+  gc)        exec /bin/flynn-gc ;;
   *)
-    echo "Usage: $0 {controller|scheduler|deployer}"
+    echo "Usage: $0 {controller|scheduler|deployer|gc}"
     exit 2
     ;;
 esac
@@ -105,6 +105,29 @@ func (c *FakeCluster) AddHost(h host.Host) {
 	c.hosts[h.ID] = h
 }
 
+func (c *FakeCluster) UpdateHostMeta(hostID string, meta map[string]string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	h, ok := c.hosts[hostID]
+	if !ok {
+		return errors.New("FakeCluster: unknown host")
+	}
+	newMeta := make(map[string]string, len(h.Metadata)+len(meta))
+	for k, v := range h.Metadata {
+		newMeta[k] = v
+	}
+	for k, v := range meta {
+		if v == "" {
+			delete(newMeta, k)
+		} else {
+			newMeta[k] = v
+		}
+	}
+	h.Metadata = newMeta
+	c.hosts[hostID] = h
+	return nil
+}
+
 func (c *FakeCluster) SetHostClient(id string, h *FakeHostClient) {
 	h.cluster = c
 	c.hostClients[id] = h
@@ -107,6 +107,10 @@ func (c *FakeHostClient) PullImages(repository, driver, root string, tufDB io.Re
 	return nil, nil
 }
 
+func (c *FakeHostClient) LogStats() (*host.LogStats, error) {
+	return &host.LogStats{}, nil
+}
+
 type attachFunc func(req *host.AttachReq, wait bool) (cluster.AttachClient, error)
 
 type FakeHostEventStream struct {
@@ -141,3 +145,15 @@ func (c *FakeHostClient) PullSnapshot(receiveVolID string, sourceHostID string,
 func (c *FakeHostClient) SendSnapshot(snapID string, assumeHaves []json.RawMessage) (io.ReadCloser, error) {
 	return nil, nil
 }
+
+func (c *FakeHostClient) ExportSnapshot(snapID string, url string) error {
+	return nil
+}
+
+func (c *FakeHostClient) ImportSnapshot(volumeID string, url string) (*volume.Info, error) {
+	return nil, nil
+}
+
+func (c *FakeHostClient) SetSnapshotPolicy(volumeID string, policy *volume.SnapshotPolicy) error {
+	return nil
+}
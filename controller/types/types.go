@@ -50,6 +50,64 @@ type ProcessType struct {
 	HostNetwork bool              `json:"host_network,omitempty"`
 	Service     string            `json:"service,omitempty"`
 	Resurrect   bool              `json:"resurrect,omitempty"`
+
+	// StopSignal and StopTimeout control how jobs of this type are stopped,
+	// see host.ContainerConfig.
+	StopSignal  int           `json:"stop_signal,omitempty"`
+	StopTimeout host.Duration `json:"stop_timeout,omitempty"`
+
+	// LogRateLimit limits the rate at which jobs of this type can emit log
+	// lines, see host.ContainerConfig.
+	LogRateLimit *host.LogRateLimit `json:"log_rate_limit,omitempty"`
+
+	// Constraints must all be satisfied by the labels of a host for jobs of
+	// this type to be placed on it.
+	Constraints []HostConstraint `json:"constraints,omitempty"`
+
+	// Affinity and AntiAffinity are preferences for placing jobs on hosts
+	// which are, or are not, already running jobs of other process types.
+	// Unlike Constraints they are best effort, the scheduler emits an event
+	// when a job has to be placed in violation of them. Spread is shorthand
+	// for anti-affinity with the process type itself.
+	Affinity     []JobAffinity `json:"affinity,omitempty"`
+	AntiAffinity []JobAffinity `json:"anti_affinity,omitempty"`
+	Spread       bool          `json:"spread,omitempty"`
+}
+
+const (
+	ConstraintOpEqual     = "=="
+	ConstraintOpNotEqual  = "!="
+	ConstraintOpExists    = "exists"
+	ConstraintOpNotExists = "!exists"
+)
+
+// HostConstraint matches hosts by one of their labels (see the --label flag
+// of flynn-host daemon). Op defaults to ConstraintOpEqual.
+type HostConstraint struct {
+	Label string `json:"label"`
+	Op    string `json:"op,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+func (c HostConstraint) Match(labels map[string]string) bool {
+	v, ok := labels[c.Label]
+	switch c.Op {
+	case ConstraintOpNotEqual:
+		return v != c.Value
+	case ConstraintOpExists:
+		return ok
+	case ConstraintOpNotExists:
+		return !ok
+	default:
+		return ok && v == c.Value
+	}
+}
+
+// JobAffinity refers to the jobs of a process type, AppID defaults to the app
+// of the process type the affinity is declared on.
+type JobAffinity struct {
+	AppID string `json:"app_id,omitempty"`
+	Type  string `json:"type"`
 }
 
 type Port struct {
@@ -98,6 +156,30 @@ type JobEvent struct {
 	JobID string `json:"job_id,omitempty"`
 }
 
+const (
+	// SchedulerEventConstraintViolation is reported when no host satisfies
+	// the constraints of a process type, so a job could not be placed.
+	SchedulerEventConstraintViolation = "constraint_violation"
+
+	// SchedulerEventAffinityViolation is reported when a job is placed on a
+	// host which breaks the affinity or anti-affinity rules of its process
+	// type because no better host was available.
+	SchedulerEventAffinityViolation = "affinity_violation"
+)
+
+// SchedulerEvent is reported by the scheduler when a placement decision for
+// an app could not honor the rules of a process type.
+type SchedulerEvent struct {
+	ID          int64      `json:"id,omitempty"`
+	AppID       string     `json:"app,omitempty"`
+	ReleaseID   string     `json:"release,omitempty"`
+	ProcessType string     `json:"process_type,omitempty"`
+	HostID      string     `json:"host_id,omitempty"`
+	Type        string     `json:"type"`
+	Message     string     `json:"message,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
+
 func (e *JobEvent) IsDown() bool {
 	return e.State == "failed" || e.State == "crashed" || e.State == "down"
 }
@@ -189,4 +271,70 @@ type LogOpts struct {
 	JobID       string
 	Lines       *int
 	ProcessType *string
+
+	HostID string
+	Stream string
+	Since  *time.Time
+	Until  *time.Time
+	Search string
+	Regexp string
+
+	// After is the ID of the last message already read, only messages
+	// following it are returned.
+	After string
+
+	// ParseFields causes messages which are JSON objects or logfmt
+	// key=value pairs to be returned with their parsed fields.
+	ParseFields bool
+	// FieldFilters restricts the log to messages with parsed fields having
+	// the given values.
+	FieldFilters map[string]string
+}
+
+// LogDrain forwards the logs of an app to an external endpoint. Supported URL
+// schemes are syslog (plain TCP), syslog+tls, http and https. Syslog drains
+// receive RFC6587-framed RFC5424 messages, HTTP drains receive batches of
+// messages POSTed as JSON arrays.
+type LogDrain struct {
+	ID        string         `json:"id,omitempty"`
+	AppID     string         `json:"app,omitempty"`
+	URL       string         `json:"url,omitempty"`
+	CreatedAt *time.Time     `json:"created_at,omitempty"`
+	Stats     *LogDrainStats `json:"stats,omitempty"`
+}
+
+// LogDrainStats are the delivery statistics of a log drain, as reported by
+// the log aggregator since it last started.
+type LogDrainStats struct {
+	// Delivered is the number of messages successfully sent to the drain.
+	Delivered uint64 `json:"delivered"`
+	// Dropped is the number of messages discarded because the drain was not
+	// keeping up and its queue was full.
+	Dropped uint64 `json:"dropped"`
+	// Failed is the number of messages discarded after all delivery
+	// attempts failed.
+	Failed uint64 `json:"failed"`
+	// Retries is the number of delivery attempts which were retried.
+	Retries uint64 `json:"retries"`
+	// Queued is the number of messages waiting to be sent.
+	Queued      int        `json:"queued"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// SignedURL is a blobstore URL signed by the controller, which allows requests
+// using Methods until ExpiresAt.
+type SignedURL struct {
+	URL       string     `json:"url"`
+	Methods   []string   `json:"methods"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// BlobstoreKey is a key issued by the controller which allows blobstore URLs
+// under Prefix to be signed for any of Methods, see pkg/signedurl.PrefixKey.
+// Key is empty if the blobstore does not require signed URLs.
+type BlobstoreKey struct {
+	Prefix  string   `json:"prefix"`
+	Methods []string `json:"methods"`
+	Key     string   `json:"key,omitempty"`
 }
@@ -0,0 +1,37 @@
+package types
+
+import (
+	"encoding/json"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/host/types"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func (S) TestProcessTypeStopJSON(c *C) {
+	t := ProcessType{
+		Cmd:         []string{"start"},
+		StopSignal:  int(syscall.SIGINT),
+		StopTimeout: host.Duration(2 * time.Minute),
+	}
+	data, err := json.Marshal(t)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"cmd":["start"],"stop_signal":2,"stop_timeout":"2m0s"}`)
+
+	var decoded ProcessType
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(decoded, DeepEquals, t)
+
+	// stop_timeout can also be given in seconds
+	c.Assert(json.Unmarshal([]byte(`{"stop_timeout":45}`), &decoded), IsNil)
+	c.Assert(decoded.StopTimeout, Equals, host.Duration(45*time.Second))
+}
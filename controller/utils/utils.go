@@ -1,9 +1,13 @@
 package utils
 
 import (
+	"net/url"
+	"time"
+
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/signedurl"
 )
 
 func JobConfig(f *ct.ExpandedFormation, name, hostID string) *host.Job {
@@ -36,6 +40,10 @@ func JobConfig(f *ct.ExpandedFormation, name, hostID string) *host.Job {
 			Cmd:         t.Cmd,
 			Env:         env,
 			HostNetwork: t.HostNetwork,
+			StopSignal:  t.StopSignal,
+			StopTimeout: t.StopTimeout,
+
+			LogRateLimit: t.LogRateLimit,
 		},
 		Resurrect: t.Resurrect,
 	}
@@ -51,6 +59,56 @@ func JobConfig(f *ct.ExpandedFormation, name, hostID string) *host.Job {
 	return job
 }
 
+// BlobstoreHost is the host of blobstore URLs.
+const BlobstoreHost = "blobstore.discoverd"
+
+// JobURLExpiry is how long the blobstore URLs given to jobs are valid for.
+const JobURLExpiry = 24 * time.Hour
+
+// SignBlobstoreURL returns rawurl signed with key, allowing requests to the
+// blobstore using methods until expires. URLs of other hosts, and all URLs if
+// key is empty, are returned unchanged.
+func SignBlobstoreURL(key []byte, rawurl string, methods []string, expires time.Time) (string, error) {
+	if len(key) == 0 {
+		return rawurl, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != BlobstoreHost {
+		return rawurl, nil
+	}
+	return signedurl.Sign(key, rawurl, methods, expires)
+}
+
+// SignJobURLs replaces the SLUG_URL of job, if it is a blobstore URL, with one
+// signed with key which allows the job to read it. Resurrectable jobs are also
+// given a GET-only key for the path of SLUG_URL, so that the host can sign it
+// again when it resurrects the job after the URL has expired.
+func SignJobURLs(job *host.Job, key []byte) error {
+	slugURL, ok := job.Config.Env["SLUG_URL"]
+	if !ok || len(key) == 0 {
+		return nil
+	}
+	u, err := url.Parse(slugURL)
+	if err != nil {
+		return err
+	}
+	if u.Host != BlobstoreHost {
+		return nil
+	}
+	signed, err := signedurl.Sign(key, slugURL, []string{"GET"}, time.Now().Add(JobURLExpiry))
+	if err != nil {
+		return err
+	}
+	job.Config.Env["SLUG_URL"] = signed
+	if job.Resurrect {
+		job.SlugURLKey = signedurl.PrefixKey(key, u.Path, []string{"GET"})
+	}
+	return nil
+}
+
 type HostDialer interface {
 	DialHost(id string) (cluster.Host, error)
 }
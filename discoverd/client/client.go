@@ -17,6 +17,7 @@ import (
 type Service interface {
 	Leader() (*Instance, error)
 	Instances() ([]*Instance, error)
+	AllInstances() ([]*Instance, error)
 	Addrs() ([]string, error)
 	Leaders(chan *Instance) (stream.Stream, error)
 	Watch(events chan *Event) (stream.Stream, error)
@@ -76,6 +77,51 @@ const (
 
 type ServiceConfig struct {
 	LeaderType LeaderType `json:"leader_type"`
+
+	// Check, if set, is run by discoverd against every registered instance of
+	// the service. Instances which fail the check are marked as down, so they
+	// are not returned from DNS, Instances or Watch, but remain registered and
+	// are marked as up again once the check passes.
+	Check *HealthCheck `json:"check,omitempty"`
+
+	// DNSTTL is the TTL in seconds of DNS records for the service. It
+	// defaults to zero, so that records are not cached.
+	DNSTTL uint32 `json:"dns_ttl,omitempty"`
+}
+
+type HealthCheck struct {
+	// Type is one of tcp, http, https
+	Type string `json:"type"`
+	// Interval is the time to wait between checks. It defaults to two
+	// seconds.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Threshold is the number of consecutive checks of the same status before
+	// an instance will be marked as up or down. It defaults to 2.
+	Threshold int `json:"threshold,omitempty"`
+	// Timeout is the maximum duration of a check. It defaults to two seconds.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// Extra optional config fields for http/https checks
+	Path   string `json:"path,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Match  string `json:"match,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+const (
+	CheckStatusUp   = "up"
+	CheckStatusDown = "down"
+)
+
+// CheckStatus is the status of a service's health check against an instance.
+type CheckStatus struct {
+	// Status is either CheckStatusUp or CheckStatusDown.
+	Status string `json:"status"`
+	// Failures is the number of consecutive failed checks.
+	Failures int `json:"failures,omitempty"`
+	// LastError is the error from the last failed check.
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
 }
 
 func (c *Client) AddService(name string, conf *ServiceConfig) error {
@@ -165,6 +211,13 @@ func (s *service) Instances() ([]*Instance, error) {
 	return res, s.client.c.Get(fmt.Sprintf("/services/%s/instances", s.name), &res)
 }
 
+// AllInstances returns every registered instance, including those marked as
+// down as they are failing the service's health check.
+func (s *service) AllInstances() ([]*Instance, error) {
+	var res []*Instance
+	return res, s.client.c.Get(fmt.Sprintf("/services/%s/instances?include_down=true", s.name), &res)
+}
+
 func (s *service) Addrs() ([]string, error) {
 	instances, err := s.Instances()
 	if err != nil {
@@ -18,8 +18,20 @@ var EnvInstanceMeta = map[string]struct{}{
 	"FLYNN_RELEASE_ID":   {},
 	"FLYNN_PROCESS_TYPE": {},
 	"FLYNN_JOB_ID":       {},
+	InstanceMetaWeight:   {},
+	InstanceMetaPriority: {},
 }
 
+// InstanceMetaWeight and InstanceMetaPriority are instance metadata keys
+// holding the weight and priority of the instance in DNS responses, as defined
+// for SRV records by RFC 2782. Instances with a lower priority are returned
+// first, and instances with the same priority are ordered randomly in
+// proportion to their weight. Both default to 1.
+const (
+	InstanceMetaWeight   = "DISCOVERD_WEIGHT"
+	InstanceMetaPriority = "DISCOVERD_PRIORITY"
+)
+
 type Heartbeater interface {
 	SetMeta(map[string]string) error
 	Close() error
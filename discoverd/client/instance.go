@@ -109,6 +109,10 @@ type Instance struct {
 	// instance creation.
 	Index uint64 `json:"index,omitempty"`
 
+	// Check is the status of the service's health check against the
+	// instance. It is only set by discoverd for services with a check.
+	Check *CheckStatus `json:"check,omitempty"`
+
 	// addrOnce is used to initialize host/port
 	addrOnce sync.Once
 	host     string
@@ -18,6 +18,10 @@ func AddServiceAndRegister(service, addr string) (Heartbeater, error) {
 	return DefaultClient.AddServiceAndRegister(service, addr)
 }
 
+func AddServiceAndRegisterInstance(service string, inst *Instance) (Heartbeater, error) {
+	return DefaultClient.AddServiceAndRegisterInstance(service, inst)
+}
+
 func Register(service, addr string) (Heartbeater, error) {
 	return DefaultClient.Register(service, addr)
 }
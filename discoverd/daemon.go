@@ -5,10 +5,13 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
+	"github.com/flynn/flynn/discoverd/raft"
 	"github.com/flynn/flynn/discoverd/server"
 	"github.com/flynn/flynn/pkg/attempt"
 	"github.com/flynn/flynn/pkg/shutdown"
@@ -21,9 +24,49 @@ func main() {
 	dnsAddr := flag.String("dns-addr", ":53", "address to service DNS from")
 	resolvers := flag.String("recursors", "8.8.8.8,8.8.4.4", "upstream recursive DNS servers")
 	etcdAddrs := flag.String("etcd", "http://127.0.0.1:2379", "etcd servers (comma separated)")
+	backendType := flag.String("backend", "etcd", "storage backend to use (etcd or raft)")
+	raftAddr := flag.String("raft-addr", "", "address to serve raft RPCs from, used as the ID of this server (raft backend)")
+	raftPeers := flag.String("raft-peers", "", "raft addresses of all discoverd servers (comma separated, raft backend, fixed once the raft log is created)")
+	dataDir := flag.String("data-dir", "/data/discoverd", "directory to store the raft log in (raft backend)")
 	flag.Parse()
 
-	etcdClient := etcd.NewClient(strings.Split(*etcdAddrs, ","))
+	state := server.NewState()
+	var backend server.Backend
+	switch *backendType {
+	case "etcd":
+		backend = newEtcdBackend(strings.Split(*etcdAddrs, ","), state)
+	case "raft":
+		backend = newRaftBackend(*raftAddr, *raftPeers, *dataDir, state)
+	default:
+		log.Fatalf("Unknown backend %q", *backendType)
+	}
+	if err := backend.StartSync(); err != nil {
+		log.Fatalf("Failed to perform initial %s sync: %s", *backendType, err)
+	}
+	server.NewHealthChecker(state)
+
+	dns := server.DNSServer{
+		UDPAddr: *dnsAddr,
+		TCPAddr: *dnsAddr,
+		Store:   state,
+	}
+	if *resolvers != "" {
+		dns.Recursors = strings.Split(*resolvers, ",")
+	}
+	if err := dns.ListenAndServe(); err != nil {
+		log.Fatalf("Failed to start DNS server: %s", err)
+	}
+
+	l, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		log.Fatalf("Failed to start HTTP listener: %s", err)
+	}
+	log.Printf("discoverd listening for HTTP on %s and DNS on %s", *httpAddr, *dnsAddr)
+	http.Serve(l, server.NewHTTPHandler(server.NewBasicDatastore(state, backend)))
+}
+
+func newEtcdBackend(addrs []string, state *server.State) server.Backend {
+	etcdClient := etcd.NewClient(addrs)
 
 	// Check to make sure that etcd is online and accepting connections
 	// etcd takes a while to come online, so we attempt a GET multiple times
@@ -40,31 +83,40 @@ func main() {
 		return
 	})
 	if err != nil {
-		log.Fatalf("Failed to connect to etcd at %v: %q", etcdAddrs, err)
+		log.Fatalf("Failed to connect to etcd at %v: %q", addrs, err)
 	}
+	return server.NewEtcdBackend(etcdClient, "/discoverd", state)
+}
 
-	state := server.NewState()
-	backend := server.NewEtcdBackend(etcdClient, "/discoverd", state)
-	if err := backend.StartSync(); err != nil {
-		log.Fatalf("Failed to perform initial etcd sync: %s", err)
+func newRaftBackend(addr, peers, dataDir string, state *server.State) server.Backend {
+	if addr == "" {
+		log.Fatal("The raft backend requires -raft-addr")
 	}
-
-	dns := server.DNSServer{
-		UDPAddr: *dnsAddr,
-		TCPAddr: *dnsAddr,
-		Store:   state,
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Fatalf("Failed to create data directory: %s", err)
 	}
-	if *resolvers != "" {
-		dns.Recursors = strings.Split(*resolvers, ",")
+	store, err := raft.NewBoltStore(filepath.Join(dataDir, "raft.db"))
+	if err != nil {
+		log.Fatalf("Failed to open raft log: %s", err)
 	}
-	if err := dns.ListenAndServe(); err != nil {
-		log.Fatalf("Failed to start DNS server: %s", err)
+	config := raft.Config{
+		ID:        addr,
+		Peers:     []string{addr},
+		Store:     store,
+		Transport: raft.NewHTTPTransport(5 * time.Second),
+	}
+	if peers != "" {
+		config.Peers = strings.Split(peers, ",")
+	}
+	backend, err := server.NewRaftBackend(config, state)
+	if err != nil {
+		log.Fatalf("Failed to start raft: %s", err)
 	}
 
-	l, err := net.Listen("tcp", *httpAddr)
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalf("Failed to start HTTP listener: %s", err)
+		log.Fatalf("Failed to start raft listener: %s", err)
 	}
-	log.Printf("discoverd listening for HTTP on %s and DNS on %s", *httpAddr, *dnsAddr)
-	http.Serve(l, server.NewHTTPHandler(server.NewBasicDatastore(state, backend)))
+	go http.Serve(l, backend)
+	return backend
 }
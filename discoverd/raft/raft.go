@@ -0,0 +1,895 @@
+// Package raft implements the Raft consensus algorithm, replicating a log of
+// commands to a fixed set of nodes which apply them in the same order to a
+// state machine.
+//
+// It implements leader election, log replication and log compaction with
+// snapshots as described in "In Search of an Understandable Consensus
+// Algorithm" by Ongaro and Ousterhout.
+//
+// Cluster membership changes are not supported. Every node must be configured
+// with the same set of peers, which is stored along with the log when it is
+// created, and a node refuses to start with a different set of peers or to
+// handle RPCs from nodes which are not peers. Changing the peers of a cluster
+// requires creating a new one with empty stores.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned by Apply when the node is not the leader.
+	ErrNotLeader = errors.New("raft: node is not the leader")
+
+	// ErrLeadershipLost is returned by Apply when the node stopped being
+	// the leader before the command was committed. The command may or may
+	// not be applied by the new leader.
+	ErrLeadershipLost = errors.New("raft: leadership lost while committing command")
+
+	// ErrTimeout is returned by Apply when the command was not applied
+	// within the timeout.
+	ErrTimeout = errors.New("raft: timed out applying command")
+
+	// ErrClosed is returned by Apply once the node has been closed.
+	ErrClosed = errors.New("raft: node is closed")
+
+	// ErrUnknownPeer is returned by the RPC handlers when the sender is
+	// not one of the node's peers.
+	ErrUnknownPeer = errors.New("raft: RPC from a node which is not a peer")
+)
+
+// FSM is the state machine that committed commands are applied to. Its
+// methods are never called concurrently.
+type FSM interface {
+	// Apply applies the command at index of the log, the returned value is
+	// returned from Node.Apply on the leader.
+	Apply(index uint64, cmd []byte) interface{}
+
+	// Snapshot returns the state of the FSM, which may be passed to Restore
+	// in place of applying every command up to the last one applied.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the state of the FSM with a snapshot.
+	Restore(data []byte) error
+}
+
+type Config struct {
+	// ID is the address of the node, which peers use to send it RPCs.
+	ID string
+
+	// Peers are the addresses of every node in the cluster, they may or may
+	// not include ID. They must be the same on every node and can't be
+	// changed once the log has been created.
+	Peers []string
+
+	Store     Store
+	Transport Transport
+	FSM       FSM
+
+	// HeartbeatInterval is how often the leader sends entries, or empty
+	// heartbeats, to followers. It defaults to 100ms.
+	HeartbeatInterval time.Duration
+
+	// ElectionTimeout is the minimum time a follower waits to hear from a
+	// leader before starting an election, the actual timeout is randomized
+	// between it and twice it. It defaults to one second.
+	ElectionTimeout time.Duration
+
+	// SnapshotThreshold is the number of log entries applied after which a
+	// snapshot is taken and the log compacted. It defaults to 1024.
+	SnapshotThreshold uint64
+}
+
+const maxAppendEntries = 256
+
+type nodeState int
+
+const (
+	stateFollower nodeState = iota
+	stateCandidate
+	stateLeader
+)
+
+// Node is a member of a Raft cluster.
+type Node struct {
+	id        string
+	peers     []string
+	store     Store
+	transport Transport
+	fsm       FSM
+
+	heartbeatInterval time.Duration
+	electionTimeout   time.Duration
+	snapshotThreshold uint64
+
+	mtx         sync.Mutex
+	state       nodeState
+	term        uint64
+	votedFor    string
+	votes       int
+	leader      string
+	lastContact time.Time
+	timeout     time.Duration
+
+	// log holds the entries following the snapshot.
+	log         []*Entry
+	snapshot    *Snapshot
+	commitIndex uint64
+	lastApplied uint64
+	// restore is a snapshot received from the leader which is yet to be
+	// restored into the FSM.
+	restore *Snapshot
+
+	// leader state
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	replicate  map[string]chan struct{}
+	lastAck    map[string]time.Time
+	stepDown   chan struct{}
+	futures    map[uint64]chan applyResult
+
+	applyc chan struct{}
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+type applyResult struct {
+	res interface{}
+	err error
+}
+
+// NewNode restores the state of a node from config.Store and starts it.
+func NewNode(config Config) (*Node, error) {
+	n := &Node{
+		id:                config.ID,
+		store:             config.Store,
+		transport:         config.Transport,
+		fsm:               config.FSM,
+		heartbeatInterval: config.HeartbeatInterval,
+		electionTimeout:   config.ElectionTimeout,
+		snapshotThreshold: config.SnapshotThreshold,
+		snapshot:          &Snapshot{},
+		futures:           make(map[uint64]chan applyResult),
+		applyc:            make(chan struct{}, 1),
+		closed:            make(chan struct{}),
+	}
+	if n.heartbeatInterval == 0 {
+		n.heartbeatInterval = 100 * time.Millisecond
+	}
+	if n.electionTimeout == 0 {
+		n.electionTimeout = time.Second
+	}
+	if n.snapshotThreshold == 0 {
+		n.snapshotThreshold = 1024
+	}
+	members := map[string]struct{}{n.id: {}}
+	for _, p := range config.Peers {
+		if _, ok := members[p]; !ok {
+			members[p] = struct{}{}
+			n.peers = append(n.peers, p)
+		}
+	}
+	if err := n.checkPeers(members); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if n.term, n.votedFor, err = n.store.State(); err != nil {
+		return nil, err
+	}
+	snapshot, err := n.store.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		if err := n.fsm.Restore(snapshot.Data); err != nil {
+			return nil, err
+		}
+		n.snapshot = snapshot
+		n.commitIndex = snapshot.Index
+		n.lastApplied = snapshot.Index
+	}
+	entries, err := n.store.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Index > n.snapshot.Index {
+			n.log = append(n.log, e)
+		}
+	}
+	n.resetTimeout()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// checkPeers stores the members of the cluster if the log is new, and
+// otherwise checks that they haven't changed.
+func (n *Node) checkPeers(members map[string]struct{}) error {
+	configured := make([]string, 0, len(members))
+	for m := range members {
+		configured = append(configured, m)
+	}
+	sort.Strings(configured)
+
+	stored, err := n.store.Peers()
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return n.store.SetPeers(configured)
+	}
+	if len(stored) != len(configured) {
+		return peersChangedError(stored, configured)
+	}
+	for i, p := range stored {
+		if p != configured[i] {
+			return peersChangedError(stored, configured)
+		}
+	}
+	return nil
+}
+
+func peersChangedError(stored, configured []string) error {
+	return fmt.Errorf("raft: configured peers %v differ from the peers %v the log was created with, membership changes are not supported", configured, stored)
+}
+
+// isPeer reports whether id is one of the other nodes of the cluster.
+func (n *Node) isPeer(id string) bool {
+	for _, p := range n.peers {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ID returns the address of the node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader returns the address of the current leader, or an empty string if it
+// isn't known.
+func (n *Node) Leader() string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.leader
+}
+
+// LastIndex returns the index of the last entry in the log.
+func (n *Node) LastIndex() uint64 {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.lastIndex()
+}
+
+// IsLeader reports whether the node is the leader.
+func (n *Node) IsLeader() bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.state == stateLeader
+}
+
+// Apply appends cmd to the log and waits until it has been committed and
+// applied to the FSM, returning the result of FSM.Apply. It must be called
+// on the leader.
+func (n *Node) Apply(cmd []byte, timeout time.Duration) (interface{}, error) {
+	n.mtx.Lock()
+	select {
+	case <-n.closed:
+		n.mtx.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	if n.state != stateLeader {
+		n.mtx.Unlock()
+		return nil, ErrNotLeader
+	}
+	if cmd == nil {
+		cmd = []byte{}
+	}
+	e := &Entry{Index: n.lastIndex() + 1, Term: n.term, Data: cmd}
+	if err := n.appendEntries(e); err != nil {
+		n.mtx.Unlock()
+		return nil, err
+	}
+	f := make(chan applyResult, 1)
+	n.futures[e.Index] = f
+	n.triggerReplication()
+	n.maybeCommit()
+	n.mtx.Unlock()
+
+	select {
+	case res := <-f:
+		return res.res, res.err
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	case <-n.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops the node and closes its store.
+func (n *Node) Close() error {
+	n.mtx.Lock()
+	select {
+	case <-n.closed:
+		n.mtx.Unlock()
+		return nil
+	default:
+	}
+	close(n.closed)
+	if n.state == stateLeader {
+		n.becomeFollower()
+	}
+	n.mtx.Unlock()
+
+	n.wg.Wait()
+	return n.store.Close()
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) resetTimeout() {
+	n.lastContact = time.Now()
+	n.timeout = n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout)))
+}
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Index
+	}
+	return n.snapshot.Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Term
+	}
+	return n.snapshot.Term
+}
+
+// entry returns the entry at index, or nil if it has been compacted or
+// doesn't exist.
+func (n *Node) entry(index uint64) *Entry {
+	if index <= n.snapshot.Index || index > n.lastIndex() {
+		return nil
+	}
+	return n.log[index-n.snapshot.Index-1]
+}
+
+// termAt returns the term of the entry at index, and false if it has been
+// compacted (other than the last entry in the snapshot) or doesn't exist.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapshot.Index {
+		return n.snapshot.Term, true
+	}
+	if e := n.entry(index); e != nil {
+		return e.Term, true
+	}
+	return 0, false
+}
+
+func (n *Node) appendEntries(entries ...*Entry) error {
+	if err := n.store.Append(entries); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+func (n *Node) setTerm(term uint64, votedFor string) error {
+	if err := n.store.SetState(term, votedFor); err != nil {
+		return err
+	}
+	n.term, n.votedFor = term, votedFor
+	return nil
+}
+
+func (n *Node) notifyApply() {
+	select {
+	case n.applyc <- struct{}{}:
+	default:
+	}
+}
+
+// run starts elections when the leader hasn't been heard from for the
+// election timeout.
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.electionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.closed:
+			return
+		}
+		n.mtx.Lock()
+		if n.state != stateLeader && time.Since(n.lastContact) > n.timeout {
+			n.startElection()
+		} else if n.state == stateLeader && !n.hasQuorumContact() {
+			// stop accepting commands which can't be committed, and let
+			// the rest of the cluster elect a new leader
+			log.Printf("raft: stepping down after losing contact with a quorum")
+			n.becomeFollower()
+		}
+		n.mtx.Unlock()
+	}
+}
+
+func (n *Node) startElection() {
+	if err := n.setTerm(n.term+1, n.id); err != nil {
+		log.Printf("raft: error starting election: %s", err)
+		return
+	}
+	n.state = stateCandidate
+	n.leader = ""
+	n.votes = 1
+	n.resetTimeout()
+	if n.votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	req := &RequestVoteRequest{
+		Term:         n.term,
+		Candidate:    n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			res, err := n.transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+			n.mtx.Lock()
+			defer n.mtx.Unlock()
+			if res.Term > n.term {
+				n.stepDownToTerm(res.Term)
+				return
+			}
+			if n.state != stateCandidate || n.term != req.Term || !res.Granted {
+				return
+			}
+			if n.votes++; n.votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// hasQuorumContact reports whether a leader has heard from a quorum of nodes
+// within the election timeout.
+func (n *Node) hasQuorumContact() bool {
+	count := 1
+	for _, t := range n.lastAck {
+		if time.Since(t) < n.electionTimeout {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+func (n *Node) becomeLeader() {
+	n.state = stateLeader
+	n.leader = n.id
+	n.nextIndex = make(map[string]uint64, len(n.peers))
+	n.matchIndex = make(map[string]uint64, len(n.peers))
+	n.replicate = make(map[string]chan struct{}, len(n.peers))
+	n.lastAck = make(map[string]time.Time, len(n.peers))
+	n.stepDown = make(chan struct{})
+
+	// entries from previous terms can only be committed along with an
+	// entry of the current term, so append an empty one
+	if err := n.appendEntries(&Entry{Index: n.lastIndex() + 1, Term: n.term}); err != nil {
+		log.Printf("raft: error appending entry after election: %s", err)
+		n.becomeFollower()
+		return
+	}
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex()
+		n.lastAck[peer] = time.Now()
+		trigger := make(chan struct{}, 1)
+		n.replicate[peer] = trigger
+		n.wg.Add(1)
+		go n.replicateTo(peer, trigger, n.stepDown)
+	}
+	n.triggerReplication()
+	n.maybeCommit()
+}
+
+// stepDownToTerm moves to a newer term, which a leader or candidate learnt of
+// from another node, as a follower.
+func (n *Node) stepDownToTerm(term uint64) {
+	if err := n.setTerm(term, ""); err != nil {
+		log.Printf("raft: error updating term: %s", err)
+	}
+	n.becomeFollower()
+}
+
+func (n *Node) becomeFollower() {
+	if n.state == stateFollower {
+		return
+	}
+	if n.state == stateLeader {
+		close(n.stepDown)
+		for index, f := range n.futures {
+			f <- applyResult{err: ErrLeadershipLost}
+			delete(n.futures, index)
+		}
+		n.leader = ""
+	}
+	n.state = stateFollower
+	n.resetTimeout()
+}
+
+func (n *Node) triggerReplication() {
+	for _, trigger := range n.replicate {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// maybeCommit advances the commit index to the latest entry of the current
+// term stored by a quorum of nodes.
+func (n *Node) maybeCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			return
+		}
+		count := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.notifyApply()
+			return
+		}
+	}
+}
+
+// replicateTo sends entries or heartbeats to peer until the node stops being
+// the leader.
+func (n *Node) replicateTo(peer string, trigger chan struct{}, stop chan struct{}) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-trigger:
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		n.sendTo(peer, trigger, stop)
+	}
+}
+
+func (n *Node) sendTo(peer string, trigger chan struct{}, stop chan struct{}) {
+	n.mtx.Lock()
+	select {
+	case <-stop:
+		n.mtx.Unlock()
+		return
+	default:
+	}
+	term := n.term
+	next := n.nextIndex[peer]
+	if next <= n.snapshot.Index {
+		req := &InstallSnapshotRequest{
+			Term:     term,
+			Leader:   n.id,
+			Snapshot: n.snapshot,
+		}
+		n.mtx.Unlock()
+
+		res, err := n.transport.InstallSnapshot(peer, req)
+		if err != nil {
+			return
+		}
+		n.mtx.Lock()
+		defer n.mtx.Unlock()
+		if res.Term > n.term {
+			n.stepDownToTerm(res.Term)
+			return
+		}
+		if n.state == stateLeader && n.term == term {
+			n.lastAck[peer] = time.Now()
+			n.matchIndex[peer] = req.Snapshot.Index
+			n.nextIndex[peer] = req.Snapshot.Index + 1
+			n.maybeCommit()
+			retrigger(trigger)
+		}
+		return
+	}
+
+	prevTerm, _ := n.termAt(next - 1)
+	req := &AppendEntriesRequest{
+		Term:         term,
+		Leader:       n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  prevTerm,
+		LeaderCommit: n.commitIndex,
+	}
+	for i := next; i <= n.lastIndex() && len(req.Entries) < maxAppendEntries; i++ {
+		req.Entries = append(req.Entries, n.entry(i))
+	}
+	n.mtx.Unlock()
+
+	res, err := n.transport.AppendEntries(peer, req)
+	if err != nil {
+		return
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if res.Term > n.term {
+		n.stepDownToTerm(res.Term)
+		return
+	}
+	if n.state != stateLeader || n.term != term {
+		return
+	}
+	n.lastAck[peer] = time.Now()
+	if res.Success {
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.maybeCommit()
+		if n.nextIndex[peer] <= n.lastIndex() {
+			retrigger(trigger)
+		}
+		return
+	}
+	// back off to the end of the peer's log, or one before the entry which
+	// didn't match
+	next = req.PrevLogIndex
+	if res.LastLogIndex+1 < next {
+		next = res.LastLogIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	n.nextIndex[peer] = next
+	retrigger(trigger)
+}
+
+func retrigger(trigger chan struct{}) {
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+// RequestVote handles a RequestVote RPC from a candidate.
+func (n *Node) RequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	if !n.isPeer(req.Candidate) {
+		return nil, ErrUnknownPeer
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if req.Term > n.term {
+		n.stepDownToTerm(req.Term)
+	}
+	res := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return res, nil
+	}
+	if n.votedFor != "" && n.votedFor != req.Candidate {
+		return res, nil
+	}
+	// only vote for candidates with logs at least as up to date
+	if req.LastLogTerm < n.lastTerm() || req.LastLogTerm == n.lastTerm() && req.LastLogIndex < n.lastIndex() {
+		return res, nil
+	}
+	if err := n.setTerm(n.term, req.Candidate); err != nil {
+		return nil, err
+	}
+	n.resetTimeout()
+	res.Granted = true
+	return res, nil
+}
+
+// AppendEntries handles an AppendEntries RPC from the leader.
+func (n *Node) AppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	if !n.isPeer(req.Leader) {
+		return nil, ErrUnknownPeer
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	res := &AppendEntriesResponse{Term: n.term, LastLogIndex: n.lastIndex()}
+	if req.Term < n.term {
+		return res, nil
+	}
+	if req.Term > n.term {
+		n.stepDownToTerm(req.Term)
+	} else if n.state != stateFollower {
+		n.becomeFollower()
+	}
+	n.leader = req.Leader
+	n.resetTimeout()
+	res.Term = n.term
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return res, nil
+	}
+	if req.PrevLogIndex >= n.snapshot.Index {
+		if term, _ := n.termAt(req.PrevLogIndex); term != req.PrevLogTerm {
+			res.LastLogIndex = req.PrevLogIndex - 1
+			return res, nil
+		}
+	}
+
+	for i, e := range req.Entries {
+		if e.Index <= n.snapshot.Index {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if term, _ := n.termAt(e.Index); term == e.Term {
+				continue
+			}
+			if err := n.store.Truncate(e.Index); err != nil {
+				return nil, err
+			}
+			n.log = n.log[:e.Index-n.snapshot.Index-1]
+		}
+		if err := n.appendEntries(req.Entries[i:]...); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = req.LeaderCommit
+		if last := req.PrevLogIndex + uint64(len(req.Entries)); last < n.commitIndex {
+			n.commitIndex = last
+		}
+		n.notifyApply()
+	}
+	res.Success = true
+	res.LastLogIndex = n.lastIndex()
+	return res, nil
+}
+
+// InstallSnapshot handles an InstallSnapshot RPC from the leader, which is
+// sent when the leader has compacted entries the node doesn't have.
+func (n *Node) InstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	if !n.isPeer(req.Leader) {
+		return nil, ErrUnknownPeer
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	res := &InstallSnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		return res, nil
+	}
+	if req.Term > n.term {
+		n.stepDownToTerm(req.Term)
+	} else if n.state != stateFollower {
+		n.becomeFollower()
+	}
+	n.leader = req.Leader
+	n.resetTimeout()
+	res.Term = n.term
+
+	snapshot := req.Snapshot
+	if snapshot.Index <= n.commitIndex {
+		// already have everything in the snapshot
+		return res, nil
+	}
+	if err := n.store.SetSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	if term, ok := n.termAt(snapshot.Index); ok && term == snapshot.Term {
+		n.log = n.log[snapshot.Index-n.snapshot.Index:]
+	} else {
+		if err := n.store.Truncate(snapshot.Index + 1); err != nil {
+			return nil, err
+		}
+		n.log = nil
+	}
+	n.snapshot = snapshot
+	n.commitIndex = snapshot.Index
+	n.restore = snapshot
+	n.notifyApply()
+	return res, nil
+}
+
+// applyLoop applies committed entries to the FSM, and takes snapshots once
+// enough entries have been applied.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.applyc:
+		case <-n.closed:
+			return
+		}
+
+		n.mtx.Lock()
+		if restore := n.restore; restore != nil {
+			n.restore = nil
+			n.lastApplied = restore.Index
+			n.mtx.Unlock()
+			if err := n.fsm.Restore(restore.Data); err != nil {
+				log.Printf("raft: error restoring snapshot: %s", err)
+			}
+			n.notifyApply()
+			continue
+		}
+		var entries []*Entry
+		for i := n.lastApplied + 1; i <= n.commitIndex; i++ {
+			entries = append(entries, n.entry(i))
+		}
+		n.mtx.Unlock()
+
+		for _, e := range entries {
+			var res interface{}
+			if e.Data != nil {
+				res = n.fsm.Apply(e.Index, e.Data)
+			}
+			n.mtx.Lock()
+			if n.restore == nil {
+				n.lastApplied = e.Index
+			}
+			if f, ok := n.futures[e.Index]; ok {
+				f <- applyResult{res: res}
+				delete(n.futures, e.Index)
+			}
+			n.mtx.Unlock()
+		}
+
+		n.mtx.Lock()
+		compact := n.restore == nil && n.lastApplied-n.snapshot.Index >= n.snapshotThreshold
+		index := n.lastApplied
+		n.mtx.Unlock()
+		if compact {
+			n.takeSnapshot(index)
+		}
+	}
+}
+
+func (n *Node) takeSnapshot(index uint64) {
+	data, err := n.fsm.Snapshot()
+	if err != nil {
+		log.Printf("raft: error taking snapshot: %s", err)
+		return
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	term, ok := n.termAt(index)
+	if !ok || index <= n.snapshot.Index {
+		return
+	}
+	snapshot := &Snapshot{Index: index, Term: term, Data: data}
+	if err := n.store.SetSnapshot(snapshot); err != nil {
+		log.Printf("raft: error saving snapshot: %s", err)
+		return
+	}
+	n.log = n.log[index-n.snapshot.Index:]
+	n.snapshot = snapshot
+}
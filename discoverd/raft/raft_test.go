@@ -0,0 +1,321 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type RaftSuite struct{}
+
+var _ = Suite(&RaftSuite{})
+
+// testFSM appends each command to a list.
+type testFSM struct {
+	mtx  sync.Mutex
+	cmds []string
+}
+
+func (f *testFSM) Apply(index uint64, cmd []byte) interface{} {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.cmds = append(f.cmds, string(cmd))
+	return len(f.cmds)
+}
+
+func (f *testFSM) Snapshot() ([]byte, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return json.Marshal(f.cmds)
+}
+
+func (f *testFSM) Restore(data []byte) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.cmds = nil
+	return json.Unmarshal(data, &f.cmds)
+}
+
+func (f *testFSM) commands() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string(nil), f.cmds...)
+}
+
+type testCluster struct {
+	transport *MemoryTransport
+	ids       []string
+	nodes     map[string]*Node
+	fsms      map[string]*testFSM
+	stores    map[string]Store
+	threshold uint64
+}
+
+func newTestCluster(c *C, size int, threshold uint64) *testCluster {
+	tc := &testCluster{
+		transport: NewMemoryTransport(),
+		nodes:     make(map[string]*Node, size),
+		fsms:      make(map[string]*testFSM, size),
+		stores:    make(map[string]Store, size),
+		threshold: threshold,
+	}
+	for i := 0; i < size; i++ {
+		tc.ids = append(tc.ids, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range tc.ids {
+		tc.stores[id] = NewMemoryStore()
+		tc.start(c, id)
+	}
+	return tc
+}
+
+func (tc *testCluster) start(c *C, id string) {
+	tc.startWithPeers(c, id, tc.ids)
+}
+
+func (tc *testCluster) startWithPeers(c *C, id string, peers []string) {
+	fsm := &testFSM{}
+	node, err := NewNode(Config{
+		ID:                id,
+		Peers:             peers,
+		Store:             tc.stores[id],
+		Transport:         tc.transport.Sender(id),
+		FSM:               fsm,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   100 * time.Millisecond,
+		SnapshotThreshold: tc.threshold,
+	})
+	c.Assert(err, IsNil)
+	tc.transport.Add(node)
+	tc.nodes[id] = node
+	tc.fsms[id] = fsm
+}
+
+func (tc *testCluster) close() {
+	for _, n := range tc.nodes {
+		n.Close()
+	}
+}
+
+// waitForLeader waits for a single connected node to become leader and
+// returns it.
+func (tc *testCluster) waitForLeader(c *C, exclude ...string) *Node {
+	excluded := make(map[string]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		var leader *Node
+		for id, n := range tc.nodes {
+			if !excluded[id] && n.IsLeader() {
+				leader = n
+			}
+		}
+		if leader != nil {
+			return leader
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for leader")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (tc *testCluster) waitForCommands(c *C, id string, expected []string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		cmds := tc.fsms[id].commands()
+		if len(cmds) == len(expected) {
+			c.Assert(cmds, DeepEquals, expected)
+			return
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for %s commands, got %v, want %v", id, cmds, expected)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (RaftSuite) TestSingleNode(c *C) {
+	tc := newTestCluster(c, 1, 0)
+	defer tc.close()
+
+	leader := tc.waitForLeader(c)
+	for i := 1; i <= 3; i++ {
+		res, err := leader.Apply([]byte(fmt.Sprintf("cmd%d", i)), time.Second)
+		c.Assert(err, IsNil)
+		c.Assert(res, Equals, i)
+	}
+	c.Assert(tc.fsms["node0"].commands(), DeepEquals, []string{"cmd1", "cmd2", "cmd3"})
+}
+
+func (RaftSuite) TestReplication(c *C) {
+	tc := newTestCluster(c, 3, 0)
+	defer tc.close()
+
+	leader := tc.waitForLeader(c)
+	for _, n := range tc.nodes {
+		if n != leader {
+			_, err := n.Apply([]byte("cmd"), time.Second)
+			c.Assert(err, Equals, ErrNotLeader)
+			c.Assert(n.Leader(), Equals, leader.ID())
+		}
+	}
+
+	expected := []string{"cmd1", "cmd2", "cmd3"}
+	for _, cmd := range expected {
+		_, err := leader.Apply([]byte(cmd), time.Second)
+		c.Assert(err, IsNil)
+	}
+	for _, id := range tc.ids {
+		tc.waitForCommands(c, id, expected)
+	}
+}
+
+func (RaftSuite) TestLeaderFailover(c *C) {
+	tc := newTestCluster(c, 3, 0)
+	defer tc.close()
+
+	leader := tc.waitForLeader(c)
+	_, err := leader.Apply([]byte("cmd1"), time.Second)
+	c.Assert(err, IsNil)
+
+	// a partitioned leader can't commit commands and steps down
+	old := leader.ID()
+	tc.transport.SetDisconnected(old, true)
+	_, err = leader.Apply([]byte("lost"), 500*time.Millisecond)
+	c.Assert(err, NotNil)
+
+	leader = tc.waitForLeader(c, old)
+	c.Assert(leader.ID(), Not(Equals), old)
+	_, err = leader.Apply([]byte("cmd2"), time.Second)
+	c.Assert(err, IsNil)
+
+	// when the partition heals, the old leader discards its uncommitted
+	// entry and catches up
+	tc.transport.SetDisconnected(old, false)
+	for _, id := range tc.ids {
+		tc.waitForCommands(c, id, []string{"cmd1", "cmd2"})
+	}
+}
+
+func (RaftSuite) TestSnapshot(c *C) {
+	tc := newTestCluster(c, 3, 5)
+	defer tc.close()
+
+	leader := tc.waitForLeader(c)
+	var lagging string
+	for _, id := range tc.ids {
+		if id != leader.ID() {
+			lagging = id
+			break
+		}
+	}
+	tc.transport.SetDisconnected(lagging, true)
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		cmd := fmt.Sprintf("cmd%d", i)
+		expected = append(expected, cmd)
+		_, err := leader.Apply([]byte(cmd), time.Second)
+		c.Assert(err, IsNil)
+	}
+	leader.mtx.Lock()
+	c.Assert(leader.snapshot.Index > 5, Equals, true)
+	c.Assert(len(leader.log) < 20, Equals, true)
+	leader.mtx.Unlock()
+
+	// the lagging node is sent a snapshot as the entries it is missing
+	// have been compacted
+	tc.transport.SetDisconnected(lagging, false)
+	tc.waitForCommands(c, lagging, expected)
+}
+
+func (RaftSuite) TestRestart(c *C) {
+	dir := c.MkDir()
+	tc := newTestCluster(c, 1, 3)
+	defer tc.close()
+	tc.nodes["node0"].Close()
+
+	store, err := NewBoltStore(filepath.Join(dir, "raft.db"))
+	c.Assert(err, IsNil)
+	tc.stores["node0"] = store
+	tc.start(c, "node0")
+
+	var expected []string
+	for i := 0; i < 5; i++ {
+		cmd := fmt.Sprintf("cmd%d", i)
+		expected = append(expected, cmd)
+		_, err := tc.waitForLeader(c).Apply([]byte(cmd), time.Second)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tc.nodes["node0"].Close(), IsNil)
+
+	// the snapshot and entries following it are restored
+	store, err = NewBoltStore(filepath.Join(dir, "raft.db"))
+	c.Assert(err, IsNil)
+	tc.stores["node0"] = store
+	tc.start(c, "node0")
+	leader := tc.waitForLeader(c)
+	_, err = leader.Apply([]byte("cmd5"), time.Second)
+	c.Assert(err, IsNil)
+	tc.waitForCommands(c, "node0", append(expected, "cmd5"))
+}
+
+func (RaftSuite) TestFixedPeers(c *C) {
+	tc := newTestCluster(c, 3, 0)
+	defer tc.close()
+	leader := tc.waitForLeader(c)
+	_, err := leader.Apply([]byte("cmd1"), time.Second)
+	c.Assert(err, IsNil)
+
+	// RPCs from nodes which are not peers are rejected without changing
+	// the term
+	leader.mtx.Lock()
+	term := leader.term
+	leader.mtx.Unlock()
+	_, err = leader.RequestVote(&RequestVoteRequest{Term: term + 1, Candidate: "node3", LastLogIndex: 100, LastLogTerm: term + 1})
+	c.Assert(err, Equals, ErrUnknownPeer)
+	_, err = leader.AppendEntries(&AppendEntriesRequest{Term: term + 1, Leader: "node3"})
+	c.Assert(err, Equals, ErrUnknownPeer)
+	_, err = leader.InstallSnapshot(&InstallSnapshotRequest{Term: term + 1, Leader: "node3", Snapshot: &Snapshot{}})
+	c.Assert(err, Equals, ErrUnknownPeer)
+	c.Assert(leader.IsLeader(), Equals, true)
+	leader.mtx.Lock()
+	c.Assert(leader.term, Equals, term)
+	leader.mtx.Unlock()
+
+	// a node can't be restarted with different peers
+	id := tc.ids[0]
+	c.Assert(tc.nodes[id].Close(), IsNil)
+	for _, peers := range [][]string{
+		append(tc.ids, "node3"),
+		tc.ids[:2],
+		{id, tc.ids[1], "node3"},
+	} {
+		_, err := NewNode(Config{
+			ID:        id,
+			Peers:     peers,
+			Store:     tc.stores[id],
+			Transport: tc.transport.Sender(id),
+			FSM:       &testFSM{},
+		})
+		c.Assert(err, ErrorMatches, "raft: configured peers .* differ from the peers .*", Commentf("peers %v", peers))
+	}
+
+	// the same peers in a different order and without the node's own ID
+	// are accepted
+	tc.startWithPeers(c, id, []string{tc.ids[2], tc.ids[1]})
+	tc.waitForCommands(c, id, []string{"cmd1"})
+}
@@ -0,0 +1,301 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/boltdb/bolt"
+)
+
+// Entry is an entry in the replicated log.
+type Entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	// Data is the command, it is nil for the empty entry a leader appends
+	// when it is elected.
+	Data []byte `json:"data"`
+}
+
+// Snapshot is the state of the FSM after applying the entry at Index, which
+// has term Term.
+type Snapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+// Store persists the state of a node.
+type Store interface {
+	// State returns the current term and the candidate voted for in it.
+	State() (term uint64, votedFor string, err error)
+	SetState(term uint64, votedFor string) error
+
+	// Peers returns the addresses of the nodes the log was created with,
+	// or nil if they haven't been set.
+	Peers() ([]string, error)
+	SetPeers(peers []string) error
+
+	// Snapshot returns the latest snapshot, or nil if there isn't one.
+	Snapshot() (*Snapshot, error)
+	// SetSnapshot stores snapshot and deletes the entries it includes.
+	SetSnapshot(snapshot *Snapshot) error
+
+	// Entries returns the stored log entries in index order.
+	Entries() ([]*Entry, error)
+	Append(entries []*Entry) error
+	// Truncate deletes the entries with an index of index or greater.
+	Truncate(index uint64) error
+
+	Close() error
+}
+
+var (
+	bucketState   = []byte("state")
+	bucketEntries = []byte("entries")
+
+	keyTerm     = []byte("term")
+	keyVote     = []byte("vote")
+	keyPeers    = []byte("peers")
+	keySnapshot = []byte("snapshot")
+)
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore returns a Store which persists state to a BoltDB file at path.
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketState); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketEntries)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func encodeIndex(index uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, index)
+	return b
+}
+
+func (s *boltStore) State() (term uint64, votedFor string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketState)
+		if v := b.Get(keyTerm); v != nil {
+			term = binary.BigEndian.Uint64(v)
+		}
+		votedFor = string(b.Get(keyVote))
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) SetState(term uint64, votedFor string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketState)
+		if err := b.Put(keyTerm, encodeIndex(term)); err != nil {
+			return err
+		}
+		return b.Put(keyVote, []byte(votedFor))
+	})
+}
+
+func (s *boltStore) Peers() ([]string, error) {
+	var peers []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketState).Get(keyPeers)
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &peers)
+	})
+	return peers, err
+}
+
+func (s *boltStore) SetPeers(peers []string) error {
+	data, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketState).Put(keyPeers, data)
+	})
+}
+
+func (s *boltStore) Snapshot() (*Snapshot, error) {
+	var snapshot *Snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketState).Get(keySnapshot)
+		if v == nil {
+			return nil
+		}
+		snapshot = &Snapshot{}
+		return json.Unmarshal(v, snapshot)
+	})
+	return snapshot, err
+}
+
+func (s *boltStore) SetSnapshot(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketState).Put(keySnapshot, data); err != nil {
+			return err
+		}
+		c := tx.Bucket(bucketEntries).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= snapshot.Index; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Entries() ([]*Entry, error) {
+	var entries []*Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketEntries).ForEach(func(k, v []byte) error {
+			e := &Entry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *boltStore) Append(entries []*Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketEntries)
+		for _, e := range entries {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(encodeIndex(e.Index), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Truncate(index uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketEntries).Cursor()
+		for k, _ := c.Seek(encodeIndex(index)); k != nil; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// MemoryStore is a Store which keeps state in memory, it is intended for
+// testing.
+type MemoryStore struct {
+	mtx      sync.Mutex
+	term     uint64
+	votedFor string
+	peers    []string
+	snapshot *Snapshot
+	entries  []*Entry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) State() (uint64, string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.term, s.votedFor, nil
+}
+
+func (s *MemoryStore) SetState(term uint64, votedFor string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.term, s.votedFor = term, votedFor
+	return nil
+}
+
+func (s *MemoryStore) Peers() ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.peers, nil
+}
+
+func (s *MemoryStore) SetPeers(peers []string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.peers = peers
+	return nil
+}
+
+func (s *MemoryStore) Snapshot() (*Snapshot, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.snapshot, nil
+}
+
+func (s *MemoryStore) SetSnapshot(snapshot *Snapshot) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.snapshot = snapshot
+	entries := s.entries[:0:0]
+	for _, e := range s.entries {
+		if e.Index > snapshot.Index {
+			entries = append(entries, e)
+		}
+	}
+	s.entries = entries
+	return nil
+}
+
+func (s *MemoryStore) Entries() ([]*Entry, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]*Entry(nil), s.entries...), nil
+}
+
+func (s *MemoryStore) Append(entries []*Entry) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+func (s *MemoryStore) Truncate(index uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, e := range s.entries {
+		if e.Index >= index {
+			s.entries = s.entries[:i]
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error { return nil }
@@ -0,0 +1,214 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	hh "github.com/flynn/flynn/pkg/httphelper"
+)
+
+type RequestVoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type RequestVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendEntriesRequest struct {
+	Term         uint64   `json:"term"`
+	Leader       string   `json:"leader"`
+	PrevLogIndex uint64   `json:"prev_log_index"`
+	PrevLogTerm  uint64   `json:"prev_log_term"`
+	Entries      []*Entry `json:"entries,omitempty"`
+	LeaderCommit uint64   `json:"leader_commit"`
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastLogIndex is the index of the last entry in the follower's log,
+	// or the index before the first entry that conflicted, which the leader
+	// uses to find where the logs diverge.
+	LastLogIndex uint64 `json:"last_log_index"`
+}
+
+type InstallSnapshotRequest struct {
+	Term     uint64    `json:"term"`
+	Leader   string    `json:"leader"`
+	Snapshot *Snapshot `json:"snapshot"`
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport sends RPCs to the peer with the given address.
+type Transport interface {
+	RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// HTTPTransport sends RPCs as JSON over HTTP to the handler returned by
+// NewHTTPHandler, peers are addressed by host and port.
+type HTTPTransport struct {
+	Client *http.Client
+}
+
+// NewHTTPTransport returns a transport which times out RPCs after timeout.
+func NewHTTPTransport(timeout time.Duration) *HTTPTransport {
+	return &HTTPTransport{Client: &http.Client{Timeout: timeout}}
+}
+
+func (t *HTTPTransport) post(peer, rpc string, req, res interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := t.Client.Post(fmt.Sprintf("http://%s/raft/%s", peer, rpc), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: unexpected status %d from %s", r.StatusCode, peer)
+	}
+	return json.NewDecoder(r.Body).Decode(res)
+}
+
+func (t *HTTPTransport) RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	res := &RequestVoteResponse{}
+	return res, t.post(peer, "request_vote", req, res)
+}
+
+func (t *HTTPTransport) AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	res := &AppendEntriesResponse{}
+	return res, t.post(peer, "append_entries", req, res)
+}
+
+func (t *HTTPTransport) InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	res := &InstallSnapshotResponse{}
+	return res, t.post(peer, "install_snapshot", req, res)
+}
+
+// NewHTTPHandler returns a handler serving the RPCs sent by HTTPTransport to
+// node.
+func NewHTTPHandler(node *Node) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/request_vote", func(w http.ResponseWriter, req *http.Request) {
+		var rpc RequestVoteRequest
+		serveRPC(w, req, &rpc, func() (interface{}, error) { return node.RequestVote(&rpc) })
+	})
+	mux.HandleFunc("/raft/append_entries", func(w http.ResponseWriter, req *http.Request) {
+		var rpc AppendEntriesRequest
+		serveRPC(w, req, &rpc, func() (interface{}, error) { return node.AppendEntries(&rpc) })
+	})
+	mux.HandleFunc("/raft/install_snapshot", func(w http.ResponseWriter, req *http.Request) {
+		var rpc InstallSnapshotRequest
+		serveRPC(w, req, &rpc, func() (interface{}, error) { return node.InstallSnapshot(&rpc) })
+	})
+	return mux
+}
+
+func serveRPC(w http.ResponseWriter, req *http.Request, rpc interface{}, handle func() (interface{}, error)) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(rpc); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	res, err := handle()
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	hh.JSON(w, 200, res)
+}
+
+var errUnreachable = errors.New("raft: peer unreachable")
+
+// MemoryTransport delivers RPCs directly to nodes in the same process, it is
+// intended for testing.
+type MemoryTransport struct {
+	mtx          sync.RWMutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		nodes:        make(map[string]*Node),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Add makes node reachable by its ID.
+func (t *MemoryTransport) Add(node *Node) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.nodes[node.ID()] = node
+}
+
+// SetDisconnected partitions the node with id from all other nodes if
+// disconnected is true, or heals the partition otherwise.
+func (t *MemoryTransport) SetDisconnected(id string, disconnected bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.disconnected[id] = disconnected
+}
+
+// Sender returns a Transport which sends RPCs from the node with id.
+func (t *MemoryTransport) Sender(id string) Transport {
+	return &memorySender{t: t, from: id}
+}
+
+func (t *MemoryTransport) node(from, to string) (*Node, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	n, ok := t.nodes[to]
+	if !ok || t.disconnected[from] || t.disconnected[to] {
+		return nil, errUnreachable
+	}
+	return n, nil
+}
+
+type memorySender struct {
+	t    *MemoryTransport
+	from string
+}
+
+func (s *memorySender) RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n, err := s.t.node(s.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.RequestVote(req)
+}
+
+func (s *memorySender) AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n, err := s.t.node(s.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.AppendEntries(req)
+}
+
+func (s *memorySender) InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n, err := s.t.node(s.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.InstallSnapshot(req)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/health"
+)
+
+const (
+	defaultCheckInterval  = 2 * time.Second
+	defaultCheckThreshold = 2
+)
+
+// HealthChecker runs the health checks declared in the config of services
+// against their registered instances, and marks instances as down in the
+// State while their check is failing.
+//
+// Every discoverd server runs the checks itself, so an instance being down
+// only affects the State of the server which checked it. Instances are never
+// deregistered because of a failing check, and failing instances remain
+// eligible as the leader so that all servers agree on the leader.
+type HealthChecker struct {
+	state *State
+
+	// interval is how often the running checks are updated to match the
+	// registered instances.
+	interval time.Duration
+
+	checks map[instanceKey]*instanceCheck
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// instanceCheck is a running health check of an instance.
+type instanceCheck struct {
+	config discoverd.HealthCheck
+	addr   string
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewHealthChecker starts running the health checks of services in state.
+func NewHealthChecker(state *State) *HealthChecker {
+	return newHealthChecker(state, time.Second)
+}
+
+func newHealthChecker(state *State, interval time.Duration) *HealthChecker {
+	c := &HealthChecker{
+		state:    state,
+		interval: interval,
+		checks:   make(map[instanceKey]*instanceCheck),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Close stops all health checks.
+func (c *HealthChecker) Close() {
+	close(c.stop)
+	<-c.done
+}
+
+func (c *HealthChecker) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.update()
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			for k, check := range c.checks {
+				check.close()
+				delete(c.checks, k)
+			}
+			return
+		}
+	}
+}
+
+// update starts checks of newly registered instances, and stops those of
+// instances which have been removed or whose check has changed.
+func (c *HealthChecker) update() {
+	wanted := make(map[instanceKey]struct{})
+	for _, service := range c.state.ListServices() {
+		config := c.state.GetConfig(service)
+		if config == nil || config.Check == nil {
+			continue
+		}
+		for _, inst := range c.state.GetAll(service) {
+			k := instanceKey{service, inst.ID}
+			wanted[k] = struct{}{}
+			if check, ok := c.checks[k]; ok {
+				if check.config == *config.Check && check.addr == inst.Addr {
+					continue
+				}
+				check.close()
+			}
+			check, err := c.startCheck(service, inst, *config.Check)
+			if err != nil {
+				log.Printf("Error starting health check of %s/%s: %s", service, inst.ID, err)
+				delete(c.checks, k)
+				continue
+			}
+			c.checks[k] = check
+		}
+	}
+	for k, check := range c.checks {
+		if _, ok := wanted[k]; !ok {
+			check.close()
+			delete(c.checks, k)
+		}
+	}
+}
+
+func newCheck(config *discoverd.HealthCheck, addr string) (health.Check, error) {
+	switch config.Type {
+	case "tcp":
+		return &health.TCPCheck{Addr: addr, Timeout: config.Timeout}, nil
+	case "http", "https":
+		return &health.HTTPCheck{
+			URL:        fmt.Sprintf("%s://%s%s", config.Type, addr, config.Path),
+			Host:       config.Host,
+			Timeout:    config.Timeout,
+			StatusCode: config.Status,
+			MatchBytes: []byte(config.Match),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported check type: %s", config.Type)
+	}
+}
+
+func (c *HealthChecker) startCheck(service string, inst *discoverd.Instance, config discoverd.HealthCheck) (*instanceCheck, error) {
+	check, err := newCheck(&config, inst.Addr)
+	if err != nil {
+		return nil, err
+	}
+	ic := &instanceCheck{
+		config: config,
+		addr:   inst.Addr,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go ic.run(c.state, service, inst, check)
+	return ic, nil
+}
+
+func (ic *instanceCheck) close() {
+	close(ic.stop)
+	<-ic.done
+}
+
+// run checks the instance every interval, marking it as down after threshold
+// consecutive failures and up again after threshold consecutive successes.
+// Instances are assumed to be up when they are registered, otherwise the check
+// carries on from the instance's existing status, for example when the check
+// is restarted because its config changed.
+func (ic *instanceCheck) run(state *State, service string, inst *discoverd.Instance, check health.Check) {
+	defer close(ic.done)
+
+	interval := ic.config.Interval
+	if interval == 0 {
+		interval = defaultCheckInterval
+	}
+	threshold := ic.config.Threshold
+	if threshold == 0 {
+		threshold = defaultCheckThreshold
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	status := discoverd.CheckStatusUp
+	var failures, successes int
+	if inst.Check != nil {
+		status = inst.Check.Status
+		failures = inst.Check.Failures
+	}
+	for {
+		err := check.Check()
+		res := &discoverd.CheckStatus{LastCheck: time.Now()}
+		if err != nil {
+			failures++
+			successes = 0
+			if failures >= threshold {
+				status = discoverd.CheckStatusDown
+			}
+			res.LastError = err.Error()
+		} else {
+			successes++
+			failures = 0
+			if successes >= threshold {
+				status = discoverd.CheckStatusUp
+			}
+		}
+		res.Status = status
+		res.Failures = failures
+
+		select {
+		case <-ic.stop:
+			// don't update the state after the check was stopped
+			return
+		default:
+		}
+		state.SetCheckStatus(service, inst.ID, res)
+
+		select {
+		case <-ticker.C:
+		case <-ic.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+type HealthCheckerSuite struct{}
+
+var _ = Suite(&HealthCheckerSuite{})
+
+func acceptConns(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+func (HealthCheckerSuite) TestCheckInstances(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go acceptConns(l)
+
+	state := NewState()
+	state.AddService("a", &discoverd.ServiceConfig{
+		LeaderType: discoverd.LeaderTypeOldest,
+		Check: &discoverd.HealthCheck{
+			Type:      "tcp",
+			Interval:  10 * time.Millisecond,
+			Threshold: 2,
+			Timeout:   100 * time.Millisecond,
+		},
+	})
+	inst := &discoverd.Instance{Addr: l.Addr().String(), Proto: "tcp"}
+	inst.ID = md5sum(inst.Proto + "-" + inst.Addr)
+	state.AddInstance("a", inst)
+
+	events := make(chan *discoverd.Event, 1)
+	state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindDown, events)
+
+	checker := newHealthChecker(state, 10*time.Millisecond)
+	defer checker.Close()
+
+	waitForStatus := func(status string) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			all := state.GetAll("a")
+			if len(all) == 1 && all[0].Check != nil && all[0].Check.Status == status {
+				return
+			}
+		}
+		c.Fatalf("timed out waiting for check status %s", status)
+	}
+
+	// passing instance stays up
+	waitForStatus(discoverd.CheckStatusUp)
+	assertNoEvent(c, events)
+
+	// failing instance is marked as down but stays registered
+	l.Close()
+	assertEvent(c, events, "a", discoverd.EventKindDown, inst)
+	waitForStatus(discoverd.CheckStatusDown)
+	c.Assert(state.Get("a"), HasLen, 0)
+	c.Assert(state.GetAll("a")[0].Check.LastError, Not(Equals), "")
+
+	// instance is marked as up once the check passes again
+	l, err = net.Listen("tcp", inst.Addr)
+	c.Assert(err, IsNil)
+	go acceptConns(l)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst)
+	c.Assert(state.Get("a"), HasLen, 1)
+}
+
+func (HealthCheckerSuite) TestCheckKeepsStatus(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go acceptConns(l)
+
+	state := NewState()
+	state.AddService("a", &discoverd.ServiceConfig{
+		LeaderType: discoverd.LeaderTypeOldest,
+		Check: &discoverd.HealthCheck{
+			Type:      "tcp",
+			Interval:  50 * time.Millisecond,
+			Threshold: 3,
+			Timeout:   100 * time.Millisecond,
+		},
+	})
+	inst := &discoverd.Instance{Addr: l.Addr().String(), Proto: "tcp"}
+	inst.ID = md5sum(inst.Proto + "-" + inst.Addr)
+	state.AddInstance("a", inst)
+
+	// the instance failed the check of a previous checker
+	state.SetCheckStatus("a", inst.ID, &discoverd.CheckStatus{Status: discoverd.CheckStatusDown, Failures: 3})
+	c.Assert(state.Get("a"), HasLen, 0)
+
+	events := make(chan *discoverd.Event, 1)
+	state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindDown, events)
+
+	start := time.Now()
+	checker := newHealthChecker(state, 10*time.Millisecond)
+	defer checker.Close()
+
+	// the first passing check doesn't mark the instance as up
+	var status *discoverd.CheckStatus
+	for ; time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+		if s := state.GetAll("a")[0].Check; s.LastCheck.After(start) {
+			status = s
+			break
+		}
+	}
+	c.Assert(status, NotNil)
+	c.Assert(status.Status, Equals, discoverd.CheckStatusDown)
+	c.Assert(status.Failures, Equals, 0)
+	c.Assert(state.Get("a"), HasLen, 0)
+	assertNoEvent(c, events)
+
+	// it is marked as up after threshold passing checks
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst)
+	c.Assert(state.Get("a"), HasLen, 1)
+}
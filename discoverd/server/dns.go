@@ -2,7 +2,9 @@ package server
 
 import (
 	"fmt"
+	"math"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +17,7 @@ import (
 type DNSStore interface {
 	Get(string) []*discoverd.Instance
 	GetLeader(string) *discoverd.Instance
+	GetConfig(string) *discoverd.ServiceConfig
 }
 
 type DNSServer struct {
@@ -27,6 +30,10 @@ type DNSServer struct {
 	servers []*dns.Server
 }
 
+// maxUDPRecords is the maximum number of instances included in responses to
+// UDP requests without EDNS0, for which responses must fit in 512 bytes.
+// Responses to EDNS0 requests include as many instances as fit in the
+// requested UDP payload size.
 const maxUDPRecords = 3
 const dnsDomain = "discoverd."
 
@@ -167,6 +174,10 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 	res.Authoritative = true
 	res.RecursionAvailable = len(d.Recursors) > 0
 	res.SetReply(req)
+	opt := req.IsEdns0()
+	if opt != nil {
+		res.SetEdns0(udpSize(opt), opt.Do())
+	}
 	defer func() {
 		if res.Rcode == dns.RcodeSuccess && qType == dns.TypeSOA {
 			// SOA answer if requested. at the end of the request to ensure we didn't hit NXDOMAIN
@@ -206,6 +217,11 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	var ttl uint32
+	if config := d.Store.GetConfig(service); config != nil {
+		ttl = config.DNSTTL
+	}
+
 	var instances []*discoverd.Instance
 	if !leader {
 		instances = d.Store.Get(service)
@@ -243,13 +259,13 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		}
 		res.Answer = make([]dns.RR, 0, 2)
 		if qType != dns.TypeSRV {
-			res.Answer = append(res.Answer, addrRecord(qName, addr))
+			res.Answer = append(res.Answer, addrRecord(qName, addr, ttl))
 		}
 		if qType == dns.TypeSRV || qType == dns.TypeANY {
-			res.Answer = append(res.Answer, d.srvRecord(qName, service, addr, false))
+			res.Answer = append(res.Answer, d.srvRecord(qName, service, addr, false, ttl))
 		}
 		if tcp && qType == dns.TypeSRV {
-			res.Extra = []dns.RR{addrRecord(qName, addr)}
+			res.Extra = append(res.Extra, addrRecord(qName, addr, ttl))
 		}
 		return
 	}
@@ -285,34 +301,56 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		// return empty response
 		return
 	}
-	shuffle(addrs)
+	sortAddrs(addrs)
 
 	// Truncate the response if we're using UDP
-	if !tcp && len(addrs) > maxUDPRecords {
+	switch {
+	case tcp:
+	case opt != nil:
+		// drop the lowest ordered instances until the response fits
+		for n := len(addrs); n > 0; n-- {
+			d.setAnswer(res, qName, qType, service, addrs[:n], tcp, ttl)
+			if res.Len() <= int(udpSize(opt)) {
+				break
+			}
+		}
+		return
+	case len(addrs) > maxUDPRecords:
 		addrs = addrs[:maxUDPRecords]
 	}
+	d.setAnswer(res, qName, qType, service, addrs, tcp, ttl)
+}
 
+func (d dnsAPI) setAnswer(res *dns.Msg, qName string, qType uint16, service string, addrs []*addrData, tcp bool, ttl uint32) {
 	res.Answer = make([]dns.RR, 0, len(addrs)*2)
 	for _, addr := range addrs {
 		if qType == dns.TypeANY || qType == dns.TypeA || qType == dns.TypeAAAA {
-			res.Answer = append(res.Answer, addrRecord(qName, addr))
+			res.Answer = append(res.Answer, addrRecord(qName, addr, ttl))
 		}
 	}
 	for _, addr := range addrs {
 		if qType == dns.TypeANY || qType == dns.TypeSRV {
-			res.Answer = append(res.Answer, d.srvRecord(qName, service, addr, true))
+			res.Answer = append(res.Answer, d.srvRecord(qName, service, addr, true, ttl))
 		}
 	}
 
 	if qType == dns.TypeSRV && tcp {
 		// Add extra records mapping instance IDs to addresses
-		res.Extra = make([]dns.RR, len(addrs))
-		for i, addr := range addrs {
-			res.Extra[i] = addrRecord(d.instanceDomain(service, addr.ID), addr)
+		for _, addr := range addrs {
+			res.Extra = append(res.Extra, addrRecord(d.instanceDomain(service, addr.ID), addr, ttl))
 		}
 	}
 }
 
+// udpSize returns the maximum UDP response size advertised by an EDNS0
+// request.
+func udpSize(opt *dns.OPT) uint16 {
+	if size := opt.UDPSize(); size > dns.MinMsgSize {
+		return size
+	}
+	return dns.MinMsgSize
+}
+
 func (d dnsAPI) soaRecord() dns.RR {
 	return &dns.SOA{
 		Hdr: dns.RR_Header{
@@ -329,15 +367,16 @@ func (d dnsAPI) soaRecord() dns.RR {
 	}
 }
 
-func (d dnsAPI) srvRecord(name, service string, addr *addrData, instTarget bool) dns.RR {
+func (d dnsAPI) srvRecord(name, service string, addr *addrData, instTarget bool, ttl uint32) dns.RR {
 	r := &dns.SRV{
 		Hdr: dns.RR_Header{
 			Name:   name,
 			Rrtype: dns.TypeSRV,
 			Class:  dns.ClassINET,
+			Ttl:    ttl,
 		},
-		Priority: 1,
-		Weight:   1,
+		Priority: addr.Priority,
+		Weight:   addr.Weight,
 		Port:     addr.Port,
 		Target:   name,
 	}
@@ -351,13 +390,14 @@ func (d dnsAPI) instanceDomain(service, id string) string {
 	return fmt.Sprintf("%s.%s._i.%s", id, service, d.Domain)
 }
 
-func addrRecord(name string, addr *addrData) dns.RR {
+func addrRecord(name string, addr *addrData, ttl uint32) dns.RR {
 	if addr.IPv6 != nil {
 		return &dns.AAAA{
 			Hdr: dns.RR_Header{
 				Name:   name,
 				Rrtype: dns.TypeAAAA,
 				Class:  dns.ClassINET,
+				Ttl:    ttl,
 			},
 			AAAA: addr.IPv6,
 		}
@@ -367,6 +407,7 @@ func addrRecord(name string, addr *addrData) dns.RR {
 			Name:   name,
 			Rrtype: dns.TypeA,
 			Class:  dns.ClassINET,
+			Ttl:    ttl,
 		},
 		A: addr.IPv4,
 	}
@@ -378,10 +419,17 @@ type addrData struct {
 	String string
 	Port   uint16
 	ID     string
+
+	Priority uint16
+	Weight   uint16
 }
 
 func parseAddr(inst *discoverd.Instance) *addrData {
-	res := &addrData{ID: inst.ID}
+	res := &addrData{
+		ID:       inst.ID,
+		Priority: metaUint16(inst, discoverd.InstanceMetaPriority, 1),
+		Weight:   metaUint16(inst, discoverd.InstanceMetaWeight, 1),
+	}
 	ip, port, _ := net.SplitHostPort(inst.Addr)
 	res.String = ip
 	portInt, _ := strconv.Atoi(port)
@@ -394,12 +442,43 @@ func parseAddr(inst *discoverd.Instance) *addrData {
 	return res
 }
 
-func shuffle(s []*addrData) []*addrData {
-	for i := len(s) - 1; i > 0; i-- {
-		j := random.Math.Intn(i + 1)
-		s[i], s[j] = s[j], s[i]
+// metaUint16 returns the value of the instance metadata key, or def if it is
+// unset or invalid.
+func metaUint16(inst *discoverd.Instance, key string, def uint16) uint16 {
+	v, err := strconv.ParseUint(inst.Meta[key], 10, 16)
+	if err != nil {
+		return def
+	}
+	return uint16(v)
+}
+
+// sortAddrs orders addresses by priority, and randomly within each priority
+// so that the chance of an address being first is proportional to its
+// weight. Addresses with a weight of zero are ordered after all others of the
+// same priority.
+func sortAddrs(s []*addrData) {
+	keys := make(map[*addrData]float64, len(s))
+	for _, addr := range s {
+		// weighted random sampling as described by Efraimidis and Spirakis
+		if addr.Weight > 0 {
+			keys[addr] = math.Pow(random.Math.Float64(), 1/float64(addr.Weight))
+		}
+	}
+	sort.Sort(addrsByPriority{s, keys})
+}
+
+type addrsByPriority struct {
+	addrs []*addrData
+	keys  map[*addrData]float64
+}
+
+func (a addrsByPriority) Len() int      { return len(a.addrs) }
+func (a addrsByPriority) Swap(i, j int) { a.addrs[i], a.addrs[j] = a.addrs[j], a.addrs[i] }
+func (a addrsByPriority) Less(i, j int) bool {
+	if a.addrs[i].Priority != a.addrs[j].Priority {
+		return a.addrs[i].Priority < a.addrs[j].Priority
 	}
-	return s
+	return a.keys[a.addrs[i]] > a.keys[a.addrs[j]]
 }
 
 func isTCP(addr net.Addr) bool {
@@ -558,6 +558,106 @@ func (s *DNSSuite) TestServiceLookup(c *C) {
 	}
 }
 
+func (s *DNSSuite) exchange(c *C, req *dns.Msg) *dns.Msg {
+	res, _, err := (&dns.Client{}).Exchange(req, s.srv.UDPAddr)
+	c.Assert(err, IsNil)
+	c.Assert(res.Rcode, Equals, dns.RcodeSuccess)
+	return res
+}
+
+func (s *DNSSuite) TestServiceTTL(c *C) {
+	inst, _ := fakeStaticInstance("tcp", "192.168.0.1", 80)
+	s.state.SetService("a", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest, DNSTTL: 30}, []*discoverd.Instance{inst})
+
+	for _, domain := range []string{"a.discoverd.", "leader.a.discoverd.", inst.ID + ".a._i.discoverd."} {
+		req := &dns.Msg{}
+		req.SetQuestion(domain, dns.TypeANY)
+		res := s.exchange(c, req)
+		c.Assert(res.Answer, HasLen, 2)
+		for _, rr := range res.Answer {
+			c.Assert(rr.Header().Ttl, Equals, uint32(30), Commentf("domain = %s", domain))
+		}
+	}
+}
+
+func (s *DNSSuite) TestWeightPriority(c *C) {
+	primary, primaryAddr := fakeStaticInstance("tcp", "192.168.0.1", 80)
+	primary.Meta = map[string]string{discoverd.InstanceMetaPriority: "1", discoverd.InstanceMetaWeight: "10"}
+	backup, _ := fakeStaticInstance("tcp", "192.168.0.2", 80)
+	backup.Meta = map[string]string{discoverd.InstanceMetaPriority: "2"}
+	heavy, heavyAddr := fakeStaticInstance("tcp", "192.168.0.3", 80)
+	heavy.Meta = map[string]string{discoverd.InstanceMetaPriority: "1", discoverd.InstanceMetaWeight: "1000"}
+	unweighted, _ := fakeStaticInstance("tcp", "192.168.0.4", 80)
+	unweighted.Meta = map[string]string{discoverd.InstanceMetaPriority: "1", discoverd.InstanceMetaWeight: "0"}
+	s.state.SetService("a", DefaultServiceConfig, []*discoverd.Instance{backup, unweighted, primary, heavy})
+
+	// SRV records include the priority and weight
+	req := &dns.Msg{}
+	req.SetQuestion("_a._tcp.discoverd.", dns.TypeSRV)
+	req.SetEdns0(4096, false)
+	res := s.exchange(c, req)
+	c.Assert(res.Answer, HasLen, 4)
+	for _, rr := range res.Answer {
+		srv := rr.(*dns.SRV)
+		switch {
+		case strings.HasPrefix(srv.Target, primary.ID):
+			c.Assert(srv.Priority, Equals, uint16(1))
+			c.Assert(srv.Weight, Equals, uint16(10))
+		case strings.HasPrefix(srv.Target, backup.ID):
+			c.Assert(srv.Priority, Equals, uint16(2))
+			c.Assert(srv.Weight, Equals, uint16(1))
+		}
+	}
+
+	// A records are ordered by priority and then randomly by weight, so
+	// the unweighted instance is always after the weighted ones of the same
+	// priority, the backup is never included, and the heavy instance is
+	// almost always first
+	heavyFirst := 0
+	for i := 0; i < 100; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("a.discoverd.", dns.TypeA)
+		res := s.exchange(c, req)
+		c.Assert(res.Answer, HasLen, 3)
+		first := res.Answer[0].(*dns.A).A
+		c.Assert(first.Equal(heavyAddr.IP) || first.Equal(primaryAddr.IP), Equals, true)
+		if first.Equal(heavyAddr.IP) {
+			heavyFirst++
+		}
+		c.Assert(res.Answer[2].(*dns.A).A.String(), Equals, "192.168.0.4")
+	}
+	c.Assert(heavyFirst > 90, Equals, true, Commentf("heavy instance first %d times", heavyFirst))
+}
+
+func (s *DNSSuite) TestEDNS0(c *C) {
+	data := make([]*discoverd.Instance, 50)
+	for i := range data {
+		data[i], _ = fakeStaticInstance("tcp", fmt.Sprintf("192.168.0.%d", i+1), 80)
+	}
+	s.state.SetService("a", DefaultServiceConfig, data)
+
+	// without EDNS0 the response is limited to three records
+	req := &dns.Msg{}
+	req.SetQuestion("a.discoverd.", dns.TypeA)
+	res := s.exchange(c, req)
+	c.Assert(res.Answer, HasLen, 3)
+	c.Assert(res.IsEdns0(), IsNil)
+
+	// with EDNS0 the response includes as many records as fit
+	req.SetEdns0(4096, false)
+	res = s.exchange(c, req)
+	c.Assert(res.Answer, HasLen, 50)
+	c.Assert(res.IsEdns0(), NotNil)
+
+	req = &dns.Msg{}
+	req.SetQuestion("_a._tcp.discoverd.", dns.TypeSRV)
+	req.SetEdns0(1024, false)
+	res = s.exchange(c, req)
+	c.Assert(res.Len() <= 1024, Equals, true)
+	c.Assert(len(res.Answer) > 3, Equals, true)
+	c.Assert(len(res.Answer) < 50, Equals, true)
+}
+
 func assertSOA(c *C, rrs []dns.RR) {
 	c.Assert(rrs, HasLen, 1)
 	c.Assert(rrs[0], FitsTypeOf, &dns.SOA{})
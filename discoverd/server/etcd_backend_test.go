@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"testing"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
@@ -26,6 +27,10 @@ type etcdLogger struct {
 func (l etcdLogger) Log(v ...interface{}) { l.Output(2, fmt.Sprintln(v...)) }
 
 func TestMain(m *testing.M) {
+	// only the suites which need etcd are skipped if it is not installed
+	if _, err := exec.LookPath("etcd"); err != nil {
+		os.Exit(m.Run())
+	}
 	var cleanup func()
 	etcdAddr, cleanup = etcdrunner.RunEtcdServer(etcdLogger{log.New(os.Stderr, "", log.Lmicroseconds|log.Lshortfile)})
 	exitCode := m.Run()
@@ -33,30 +38,50 @@ func TestMain(m *testing.M) {
 	os.Exit(exitCode)
 }
 
-type EtcdSuite struct {
+func skipWithoutEtcd(c *C) {
+	if etcdAddr == "" {
+		c.Skip("etcd is not installed")
+	}
+}
+
+// BackendSuite tests a Backend syncing to a State, it is embedded in a suite
+// for each Backend implementation.
+type BackendSuite struct {
 	state   *State
 	backend Backend
-}
 
-func newEtcdBackend(state *State) Backend {
-	return NewEtcdBackend(etcd.NewClient([]string{etcdAddr}), fmt.Sprintf("/test/discoverd/%s", random.String(8)), state)
+	newBackend func(c *C, state *State) Backend
 }
 
-func (s *EtcdSuite) SetUpTest(c *C) {
+func (s *BackendSuite) SetUpTest(c *C) {
 	s.state = NewState()
-	s.backend = newEtcdBackend(s.state)
+	s.backend = s.newBackend(c, s.state)
 }
 
-func (s *EtcdSuite) TearDownTest(c *C) {
+func (s *BackendSuite) TearDownTest(c *C) {
 	if s.backend != nil {
 		s.backend.Close()
 	}
 }
 
-var _ = Suite(&EtcdSuite{})
+type EtcdSuite struct {
+	BackendSuite
+}
+
+func newEtcdBackend(state *State) Backend {
+	return NewEtcdBackend(etcd.NewClient([]string{etcdAddr}), fmt.Sprintf("/test/discoverd/%s", random.String(8)), state)
+}
+
+var _ = Suite(&EtcdSuite{BackendSuite{newBackend: func(c *C, state *State) Backend {
+	return newEtcdBackend(state)
+}}})
+
+func (s *EtcdSuite) SetUpSuite(c *C) {
+	skipWithoutEtcd(c)
+}
 
 // Sync starting with a clean slate
-func (s *EtcdSuite) TestBasicSync(c *C) {
+func (s *BackendSuite) TestBasicSync(c *C) {
 	events := make(chan *discoverd.Event, 1)
 	s.state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindDown|discoverd.EventKindUpdate, events)
 
@@ -66,7 +91,7 @@ func (s *EtcdSuite) TestBasicSync(c *C) {
 	s.testBasicSync(c, events)
 }
 
-func (s *EtcdSuite) testBasicSync(c *C, events chan *discoverd.Event) {
+func (s *BackendSuite) testBasicSync(c *C, events chan *discoverd.Event) {
 	// Remove instance that doesn't exist
 	err := s.backend.RemoveInstance("a", "b")
 	c.Assert(err, DeepEquals, NotFoundError{Service: "a", Instance: "b"})
@@ -102,7 +127,7 @@ func (s *EtcdSuite) testBasicSync(c *C, events chan *discoverd.Event) {
 	assertEvent(c, events, "a", discoverd.EventKindDown, &inst2)
 }
 
-func (s *EtcdSuite) TestLeaderElection(c *C) {
+func (s *BackendSuite) TestLeaderElection(c *C) {
 	events := make(chan *discoverd.Event, 2)
 	s.state.Subscribe("a", false, discoverd.EventKindLeader|discoverd.EventKindUp, events)
 
@@ -133,7 +158,7 @@ func (s *EtcdSuite) TestLeaderElection(c *C) {
 }
 
 // Sync starting with empty etcd, but services in local state
-func (s *EtcdSuite) TestNoServiceSync(c *C) {
+func (s *BackendSuite) TestNoServiceSync(c *C) {
 	inst := fakeInstance()
 	s.state.AddInstance("a", inst)
 
@@ -149,7 +174,7 @@ func (s *EtcdSuite) TestNoServiceSync(c *C) {
 }
 
 // Sync starting with existing, updated, deleted, added, etc services
-func (s *EtcdSuite) TestLocalDiffSync(c *C) {
+func (s *BackendSuite) TestLocalDiffSync(c *C) {
 	existing := fakeInstance()
 	updated := fakeInstance()
 	deleted := fakeInstance()
@@ -214,7 +239,7 @@ func (s *EtcdSuite) TestLocalDiffSync(c *C) {
 	s.testBasicSync(c, aEvents)
 }
 
-func (s *EtcdSuite) TestServiceAddRemove(c *C) {
+func (s *BackendSuite) TestServiceAddRemove(c *C) {
 	err := s.backend.RemoveService("a")
 	c.Assert(err, DeepEquals, NotFoundError{Service: "a"})
 
@@ -231,7 +256,7 @@ func (s *EtcdSuite) TestServiceAddRemove(c *C) {
 	c.Assert(err, DeepEquals, NotFoundError{Service: "a"})
 }
 
-func (s *EtcdSuite) TestLeaderElectionCreatedIndex(c *C) {
+func (s *BackendSuite) TestLeaderElectionCreatedIndex(c *C) {
 	c.Assert(s.backend.AddService("a", nil), IsNil)
 
 	inst1, inst2 := fakeInstance(), fakeInstance()
@@ -246,7 +271,7 @@ func (s *EtcdSuite) TestLeaderElectionCreatedIndex(c *C) {
 	assertEvent(c, events, "a", discoverd.EventKindLeader, inst1)
 }
 
-func (s *EtcdSuite) TestSetMeta(c *C) {
+func (s *BackendSuite) TestSetMeta(c *C) {
 	events := make(chan *discoverd.Event, 1)
 	s.state.Subscribe("a", false, discoverd.EventKindServiceMeta, events)
 
@@ -282,7 +307,7 @@ func (s *EtcdSuite) TestSetMeta(c *C) {
 	c.Assert(hh.IsPreconditionFailedError(err), Equals, true)
 }
 
-func (s *EtcdSuite) TestManualLeaderInitialSync(c *C) {
+func (s *BackendSuite) TestManualLeaderInitialSync(c *C) {
 	events := make(chan *discoverd.Event, 1)
 	s.state.Subscribe("a", false, discoverd.EventKindLeader, events)
 
@@ -296,7 +321,7 @@ func (s *EtcdSuite) TestManualLeaderInitialSync(c *C) {
 	assertEvent(c, events, "a", discoverd.EventKindLeader, inst2)
 }
 
-func (s *EtcdSuite) TestManualLeaderInitialSyncDelayedRegister(c *C) {
+func (s *BackendSuite) TestManualLeaderInitialSyncDelayedRegister(c *C) {
 	events := make(chan *discoverd.Event, 1)
 	s.state.Subscribe("a", false, discoverd.EventKindLeader, events)
 
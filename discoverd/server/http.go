@@ -23,6 +23,7 @@ type Datastore interface {
 
 	// Typically implemented by State
 	Get(service string) []*discoverd.Instance
+	GetAll(service string) []*discoverd.Instance
 	GetConfig(service string) *discoverd.ServiceConfig
 	GetServiceMeta(service string) *discoverd.ServiceMeta
 	GetLeader(service string) *discoverd.Instance
@@ -104,6 +105,12 @@ func (h *httpAPI) AddService(w http.ResponseWriter, r *http.Request, params http
 		hh.Error(w, err)
 		return
 	}
+	if config.Check != nil {
+		if _, err := newCheck(config.Check, "127.0.0.1:0"); err != nil {
+			hh.ValidationError(w, "check.type", err.Error())
+			return
+		}
+	}
 
 	if err := h.Store.AddService(service, config); err != nil {
 		if IsServiceExists(err) {
@@ -169,6 +176,8 @@ func (h *httpAPI) AddInstance(w http.ResponseWriter, r *http.Request, params htt
 		hh.ValidationError(w, "", err.Error())
 		return
 	}
+	// the check status is only set by discoverd
+	inst.Check = nil
 	if err := h.Store.AddInstance(params.ByName("service"), inst); err != nil {
 		if IsNotFound(err) {
 			hh.ObjectNotFoundError(w, err.Error())
@@ -196,7 +205,12 @@ func (h *httpAPI) GetInstances(w http.ResponseWriter, r *http.Request, params ht
 		return
 	}
 
-	instances := h.Store.Get(params.ByName("service"))
+	var instances []*discoverd.Instance
+	if r.URL.Query().Get("include_down") == "true" {
+		instances = h.Store.GetAll(params.ByName("service"))
+	} else {
+		instances = h.Store.Get(params.ByName("service"))
+	}
 	if instances == nil {
 		hh.ObjectNotFoundError(w, "service not found")
 		return
@@ -20,6 +20,10 @@ type HTTPSuite struct {
 	client  *discoverd.Client
 }
 
+func (s *HTTPSuite) SetUpSuite(c *C) {
+	skipWithoutEtcd(c)
+}
+
 func (s *HTTPSuite) SetUpTest(c *C) {
 	s.cleanup = nil
 	s.state = NewState()
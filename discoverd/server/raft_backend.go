@@ -0,0 +1,652 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/raft"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+)
+
+// RaftBackend is a Backend which stores services in a Raft log replicated
+// between discoverd servers, so that no external datastore is needed.
+//
+// Writes made on any server are forwarded to the Raft leader, which also
+// expires instances which haven't been re-registered within the TTL. The TTL
+// is tracked in the leader's memory rather than in the log, so
+// re-registrations of unchanged instances, which clients send as heartbeats,
+// are not written to the log. It serves the Raft RPCs and forwarded writes
+// from other servers over HTTP.
+//
+// The servers of the cluster are fixed, see the raft package.
+type RaftBackend struct {
+	node    *raft.Node
+	fsm     *raftFSM
+	handler http.Handler
+	client  *http.Client
+
+	// ttl is how long after its last registration an instance is expired.
+	ttl time.Duration
+
+	// lastSeen holds the last time each instance was registered, keyed by
+	// service and instance ID. It is only maintained by the leader.
+	seenMtx  sync.Mutex
+	lastSeen map[instanceKey]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type instanceKey struct {
+	service, id string
+}
+
+const raftApplyTimeout = 10 * time.Second
+
+// raftInstanceTTL is the TTL of instances, it is a variable so that it can be
+// shortened in tests.
+var raftInstanceTTL = defaultTTL * time.Second
+
+// NewRaftBackend starts a Raft node with config, which the returned backend
+// uses as its FSM, and calls h with changes to services once StartSync is
+// called.
+func NewRaftBackend(config raft.Config, h SyncHandler) (*RaftBackend, error) {
+	b := &RaftBackend{
+		fsm:      newRaftFSM(h),
+		client:   &http.Client{Timeout: raftApplyTimeout},
+		ttl:      raftInstanceTTL,
+		lastSeen: make(map[instanceKey]time.Time),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	config.FSM = b.fsm
+	node, err := raft.NewNode(config)
+	if err != nil {
+		return nil, err
+	}
+	b.node = node
+
+	mux := http.NewServeMux()
+	mux.Handle("/raft/", raft.NewHTTPHandler(node))
+	mux.HandleFunc("/raft/apply", b.serveApply)
+	mux.HandleFunc("/raft/refresh", b.serveRefresh)
+	b.handler = mux
+
+	go b.expireInstances()
+	return b, nil
+}
+
+// ServeHTTP serves the Raft RPCs and writes forwarded from other servers.
+func (b *RaftBackend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.handler.ServeHTTP(w, req)
+}
+
+func (b *RaftBackend) AddService(service string, config *discoverd.ServiceConfig) error {
+	if config == nil {
+		config = DefaultServiceConfig
+	}
+	_, err := b.apply(&raftCommand{Op: raftOpAddService, Service: service, Config: config})
+	return err
+}
+
+func (b *RaftBackend) RemoveService(service string) error {
+	_, err := b.apply(&raftCommand{Op: raftOpRemoveService, Service: service})
+	return err
+}
+
+func (b *RaftBackend) AddInstance(service string, inst *discoverd.Instance) error {
+	// re-registering an unchanged instance only needs to refresh its TTL,
+	// if that fails it is registered through the log
+	if b.fsm.hasInstance(service, inst) && b.refresh(service, inst) == nil {
+		return nil
+	}
+	_, err := b.apply(&raftCommand{Op: raftOpAddInstance, Service: service, Instance: inst})
+	return err
+}
+
+func (b *RaftBackend) RemoveInstance(service, id string) error {
+	_, err := b.apply(&raftCommand{Op: raftOpRemoveInstance, Service: service, ID: id})
+	return err
+}
+
+func (b *RaftBackend) SetServiceMeta(service string, meta *discoverd.ServiceMeta) error {
+	res, err := b.apply(&raftCommand{
+		Op:      raftOpSetServiceMeta,
+		Service: service,
+		Meta:    &raftServiceMeta{Data: meta.Data, Index: meta.Index},
+	})
+	if err != nil {
+		return err
+	}
+	meta.Index = res.Index
+	return nil
+}
+
+func (b *RaftBackend) SetLeader(service, id string) error {
+	_, err := b.apply(&raftCommand{Op: raftOpSetLeader, Service: service, ID: id})
+	return err
+}
+
+// StartSync sets the services of the SyncHandler to those stored in the log,
+// and keeps them updated as further commands are applied.
+func (b *RaftBackend) StartSync() error {
+	b.fsm.startSync()
+	return nil
+}
+
+func (b *RaftBackend) Close() error {
+	select {
+	case <-b.stop:
+		return nil
+	default:
+	}
+	close(b.stop)
+	<-b.done
+	return b.node.Close()
+}
+
+// apply applies cmd on the leader, forwarding it if this server is not the
+// leader, and waiting for a leader to be elected if there isn't one.
+func (b *RaftBackend) apply(cmd *raftCommand) (*raftResult, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(raftApplyTimeout)
+	for {
+		var res *raftResult
+		switch leader := b.node.Leader(); leader {
+		case "":
+			err = raft.ErrNotLeader
+		case b.node.ID():
+			res, err = b.applyLocal(cmd, data)
+		default:
+			res, err = b.forward(leader, data)
+		}
+		if err == raft.ErrNotLeader && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return res, res.err()
+	}
+}
+
+func (b *RaftBackend) applyLocal(cmd *raftCommand, data []byte) (*raftResult, error) {
+	v, err := b.node.Apply(data, raftApplyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	res := v.(*raftResult)
+	if cmd.Op == raftOpAddInstance && res.Error == nil {
+		b.seen(cmd.Service, cmd.Instance.ID)
+	}
+	return res, nil
+}
+
+func (b *RaftBackend) forward(leader string, data []byte) (*raftResult, error) {
+	r, err := b.client.Post(fmt.Sprintf("http://%s/raft/apply", leader), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusServiceUnavailable {
+		// leadership changed
+		return nil, raft.ErrNotLeader
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discoverd: unexpected status %d forwarding to raft leader %s", r.StatusCode, leader)
+	}
+	res := &raftResult{}
+	return res, json.NewDecoder(r.Body).Decode(res)
+}
+
+func (b *RaftBackend) serveApply(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(req.Body); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	cmd := &raftCommand{}
+	if err := json.Unmarshal(buf.Bytes(), cmd); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	res, err := b.applyLocal(cmd, buf.Bytes())
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	hh.JSON(w, 200, res)
+}
+
+// refresh refreshes the TTL of an unchanged instance on the leader, forwarding
+// it if this server is not the leader.
+func (b *RaftBackend) refresh(service string, inst *discoverd.Instance) error {
+	switch leader := b.node.Leader(); leader {
+	case "":
+		return raft.ErrNotLeader
+	case b.node.ID():
+		return b.refreshLocal(service, inst)
+	default:
+		data, err := json.Marshal(&raftCommand{Op: raftOpAddInstance, Service: service, Instance: inst})
+		if err != nil {
+			return err
+		}
+		r, err := b.client.Post(fmt.Sprintf("http://%s/raft/refresh", leader), "application/json", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			return fmt.Errorf("discoverd: unexpected status %d refreshing instance on raft leader %s", r.StatusCode, leader)
+		}
+		return nil
+	}
+}
+
+func (b *RaftBackend) refreshLocal(service string, inst *discoverd.Instance) error {
+	if !b.node.IsLeader() {
+		return raft.ErrNotLeader
+	}
+	if !b.fsm.hasInstance(service, inst) {
+		return NotFoundError{Service: service, Instance: inst.ID}
+	}
+	b.seen(service, inst.ID)
+	return nil
+}
+
+func (b *RaftBackend) serveRefresh(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	cmd := &raftCommand{}
+	if err := json.NewDecoder(req.Body).Decode(cmd); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	if cmd.Instance == nil {
+		hh.Error(w, hh.JSONError{Code: hh.ValidationErrorCode, Message: "instance is required"})
+		return
+	}
+	switch err := b.refreshLocal(cmd.Service, cmd.Instance); err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case NotFoundError:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (b *RaftBackend) seen(service, id string) {
+	b.seenMtx.Lock()
+	defer b.seenMtx.Unlock()
+	b.lastSeen[instanceKey{service, id}] = time.Now()
+}
+
+// expireInstances removes instances which haven't been registered within the
+// TTL while this server is the leader. Instances are given a full TTL from
+// when the server becomes leader, as it doesn't know when they were last
+// registered with the previous leader.
+func (b *RaftBackend) expireInstances() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.ttl / 10)
+	defer ticker.Stop()
+	wasLeader := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+		if !b.node.IsLeader() {
+			wasLeader = false
+			continue
+		}
+
+		var expired []instanceKey
+		now := time.Now()
+		instances := b.fsm.instanceKeys()
+		b.seenMtx.Lock()
+		if !wasLeader {
+			b.lastSeen = make(map[instanceKey]time.Time, len(instances))
+			wasLeader = true
+		}
+		current := make(map[instanceKey]struct{}, len(instances))
+		for _, k := range instances {
+			current[k] = struct{}{}
+			if seen, ok := b.lastSeen[k]; !ok {
+				b.lastSeen[k] = now
+			} else if now.Sub(seen) > b.ttl {
+				expired = append(expired, k)
+			}
+		}
+		for k := range b.lastSeen {
+			if _, ok := current[k]; !ok {
+				delete(b.lastSeen, k)
+			}
+		}
+		b.seenMtx.Unlock()
+
+		for _, k := range expired {
+			cmd := &raftCommand{Op: raftOpRemoveInstance, Service: k.service, ID: k.id}
+			data, _ := json.Marshal(cmd)
+			if _, err := b.applyLocal(cmd, data); err != nil {
+				log.Printf("Error expiring instance %s/%s: %s", k.service, k.id, err)
+			}
+		}
+	}
+}
+
+const (
+	raftOpAddService     = "add_service"
+	raftOpRemoveService  = "remove_service"
+	raftOpAddInstance    = "add_instance"
+	raftOpRemoveInstance = "remove_instance"
+	raftOpSetServiceMeta = "set_service_meta"
+	raftOpSetLeader      = "set_leader"
+)
+
+// raftCommand is a change to services stored in the Raft log.
+type raftCommand struct {
+	Op       string                   `json:"op"`
+	Service  string                   `json:"service"`
+	Config   *discoverd.ServiceConfig `json:"config,omitempty"`
+	Instance *discoverd.Instance      `json:"instance,omitempty"`
+	Meta     *raftServiceMeta         `json:"meta,omitempty"`
+	// ID is the instance ID for remove_instance and set_leader.
+	ID string `json:"id,omitempty"`
+}
+
+// raftResult is the result of applying a raftCommand.
+type raftResult struct {
+	// Index is the new index of the service metadata after
+	// set_service_meta.
+	Index uint64     `json:"index,omitempty"`
+	Error *raftError `json:"error,omitempty"`
+}
+
+func (r *raftResult) err() error {
+	if r.Error == nil {
+		return nil
+	}
+	return r.Error.err()
+}
+
+// raftError is an error returned by a command, encoded so that it can be
+// returned from forwarded writes.
+type raftError struct {
+	NotFound      *NotFoundError `json:"not_found,omitempty"`
+	ServiceExists string         `json:"service_exists,omitempty"`
+	JSON          *hh.JSONError  `json:"json,omitempty"`
+}
+
+func newRaftError(err error) *raftError {
+	switch e := err.(type) {
+	case NotFoundError:
+		return &raftError{NotFound: &e}
+	case ServiceExistsError:
+		return &raftError{ServiceExists: string(e)}
+	case hh.JSONError:
+		return &raftError{JSON: &e}
+	default:
+		return &raftError{JSON: &hh.JSONError{Code: hh.UnknownErrorCode, Message: err.Error()}}
+	}
+}
+
+func (e *raftError) err() error {
+	switch {
+	case e.NotFound != nil:
+		return *e.NotFound
+	case e.ServiceExists != "":
+		return ServiceExistsError(e.ServiceExists)
+	default:
+		return *e.JSON
+	}
+}
+
+type raftService struct {
+	Config    *discoverd.ServiceConfig       `json:"config"`
+	Instances map[string]*discoverd.Instance `json:"instances"`
+	Meta      *raftServiceMeta               `json:"meta,omitempty"`
+	Leader    string                         `json:"leader,omitempty"`
+}
+
+// raftServiceMeta is service metadata, the data is stored as bytes rather
+// than the JSON of discoverd.ServiceMeta as it is not validated as JSON.
+type raftServiceMeta struct {
+	Data  []byte `json:"data"`
+	Index uint64 `json:"index"`
+}
+
+// raftFSM applies commands from the Raft log to the stored services, and
+// passes the changes on to a SyncHandler once syncing has started.
+type raftFSM struct {
+	mtx      sync.Mutex
+	services map[string]*raftService
+	h        SyncHandler
+	syncing  bool
+}
+
+func newRaftFSM(h SyncHandler) *raftFSM {
+	return &raftFSM{services: make(map[string]*raftService), h: h}
+}
+
+func (f *raftFSM) Apply(index uint64, data []byte) interface{} {
+	cmd := &raftCommand{}
+	if err := json.Unmarshal(data, cmd); err != nil {
+		return &raftResult{Error: newRaftError(err)}
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	res, err := f.apply(index, cmd)
+	if err != nil {
+		return &raftResult{Error: newRaftError(err)}
+	}
+	return res
+}
+
+func (f *raftFSM) apply(index uint64, cmd *raftCommand) (*raftResult, error) {
+	res := &raftResult{}
+	service, ok := f.services[cmd.Service]
+	switch cmd.Op {
+	case raftOpAddService:
+		if ok {
+			return nil, ServiceExistsError(cmd.Service)
+		}
+		f.services[cmd.Service] = &raftService{Config: cmd.Config, Instances: make(map[string]*discoverd.Instance)}
+		if f.syncing {
+			f.h.AddService(cmd.Service, cmd.Config)
+		}
+
+	case raftOpRemoveService:
+		if !ok {
+			return nil, NotFoundError{Service: cmd.Service}
+		}
+		delete(f.services, cmd.Service)
+		if f.syncing {
+			f.h.RemoveService(cmd.Service)
+		}
+
+	case raftOpAddInstance:
+		if !ok {
+			return nil, NotFoundError{Service: cmd.Service}
+		}
+		inst := cmd.Instance
+		// the index is that of the initial registration, so that it is
+		// unchanged by re-registration
+		if existing, ok := service.Instances[inst.ID]; ok {
+			inst.Index = existing.Index
+		} else {
+			inst.Index = index
+		}
+		service.Instances[inst.ID] = inst
+		if f.syncing {
+			f.h.AddInstance(cmd.Service, copyInstance(inst))
+		}
+
+	case raftOpRemoveInstance:
+		if !ok {
+			return nil, NotFoundError{Service: cmd.Service, Instance: cmd.ID}
+		}
+		if _, ok := service.Instances[cmd.ID]; !ok {
+			return nil, NotFoundError{Service: cmd.Service, Instance: cmd.ID}
+		}
+		delete(service.Instances, cmd.ID)
+		if f.syncing {
+			f.h.RemoveInstance(cmd.Service, cmd.ID)
+		}
+
+	case raftOpSetServiceMeta:
+		if !ok {
+			return nil, NotFoundError{Service: cmd.Service}
+		}
+		if cmd.Meta.Index == 0 && service.Meta != nil {
+			return nil, hh.ObjectExistsErr(fmt.Sprintf("Service metadata for %q already exists, use index=n to set", cmd.Service))
+		}
+		if cmd.Meta.Index != 0 && service.Meta == nil {
+			return nil, hh.PreconditionFailedErr(fmt.Sprintf("Service metadata for %q does not exist, use index=0 to set", cmd.Service))
+		}
+		if cmd.Meta.Index != 0 && cmd.Meta.Index != service.Meta.Index {
+			return nil, hh.PreconditionFailedErr(fmt.Sprintf("Service metadata for %q exists, but wrong index provided", cmd.Service))
+		}
+		service.Meta = &raftServiceMeta{Data: cmd.Meta.Data, Index: index}
+		res.Index = index
+		if f.syncing {
+			f.h.SetServiceMeta(cmd.Service, service.Meta.Data, index)
+		}
+
+	case raftOpSetLeader:
+		if !ok {
+			return nil, NotFoundError{Service: cmd.Service}
+		}
+		service.Leader = cmd.ID
+		if f.syncing {
+			f.h.SetLeader(cmd.Service, cmd.ID)
+		}
+
+	default:
+		return nil, fmt.Errorf("discoverd: unknown raft command %q", cmd.Op)
+	}
+	return res, nil
+}
+
+func (f *raftFSM) Snapshot() ([]byte, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return json.Marshal(f.services)
+}
+
+func (f *raftFSM) Restore(data []byte) error {
+	services := make(map[string]*raftService)
+	if err := json.Unmarshal(data, &services); err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.services = services
+	if f.syncing {
+		f.sync()
+	}
+	return nil
+}
+
+func (f *raftFSM) startSync() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.syncing = true
+	f.sync()
+}
+
+// sync sets the services of the SyncHandler to the stored services.
+func (f *raftFSM) sync() {
+	for name, service := range f.services {
+		instances := make([]*discoverd.Instance, 0, len(service.Instances))
+		for _, inst := range service.Instances {
+			instances = append(instances, copyInstance(inst))
+		}
+		if service.Meta != nil {
+			f.h.SetServiceMeta(name, service.Meta.Data, service.Meta.Index)
+		}
+		f.h.SetService(name, service.Config, instances)
+		if service.Leader != "" {
+			f.h.SetLeader(name, service.Leader)
+		}
+	}
+	for _, name := range f.h.ListServices() {
+		if _, ok := f.services[name]; !ok {
+			f.h.SetService(name, nil, nil)
+		}
+	}
+}
+
+// hasInstance reports whether inst is stored in service with the same
+// address, protocol and metadata.
+func (f *raftFSM) hasInstance(service string, inst *discoverd.Instance) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	s, ok := f.services[service]
+	if !ok {
+		return false
+	}
+	existing, ok := s.Instances[inst.ID]
+	return ok && existing.Addr == inst.Addr && existing.Proto == inst.Proto && reflect.DeepEqual(existing.Meta, inst.Meta)
+}
+
+// instanceKeys returns the keys of all stored instances.
+func (f *raftFSM) instanceKeys() []instanceKey {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var keys []instanceKey
+	for name, service := range f.services {
+		for id := range service.Instances {
+			keys = append(keys, instanceKey{name, id})
+		}
+	}
+	sort.Sort(instanceKeys(keys))
+	return keys
+}
+
+type instanceKeys []instanceKey
+
+func (k instanceKeys) Len() int      { return len(k) }
+func (k instanceKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k instanceKeys) Less(i, j int) bool {
+	if k[i].service == k[j].service {
+		return k[i].id < k[j].id
+	}
+	return k[i].service < k[j].service
+}
+
+// copyInstance returns a copy of inst which can be passed to a SyncHandler
+// without sharing it with the FSM.
+func copyInstance(inst *discoverd.Instance) *discoverd.Instance {
+	return &discoverd.Instance{
+		ID:    inst.ID,
+		Addr:  inst.Addr,
+		Proto: inst.Proto,
+		Meta:  inst.Meta,
+		Index: inst.Index,
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/raft"
+)
+
+type RaftSuite struct {
+	BackendSuite
+}
+
+var _ = Suite(&RaftSuite{BackendSuite{newBackend: func(c *C, state *State) Backend {
+	return newRaftBackend(c, "node0", []string{"node0"}, raft.NewMemoryTransport().Sender("node0"), state)
+}}})
+
+func newRaftBackend(c *C, id string, peers []string, transport raft.Transport, h SyncHandler) *RaftBackend {
+	backend, err := NewRaftBackend(raft.Config{
+		ID:                id,
+		Peers:             peers,
+		Store:             raft.NewMemoryStore(),
+		Transport:         transport,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   50 * time.Millisecond,
+	}, h)
+	c.Assert(err, IsNil)
+	return backend
+}
+
+// raftCluster is a cluster of RaftBackends which communicate over HTTP.
+type raftCluster struct {
+	states    []*State
+	backends  []*RaftBackend
+	listeners []net.Listener
+}
+
+func newRaftCluster(c *C, size int) *raftCluster {
+	cluster := &raftCluster{}
+	peers := make([]string, size)
+	for i := range peers {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, IsNil)
+		cluster.listeners = append(cluster.listeners, l)
+		peers[i] = l.Addr().String()
+	}
+	for i, l := range cluster.listeners {
+		state := NewState()
+		backend := newRaftBackend(c, peers[i], peers, raft.NewHTTPTransport(time.Second), state)
+		c.Assert(backend.StartSync(), IsNil)
+		go http.Serve(l, backend)
+		cluster.states = append(cluster.states, state)
+		cluster.backends = append(cluster.backends, backend)
+	}
+	return cluster
+}
+
+func (rc *raftCluster) close() {
+	for i, b := range rc.backends {
+		b.Close()
+		rc.listeners[i].Close()
+	}
+}
+
+// follower returns the index of a backend which is not the leader.
+func (rc *raftCluster) follower(c *C) int {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		leader := rc.backends[0].node.Leader()
+		if leader == "" {
+			continue
+		}
+		for i, b := range rc.backends {
+			if b.node.ID() != leader {
+				return i
+			}
+		}
+	}
+	c.Fatal("timed out waiting for leader")
+	return -1
+}
+
+func (s *RaftSuite) TestForwardToLeader(c *C) {
+	cluster := newRaftCluster(c, 3)
+	defer cluster.close()
+
+	events := make([]chan *discoverd.Event, len(cluster.states))
+	for i, state := range cluster.states {
+		events[i] = make(chan *discoverd.Event, 1)
+		state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindDown, events[i])
+	}
+
+	// writes to a follower are applied on every node
+	follower := cluster.backends[cluster.follower(c)]
+	c.Assert(follower.AddService("a", nil), IsNil)
+	inst := fakeInstance()
+	c.Assert(follower.AddInstance("a", inst), IsNil)
+	for i := range cluster.states {
+		assertEvent(c, events[i], "a", discoverd.EventKindUp, inst)
+	}
+
+	// errors are returned from forwarded writes
+	c.Assert(follower.AddService("a", nil), DeepEquals, ServiceExistsError("a"))
+	c.Assert(follower.RemoveInstance("a", "b"), DeepEquals, NotFoundError{Service: "a", Instance: "b"})
+	err := follower.SetServiceMeta("a", &discoverd.ServiceMeta{Data: []byte("foo"), Index: 1})
+	c.Assert(err, NotNil)
+
+	c.Assert(follower.RemoveInstance("a", inst.ID), IsNil)
+	for i := range cluster.states {
+		assertEvent(c, events[i], "a", discoverd.EventKindDown, inst)
+	}
+}
+
+func (s *RaftSuite) TestExpireInstance(c *C) {
+	defer func(ttl time.Duration) { raftInstanceTTL = ttl }(raftInstanceTTL)
+	raftInstanceTTL = 200 * time.Millisecond
+
+	state := NewState()
+	backend := newRaftBackend(c, "node0", []string{"node0"}, raft.NewMemoryTransport().Sender("node0"), state)
+	defer backend.Close()
+	c.Assert(backend.StartSync(), IsNil)
+
+	events := make(chan *discoverd.Event, 1)
+	state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindDown, events)
+	c.Assert(backend.AddService("a", nil), IsNil)
+
+	// an instance which is re-registered within the TTL does not expire,
+	// and the re-registrations are not written to the log
+	inst := fakeInstance()
+	c.Assert(backend.AddInstance("a", inst), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst)
+	index := backend.node.LastIndex()
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		c.Assert(backend.AddInstance("a", inst), IsNil)
+	}
+	assertNoEvent(c, events)
+	c.Assert(backend.node.LastIndex(), Equals, index)
+
+	// an instance which isn't re-registered expires
+	assertEvent(c, events, "a", discoverd.EventKindDown, inst)
+}
+
+func (s *RaftSuite) TestRefreshInstance(c *C) {
+	cluster := newRaftCluster(c, 3)
+	defer cluster.close()
+
+	// subscribe on the follower so it has applied each write before the next
+	i := cluster.follower(c)
+	follower := cluster.backends[i]
+	events := make(chan *discoverd.Event, 1)
+	cluster.states[i].Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindUpdate, events)
+
+	var leader *RaftBackend
+	for _, b := range cluster.backends {
+		if b.node.ID() == follower.node.Leader() {
+			leader = b
+		}
+	}
+	c.Assert(leader, NotNil)
+	c.Assert(follower.AddService("a", nil), IsNil)
+	inst := fakeInstance()
+	c.Assert(follower.AddInstance("a", inst), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst)
+
+	// re-registering an unchanged instance on a follower refreshes it on
+	// the leader without writing to the log
+	index := leader.node.LastIndex()
+	refreshed := &discoverd.Instance{ID: inst.ID, Addr: inst.Addr, Proto: inst.Proto, Meta: inst.Meta}
+	c.Assert(follower.AddInstance("a", refreshed), IsNil)
+	c.Assert(leader.node.LastIndex(), Equals, index)
+	assertNoEvent(c, events)
+
+	// re-registering a changed instance is written to the log
+	updated := &discoverd.Instance{ID: inst.ID, Addr: inst.Addr, Proto: inst.Proto, Meta: map[string]string{"foo": "baz"}}
+	c.Assert(follower.AddInstance("a", updated), IsNil)
+	assertEvent(c, events, "a", discoverd.EventKindUpdate, updated)
+	c.Assert(leader.node.LastIndex() > index, Equals, true)
+}
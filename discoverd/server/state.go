@@ -58,6 +58,14 @@ type service struct {
 	// instance ID -> instance
 	instances map[string]*discoverd.Instance
 
+	// failing holds registered instances which are marked as down as they
+	// are failing the service's health check, they are not included in
+	// instances. They can still be the leader, as every server runs the
+	// checks itself and servers would otherwise disagree on the leader.
+	failing map[string]*discoverd.Instance
+	// instance ID -> health check status
+	checks map[string]*discoverd.CheckStatus
+
 	config *discoverd.ServiceConfig
 
 	meta      []byte
@@ -91,6 +99,18 @@ func (s *service) maybePickLeader() {
 	for _, inst := range s.instances {
 		s.maybeSetLeader(inst)
 	}
+	for _, inst := range s.failing {
+		s.maybeSetLeader(inst)
+	}
+}
+
+// registered returns the instance with id, including if it is failing the
+// service's health check.
+func (s *service) registered(id string) *discoverd.Instance {
+	if inst, ok := s.instances[id]; ok {
+		return inst
+	}
+	return s.failing[id]
 }
 
 func (s *service) maybeNotifyManualLeader(inst *discoverd.Instance) {
@@ -111,11 +131,15 @@ func (s *service) AddInstance(inst *discoverd.Instance) *discoverd.Instance {
 }
 
 func (s *service) RemoveInstance(id string) *discoverd.Instance {
+	delete(s.checks, id)
 	inst, ok := s.instances[id]
-	if !ok {
+	if ok {
+		delete(s.instances, id)
+	} else if inst, ok = s.failing[id]; ok {
+		delete(s.failing, id)
+	} else {
 		return nil
 	}
-	delete(s.instances, id)
 	if !s.manualLeader() && inst.ID == s.leaderID {
 		s.leaderID = ""
 		s.leaderIndex = 0
@@ -124,12 +148,38 @@ func (s *service) RemoveInstance(id string) *discoverd.Instance {
 	return inst
 }
 
+// markDown marks an instance which is failing the health check as down,
+// without changing the leader.
+func (s *service) markDown(id string) *discoverd.Instance {
+	inst, ok := s.instances[id]
+	if !ok {
+		return nil
+	}
+	delete(s.instances, id)
+	if s.failing == nil {
+		s.failing = make(map[string]*discoverd.Instance)
+	}
+	s.failing[id] = inst
+	return inst
+}
+
+// markUp marks an instance which is passing the health check again as up.
+func (s *service) markUp(id string) *discoverd.Instance {
+	inst, ok := s.failing[id]
+	if !ok {
+		return nil
+	}
+	delete(s.failing, id)
+	s.instances[id] = inst
+	return inst
+}
+
 func (s *service) SetLeader(id string) {
 	if s.leaderID == id {
 		return
 	}
 	s.leaderID = id
-	if inst, ok := s.instances[id]; ok {
+	if inst := s.registered(id); inst != nil {
 		s.leaderIndex = inst.Index
 		s.notifyLeader = true
 	} else {
@@ -139,7 +189,7 @@ func (s *service) SetLeader(id string) {
 
 func (s *service) SetInstances(data map[string]*discoverd.Instance) {
 	if !s.manualLeader() {
-		if _, ok := data[s.leaderID]; !ok {
+		if _, ok := data[s.leaderID]; !ok && s.failing[s.leaderID] == nil {
 			// the current leader is not in the new set
 			s.leaderID = ""
 			s.leaderIndex = 0
@@ -153,10 +203,26 @@ func (s *service) SetConfig(conf *discoverd.ServiceConfig) {
 	s.config = conf
 }
 
+func (s *service) checked() bool {
+	return s.config != nil && s.config.Check != nil
+}
+
+// withCheck returns inst, or a copy of it with its health check status if it
+// has one.
+func (s *service) withCheck(inst *discoverd.Instance) *discoverd.Instance {
+	status, ok := s.checks[inst.ID]
+	if !ok {
+		return inst
+	}
+	res := inst.Clone()
+	res.Check = status
+	return res
+}
+
 func (s *service) BroadcastLeader() *discoverd.Instance {
 	if s.notifyLeader {
 		s.notifyLeader = false
-		return s.instances[s.leaderID]
+		return s.registered(s.leaderID)
 	}
 	return nil
 }
@@ -165,7 +231,7 @@ func (s *service) Leader() *discoverd.Instance {
 	if s == nil {
 		return nil
 	}
-	return s.instances[s.leaderID]
+	return s.registered(s.leaderID)
 }
 
 func (s *service) Meta() *discoverd.ServiceMeta {
@@ -191,7 +257,23 @@ func (s *State) AddService(name string, config *discoverd.ServiceConfig) {
 	if _, ok := s.services[name]; !ok {
 		s.services[name] = newService()
 	}
-	s.services[name].SetConfig(config)
+	srv := s.services[name]
+	srv.SetConfig(config)
+
+	if !srv.checked() {
+		// the service is no longer checked, so no instances are failing
+		for id, inst := range srv.failing {
+			delete(srv.failing, id)
+			srv.AddInstance(inst)
+			s.broadcast(&discoverd.Event{
+				Service:  name,
+				Kind:     discoverd.EventKindUp,
+				Instance: inst,
+			})
+		}
+		srv.checks = nil
+		s.broadcastLeader(name)
+	}
 }
 
 func (s *State) RemoveService(name string) {
@@ -225,6 +307,11 @@ func (s *State) AddInstance(serviceName string, inst *discoverd.Instance) {
 		s.services[serviceName] = data
 	}
 
+	if _, ok := data.failing[inst.ID]; ok {
+		// the instance stays down until its check passes
+		data.failing[inst.ID] = inst
+		return
+	}
 	if old := data.AddInstance(inst); old == nil || !inst.Equal(old) {
 		s.broadcast(&discoverd.Event{
 			Service:  serviceName,
@@ -243,6 +330,12 @@ func (s *State) RemoveInstance(serviceName, id string) {
 	if !ok {
 		return
 	}
+	if _, ok := data.failing[id]; ok {
+		// a down event was sent when the instance started failing
+		data.RemoveInstance(id)
+		s.broadcastLeader(serviceName)
+		return
+	}
 	inst := data.RemoveInstance(id)
 	if inst == nil {
 		return
@@ -300,23 +393,38 @@ func (s *State) SetService(serviceName string, config *discoverd.ServiceConfig,
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	var newData, oldData map[string]*discoverd.Instance
+	var newData, oldData, oldFailing map[string]*discoverd.Instance
 	oldService, ok := s.services[serviceName]
 	if ok {
 		oldData = oldService.instances
+		oldFailing = oldService.failing
 	}
 	if data == nil {
 		delete(s.services, serviceName)
 	} else {
-		newData = make(map[string]*discoverd.Instance, len(data))
-		for _, inst := range data {
-			newData[inst.ID] = inst
-		}
 		if !ok {
 			s.services[serviceName] = &service{}
 		}
 		srv := s.services[serviceName]
 		srv.SetConfig(config)
+
+		newData = make(map[string]*discoverd.Instance, len(data))
+		failing := make(map[string]*discoverd.Instance)
+		for _, inst := range data {
+			// instances which are failing their check stay down
+			if _, ok := oldFailing[inst.ID]; ok && srv.checked() {
+				failing[inst.ID] = inst
+				continue
+			}
+			newData[inst.ID] = inst
+		}
+		srv.failing = failing
+		for id := range srv.checks {
+			_, up := newData[id]
+			if _, down := failing[id]; !up && !down {
+				delete(srv.checks, id)
+			}
+		}
 		srv.SetInstances(newData)
 	}
 	if !ok {
@@ -334,6 +442,9 @@ func (s *State) SetService(serviceName string, config *discoverd.ServiceConfig,
 
 	// diff existing
 	for _, inst := range data {
+		if _, ok := newData[inst.ID]; !ok {
+			continue
+		}
 		if old, existing := oldData[inst.ID]; !existing || !inst.Equal(old) {
 			s.broadcast(&discoverd.Event{
 				Service:  serviceName,
@@ -386,6 +497,61 @@ func (s *State) Get(service string) []*discoverd.Instance {
 	return res
 }
 
+// GetAll returns every registered instance of service, including those which
+// are down as they are failing the service's health check.
+func (s *State) GetAll(service string) []*discoverd.Instance {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	res := s.getLocked(service)
+	if data, ok := s.services[service]; ok {
+		for _, inst := range data.failing {
+			res = append(res, data.withCheck(inst))
+		}
+	}
+	sort.Sort(sortInstances(res))
+	return res
+}
+
+// SetCheckStatus sets the health check status of an instance, marking it as
+// down if the status is down, or up again if it was down and the status is up.
+// The status does not affect which instance is the leader.
+func (s *State) SetCheckStatus(serviceName, id string, status *discoverd.CheckStatus) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	data, ok := s.services[serviceName]
+	if !ok || !data.checked() {
+		return
+	}
+	inst, up := data.instances[id]
+	if !up {
+		if inst, ok = data.failing[id]; !ok {
+			return
+		}
+	}
+	if data.checks == nil {
+		data.checks = make(map[string]*discoverd.CheckStatus)
+	}
+	data.checks[id] = status
+
+	switch {
+	case up && status.Status == discoverd.CheckStatusDown:
+		data.markDown(id)
+		s.broadcast(&discoverd.Event{
+			Service:  serviceName,
+			Kind:     discoverd.EventKindDown,
+			Instance: inst,
+		})
+	case !up && status.Status == discoverd.CheckStatusUp:
+		data.markUp(id)
+		s.broadcast(&discoverd.Event{
+			Service:  serviceName,
+			Kind:     discoverd.EventKindUp,
+			Instance: inst,
+		})
+	}
+}
+
 func (s *State) ListServices() []string {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -404,7 +570,7 @@ func (s *State) getLocked(name string) []*discoverd.Instance {
 
 	res := make([]*discoverd.Instance, 0, len(data.instances))
 	for _, inst := range data.instances {
-		res = append(res, inst)
+		res = append(res, data.withCheck(inst))
 	}
 	return res
 }
@@ -744,6 +744,79 @@ func (StateSuite) TestManualLeader(c *C) {
 	assertInstanceEqual(c, state.GetLeader("a"), inst)
 }
 
+func (StateSuite) TestCheckStatus(c *C) {
+	state := NewState()
+	state.AddService("a", &discoverd.ServiceConfig{
+		LeaderType: discoverd.LeaderTypeOldest,
+		Check:      &discoverd.HealthCheck{Type: "tcp"},
+	})
+	inst1, inst2 := fakeInstance(), fakeInstance()
+	inst1.Index, inst2.Index = 1, 2
+	state.AddInstance("a", inst1)
+	state.AddInstance("a", inst2)
+
+	events := make(chan *discoverd.Event, 2)
+	state.Subscribe("a", false, discoverd.EventKindUp|discoverd.EventKindDown|discoverd.EventKindUpdate|discoverd.EventKindLeader, events)
+
+	// passing check status is reported with the instance
+	up := &discoverd.CheckStatus{Status: discoverd.CheckStatusUp}
+	state.SetCheckStatus("a", inst1.ID, up)
+	assertNoEvent(c, events)
+	c.Assert(state.Get("a")[0].Check, DeepEquals, up)
+
+	// failing instance is marked as down, but stays the leader
+	down := &discoverd.CheckStatus{Status: discoverd.CheckStatusDown, Failures: 2, LastError: "connection refused"}
+	state.SetCheckStatus("a", inst1.ID, down)
+	assertEvent(c, events, "a", discoverd.EventKindDown, inst1)
+	assertNoEvent(c, events)
+	assertInstanceEqual(c, state.GetLeader("a"), inst1)
+	assertHasInstance(c, state.Get("a"), inst2)
+	c.Assert(state.Get("a"), HasLen, 1)
+	all := state.GetAll("a")
+	c.Assert(all, HasLen, 2)
+	c.Assert(all[0].ID, Equals, inst1.ID)
+	c.Assert(all[0].Check, DeepEquals, down)
+
+	// re-registering doesn't mark it as up
+	state.AddInstance("a", inst1)
+	assertNoEvent(c, events)
+	state.SetService("a", state.GetConfig("a"), []*discoverd.Instance{inst1, inst2})
+	assertNoEvent(c, events)
+	c.Assert(state.Get("a"), HasLen, 1)
+
+	// passing instance is marked as up
+	state.SetCheckStatus("a", inst1.ID, up)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst1)
+	assertNoEvent(c, events)
+	c.Assert(state.Get("a"), HasLen, 2)
+
+	// removing a failing leader picks a new leader
+	state.SetCheckStatus("a", inst1.ID, down)
+	assertEvent(c, events, "a", discoverd.EventKindDown, inst1)
+	state.RemoveInstance("a", inst1.ID)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, inst2)
+	state.AddInstance("a", inst1)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst1)
+	assertEvent(c, events, "a", discoverd.EventKindLeader, inst1)
+
+	// removing a failing instance doesn't send another down event
+	state.SetCheckStatus("a", inst2.ID, down)
+	assertEvent(c, events, "a", discoverd.EventKindDown, inst2)
+	state.RemoveInstance("a", inst2.ID)
+	assertNoEvent(c, events)
+	c.Assert(state.GetAll("a"), HasLen, 1)
+
+	// failing instances are up once the service is no longer checked
+	state.AddInstance("a", inst2)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst2)
+	state.SetCheckStatus("a", inst2.ID, down)
+	assertEvent(c, events, "a", discoverd.EventKindDown, inst2)
+	state.AddService("a", DefaultServiceConfig)
+	assertEvent(c, events, "a", discoverd.EventKindUp, inst2)
+	c.Assert(state.Get("a"), HasLen, 2)
+	c.Assert(state.Get("a")[0].Check, IsNil)
+}
+
 func md5sum(data string) string {
 	digest := md5.Sum([]byte(data))
 	return hex.EncodeToString(digest[:])
@@ -39,6 +39,7 @@ var repoPath = flag.String("r", "/tmp/repos", "path to repo cache")
 var noAuth = flag.Bool("n", false, "disable client authentication")
 var keys = flag.String("k", "", "pem file containing private keys (read from SSH_PRIVATE_KEYS by default)")
 var cacheKeyHook = flag.String("cache-key-hook", "", "hook to run to determine the cache key (optional)")
+var cacheURLHook = flag.String("cache-url-hook", "", "hook to run to determine the blobstore URL of the repo cache (optional)")
 
 var authChecker = flag.String("auth-checker", "", "path to an executable that will check if the key is authorized")
 var receiver = flag.String("receiver", "", "path to an executable that will handle the push")
@@ -224,8 +225,14 @@ func handleChannel(conn *ssh.ServerConn, newChan ssh.NewChannel) {
 				fail("ensureCacheRepo", err)
 				return
 			}
+			var cacheURL string
 			if *useBlobstore {
-				if err := restoreBlobstoreCache(tempDir, cacheKey); err != nil {
+				cacheURL, err = blobstoreCacheURL(cacheKey)
+				if err != nil {
+					fail("cacheURLHook", err)
+					return
+				}
+				if err := restoreBlobstoreCache(tempDir, cacheKey, cacheURL); err != nil {
 					fail("restoreBlobstoreCache", err)
 					return
 				}
@@ -252,7 +259,7 @@ func handleChannel(conn *ssh.ServerConn, newChan ssh.NewChannel) {
 				return
 			}
 			if *useBlobstore {
-				if err := uploadCache(tempDir, cacheKey); err != nil {
+				if err := uploadCache(tempDir, cacheKey, cacheURL); err != nil {
 					fail("uploadCache", err)
 				}
 			}
@@ -336,10 +343,27 @@ func exitStatus(err error) (exitStatusMsg, error) {
 
 var cacheMtx sync.Mutex
 
-func restoreBlobstoreCache(tempDir, path string) error {
+// blobstoreCacheURL returns the blobstore URL of the cache of the repo with
+// the given cache key, which is given by the cache URL hook if it is set.
+func blobstoreCacheURL(path string) (string, error) {
+	if *cacheURLHook == "" {
+		return "http://blobstore.discoverd/cache/" + path + ".tar", nil
+	}
+	var result bytes.Buffer
+	var errout bytes.Buffer
+	cmd := exec.Command(*cacheURLHook, path)
+	cmd.Stdout = &result
+	cmd.Stderr = &errout
+	if err := cmd.Run(); err != nil {
+		return "", errors.New(errout.String())
+	}
+	return strings.TrimSpace(result.String()), nil
+}
+
+func restoreBlobstoreCache(tempDir, path, url string) error {
 	cachePath := tempDir + "/" + path
 
-	res, err := http.Get("http://blobstore.discoverd/cache/" + path + ".tar")
+	res, err := http.Get(url)
 	if err != nil {
 		return err
 	}
@@ -372,7 +396,7 @@ func ensureCacheRepo(tempDir, path string) error {
 	return nil
 }
 
-func uploadCache(tempDir, path string) error {
+func uploadCache(tempDir, path, url string) error {
 	cachePath := tempDir + "/" + path
 
 	r, w := io.Pipe()
@@ -387,7 +411,7 @@ func uploadCache(tempDir, path string) error {
 	}()
 
 	// upload the tarball to the blobstore
-	req, err := http.NewRequest("PUT", "http://blobstore.discoverd/cache/"+path+".tar", r)
+	req, err := http.NewRequest("PUT", url, r)
 	client := http.DefaultClient
 	resp, err := client.Do(req)
 	if err != nil {
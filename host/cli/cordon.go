@@ -0,0 +1,35 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func init() {
+	Register("cordon", runCordon, `
+usage: flynn-host cordon [--undo] HOSTID
+
+Mark a host as unschedulable so that no new jobs are placed on it.
+Existing jobs keep running, use 'flynn-host drain' to move them.
+
+Options:
+  --undo  make the host schedulable again`)
+}
+
+func runCordon(args *docopt.Args, client *cluster.Client) error {
+	hostID := args.String["HOSTID"]
+	if args.Bool["--undo"] {
+		if err := client.UncordonHost(hostID); err != nil {
+			return err
+		}
+		fmt.Println(hostID, "uncordoned")
+		return nil
+	}
+	if err := client.CordonHost(hostID); err != nil {
+		return err
+	}
+	fmt.Println(hostID, "cordoned")
+	return nil
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func init() {
+	Register("drain", runDrain, `
+usage: flynn-host drain [--timeout=<duration>] HOSTID
+
+Cordon a host and move its jobs to other hosts.
+
+The scheduler starts a replacement for each job on the host one at a time,
+stopping the original once the replacement is up. Omni jobs and one-off jobs
+are left running. The host stays cordoned once drained, run
+'flynn-host cordon --undo HOSTID' to make it schedulable again.
+
+Options:
+  --timeout=<duration>  how long to wait for the drain to finish [default: 30m]`)
+}
+
+func runDrain(args *docopt.Args, client *cluster.Client) error {
+	hostID := args.String["HOSTID"]
+	timeout, err := time.ParseDuration(args.String["--timeout"])
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %s", err)
+	}
+
+	if err := client.DrainHost(hostID); err != nil {
+		return err
+	}
+	fmt.Println("draining", hostID)
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		hosts, err := client.ListHosts()
+		if err != nil {
+			return err
+		}
+		var h *host.Host
+		for i := range hosts {
+			if hosts[i].ID == hostID {
+				h = &hosts[i]
+				break
+			}
+		}
+		if h == nil {
+			return fmt.Errorf("host %s went away whilst draining", hostID)
+		}
+		switch h.Metadata[host.HostMetaDrain] {
+		case "done":
+			fmt.Println(hostID, "drained")
+			return nil
+		case "failed":
+			return errors.New("drain failed, check the scheduler logs for details")
+		}
+	}
+	return errors.New("timed out waiting for drain to finish")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/host/types"
+)
+
+// fakeContainer records the calls made to stop it, exiting when it receives
+// exitOn.
+type fakeContainer struct {
+	exitOn      int
+	deregisters int
+	signals     []int
+	timeouts    []time.Duration
+}
+
+func (c *fakeContainer) Deregister() error {
+	c.deregisters++
+	return nil
+}
+
+func (c *fakeContainer) Signal(sig int) error {
+	c.signals = append(c.signals, sig)
+	return nil
+}
+
+func (c *fakeContainer) WaitStop(timeout time.Duration) error {
+	c.timeouts = append(c.timeouts, timeout)
+	if len(c.signals) > 0 && c.signals[len(c.signals)-1] == c.exitOn {
+		return nil
+	}
+	return errors.New("timed out")
+}
+
+func (S) TestStopContainerDefaults(c *C) {
+	// a job which exits on SIGTERM is stopped with SIGTERM and a ten
+	// second timeout
+	container := &fakeContainer{exitOn: int(syscall.SIGTERM)}
+	c.Assert(stopContainer(container, &host.Job{ID: "a"}, "test"), IsNil)
+	c.Assert(container.deregisters, Equals, 1)
+	c.Assert(container.signals, DeepEquals, []int{int(syscall.SIGTERM)})
+	c.Assert(container.timeouts, DeepEquals, []time.Duration{10 * time.Second})
+
+	// a job which ignores SIGTERM is killed after the timeout
+	container = &fakeContainer{}
+	c.Assert(stopContainer(container, &host.Job{ID: "b"}, "test"), IsNil)
+	c.Assert(container.signals, DeepEquals, []int{int(syscall.SIGTERM), int(syscall.SIGKILL)})
+	c.Assert(container.timeouts, DeepEquals, []time.Duration{10 * time.Second})
+}
+
+func (S) TestStopContainerConfig(c *C) {
+	job := &host.Job{ID: "a", Config: host.ContainerConfig{
+		StopSignal:  int(syscall.SIGQUIT),
+		StopTimeout: host.Duration(time.Minute),
+	}}
+	container := &fakeContainer{}
+	c.Assert(stopContainer(container, job, "test"), IsNil)
+	c.Assert(container.signals, DeepEquals, []int{int(syscall.SIGQUIT), int(syscall.SIGKILL)})
+	c.Assert(container.timeouts, DeepEquals, []time.Duration{time.Minute})
+}
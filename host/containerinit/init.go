@@ -146,6 +146,12 @@ func (c *Client) GetStdin() (*os.File, error) {
 	return os.NewFile(uintptr(fd.FD), "stdin"), nil
 }
 
+// Deregister removes the container's services from service discovery so that
+// no new connections are routed to it while it is stopping.
+func (c *Client) Deregister() error {
+	return c.c.Call("ContainerInit.Deregister", struct{}{}, &struct{}{})
+}
+
 func (c *Client) Signal(signal int) error {
 	err := c.c.Call("ContainerInit.Signal", signal, &struct{}{})
 	if err != nil {
@@ -177,6 +183,10 @@ type ContainerInit struct {
 	ptyMaster  *os.File
 	openStdin  bool
 
+	// service heartbeaters, closed when the job is deregistered or exits
+	hbs          []discoverd.Heartbeater
+	deregistered bool
+
 	streams    map[chan StateChange]struct{}
 	streamsMtx sync.RWMutex
 }
@@ -210,6 +220,17 @@ func (c *ContainerInit) Signal(sig int, res *struct{}) error {
 	return nil
 }
 
+func (c *ContainerInit) Deregister(arg struct{}, res *struct{}) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, hb := range c.hbs {
+		hb.Close()
+	}
+	c.hbs = nil
+	c.deregistered = true
+	return nil
+}
+
 func (c *ContainerInit) GetPtyMaster(arg struct{}, fd *fdrpc.FD) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -693,7 +714,6 @@ func containerInitApp(c *Config, logFile *os.File) error {
 
 	init.mtx.Unlock() // Allow calls
 	// monitor services
-	hbs := make([]discoverd.Heartbeater, 0, len(c.Ports))
 	for _, port := range c.Ports {
 		if port.Service == nil {
 			continue
@@ -705,14 +725,22 @@ func containerInitApp(c *Config, logFile *os.File) error {
 			log.Error("error monitoring service", "err", err)
 			os.Exit(70)
 		}
-		hbs = append(hbs, hb)
+		init.mtx.Lock()
+		if init.deregistered {
+			// the job is already stopping, don't advertise it
+			hb.Close()
+		} else {
+			init.hbs = append(init.hbs, hb)
+		}
+		init.mtx.Unlock()
 	}
 	exitCode := babySit(init.process)
 	log.Info("command exited", "status", exitCode)
 	init.mtx.Lock()
-	for _, hb := range hbs {
+	for _, hb := range init.hbs {
 		hb.Close()
 	}
+	init.hbs = nil
 	init.changeState(StateExited, "", exitCode)
 	init.mtx.Unlock() // Allow calls
 
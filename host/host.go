@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/reexec"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
 	"github.com/flynn/flynn/discoverd/client"
@@ -39,7 +40,7 @@ func init() {
 	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
 
 	cli.Register("daemon", runDaemon, `
-usage: flynn-host daemon [options] [--meta=<KEY=VAL>...]
+usage: flynn-host daemon [options] [--meta=<KEY=VAL>...] [--label=<KEY=VAL>...]
 
 options:
   --external=IP          external IP of host
@@ -49,14 +50,19 @@ options:
   --force                kill all containers booted by flynn-host before starting
   --legacy-volpath=PATH  directory to create legacy volumes in [default: /var/lib/flynn/host-volumes]
   --volpath=PATH         directory to create volumes in [default: /var/lib/flynn/volumes]
-  --backend=BACKEND      runner backend [default: libvirt-lxc]
+  --backend=BACKEND      runner backend, libvirt-lxc or native [default: libvirt-lxc]
   --meta=<KEY=VAL>...    key=value pair to add as metadata
+  --label=<KEY=VAL>...   key=value label used by process type placement constraints
   --bind=IP              bind containers to IP
   --flynn-init=PATH      path to flynn-init binary [default: /usr/local/bin/flynn-init]
 	`)
 }
 
 func main() {
+	// flynn-host re-executes itself to set up native backend containers
+	if reexec.Init() {
+		return
+	}
 	defer shutdown.Exit()
 
 	usage := `usage: flynn-host [-h|--help] [--version] <command> [<args>...]
@@ -76,6 +82,8 @@ Commands:
   log                        Get the logs of a job
   ps                         List jobs
   stop                       Stop running jobs
+  cordon                     Mark a host as unschedulable
+  drain                      Move jobs off a host
   destroy-volumes            Destroys the local volume database
   collect-debug-info         Collect debug information into an anonymous gist or tarball
   version                    Show current version
@@ -144,6 +152,7 @@ func runDaemon(args *docopt.Args) {
 	backendName := args.String["--backend"]
 	flynnInit := args.String["--flynn-init"]
 	metadata := args.All["--meta"].([]string)
+	labels := args.All["--label"].([]string)
 
 	grohl.AddContext("app", "host")
 	grohl.Log(grohl.Data{"at": "start"})
@@ -184,6 +193,7 @@ func runDaemon(args *docopt.Args) {
 	if err != nil {
 		shutdown.Fatal(err)
 	}
+	go vman.RunSnapshotPolicies(time.Minute, nil)
 
 	mux := logmux.New(1000)
 	shutdown.BeforeExit(func() { mux.Close() })
@@ -191,6 +201,8 @@ func runDaemon(args *docopt.Args) {
 	switch backendName {
 	case "libvirt-lxc":
 		backend, err = NewLibvirtLXCBackend(state, vman, legacyVolPath, "/tmp/flynn-host-logs", flynnInit, mux)
+	case "native":
+		backend, err = NewNativeBackend(state, vman, legacyVolPath, "/tmp/flynn-host-logs", flynnInit, mux)
 	default:
 		log.Fatalf("unknown backend %q", backendName)
 	}
@@ -287,7 +299,7 @@ func runDaemon(args *docopt.Args) {
 	}
 
 	router, err := serveHTTP(
-		&Host{state: state, backend: backend},
+		&Host{state: state, backend: backend, mux: mux},
 		&attachHandler{state: state, backend: backend},
 		cluster,
 		vman,
@@ -333,6 +345,13 @@ func runDaemon(args *docopt.Args) {
 		kv := strings.SplitN(s, "=", 2)
 		h.Metadata[kv[0]] = kv[1]
 	}
+	for _, s := range labels {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			shutdown.Fatal(fmt.Errorf("invalid label %q, expected KEY=VAL", s))
+		}
+		h.Metadata[host.HostLabelPrefix+kv[0]] = kv[1]
+	}
 
 	if err := resurrectLayer1(); err != nil {
 		shutdown.Fatal(err)
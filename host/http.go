@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/flynn/flynn/host/logmux"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/host/volume/api"
 	"github.com/flynn/flynn/host/volume/manager"
@@ -24,6 +25,7 @@ import (
 type Host struct {
 	state   *State
 	backend Backend
+	mux     *logmux.LogMux
 }
 
 func (h *Host) StopJob(id string) error {
@@ -152,12 +154,17 @@ func extractTufDB(r *http.Request) (string, error) {
 	return tmp.Name(), nil
 }
 
+func (h *jobAPI) LogStats(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	httphelper.JSON(w, 200, h.host.mux.Stats())
+}
+
 func (h *jobAPI) RegisterRoutes(r *httprouter.Router) error {
 	r.GET("/host/jobs", h.ListJobs)
 	r.GET("/host/jobs/:id", h.GetJob)
 	r.DELETE("/host/jobs/:id", h.StopJob)
 	r.PUT("/host/jobs/:id/signal/:signal", h.SignalJob)
 	r.POST("/host/pull-images", h.PullImages)
+	r.GET("/host/log-stats", h.LogStats)
 	return nil
 }
 
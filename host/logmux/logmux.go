@@ -5,21 +5,31 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
 
 	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/syslog/rfc5424"
 	"github.com/flynn/flynn/pkg/syslog/rfc6587"
 )
 
 // LogMux collects log lines from multiple readers and forwards them to a log
 // aggregator service registered in discoverd. Log lines are buffered in memory
-// and are dropped in LIFO order.
+// and are dropped in LIFO order. Each job is rate limited so that it can't
+// fill the buffer with its own lines, a message saying how many lines were
+// dropped is sent in place of lines over the limit.
 type LogMux struct {
 	logc chan *rfc5424.Message
 
+	jobsMtx sync.Mutex
+	jobs    map[string]*jobLog
+	// dropped is the number of lines dropped because logc was full, it is
+	// accessed atomically.
+	dropped uint64
+
 	sc *serviceConn
 
 	producerwg *sync.WaitGroup
@@ -36,6 +46,7 @@ type LogMux struct {
 func New(bufferSize int) *LogMux {
 	return &LogMux{
 		logc:       make(chan *rfc5424.Message, bufferSize),
+		jobs:       make(map[string]*jobLog),
 		producerwg: &sync.WaitGroup{},
 		shutdownc:  make(chan struct{}),
 		donec:      make(chan struct{}),
@@ -99,6 +110,10 @@ func (m *LogMux) Close() {
 
 type Config struct {
 	AppID, HostID, JobID, JobType string
+
+	// RateLimit is the limit of the job's log lines, DefaultRateLimit is
+	// used if it is nil.
+	RateLimit *host.LogRateLimit
 }
 
 // Follow forwards log lines from the reader into the syslog client. Follow
@@ -114,26 +129,90 @@ func (m *LogMux) Follow(r io.Reader, fd int, config Config) {
 		MsgID:    []byte(fmt.Sprintf("ID%d", fd)),
 	}
 
-	go m.follow(r, hdr)
+	go m.follow(r, hdr, m.addJob(config))
 }
 
-func (m *LogMux) follow(r io.Reader, hdr *rfc5424.Header) {
+func (m *LogMux) follow(r io.Reader, hdr *rfc5424.Header, job *jobLog) {
 	defer m.producerwg.Done()
+	defer m.removeJob(job)
 
 	g := grohl.NewContext(grohl.Data{"at": "logmux_follow"})
 	s := bufio.NewScanner(r)
 
 	for s.Scan() {
-		msg := rfc5424.NewMessage(hdr, s.Bytes())
-
-		select {
-		case m.logc <- msg:
-		default:
-			// throw away msg if logc buffer is full
+		ok, dropped := job.allow(time.Now())
+		if !ok {
+			continue
 		}
+		if dropped > 0 {
+			m.send(droppedMessage(hdr, dropped), job)
+		}
+		m.send(rfc5424.NewMessage(hdr, s.Bytes()), job)
+	}
+	if dropped := job.takePending(); dropped > 0 {
+		m.send(droppedMessage(hdr, dropped), job)
 	}
 
 	if s.Err() != nil {
 		g.Log(grohl.Data{"status": "error", "err": s.Err()})
 	}
 }
+
+func (m *LogMux) send(msg *rfc5424.Message, job *jobLog) {
+	select {
+	case m.logc <- msg:
+	default:
+		// throw away msg if logc buffer is full
+		atomic.AddUint64(&m.dropped, 1)
+		job.incDropped()
+	}
+}
+
+func droppedMessage(hdr *rfc5424.Header, n uint64) *rfc5424.Message {
+	return rfc5424.NewMessage(hdr, []byte(fmt.Sprintf("%d lines dropped by log rate limit", n)))
+}
+
+// addJob returns the log state of the job with config, creating it if this is
+// the first of the job's streams to be followed.
+func (m *LogMux) addJob(config Config) *jobLog {
+	m.jobsMtx.Lock()
+	defer m.jobsMtx.Unlock()
+
+	job, ok := m.jobs[config.JobID]
+	if !ok {
+		limit := DefaultRateLimit
+		if config.RateLimit != nil {
+			limit = *config.RateLimit
+		}
+		job = newJobLog(config, limit)
+		m.jobs[config.JobID] = job
+	}
+	job.refs++
+	return job
+}
+
+// removeJob removes the log state of a job once all its streams are done.
+func (m *LogMux) removeJob(job *jobLog) {
+	m.jobsMtx.Lock()
+	defer m.jobsMtx.Unlock()
+
+	if job.refs--; job.refs == 0 {
+		delete(m.jobs, job.id)
+	}
+}
+
+// Stats returns counters of the log lines which have been dropped, along with
+// those of each job currently being followed.
+func (m *LogMux) Stats() *host.LogStats {
+	m.jobsMtx.Lock()
+	defer m.jobsMtx.Unlock()
+
+	stats := &host.LogStats{
+		Dropped: atomic.LoadUint64(&m.dropped),
+		Jobs:    make(map[string]*host.JobLogStats, len(m.jobs)),
+	}
+	for id, job := range m.jobs {
+		stats.Jobs[id] = job.stats()
+	}
+	return stats
+}
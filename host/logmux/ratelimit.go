@@ -0,0 +1,101 @@
+package logmux
+
+import (
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// DefaultRateLimit is the rate limit of jobs which don't set their own. It
+// allows short bursts of output while stopping a single job from filling the
+// buffer shared by every job on the host.
+var DefaultRateLimit = host.LogRateLimit{Rate: 200, Burst: 1000}
+
+// jobLog is the log state of a job, shared by all of its followed streams.
+type jobLog struct {
+	id, appID, processType string
+
+	// refs is the number of streams being followed, it is guarded by the
+	// LogMux jobsMtx.
+	refs int
+
+	mtx    sync.Mutex
+	limit  host.LogRateLimit
+	tokens float64
+	last   time.Time
+	// pending is the number of lines dropped by the rate limit since the
+	// last summary.
+	pending     uint64
+	rateLimited uint64
+	dropped     uint64
+}
+
+func newJobLog(config Config, limit host.LogRateLimit) *jobLog {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &jobLog{
+		id:          config.JobID,
+		appID:       config.AppID,
+		processType: config.JobType,
+		limit:       limit,
+		tokens:      float64(limit.Burst),
+	}
+}
+
+// allow takes a token from the job's bucket, reporting whether a line emitted
+// at now may be sent. If it may, the number of lines dropped before it which
+// have not yet been summarized is also returned.
+func (j *jobLog) allow(now time.Time) (bool, uint64) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.limit.Rate <= 0 {
+		return true, 0
+	}
+	if !j.last.IsZero() {
+		j.tokens += now.Sub(j.last).Seconds() * j.limit.Rate
+		if max := float64(j.limit.Burst); j.tokens > max {
+			j.tokens = max
+		}
+	}
+	j.last = now
+
+	if j.tokens < 1 {
+		j.pending++
+		j.rateLimited++
+		return false, 0
+	}
+	j.tokens--
+	pending := j.pending
+	j.pending = 0
+	return true, pending
+}
+
+// takePending returns the number of lines dropped by the rate limit which
+// have not been summarized, and resets it.
+func (j *jobLog) takePending() uint64 {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	pending := j.pending
+	j.pending = 0
+	return pending
+}
+
+func (j *jobLog) incDropped() {
+	j.mtx.Lock()
+	j.dropped++
+	j.mtx.Unlock()
+}
+
+func (j *jobLog) stats() *host.JobLogStats {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return &host.JobLogStats{
+		AppID:       j.appID,
+		ProcessType: j.processType,
+		RateLimited: j.rateLimited,
+		Dropped:     j.dropped,
+	}
+}
@@ -0,0 +1,142 @@
+package logmux
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/host/types"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+// waitForStats waits until the stats of lm satisfy f, as lines are processed
+// after they have been read from a followed stream.
+func waitForStats(c *C, lm *LogMux, f func(*host.LogStats) bool) *host.LogStats {
+	timeout := time.After(5 * time.Second)
+	for {
+		if stats := lm.Stats(); f(stats) {
+			return stats
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for log stats, got %+v", lm.Stats())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (RateLimitSuite) TestTokenBucket(c *C) {
+	j := newJobLog(Config{JobID: "1"}, host.LogRateLimit{Rate: 10, Burst: 5})
+	now := time.Now()
+
+	// the bucket starts full
+	for i := 0; i < 5; i++ {
+		ok, dropped := j.allow(now)
+		c.Assert(ok, Equals, true)
+		c.Assert(dropped, Equals, uint64(0))
+	}
+	for i := 0; i < 3; i++ {
+		ok, _ := j.allow(now)
+		c.Assert(ok, Equals, false)
+	}
+
+	// tokens are added at the rate, and the first line allowed reports
+	// the lines dropped before it
+	now = now.Add(100 * time.Millisecond)
+	ok, dropped := j.allow(now)
+	c.Assert(ok, Equals, true)
+	c.Assert(dropped, Equals, uint64(3))
+	ok, _ = j.allow(now)
+	c.Assert(ok, Equals, false)
+
+	// the bucket doesn't fill beyond the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		ok, dropped = j.allow(now)
+		c.Assert(ok, Equals, true)
+	}
+	c.Assert(dropped, Equals, uint64(0))
+	ok, _ = j.allow(now)
+	c.Assert(ok, Equals, false)
+
+	c.Assert(j.takePending(), Equals, uint64(1))
+	c.Assert(j.takePending(), Equals, uint64(0))
+	c.Assert(j.stats().RateLimited, Equals, uint64(5))
+}
+
+func (RateLimitSuite) TestUnlimited(c *C) {
+	j := newJobLog(Config{JobID: "1"}, host.LogRateLimit{})
+	for i := 0; i < 1000; i++ {
+		ok, _ := j.allow(time.Now())
+		c.Assert(ok, Equals, true)
+	}
+}
+
+func (RateLimitSuite) TestFollowRateLimit(c *C) {
+	lm := New(1000)
+	limit := &host.LogRateLimit{Rate: 0.001, Burst: 10}
+	config := Config{AppID: "test", HostID: "1234", JobType: "worker", JobID: "567", RateLimit: limit}
+	other := Config{AppID: "test", HostID: "1234", JobType: "web", JobID: "890", RateLimit: limit}
+
+	pr, pw := io.Pipe()
+	lm.Follow(pr, 1, config)
+	otherR, otherW := io.Pipe()
+	lm.Follow(otherR, 1, other)
+
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(pw, "line %d\n", i)
+	}
+	fmt.Fprintln(otherW, "other line")
+
+	// the limit is per job, and counters are kept while it is followed
+	stats := waitForStats(c, lm, func(s *host.LogStats) bool {
+		return s.Jobs["567"] != nil && s.Jobs["567"].RateLimited == 90
+	})
+	c.Assert(stats.Jobs, HasLen, 2)
+	c.Assert(stats.Jobs["567"].ProcessType, Equals, "worker")
+	c.Assert(stats.Jobs["890"].RateLimited, Equals, uint64(0))
+
+	pw.Close()
+	otherW.Close()
+	lm.producerwg.Wait()
+	close(lm.logc)
+
+	var worker, web []string
+	for msg := range lm.logc {
+		switch string(msg.ProcID) {
+		case "worker.567":
+			worker = append(worker, string(msg.Msg))
+		case "web.890":
+			web = append(web, string(msg.Msg))
+		}
+	}
+	c.Assert(worker, HasLen, 11)
+	c.Assert(worker[9], Equals, "line 9")
+	c.Assert(worker[10], Equals, "90 lines dropped by log rate limit")
+	c.Assert(web, DeepEquals, []string{"other line"})
+
+	// jobs are removed once all their streams are done
+	stats = lm.Stats()
+	c.Assert(stats.Jobs, HasLen, 0)
+	c.Assert(stats.Dropped, Equals, uint64(0))
+}
+
+func (RateLimitSuite) TestBufferFullStats(c *C) {
+	lm := New(5)
+	config := Config{AppID: "test", HostID: "1234", JobType: "worker", JobID: "567", RateLimit: &host.LogRateLimit{}}
+
+	pr, pw := io.Pipe()
+	lm.Follow(pr, 1, config)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(pw, "line %d\n", i)
+	}
+
+	stats := waitForStats(c, lm, func(s *host.LogStats) bool { return s.Dropped == 5 })
+	c.Assert(stats.Jobs["567"].Dropped, Equals, uint64(5))
+	c.Assert(stats.Jobs["567"].RateLimited, Equals, uint64(0))
+	pw.Close()
+}
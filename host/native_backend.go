@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/reexec"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/libcontainer/netlink"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/logmux"
+	"github.com/flynn/flynn/host/volume/manager"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// cgroupRoot is where the cgroup hierarchies are mounted
+var cgroupRoot = "/sys/fs/cgroup"
+
+const (
+	cgroupParent = "flynn"
+
+	// defaultMemoryLimit matches the memory given to libvirt-lxc domains
+	defaultMemoryLimit = 1024 * 1024 * 1024
+)
+
+// cgroupSubsystems are the cgroup v1 hierarchies containers are placed in
+var cgroupSubsystems = []string{"memory", "cpu", "cpuacct", "blkio", "freezer"}
+
+func NewNativeBackend(state *State, vman *volumemanager.Manager, volPath, logPath, initPath string, mux *logmux.LogMux) (Backend, error) {
+	n := &NativeBackend{}
+	var err error
+	n.containerBackend, err = newContainerBackend("native", n, state, vman, volPath, logPath, initPath, mux)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+/*
+	NativeBackend runs containers directly using Linux namespaces and cgroups,
+	without depending on libvirt.
+
+	Containers are started by re-executing flynn-host as nsInit in new
+	namespaces, which finishes setting up the container (see nsinit.go) and
+	then executes containerinit.
+*/
+type NativeBackend struct {
+	*containerBackend
+}
+
+func (n *NativeBackend) setupNetwork() error { return nil }
+
+func (n *NativeBackend) startContainer(c *jobContainer) (err error) {
+	g := grohl.NewContext(grohl.Data{"backend": "native", "fn": "start_container", "job.id": c.job.ID})
+
+	// the sync pipe blocks nsInit until the container's cgroups and network
+	// interface have been set up
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer syncR.Close()
+	defer syncW.Close()
+
+	logDir := filepath.Join(n.LogPath, c.job.ID)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	console, err := os.OpenFile(filepath.Join(logDir, "console.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+
+	flags := syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWPID
+	if !c.job.Config.HostNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	// reexec.Command is not used as its parent death signal would kill the
+	// container whenever flynn-host exits. A clean shutdown stops containers
+	// via Cleanup, but they must survive flynn-host crashing or being killed
+	// so that UnmarshalState can restore them when it restarts.
+	cmd := &exec.Cmd{
+		Path:        reexec.Self(),
+		Args:        []string{nsInitName, c.RootPath},
+		Stdout:      console,
+		Stderr:      console,
+		ExtraFiles:  []*os.File{syncR},
+		SysProcAttr: &syscall.SysProcAttr{Cloneflags: uintptr(flags), Setsid: true},
+	}
+	g.Log(grohl.Data{"at": "exec"})
+	if err := cmd.Start(); err != nil {
+		g.Log(grohl.Data{"at": "exec", "status": "error", "err": err})
+		return err
+	}
+	c.Pid = cmd.Process.Pid
+	go cmd.Wait()
+	defer func() {
+		if err != nil {
+			cmd.Process.Kill()
+		}
+	}()
+	n.state.SetContainerID(c.job.ID, strconv.Itoa(c.Pid))
+
+	g.Log(grohl.Data{"at": "cgroups", "pid": c.Pid})
+	if err := joinCgroups(c.job.ID, c.Pid, c.job.Resources.Memory); err != nil {
+		g.Log(grohl.Data{"at": "cgroups", "status": "error", "err": err})
+		return err
+	}
+
+	var config nsInitConfig
+	if !c.job.Config.HostNetwork {
+		g.Log(grohl.Data{"at": "veth"})
+		config.Veth, err = n.createVeth(c.Pid)
+		if err != nil {
+			g.Log(grohl.Data{"at": "veth", "status": "error", "err": err})
+			return err
+		}
+	}
+	return json.NewEncoder(syncW).Encode(config)
+}
+
+// createVeth creates a veth pair, attaches one end to the bridge and moves
+// the other end into the network namespace of pid, returning its name.
+func (n *NativeBackend) createVeth(pid int) (string, error) {
+	bridge, err := net.InterfaceByName(bridgeName)
+	if err != nil {
+		return "", err
+	}
+	suffix := random.String(8)
+	hostName, peerName := "veth"+suffix, "vethc"+suffix
+	if err := netlink.NetworkCreateVethPair(hostName, peerName, 0); err != nil {
+		return "", err
+	}
+	hostIface, err := net.InterfaceByName(hostName)
+	if err != nil {
+		return "", err
+	}
+	peerIface, err := net.InterfaceByName(peerName)
+	if err != nil {
+		return "", err
+	}
+	if n.ifaceMTU > 0 {
+		if err := netlink.NetworkSetMTU(hostIface, n.ifaceMTU); err != nil {
+			return "", err
+		}
+		if err := netlink.NetworkSetMTU(peerIface, n.ifaceMTU); err != nil {
+			return "", err
+		}
+	}
+	if err := netlink.AddToBridge(hostIface, bridge); err != nil {
+		return "", err
+	}
+	if err := netlink.NetworkLinkUp(hostIface); err != nil {
+		return "", err
+	}
+	if err := netlink.NetworkSetNsPid(peerIface, pid); err != nil {
+		return "", err
+	}
+	return peerName, nil
+}
+
+func (n *NativeBackend) destroyContainer(c *jobContainer) error {
+	if c.Pid == 0 {
+		return errors.New("native: unknown container pid")
+	}
+	// containerinit is pid 1 of the container's pid namespace, so killing
+	// it kills every process in the container.
+	return syscall.Kill(c.Pid, syscall.SIGKILL)
+}
+
+func (n *NativeBackend) releaseContainer(c *jobContainer) {
+	if err := removeCgroups(c.job.ID); err != nil {
+		grohl.Log(grohl.Data{"backend": "native", "fn": "release_container", "job.id": c.job.ID, "at": "cgroups", "status": "error", "err": err})
+	}
+}
+
+// cgroupV2 returns whether the host uses the unified cgroup hierarchy.
+func cgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+type cgroupPath struct {
+	subsys string // empty for the unified hierarchy
+	path   string
+}
+
+func cgroupPaths(id string) []cgroupPath {
+	if cgroupV2() {
+		return []cgroupPath{{"", filepath.Join(cgroupRoot, cgroupParent, id)}}
+	}
+	var paths []cgroupPath
+	for _, subsys := range cgroupSubsystems {
+		if _, err := os.Stat(filepath.Join(cgroupRoot, subsys)); err != nil {
+			continue
+		}
+		paths = append(paths, cgroupPath{subsys, filepath.Join(cgroupRoot, subsys, cgroupParent, id)})
+	}
+	return paths
+}
+
+// joinCgroups creates the cgroups for a container, applies its memory limit
+// (given in KiB, see host.JobResources) and moves pid into them.
+func joinCgroups(id string, pid, memoryKiB int) error {
+	limit := int64(defaultMemoryLimit)
+	if memoryKiB > 0 {
+		limit = int64(memoryKiB) * 1024
+	}
+	if cgroupV2() {
+		// delegate the controllers we use to the container cgroups, errors
+		// are ignored as they may already be enabled
+		for _, dir := range []string{cgroupRoot, filepath.Join(cgroupRoot, cgroupParent)} {
+			os.MkdirAll(dir, 0755)
+			ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644)
+		}
+	}
+	for _, cg := range cgroupPaths(id) {
+		if err := os.MkdirAll(cg.path, 0755); err != nil {
+			return err
+		}
+		switch cg.subsys {
+		case "":
+			if err := writeCgroupFile(cg.path, "memory.max", limit); err != nil {
+				return err
+			}
+		case "memory":
+			if err := writeCgroupFile(cg.path, "memory.limit_in_bytes", limit); err != nil {
+				return err
+			}
+		}
+		if err := writeCgroupFile(cg.path, "cgroup.procs", int64(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(dir, name string, value int64) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(strconv.FormatInt(value, 10)), 0644); err != nil {
+		return fmt.Errorf("native: error writing %s: %s", name, err)
+	}
+	return nil
+}
+
+func removeCgroups(id string) error {
+	var err error
+	for _, cg := range cgroupPaths(id) {
+		if e := os.Remove(cg.path); e != nil && !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	return err
+}
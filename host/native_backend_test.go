@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+type CgroupSuite struct {
+	root string
+}
+
+var _ = Suite(&CgroupSuite{})
+
+func (s *CgroupSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+	cgroupRoot = s.root
+}
+
+func (s *CgroupSuite) TearDownTest(c *C) {
+	cgroupRoot = "/sys/fs/cgroup"
+}
+
+func (s *CgroupSuite) readFile(c *C, path ...string) string {
+	data, err := ioutil.ReadFile(filepath.Join(append([]string{s.root}, path...)...))
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *CgroupSuite) TestJoinCgroupsV1(c *C) {
+	// only hierarchies which are mounted are used
+	for _, subsys := range []string{"memory", "cpu", "freezer"} {
+		c.Assert(os.Mkdir(filepath.Join(s.root, subsys), 0755), IsNil)
+	}
+	c.Assert(cgroupV2(), Equals, false)
+
+	c.Assert(joinCgroups("job1", 123, 512*1024), IsNil)
+	for _, subsys := range []string{"memory", "cpu", "freezer"} {
+		c.Assert(s.readFile(c, subsys, cgroupParent, "job1", "cgroup.procs"), Equals, "123")
+	}
+	c.Assert(s.readFile(c, "memory", cgroupParent, "job1", "memory.limit_in_bytes"), Equals, "536870912")
+	_, err := os.Stat(filepath.Join(s.root, "blkio"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// jobs without a memory limit get the default
+	c.Assert(joinCgroups("job2", 456, 0), IsNil)
+	c.Assert(s.readFile(c, "memory", cgroupParent, "job2", "memory.limit_in_bytes"), Equals, "1073741824")
+}
+
+func (s *CgroupSuite) TestJoinCgroupsV2(c *C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.root, "cgroup.controllers"), []byte("cpu memory"), 0644), IsNil)
+	c.Assert(cgroupV2(), Equals, true)
+
+	c.Assert(joinCgroups("job1", 123, 512*1024), IsNil)
+	c.Assert(s.readFile(c, cgroupParent, "job1", "cgroup.procs"), Equals, "123")
+	c.Assert(s.readFile(c, cgroupParent, "job1", "memory.max"), Equals, "536870912")
+
+	// the controllers are delegated down to the container cgroups
+	c.Assert(s.readFile(c, "cgroup.subtree_control"), Equals, "+memory +cpu")
+	c.Assert(s.readFile(c, cgroupParent, "cgroup.subtree_control"), Equals, "+memory +cpu")
+}
+
+func (s *CgroupSuite) TestRemoveCgroups(c *C) {
+	c.Assert(os.Mkdir(filepath.Join(s.root, "memory"), 0755), IsNil)
+	path := filepath.Join(s.root, "memory", cgroupParent, "job1")
+	c.Assert(os.MkdirAll(path, 0755), IsNil)
+
+	c.Assert(removeCgroups("job1"), IsNil)
+	_, err := os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// removing cgroups which don't exist is not an error
+	c.Assert(removeCgroups("job1"), IsNil)
+}
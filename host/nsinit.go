@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/reexec"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/libcontainer/netlink"
+)
+
+// nsInitName is the name flynn-host is re-executed as by NativeBackend to set
+// up a container from inside its namespaces.
+const nsInitName = "flynn-host-nsinit"
+
+func init() {
+	reexec.Register(nsInitName, nsInitMain)
+}
+
+// nsInitConfig is sent to nsInit over the sync pipe once the container is
+// ready to be set up.
+type nsInitConfig struct {
+	// Veth is the name of the network interface which has been moved into
+	// the container, it is renamed to eth0 for containerinit.
+	Veth string `json:"veth,omitempty"`
+}
+
+type nsMount struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+	data   string
+}
+
+var nsMounts = []nsMount{
+	{"proc", "/proc", "proc", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+	{"sysfs", "/sys", "sysfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_RDONLY, ""},
+	{"tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID | syscall.MS_STRICTATIME, "mode=755"},
+	{"devpts", "/dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"},
+	{"shm", "/dev/shm", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, "mode=1777"},
+}
+
+// nsDevices are bind mounted from the host into the container's /dev
+var nsDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+var nsSymlinks = map[string]string{
+	"/dev/ptmx":   "pts/ptmx",
+	"/dev/fd":     "/proc/self/fd",
+	"/dev/stdin":  "/proc/self/fd/0",
+	"/dev/stdout": "/proc/self/fd/1",
+	"/dev/stderr": "/proc/self/fd/2",
+}
+
+func nsInitMain() {
+	runtime.LockOSThread()
+	if err := nsInit(os.Args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, "nsinit:", err)
+		os.Exit(70)
+	}
+}
+
+// nsInit runs as pid 1 in the new namespaces of a container. It waits for
+// flynn-host to finish setting up the container, builds the container's
+// mounts, pivots into root and executes containerinit in its place.
+func nsInit(root string) error {
+	syncPipe := os.NewFile(3, "sync")
+	var config nsInitConfig
+	if err := json.NewDecoder(syncPipe).Decode(&config); err != nil {
+		return fmt.Errorf("error reading config: %s", err)
+	}
+	syncPipe.Close()
+
+	if config.Veth != "" {
+		iface, err := net.InterfaceByName(config.Veth)
+		if err != nil {
+			return err
+		}
+		if err := netlink.NetworkChangeName(iface, "eth0"); err != nil {
+			return fmt.Errorf("error renaming %s: %s", config.Veth, err)
+		}
+	}
+
+	// don't propagate any of the following mounts back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("error making / private: %s", err)
+	}
+	// pivot_root requires the new root to be a mount point
+	if err := syscall.Mount(root, root, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("error bind mounting root: %s", err)
+	}
+	for _, m := range nsMounts {
+		target := filepath.Join(root, m.target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(m.source, target, m.fstype, m.flags, m.data); err != nil {
+			return fmt.Errorf("error mounting %s: %s", m.target, err)
+		}
+	}
+	for _, dev := range nsDevices {
+		if err := bindMount(filepath.Join("/dev", dev), filepath.Join(root, "dev", dev), true, false); err != nil {
+			return fmt.Errorf("error mounting /dev/%s: %s", dev, err)
+		}
+	}
+	for link, target := range nsSymlinks {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	oldRoot := filepath.Join(root, ".pivot_root")
+	if err := os.MkdirAll(oldRoot, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("error pivoting root: %s", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.pivot_root", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("error unmounting old root: %s", err)
+	}
+	if err := os.Remove("/.pivot_root"); err != nil {
+		return err
+	}
+
+	return syscall.Exec("/.containerinit", []string{"/.containerinit"}, []string{"container=flynn-native"})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/reexec"
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+const (
+	nsInitTestName = "flynn-host-nsinit-test"
+
+	// containerInitTestName is the path nsInit executes, which is a copy of
+	// the test binary in the test container
+	containerInitTestName = "/.containerinit"
+)
+
+func init() {
+	reexec.Register(nsInitTestName, nsInitTestMain)
+	reexec.Register(containerInitTestName, containerInitTestMain)
+}
+
+func TestMain(m *testing.M) {
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// hostDirs are bind mounted into the test container so that the dynamically
+// linked test binary can run as its containerinit
+var hostDirs = []string{"/bin", "/lib", "/lib64", "/usr"}
+
+// nsInitTestMain runs in the new namespaces of the test container, making the
+// host libraries available in the container before running nsInit.
+func nsInitTestMain() {
+	runtime.LockOSThread()
+	root := os.Args[1]
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		fmt.Fprintln(os.Stderr, "nsinit-test:", err)
+		os.Exit(1)
+	}
+	for _, dir := range hostDirs {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if err := bindMount(dir, filepath.Join(root, dir), false, true); err != nil {
+			fmt.Fprintln(os.Stderr, "nsinit-test:", err)
+			os.Exit(1)
+		}
+	}
+	if err := nsInit(root); err != nil {
+		fmt.Fprintln(os.Stderr, "nsinit:", err)
+		os.Exit(70)
+	}
+}
+
+type nsInitTestResult struct {
+	Pid       int    `json:"pid"`
+	Env       string `json:"env"`
+	Proc      bool   `json:"proc"`
+	DevNull   bool   `json:"dev_null"`
+	DevPts    bool   `json:"dev_pts"`
+	PivotRoot bool   `json:"pivot_root"`
+	Wd        string `json:"wd"`
+}
+
+// containerInitTestMain reports what the container looks like to its init
+// process.
+func containerInitTestMain() {
+	res := nsInitTestResult{Pid: os.Getpid(), Env: os.Getenv("container")}
+	if _, err := os.Stat("/proc/self/status"); err == nil {
+		res.Proc = true
+	}
+	if info, err := os.Stat("/dev/null"); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		res.DevNull = true
+	}
+	if _, err := os.Stat("/dev/pts/ptmx"); err == nil {
+		res.DevPts = true
+	}
+	if _, err := os.Stat("/.pivot_root"); err == nil {
+		res.PivotRoot = true
+	}
+	res.Wd, _ = os.Getwd()
+	json.NewEncoder(os.Stdout).Encode(res)
+}
+
+type NsInitSuite struct{}
+
+var _ = Suite(&NsInitSuite{})
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (NsInitSuite) TestNsInit(c *C) {
+	if os.Getuid() != 0 {
+		c.Skip("nsinit tests must be run as root")
+	}
+
+	root := c.MkDir()
+	c.Assert(copyFile(reexec.Self(), filepath.Join(root, containerInitTestName), 0755), IsNil)
+
+	syncR, syncW, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer syncW.Close()
+	var stdout, stderr bytes.Buffer
+	cmd := &exec.Cmd{
+		Path:        reexec.Self(),
+		Args:        []string{nsInitTestName, root},
+		Stdout:      &stdout,
+		Stderr:      &stderr,
+		ExtraFiles:  []*os.File{syncR},
+		SysProcAttr: &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWPID},
+	}
+	if err := cmd.Start(); err != nil {
+		syncR.Close()
+		c.Skip(fmt.Sprintf("unable to create namespaces: %s", err))
+	}
+	syncR.Close()
+
+	// nsInit waits for the config before setting up the container
+	c.Assert(json.NewEncoder(syncW).Encode(&nsInitConfig{}), IsNil)
+	syncW.Close()
+	if err := cmd.Wait(); err != nil {
+		c.Fatalf("nsinit failed: %s: %s", err, stderr.String())
+	}
+
+	var res nsInitTestResult
+	c.Assert(json.Unmarshal(stdout.Bytes(), &res), IsNil)
+	c.Assert(res, DeepEquals, nsInitTestResult{
+		Pid:     1,
+		Env:     "flynn-native",
+		Proc:    true,
+		DevNull: true,
+		DevPts:  true,
+		Wd:      "/",
+	})
+
+	// none of the container's mounts are visible on the host
+	_, err = os.Stat(filepath.Join(root, "proc", "self"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
@@ -67,6 +67,40 @@ func (s *Cluster) RemoveJobs(hostID string, jobIDs ...string) error {
 	return nil
 }
 
+// UpdateHostMeta merges meta into the metadata of a host and notifies
+// listeners with an "update" event.
+func (s *Cluster) UpdateHostMeta(hostID string, meta map[string]string) error {
+	l := s.logger.New("fn", "UpdateHostMeta", "host.id", hostID)
+	s.state.Begin()
+	if err := s.state.UpdateHostMeta(hostID, meta); err != nil {
+		l.Error("error updating host metadata", "err", err)
+		s.state.Rollback()
+		return err
+	}
+	s.state.Commit()
+	go s.state.sendEvent(hostID, "update")
+	return nil
+}
+
+// DrainHost cordons a host and emits a "drain" event, which the scheduler
+// reacts to by moving the host's jobs elsewhere.
+func (s *Cluster) DrainHost(hostID string) error {
+	l := s.logger.New("fn", "DrainHost", "host.id", hostID)
+	l.Info("draining host")
+	s.state.Begin()
+	if err := s.state.UpdateHostMeta(hostID, map[string]string{
+		host.HostMetaCordon: "true",
+		host.HostMetaDrain:  "pending",
+	}); err != nil {
+		l.Error("error updating host metadata", "err", err)
+		s.state.Rollback()
+		return err
+	}
+	s.state.Commit()
+	go s.state.sendEvent(hostID, "drain")
+	return nil
+}
+
 func (s *Cluster) StreamHostEvents(ch chan host.HostEvent, done chan bool) error {
 	l := s.logger.New("fn", "StreamHostEvents")
 	l.Debug("adding host event listener", "at", "add_listener")
@@ -185,6 +219,29 @@ func (c *HTTPAPI) RemoveJob(w http.ResponseWriter, r *http.Request, ps httproute
 	w.WriteHeader(200)
 }
 
+func (c *HTTPAPI) UpdateHostMeta(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	l := c.logger.New("fn", "UpdateHostMeta")
+	var meta map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		l.Error("failed to decode metadata", "err", err)
+		httphelper.Error(w, err)
+		return
+	}
+	if err := c.Cluster.UpdateHostMeta(ps.ByName("id"), meta); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (c *HTTPAPI) DrainHost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := c.Cluster.DrainHost(ps.ByName("id")); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
 func (c *HTTPAPI) StreamHostEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	l := c.logger.New("fn", "StreamHostEvents")
 	ch := make(chan host.HostEvent)
@@ -204,6 +261,8 @@ func (c *HTTPAPI) RegisterRoutes(r *httprouter.Router) error {
 	r.GET("/cluster/hosts", c.ListHosts)
 	r.PUT("/cluster/hosts/:id", c.RegisterHost)
 	r.POST("/cluster/jobs", c.AddJobs)
+	r.POST("/cluster/hosts/:id/meta", c.UpdateHostMeta)
+	r.POST("/cluster/hosts/:id/drain", c.DrainHost)
 	r.DELETE("/cluster/hosts/:host_id/jobs/:job_id", c.RemoveJob)
 	r.GET("/cluster/events", c.StreamHostEvents)
 	return nil
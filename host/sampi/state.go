@@ -183,6 +183,34 @@ func (s *State) RemoveHost(id string) {
 	s.nextModified = true
 }
 
+// UpdateHostMeta merges meta into the metadata of the given host, keys with
+// empty values are removed.
+func (s *State) UpdateHostMeta(hostID string, meta map[string]string) error {
+	l := s.logger.New("fn", "UpdateHostMeta", "host.id", hostID)
+	h, ok := s.host(hostID)
+	if !ok {
+		l.Error("host not found")
+		return fmt.Errorf("sampi: Unknown host %s", hostID)
+	}
+	l.Debug("updating metadata")
+	newMeta := make(map[string]string, len(h.Metadata)+len(meta))
+	for k, v := range h.Metadata {
+		newMeta[k] = v
+	}
+	for k, v := range meta {
+		if v == "" {
+			delete(newMeta, k)
+		} else {
+			newMeta[k] = v
+		}
+	}
+	h.Metadata = newMeta
+	s.next[hostID] = h
+	l.Debug("marking state as modified")
+	s.nextModified = true
+	return nil
+}
+
 func (s *State) AddListener(ch chan host.HostEvent) {
 	l := s.logger.New("fn", "AddListener")
 	l.Debug("locking listeners")
@@ -45,3 +45,30 @@ func TestStateRace(t *testing.T) {
 		t.Log("Got '2'")
 	}
 }
+
+func TestStateUpdateHostMeta(t *testing.T) {
+	state := NewState()
+	state.Begin()
+	state.AddHost(&host.Host{ID: "foo", Metadata: map[string]string{"a": "1"}}, nil)
+	state.Commit()
+
+	state.Begin()
+	if err := state.UpdateHostMeta("foo", map[string]string{"a": "", host.HostMetaCordon: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	state.Commit()
+
+	h := state.Get()["foo"]
+	if _, ok := h.Metadata["a"]; ok {
+		t.Error("Expected 'a' to be removed from metadata")
+	}
+	if !h.Cordoned() {
+		t.Error("Expected 'foo' to be cordoned")
+	}
+
+	state.Begin()
+	if err := state.UpdateHostMeta("bar", map[string]string{"a": "1"}); err == nil {
+		t.Error("Expected an error updating an unknown host")
+	}
+	state.Rollback()
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
@@ -14,6 +15,7 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/boltdb/bolt"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/signedurl"
 )
 
 // TODO: prune old jobs?
@@ -127,6 +129,9 @@ func (s *State) Restore(backend Backend) (func() error, error) {
 			newID := cluster.RandomJobID("")
 			log.Printf("resurrecting %s (%s) as %s", job.Job.ID, job.ManifestID, newID)
 			job.Job.ID = newID
+			if err := signSlugURL(job.Job); err != nil {
+				log.Printf("error signing SLUG_URL of %s: %s", newID, err)
+			}
 			config := &RunConfig{
 				// TODO(titanous): Use jobs instead of ActiveJobs in
 				// resurrection bucket once ManifestID is gone.
@@ -149,6 +154,30 @@ func (s *State) Restore(backend Backend) (func() error, error) {
 	return func() error { return resurrectJobs(false) }, nil
 }
 
+// resurrectURLExpiry is how long the SLUG_URLs signed for resurrected jobs are
+// valid for.
+const resurrectURLExpiry = 24 * time.Hour
+
+// signSlugURL signs the SLUG_URL of a job being resurrected with its
+// SlugURLKey, as the URL the job was created with may have expired.
+func signSlugURL(job *host.Job) error {
+	slugURL, ok := job.Config.Env["SLUG_URL"]
+	if !ok || job.SlugURLKey == "" {
+		return nil
+	}
+	u, err := url.Parse(slugURL)
+	if err != nil {
+		return err
+	}
+	get := []string{"GET"}
+	signed, err := signedurl.SignPrefix(job.SlugURLKey, u.Path, get, slugURL, get, time.Now().Add(resurrectURLExpiry))
+	if err != nil {
+		return err
+	}
+	job.Config.Env["SLUG_URL"] = signed
+	return nil
+}
+
 // MarkForResurrection is run during a clean shutdown and persists all running
 // jobs with the resurrection flag before they are terminated by
 // backend cleanup.
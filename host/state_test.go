@@ -1,11 +1,14 @@
 package main
 
 import (
+	"net/http"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/signedurl"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -58,3 +61,45 @@ func (S) TestStatePersistRestore(c *C) {
 		c.Errorf("expected job.HostID to equal %s, got %s", hostID, job.HostID)
 	}
 }
+
+type runBackend struct {
+	MockBackend
+	jobs []*host.Job
+}
+
+func (b *runBackend) Run(job *host.Job, _ *RunConfig) error {
+	b.jobs = append(b.jobs, job)
+	return nil
+}
+
+func (S) TestResurrectSignsSlugURL(c *C) {
+	key := []byte("blobstore-key")
+	slugURL, err := signedurl.Sign(key, "http://blobstore.discoverd/slug.tgz", []string{"GET"}, time.Now().Add(-time.Hour))
+	c.Assert(err, IsNil)
+
+	workdir := c.MkDir()
+	state := NewState("abc123", filepath.Join(workdir, "host-state-db"))
+	state.AddJob(&host.Job{
+		ID:         "a",
+		Config:     host.ContainerConfig{Env: map[string]string{"SLUG_URL": slugURL}},
+		Resurrect:  true,
+		SlugURLKey: signedurl.PrefixKey(key, "/slug.tgz", []string{"GET"}),
+	}, nil)
+	state.SetStatusRunning("a")
+	c.Assert(state.MarkForResurrection(), IsNil)
+	state.persistenceDBClose()
+
+	state = NewState("abc123", filepath.Join(workdir, "host-state-db"))
+	defer state.persistenceDBClose()
+	backend := &runBackend{}
+	resurrect, err := state.Restore(backend)
+	c.Assert(err, IsNil)
+	c.Assert(resurrect(), IsNil)
+
+	// the expired URL is replaced with a fresh one
+	c.Assert(backend.jobs, HasLen, 1)
+	req, err := http.NewRequest("GET", backend.jobs[0].Config.Env["SLUG_URL"], nil)
+	c.Assert(err, IsNil)
+	c.Assert(req.URL.Path, Equals, "/slug.tgz")
+	c.Assert(signedurl.Verify(key, req, time.Now()), IsNil)
+}
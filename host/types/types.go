@@ -1,6 +1,9 @@
 package host
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -17,6 +20,12 @@ type Job struct {
 	// If Resurrect is true, the host service will attempt to start the job when
 	// starting after stopping (via crash or shutdown) with the job running.
 	Resurrect bool `json:"resurrect,omitempty"`
+
+	// SlugURLKey, if set, is a GET-only key for the blobstore path of the
+	// SLUG_URL in Config.Env (see pkg/signedurl.PrefixKey). The host uses it to sign
+	// SLUG_URL again when resurrecting the job, as the URL the job was created
+	// with may have expired by then.
+	SlugURLKey string `json:"slug_url_key,omitempty"`
 }
 
 func (j *Job) Dup() *Job {
@@ -78,6 +87,49 @@ type ContainerConfig struct {
 	Uid         int               `json:"uid,omitempty"`
 	HostNetwork bool              `json:"host_network,omitempty"`
 	DisableLog  bool              `json:"disable_log,omitempty"`
+
+	// StopSignal is the signal sent to the job when it is stopped. It
+	// defaults to SIGTERM.
+	StopSignal int `json:"stop_signal,omitempty"`
+	// StopTimeout is the time to wait for the job to exit after sending
+	// StopSignal before killing it. It defaults to ten seconds.
+	StopTimeout Duration `json:"stop_timeout,omitempty"`
+
+	// LogRateLimit limits the rate at which the job's log lines are sent
+	// to the log aggregator. It defaults to the host's limit.
+	LogRateLimit *LogRateLimit `json:"log_rate_limit,omitempty"`
+}
+
+// LogRateLimit is a token bucket limit on the number of log lines a job may
+// emit, lines over the limit are dropped.
+type LogRateLimit struct {
+	// Rate is the number of lines per second that can be sustained, zero
+	// disables the limit.
+	Rate float64 `json:"rate,omitempty"`
+	// Burst is the number of lines that can be emitted at once after the
+	// job has been below the rate for a while.
+	Burst int `json:"burst,omitempty"`
+}
+
+// LogStats are counters of the log lines a host did not send to the log
+// aggregator.
+type LogStats struct {
+	// Dropped is the number of lines dropped because the host's log buffer
+	// was full.
+	Dropped uint64 `json:"dropped"`
+	// Jobs has the stats of each job the host is collecting logs from.
+	Jobs map[string]*JobLogStats `json:"jobs,omitempty"`
+}
+
+type JobLogStats struct {
+	AppID       string `json:"app_id,omitempty"`
+	ProcessType string `json:"process_type,omitempty"`
+	// RateLimited is the number of lines dropped because the job exceeded
+	// its LogRateLimit.
+	RateLimited uint64 `json:"rate_limited"`
+	// Dropped is the number of lines dropped because the host's log buffer
+	// was full.
+	Dropped uint64 `json:"dropped"`
 }
 
 // Apply 'y' to 'x', returning a new structure.  'y' trumps.
@@ -118,9 +170,47 @@ func (x ContainerConfig) Merge(y ContainerConfig) ContainerConfig {
 		x.Uid = y.Uid
 	}
 	x.HostNetwork = x.HostNetwork || y.HostNetwork
+	if y.StopSignal != 0 {
+		x.StopSignal = y.StopSignal
+	}
+	if y.StopTimeout != 0 {
+		x.StopTimeout = y.StopTimeout
+	}
+	if y.LogRateLimit != nil {
+		x.LogRateLimit = y.LogRateLimit
+	}
 	return x
 }
 
+// Duration is a time.Duration which is encoded in JSON as a string such as
+// "30s". It can also be decoded from an integer number of seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil:
+	case string:
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dur)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	default:
+		return fmt.Errorf("host: invalid duration %s", data)
+	}
+	return nil
+}
+
 type Port struct {
 	Port    int      `json:"port,omitempty"`
 	Proto   string   `json:"proto,omitempty"`
@@ -184,6 +274,38 @@ type Host struct {
 	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
+const (
+	// HostMetaCordon is the metadata key which marks a host as cordoned when
+	// set to "true". Cordoned hosts keep running their existing jobs but are
+	// not picked for new ones.
+	HostMetaCordon = "cordon"
+
+	// HostMetaDrain is the metadata key which tracks the progress of a drain,
+	// it is set to "pending" when a drain is requested and to "done" once the
+	// scheduler has moved all of the host's jobs elsewhere.
+	HostMetaDrain = "drain"
+)
+
+// Cordoned returns whether new jobs should be kept off the host.
+func (h *Host) Cordoned() bool {
+	return h.Metadata[HostMetaCordon] == "true"
+}
+
+// HostLabelPrefix is prepended to the keys of host labels when they are
+// stored in the host metadata.
+const HostLabelPrefix = "label."
+
+// Labels returns the labels of the host with HostLabelPrefix removed.
+func (h *Host) Labels() map[string]string {
+	labels := make(map[string]string)
+	for k, v := range h.Metadata {
+		if strings.HasPrefix(k, HostLabelPrefix) {
+			labels[strings.TrimPrefix(k, HostLabelPrefix)] = v
+		}
+	}
+	return labels
+}
+
 type Event struct {
 	Event string     `json:"event,omitempty"`
 	JobID string     `json:"job_id,omitempty"`
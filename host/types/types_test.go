@@ -0,0 +1,63 @@
+package host
+
+import (
+	"encoding/json"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func (S) TestMergeStopConfig(c *C) {
+	x := ContainerConfig{StopSignal: int(syscall.SIGINT), StopTimeout: Duration(time.Minute)}
+
+	// zero values don't override
+	merged := x.Merge(ContainerConfig{})
+	c.Assert(merged.StopSignal, Equals, int(syscall.SIGINT))
+	c.Assert(merged.StopTimeout, Equals, Duration(time.Minute))
+
+	merged = x.Merge(ContainerConfig{StopSignal: int(syscall.SIGQUIT), StopTimeout: Duration(5 * time.Second)})
+	c.Assert(merged.StopSignal, Equals, int(syscall.SIGQUIT))
+	c.Assert(merged.StopTimeout, Equals, Duration(5*time.Second))
+
+	merged = ContainerConfig{}.Merge(x)
+	c.Assert(merged.StopSignal, Equals, int(syscall.SIGINT))
+	c.Assert(merged.StopTimeout, Equals, Duration(time.Minute))
+}
+
+func (S) TestDurationJSON(c *C) {
+	data, err := json.Marshal(ContainerConfig{StopTimeout: Duration(90 * time.Second)})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `.*"stop_timeout":"1m30s".*`)
+
+	data, err = json.Marshal(ContainerConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Not(Matches), `.*stop_timeout.*`)
+
+	for _, t := range []struct {
+		json     string
+		expected time.Duration
+	}{
+		{`"1m30s"`, 90 * time.Second},
+		{`"500ms"`, 500 * time.Millisecond},
+		{`30`, 30 * time.Second},
+		{`0.5`, 500 * time.Millisecond},
+	} {
+		var d Duration
+		c.Assert(json.Unmarshal([]byte(t.json), &d), IsNil)
+		c.Assert(time.Duration(d), Equals, t.expected)
+	}
+
+	for _, invalid := range []string{`"30"`, `"soon"`, `true`, `{}`} {
+		var d Duration
+		c.Assert(json.Unmarshal([]byte(invalid), &d), NotNil, Commentf("decoding %s", invalid))
+	}
+}
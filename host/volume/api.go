@@ -1,6 +1,44 @@
 package volume
 
+import (
+	"time"
+)
+
 type PullCoordinate struct {
 	HostID     string `json:"host_id"`
 	SnapshotID string `json:"snapshot_id"`
 }
+
+// SnapshotTransfer names a blobstore (or any other HTTP) URL that a snapshot
+// should be exported to, or that a snapshot should be imported from.
+type SnapshotTransfer struct {
+	URL string `json:"url"`
+}
+
+/*
+	SnapshotPolicy describes how often a volume is snapshotted by the host
+	and how many of those snapshots are kept around.
+*/
+type SnapshotPolicy struct {
+	// Interval is the minimum amount of time between scheduled snapshots.
+	Interval time.Duration `json:"interval"`
+
+	// Retention is the number of scheduled snapshots to keep; older snapshots
+	// are destroyed once this is exceeded.  Zero means keep all snapshots.
+	Retention int `json:"retention,omitempty"`
+
+	// ExportURL, if set, is a URL prefix (typically in blobstore) that every
+	// scheduled snapshot is streamed to as `<ExportURL>/<snapshot id>`.
+	// Exported copies are deleted when the matching snapshot is pruned.
+	ExportURL string `json:"export_url,omitempty"`
+
+	// ExportKey, if set, is a key for the path of ExportURL and the methods in
+	// ExportKeyMethods which is used to sign export requests to a blobstore
+	// which requires signed URLs.  It is issued by the controller (see
+	// pkg/signedurl.PrefixKey).
+	ExportKey string `json:"export_key,omitempty"`
+}
+
+// ExportKeyMethods are the methods that the ExportKey of a SnapshotPolicy
+// must allow, to store exported snapshots and delete them when pruned.
+var ExportKeyMethods = []string{"PUT", "DELETE"}
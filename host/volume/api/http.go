@@ -39,6 +39,13 @@ func (api *HTTPAPI) RegisterRoutes(r *httprouter.Router) {
 	r.POST("/storage/volumes/:volume_id/pull_snapshot", api.Pull)
 	// responds with a snapshot stream binary.  only works on snapshots, takes 'haves' parameters, usually called by a node that's servicing a 'pull_snapshot' request
 	r.GET("/storage/volumes/:volume_id/send", api.Send)
+	// streams a snapshot to the URL given in the body (usually in blobstore)
+	r.POST("/storage/volumes/:volume_id/export", api.Export)
+	// restores a snapshot from the URL given in the body onto the volume
+	r.POST("/storage/volumes/:volume_id/import", api.Import)
+	r.GET("/storage/volumes/:volume_id/snapshot_policy", api.GetSnapshotPolicy)
+	r.PUT("/storage/volumes/:volume_id/snapshot_policy", api.SetSnapshotPolicy)
+	r.DELETE("/storage/volumes/:volume_id/snapshot_policy", api.SetSnapshotPolicy)
 }
 
 func (api *HTTPAPI) CreateProvider(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -204,3 +211,115 @@ func (api *HTTPAPI) Send(w http.ResponseWriter, r *http.Request, ps httprouter.P
 		}
 	}
 }
+
+func (api *HTTPAPI) Export(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	volumeID := ps.ByName("volume_id")
+
+	transfer := &volume.SnapshotTransfer{}
+	if err := httphelper.DecodeJSON(r, &transfer); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if transfer.URL == "" {
+		httphelper.ValidationError(w, "url", "must not be blank")
+		return
+	}
+
+	err := api.vman.ExportSnapshot(volumeID, transfer.URL)
+	if err != nil {
+		switch err {
+		case volumemanager.NoSuchVolume:
+			httphelper.ObjectNotFoundError(w, fmt.Sprintf("no volume with id %q", volumeID))
+			return
+		case volumemanager.NotASnapshot:
+			httphelper.ValidationError(w, "volume_id", "must be a snapshot")
+			return
+		default:
+			httphelper.Error(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+func (api *HTTPAPI) Import(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	volumeID := ps.ByName("volume_id")
+
+	transfer := &volume.SnapshotTransfer{}
+	if err := httphelper.DecodeJSON(r, &transfer); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if transfer.URL == "" {
+		httphelper.ValidationError(w, "url", "must not be blank")
+		return
+	}
+
+	snap, err := api.vman.ImportSnapshot(volumeID, transfer.URL)
+	if err != nil {
+		switch err {
+		case volumemanager.NoSuchVolume:
+			httphelper.ObjectNotFoundError(w, fmt.Sprintf("no volume with id %q", volumeID))
+			return
+		default:
+			httphelper.Error(w, err)
+			return
+		}
+	}
+
+	httphelper.JSON(w, 200, snap.Info())
+}
+
+func (api *HTTPAPI) GetSnapshotPolicy(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	volumeID := ps.ByName("volume_id")
+	if api.vman.GetVolume(volumeID) == nil {
+		httphelper.ObjectNotFoundError(w, fmt.Sprintf("no volume with id %q", volumeID))
+		return
+	}
+	policy := api.vman.GetSnapshotPolicy(volumeID)
+	if policy == nil {
+		httphelper.ObjectNotFoundError(w, fmt.Sprintf("no snapshot policy for volume %q", volumeID))
+		return
+	}
+
+	httphelper.JSON(w, 200, policy)
+}
+
+func (api *HTTPAPI) SetSnapshotPolicy(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	volumeID := ps.ByName("volume_id")
+
+	var policy *volume.SnapshotPolicy
+	if r.Method != "DELETE" {
+		policy = &volume.SnapshotPolicy{}
+		if err := httphelper.DecodeJSON(r, policy); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		if policy.Interval <= 0 {
+			httphelper.ValidationError(w, "interval", "must be positive")
+			return
+		}
+		if policy.Retention < 0 {
+			httphelper.ValidationError(w, "retention", "must not be negative")
+			return
+		}
+	}
+
+	if err := api.vman.SetSnapshotPolicy(volumeID, policy); err != nil {
+		switch err {
+		case volumemanager.NoSuchVolume:
+			httphelper.ObjectNotFoundError(w, fmt.Sprintf("no volume with id %q", volumeID))
+			return
+		default:
+			httphelper.Error(w, err)
+			return
+		}
+	}
+
+	if policy == nil {
+		w.WriteHeader(200)
+		return
+	}
+	httphelper.JSON(w, 200, policy)
+}
@@ -33,6 +33,13 @@ type Manager struct {
 	// `map[volume.Id]volume`
 	volumes map[string]volume.Volume
 
+	// `map[volume.Id]policy`
+	snapshotPolicies map[string]*volume.SnapshotPolicy
+
+	// `set[volume.Id]` of the snapshots taken by a snapshot policy, which are
+	// the only ones the policy's retention applies to.
+	scheduledSnapshots map[string]struct{}
+
 	stateDB *bolt.DB
 }
 
@@ -46,10 +53,12 @@ func New(stateFilePath string, defProvFn func() (volume.Provider, error)) (*Mana
 		return nil, err
 	}
 	m := &Manager{
-		providers:   make(map[string]volume.Provider),
-		providerIDs: make(map[volume.Provider]string),
-		volumes:     make(map[string]volume.Volume),
-		stateDB:     stateDB,
+		providers:          make(map[string]volume.Provider),
+		providerIDs:        make(map[volume.Provider]string),
+		volumes:            make(map[string]volume.Volume),
+		snapshotPolicies:   make(map[string]*volume.SnapshotPolicy),
+		scheduledSnapshots: make(map[string]struct{}),
+		stateDB:            stateDB,
 	}
 	if err := m.restore(); err != nil {
 		return nil, err
@@ -138,8 +147,22 @@ func (m *Manager) DestroyVolume(id string) error {
 		return err
 	}
 	delete(m.volumes, id)
-	// commit both changes
+	_, hadPolicy := m.snapshotPolicies[id]
+	delete(m.snapshotPolicies, id)
+	_, wasScheduled := m.scheduledSnapshots[id]
+	delete(m.scheduledSnapshots, id)
+	// commit all changes
 	m.persist(func(tx *bolt.Tx) error {
+		if hadPolicy {
+			if err := m.persistSnapshotPolicy(tx, id); err != nil {
+				return err
+			}
+		}
+		if wasScheduled {
+			if err := m.persistScheduledSnapshot(tx, id); err != nil {
+				return err
+			}
+		}
 		return m.persistVolume(tx, vol)
 	})
 	return nil
@@ -148,6 +171,15 @@ func (m *Manager) DestroyVolume(id string) error {
 func (m *Manager) CreateSnapshot(id string) (volume.Volume, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	snap, err := m.createSnapshotLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	m.persist(func(tx *bolt.Tx) error { return m.persistVolume(tx, snap) })
+	return snap, nil
+}
+
+func (m *Manager) createSnapshotLocked(id string) (volume.Volume, error) {
 	vol := m.volumes[id]
 	if vol == nil {
 		return nil, NoSuchVolume
@@ -156,8 +188,9 @@ func (m *Manager) CreateSnapshot(id string) (volume.Volume, error) {
 	if err != nil {
 		return nil, err
 	}
+	snap.Info().SnapshotOf = id
+	snap.Info().CreatedAt = time.Now().UTC()
 	m.volumes[snap.Info().ID] = snap
-	m.persist(func(tx *bolt.Tx) error { return m.persistVolume(tx, snap) })
 	return snap, nil
 }
 
@@ -194,24 +227,26 @@ func (m *Manager) ListHaves(id string) ([]json.RawMessage, error) {
 func (m *Manager) SendSnapshot(id string, haves []json.RawMessage, stream io.Writer) error {
 	m.mutex.Lock()
 	vol := m.volumes[id]
+	m.mutex.Unlock() // don't lock the manager for the duration of the send operation.
 	if vol == nil {
 		return NoSuchVolume
 	}
-	m.mutex.Unlock() // don't lock the manager for the duration of the send operation.
 	return vol.Provider().SendSnapshot(vol, haves, stream)
 }
 
 func (m *Manager) ReceiveSnapshot(id string, stream io.Reader) (volume.Volume, error) {
 	m.mutex.Lock()
 	vol := m.volumes[id]
+	m.mutex.Unlock() // don't lock the manager for the duration of the recv operation.
 	if vol == nil {
 		return nil, NoSuchVolume
 	}
-	m.mutex.Unlock() // don't lock the manager for the duration of the recv operation.
 	snap, err := vol.Provider().ReceiveSnapshot(vol, stream)
 	if err != nil {
 		return nil, err
 	}
+	snap.Info().SnapshotOf = id
+	snap.Info().CreatedAt = time.Now().UTC()
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	m.volumes[snap.Info().ID] = snap
@@ -235,6 +270,8 @@ func initializePersistence(stateFilePath string) (*bolt.DB, error) {
 		// idempotently create buckets.  (errors ignored because they're all compile-time impossible args checks.)
 		tx.CreateBucketIfNotExists([]byte("volumes"))
 		tx.CreateBucketIfNotExists([]byte("providers"))
+		tx.CreateBucketIfNotExists([]byte("snapshot_policies"))
+		tx.CreateBucketIfNotExists([]byte("scheduled_snapshots"))
 		return nil
 	}); err != nil {
 		return nil, fmt.Errorf("could not initialize volume persistence db: %s", err)
@@ -249,6 +286,8 @@ func (m *Manager) restore() error {
 	if err := m.stateDB.View(func(tx *bolt.Tx) error {
 		volumesBucket := tx.Bucket([]byte("volumes"))
 		providersBucket := tx.Bucket([]byte("providers"))
+		policiesBucket := tx.Bucket([]byte("snapshot_policies"))
+		scheduledBucket := tx.Bucket([]byte("scheduled_snapshots"))
 
 		// restore volume info
 		// keep this in a temporary map until we can get providers to transform them into reality
@@ -302,6 +341,28 @@ func (m *Manager) restore() error {
 			return err
 		}
 
+		// restore snapshot policies (older databases may not have the bucket)
+		if policiesBucket != nil {
+			if err := policiesBucket.ForEach(func(k, v []byte) error {
+				policy := &volume.SnapshotPolicy{}
+				if err := json.Unmarshal(v, policy); err != nil {
+					return fmt.Errorf("failed to deserialize snapshot policy: %s", err)
+				}
+				m.snapshotPolicies[string(k)] = policy
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		if scheduledBucket != nil {
+			if err := scheduledBucket.ForEach(func(k, v []byte) error {
+				m.scheduledSnapshots[string(k)] = struct{}{}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	}); err != nil && err != io.EOF {
 		return fmt.Errorf("could not restore from volume persistence db: %s", err)
@@ -384,6 +445,43 @@ func (m *Manager) persistVolume(tx *bolt.Tx, vol volume.Volume) error {
 	return nil
 }
 
+// Called to sync changes to disk when a volume's snapshot policy is updated
+func (m *Manager) persistSnapshotPolicy(tx *bolt.Tx, id string) error {
+	policiesBucket, err := tx.CreateBucketIfNotExists([]byte("snapshot_policies"))
+	if err != nil {
+		return fmt.Errorf("could not persist snapshot policy to boltdb: %s", err)
+	}
+	k := []byte(id)
+	policy, ok := m.snapshotPolicies[id]
+	if !ok {
+		return policiesBucket.Delete(k)
+	}
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("failed to serialize snapshot policy: %s", err)
+	}
+	if err := policiesBucket.Put(k, b); err != nil {
+		return fmt.Errorf("could not persist snapshot policy to boltdb: %s", err)
+	}
+	return nil
+}
+
+// Called to sync changes to disk when a snapshot is taken or destroyed by a snapshot policy
+func (m *Manager) persistScheduledSnapshot(tx *bolt.Tx, id string) error {
+	scheduledBucket, err := tx.CreateBucketIfNotExists([]byte("scheduled_snapshots"))
+	if err != nil {
+		return fmt.Errorf("could not persist scheduled snapshot to boltdb: %s", err)
+	}
+	k := []byte(id)
+	if _, ok := m.scheduledSnapshots[id]; !ok {
+		return scheduledBucket.Delete(k)
+	}
+	if err := scheduledBucket.Put(k, []byte{}); err != nil {
+		return fmt.Errorf("could not persist scheduled snapshot to boltdb: %s", err)
+	}
+	return nil
+}
+
 func (m *Manager) persistProvider(tx *bolt.Tx, id string) error {
 	// Note: This method does *not* include re-serializing per-volume state,
 	// because we assume that hasn't changed unless the change request
@@ -0,0 +1,285 @@
+package volumemanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/boltdb/bolt"
+	"github.com/flynn/flynn/host/volume"
+	"github.com/flynn/flynn/pkg/signedurl"
+)
+
+var NotASnapshot = errors.New("volume is not a snapshot")
+
+/*
+	SetSnapshotPolicy configures the scheduled snapshotting of a volume.
+	A nil policy removes any existing policy.
+*/
+func (m *Manager) SetSnapshotPolicy(id string, policy *volume.SnapshotPolicy) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vol := m.volumes[id]
+	if vol == nil {
+		return NoSuchVolume
+	}
+	if vol.IsSnapshot() {
+		return fmt.Errorf("cannot set a snapshot policy on a snapshot")
+	}
+	if policy == nil {
+		delete(m.snapshotPolicies, id)
+	} else {
+		if policy.Interval <= 0 {
+			return fmt.Errorf("snapshot policy interval must be positive")
+		}
+		if policy.Retention < 0 {
+			return fmt.Errorf("snapshot policy retention must not be negative")
+		}
+		m.snapshotPolicies[id] = policy
+	}
+	m.persist(func(tx *bolt.Tx) error { return m.persistSnapshotPolicy(tx, id) })
+	return nil
+}
+
+func (m *Manager) GetSnapshotPolicy(id string) *volume.SnapshotPolicy {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.snapshotPolicies[id]
+}
+
+/*
+	ListSnapshots returns the snapshots known to have been taken of the given
+	volume, oldest first.
+*/
+func (m *Manager) ListSnapshots(id string) []volume.Volume {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var snaps []volume.Volume
+	for _, v := range m.volumes {
+		if v.IsSnapshot() && v.Info().SnapshotOf == id {
+			snaps = append(snaps, v)
+		}
+	}
+	sort.Sort(snapshotsByAge(snaps))
+	return snaps
+}
+
+// scheduledSnapshotsOf returns the snapshots of the given volume which were
+// taken by its snapshot policy, oldest first.
+func (m *Manager) scheduledSnapshotsOf(id string) []volume.Volume {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var snaps []volume.Volume
+	for snapID := range m.scheduledSnapshots {
+		if v, ok := m.volumes[snapID]; ok && v.Info().SnapshotOf == id {
+			snaps = append(snaps, v)
+		}
+	}
+	sort.Sort(snapshotsByAge(snaps))
+	return snaps
+}
+
+// createScheduledSnapshot snapshots the given volume and records that the
+// snapshot belongs to its snapshot policy.
+func (m *Manager) createScheduledSnapshot(id string) (volume.Volume, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	snap, err := m.createSnapshotLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	snapID := snap.Info().ID
+	m.scheduledSnapshots[snapID] = struct{}{}
+	m.persist(func(tx *bolt.Tx) error {
+		if err := m.persistScheduledSnapshot(tx, snapID); err != nil {
+			return err
+		}
+		return m.persistVolume(tx, snap)
+	})
+	return snap, nil
+}
+
+type snapshotsByAge []volume.Volume
+
+func (s snapshotsByAge) Len() int      { return len(s) }
+func (s snapshotsByAge) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s snapshotsByAge) Less(i, j int) bool {
+	return s[i].Info().CreatedAt.Before(s[j].Info().CreatedAt)
+}
+
+/*
+	ExportSnapshot streams the full content of a snapshot to the given URL with
+	a PUT request, which is what blobstore expects for storing an object.
+*/
+func (m *Manager) ExportSnapshot(id string, url string) error {
+	vol := m.GetVolume(id)
+	if vol == nil {
+		return NoSuchVolume
+	}
+	if !vol.IsSnapshot() {
+		return NotASnapshot
+	}
+
+	r, w := io.Pipe()
+	defer r.Close()
+	go func() {
+		// no haves are passed so the stream is self-contained and can be
+		// restored onto a fresh volume.
+		w.CloseWithError(m.SendSnapshot(id, nil, w))
+	}()
+	req, err := http.NewRequest("PUT", url, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.zfs.snapshot-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("snapshot export failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("snapshot export failed: unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+/*
+	ImportSnapshot fetches a snapshot stream previously written by
+	`ExportSnapshot` and applies it to the given volume, returning the
+	resulting snapshot.  The same restrictions as `ReceiveSnapshot` apply; in
+	particular the target volume should usually be a new, empty volume.
+*/
+func (m *Manager) ImportSnapshot(id string, url string) (volume.Volume, error) {
+	if m.GetVolume(id) == nil {
+		return nil, NoSuchVolume
+	}
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot import failed: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("snapshot import failed: unexpected status %d", res.StatusCode)
+	}
+	return m.ReceiveSnapshot(id, res.Body)
+}
+
+/*
+	RunSnapshotPolicies enforces the configured snapshot policies every tick
+	until stop is closed.  A nil stop channel runs forever.
+*/
+func (m *Manager) RunSnapshotPolicies(tick time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.EnforceSnapshotPolicies(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+/*
+	EnforceSnapshotPolicies snapshots every volume whose policy interval has
+	elapsed as of now, exports the new snapshots if requested, and destroys
+	snapshots in excess of each policy's retention count.  Only snapshots taken
+	by a policy count towards its interval and retention; snapshots taken
+	through the API are left alone.
+*/
+func (m *Manager) EnforceSnapshotPolicies(now time.Time) {
+	m.mutex.Lock()
+	policies := make(map[string]volume.SnapshotPolicy, len(m.snapshotPolicies))
+	for id, p := range m.snapshotPolicies {
+		policies[id] = *p
+	}
+	m.mutex.Unlock()
+
+	for id, policy := range policies {
+		if err := m.enforceSnapshotPolicy(id, policy, now); err != nil {
+			log.Printf("error enforcing snapshot policy for volume %s: %s", id, err)
+		}
+	}
+}
+
+func (m *Manager) enforceSnapshotPolicy(id string, policy volume.SnapshotPolicy, now time.Time) error {
+	snaps := m.scheduledSnapshotsOf(id)
+	if len(snaps) == 0 || now.Sub(snaps[len(snaps)-1].Info().CreatedAt) >= policy.Interval {
+		snap, err := m.createScheduledSnapshot(id)
+		if err != nil {
+			return err
+		}
+		if policy.ExportURL != "" {
+			u, err := exportURL(policy, snap.Info().ID, "PUT")
+			if err != nil {
+				return err
+			}
+			if err := m.ExportSnapshot(snap.Info().ID, u); err != nil {
+				return err
+			}
+		}
+		snaps = append(snaps, snap)
+	}
+
+	if policy.Retention == 0 || len(snaps) <= policy.Retention {
+		return nil
+	}
+	for _, snap := range snaps[:len(snaps)-policy.Retention] {
+		snapID := snap.Info().ID
+		if err := m.DestroyVolume(snapID); err != nil {
+			return err
+		}
+		if policy.ExportURL != "" {
+			u, err := exportURL(policy, snapID, "DELETE")
+			if err != nil {
+				return err
+			}
+			if err := deleteExport(u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportURLExpiry is how long the signed URLs used to export snapshots are
+// valid for.  They are only checked when a request starts, so this doesn't
+// limit how long an export may take.
+const exportURLExpiry = time.Hour
+
+// exportURL returns the URL that the policy exports the given snapshot to,
+// signed with the policy's export key for method if it has one.
+func exportURL(policy volume.SnapshotPolicy, snapID, method string) (string, error) {
+	u := strings.TrimSuffix(policy.ExportURL, "/") + "/" + snapID
+	if policy.ExportKey == "" {
+		return u, nil
+	}
+	prefix, err := url.Parse(policy.ExportURL)
+	if err != nil {
+		return "", err
+	}
+	return signedurl.SignPrefix(policy.ExportKey, prefix.Path, volume.ExportKeyMethods, u, []string{method}, time.Now().Add(exportURLExpiry))
+}
+
+func deleteExport(url string) error {
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 404 {
+		return fmt.Errorf("deleting exported snapshot failed: unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package volumemanager_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/host/volume"
+	"github.com/flynn/flynn/host/volume/manager"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/signedurl"
+)
+
+// memProvider is a volume.Provider which keeps volume content in memory so
+// that snapshot scheduling can be tested without zfs.
+type memProvider struct {
+	volumes map[string]*memVolume
+}
+
+type memVolume struct {
+	info     *volume.Info
+	provider *memProvider
+	snapshot bool
+	data     []byte
+}
+
+func (v *memVolume) Info() *volume.Info        { return v.info }
+func (v *memVolume) Provider() volume.Provider { return v.provider }
+func (v *memVolume) Location() string          { return "" }
+func (v *memVolume) IsSnapshot() bool          { return v.snapshot }
+
+func (p *memProvider) Kind() string { return "mem" }
+
+func (p *memProvider) ForkVolume(volume.Volume) (volume.Volume, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (p *memProvider) add(data []byte, snapshot bool) *memVolume {
+	v := &memVolume{info: &volume.Info{ID: random.UUID()}, provider: p, snapshot: snapshot, data: data}
+	p.volumes[v.info.ID] = v
+	return v
+}
+
+func (p *memProvider) NewVolume() (volume.Volume, error) {
+	return p.add(nil, false), nil
+}
+
+func (p *memProvider) DestroyVolume(v volume.Volume) error {
+	delete(p.volumes, v.Info().ID)
+	return nil
+}
+
+func (p *memProvider) CreateSnapshot(v volume.Volume) (volume.Volume, error) {
+	return p.add(v.(*memVolume).data, true), nil
+}
+
+func (p *memProvider) ListHaves(volume.Volume) ([]json.RawMessage, error) {
+	return nil, nil
+}
+
+func (p *memProvider) SendSnapshot(v volume.Volume, haves []json.RawMessage, stream io.Writer) error {
+	_, err := stream.Write(v.(*memVolume).data)
+	return err
+}
+
+func (p *memProvider) ReceiveSnapshot(v volume.Volume, stream io.Reader) (volume.Volume, error) {
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+	v.(*memVolume).data = data
+	return p.add(data, true), nil
+}
+
+func (p *memProvider) MarshalGlobalState() (json.RawMessage, error) {
+	return json.Marshal(nil)
+}
+
+func (p *memProvider) MarshalVolumeState(volumeID string) (json.RawMessage, error) {
+	return json.Marshal(nil)
+}
+
+func (p *memProvider) RestoreVolumeState(*volume.Info, json.RawMessage) (volume.Volume, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// blobServer is a minimal stand-in for blobstore, which requires requests to
+// be signed if key is set.
+type blobServer struct {
+	mtx   sync.Mutex
+	blobs map[string][]byte
+	key   []byte
+}
+
+func (b *blobServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.key != nil {
+		if err := signedurl.Verify(b.key, req, time.Now()); err != nil {
+			w.WriteHeader(403)
+			return
+		}
+	}
+	switch req.Method {
+	case "GET":
+		data, ok := b.blobs[req.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(data)
+	case "PUT":
+		data, _ := ioutil.ReadAll(req.Body)
+		b.blobs[req.URL.Path] = data
+	case "DELETE":
+		delete(b.blobs, req.URL.Path)
+	}
+}
+
+type SnapshotPolicyTests struct{}
+
+var _ = Suite(&SnapshotPolicyTests{})
+
+func (SnapshotPolicyTests) newManager(c *C) *volumemanager.Manager {
+	prov := &memProvider{volumes: make(map[string]*memVolume)}
+	vman, err := volumemanager.New("", func() (volume.Provider, error) { return prov, nil })
+	c.Assert(err, IsNil)
+	return vman
+}
+
+func (s *SnapshotPolicyTests) TestEnforceRetention(c *C) {
+	vman := s.newManager(c)
+	vol, err := vman.NewVolume()
+	c.Assert(err, IsNil)
+	id := vol.Info().ID
+
+	c.Assert(vman.SetSnapshotPolicy(id, &volume.SnapshotPolicy{Interval: time.Hour, Retention: 2}), IsNil)
+
+	// the first enforcement always takes a snapshot
+	now := time.Now()
+	vman.EnforceSnapshotPolicies(now)
+	c.Assert(vman.ListSnapshots(id), HasLen, 1)
+
+	// nothing happens until the interval has elapsed
+	vman.EnforceSnapshotPolicies(now.Add(time.Minute))
+	c.Assert(vman.ListSnapshots(id), HasLen, 1)
+
+	vman.EnforceSnapshotPolicies(now.Add(2 * time.Hour))
+	snaps := vman.ListSnapshots(id)
+	c.Assert(snaps, HasLen, 2)
+	first := snaps[0].Info().ID
+
+	// a third snapshot pushes the oldest one out
+	vman.EnforceSnapshotPolicies(now.Add(4 * time.Hour))
+	snaps = vman.ListSnapshots(id)
+	c.Assert(snaps, HasLen, 2)
+	c.Assert(vman.GetVolume(first), IsNil)
+	for _, snap := range snaps {
+		c.Assert(snap.Info().SnapshotOf, Equals, id)
+	}
+
+	// destroying the volume removes its policy
+	c.Assert(vman.DestroyVolume(id), IsNil)
+	c.Assert(vman.GetSnapshotPolicy(id), IsNil)
+}
+
+func (s *SnapshotPolicyTests) TestRetentionKeepsManualSnapshots(c *C) {
+	vman := s.newManager(c)
+	vol, err := vman.NewVolume()
+	c.Assert(err, IsNil)
+	id := vol.Info().ID
+
+	manual, err := vman.CreateSnapshot(id)
+	c.Assert(err, IsNil)
+
+	c.Assert(vman.SetSnapshotPolicy(id, &volume.SnapshotPolicy{Interval: time.Hour, Retention: 1}), IsNil)
+
+	// the manual snapshot does not count towards the interval
+	now := time.Now()
+	vman.EnforceSnapshotPolicies(now)
+	c.Assert(vman.ListSnapshots(id), HasLen, 2)
+
+	// only the scheduled snapshot is pruned
+	vman.EnforceSnapshotPolicies(now.Add(2 * time.Hour))
+	snaps := vman.ListSnapshots(id)
+	c.Assert(snaps, HasLen, 2)
+	c.Assert(vman.GetVolume(manual.Info().ID), NotNil)
+}
+
+func (s *SnapshotPolicyTests) TestExportImport(c *C) {
+	blobs := &blobServer{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(blobs)
+	defer srv.Close()
+
+	vman := s.newManager(c)
+	vol, err := vman.NewVolume()
+	c.Assert(err, IsNil)
+	vol.(*memVolume).data = []byte("some data")
+
+	c.Assert(vman.SetSnapshotPolicy(vol.Info().ID, &volume.SnapshotPolicy{
+		Interval:  time.Hour,
+		Retention: 1,
+		ExportURL: srv.URL + "/backups/",
+	}), IsNil)
+
+	vman.EnforceSnapshotPolicies(time.Now())
+	snaps := vman.ListSnapshots(vol.Info().ID)
+	c.Assert(snaps, HasLen, 1)
+	snapID := snaps[0].Info().ID
+	c.Assert(blobs.blobs["/backups/"+snapID], DeepEquals, []byte("some data"))
+
+	// exporting a volume which is not a snapshot is an error
+	c.Assert(vman.ExportSnapshot(vol.Info().ID, srv.URL+"/foo"), Equals, volumemanager.NotASnapshot)
+
+	// restore onto a fresh volume
+	vol2, err := vman.NewVolume()
+	c.Assert(err, IsNil)
+	snap, err := vman.ImportSnapshot(vol2.Info().ID, srv.URL+"/backups/"+snapID)
+	c.Assert(err, IsNil)
+	c.Assert(snap.Info().SnapshotOf, Equals, vol2.Info().ID)
+	c.Assert(bytes.Equal(vol2.(*memVolume).data, []byte("some data")), Equals, true)
+
+	// pruning the snapshot also removes the exported copy
+	vman.EnforceSnapshotPolicies(time.Now().Add(2 * time.Hour))
+	c.Assert(vman.GetVolume(snapID), IsNil)
+	_, ok := blobs.blobs["/backups/"+snapID]
+	c.Assert(ok, Equals, false)
+
+	_, err = vman.ImportSnapshot(vol2.Info().ID, srv.URL+"/backups/"+snapID)
+	c.Assert(err, NotNil)
+}
+
+func (s *SnapshotPolicyTests) TestSignedExport(c *C) {
+	key := []byte("blobstore-key")
+	blobs := &blobServer{blobs: make(map[string][]byte), key: key}
+	srv := httptest.NewServer(blobs)
+	defer srv.Close()
+
+	vman := s.newManager(c)
+	vol, err := vman.NewVolume()
+	c.Assert(err, IsNil)
+	vol.(*memVolume).data = []byte("some data")
+
+	// without a key the export is rejected and no snapshots are pruned
+	policy := &volume.SnapshotPolicy{Interval: time.Hour, Retention: 1, ExportURL: srv.URL + "/backups"}
+	c.Assert(vman.SetSnapshotPolicy(vol.Info().ID, policy), IsNil)
+	now := time.Now()
+	vman.EnforceSnapshotPolicies(now)
+	c.Assert(blobs.blobs, HasLen, 0)
+
+	// nor does a key for a different prefix or for other methods
+	for i, exportKey := range []string{
+		signedurl.PrefixKey(key, "/other", volume.ExportKeyMethods),
+		signedurl.PrefixKey(key, "/backups", []string{"GET"}),
+	} {
+		policy.ExportKey = exportKey
+		c.Assert(vman.SetSnapshotPolicy(vol.Info().ID, policy), IsNil)
+		vman.EnforceSnapshotPolicies(now.Add(time.Duration(i+1) * 2 * time.Hour))
+		c.Assert(blobs.blobs, HasLen, 0)
+	}
+
+	policy.ExportKey = signedurl.PrefixKey(key, "/backups", volume.ExportKeyMethods)
+	c.Assert(vman.SetSnapshotPolicy(vol.Info().ID, policy), IsNil)
+	vman.EnforceSnapshotPolicies(now.Add(6 * time.Hour))
+	snaps := vman.ListSnapshots(vol.Info().ID)
+	c.Assert(snaps, HasLen, 1)
+	snapID := snaps[0].Info().ID
+	c.Assert(blobs.blobs["/backups/"+snapID], DeepEquals, []byte("some data"))
+
+	// the exported copy is deleted with a signed request when pruned
+	vman.EnforceSnapshotPolicies(now.Add(8 * time.Hour))
+	c.Assert(vman.GetVolume(snapID), IsNil)
+	_, ok := blobs.blobs["/backups/"+snapID]
+	c.Assert(ok, Equals, false)
+	c.Assert(blobs.blobs, HasLen, 1)
+}
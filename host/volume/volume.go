@@ -1,5 +1,9 @@
 package volume
 
+import (
+	"time"
+)
+
 /*
 	A Volume is a persistent and sharable filesystem.  Unlike most of the filesystem in a job's
 	container, which is ephemeral and is discarded after job termination, Volumes can be used to
@@ -35,4 +39,10 @@ type Info struct {
 	// These are guid formatted (v4, random); selected by the server;
 	// and though not globally sync'd, entropy should be high enough to be unique.
 	ID string `json:"id"`
+
+	// SnapshotOf is the ID of the volume this snapshot was taken from.
+	// It is empty for volumes which are not snapshots.
+	SnapshotOf string `json:"snapshot_of,omitempty"`
+
+	CreatedAt time.Time `json:"created_at,omitempty"`
 }
@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/flynn/flynn/logaggregator/client"
 	"github.com/flynn/flynn/pkg/ctxhelper"
 	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+	"github.com/flynn/flynn/pkg/syslog/rfc6587"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
@@ -22,6 +25,8 @@ func apiHandler(agg *Aggregator) http.Handler {
 	r := httprouter.New()
 
 	r.GET("/log/:channel_id", httphelper.WrapHandler(api.GetLog))
+	r.GET("/drains", httphelper.WrapHandler(api.ListDrains))
+	r.POST("/replicate", httphelper.WrapHandler(api.Replicate))
 	return httphelper.ContextInjector(
 		"logaggregator-api",
 		httphelper.NewRequestLogger(r),
@@ -32,17 +37,26 @@ type aggregatorAPI struct {
 	agg *Aggregator
 }
 
-func (a *aggregatorAPI) GetLog(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+// withCloseNotify returns a context which is cancelled when the client of w
+// goes away.
+func withCloseNotify(ctx context.Context, w http.ResponseWriter) (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(ctx)
 	if cn, ok := w.(http.CloseNotifier); ok {
+		// CloseNotify must be called before the handler returns
+		closec := cn.CloseNotify()
 		go func() {
 			select {
-			case <-cn.CloseNotify():
+			case <-closec:
 				cancel()
 			case <-ctx.Done():
 			}
 		}()
 	}
+	return ctx, cancel
+}
+
+func (a *aggregatorAPI) GetLog(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := withCloseNotify(ctx, w)
 	defer cancel()
 
 	params, _ := ctxhelper.ParamsFromContext(ctx)
@@ -53,12 +67,28 @@ func (a *aggregatorAPI) GetLog(ctx context.Context, w http.ResponseWriter, req *
 		follow = true
 	}
 
-	lines := -1 // default to all lines
+	lines := -1 // default to as many lines as are served
 	if strLines := req.FormValue("lines"); strLines != "" {
 		var err error
 		lines, err = strconv.Atoi(strLines)
-		if err != nil || lines < 0 || lines > 10000 {
-			httphelper.ValidationError(w, "lines", "lines must be an integer between 0 and 10000")
+		if err != nil || lines < 0 {
+			httphelper.ValidationError(w, "lines", "lines must be a non-negative integer")
+			return
+		}
+	}
+
+	// the cursor can also be given as Last-Event-ID, which is what
+	// EventSource clients send when reconnecting
+	var after uint64
+	strAfter := req.FormValue("after")
+	if strAfter == "" {
+		strAfter = req.Header.Get("Last-Event-ID")
+	}
+	if strAfter != "" {
+		var err error
+		after, err = strconv.ParseUint(strAfter, 10, 64)
+		if err != nil {
+			httphelper.ValidationError(w, "after", "after must be a message ID")
 			return
 		}
 	}
@@ -71,25 +101,86 @@ func (a *aggregatorAPI) GetLog(ctx context.Context, w http.ResponseWriter, req *
 		val := processTypeVals[len(processTypeVals)-1]
 		filters = append(filters, filterProcessType{[]byte(val)})
 	}
+	if strHostID := req.FormValue("host_id"); strHostID != "" {
+		filters = append(filters, filterHostID{[]byte(strHostID)})
+	}
+	if stream := req.FormValue("stream"); stream != "" {
+		if stream != "stdout" && stream != "stderr" {
+			httphelper.ValidationError(w, "stream", "stream must be stdout or stderr")
+			return
+		}
+		filters = append(filters, filterStream{stream})
+	}
+	if strSince := req.FormValue("since"); strSince != "" {
+		since, err := time.Parse(time.RFC3339Nano, strSince)
+		if err != nil {
+			httphelper.ValidationError(w, "since", "since must be an RFC3339 timestamp")
+			return
+		}
+		filters = append(filters, filterSince{since})
+	}
+	if strUntil := req.FormValue("until"); strUntil != "" {
+		until, err := time.Parse(time.RFC3339Nano, strUntil)
+		if err != nil {
+			httphelper.ValidationError(w, "until", "until must be an RFC3339 timestamp")
+			return
+		}
+		filters = append(filters, filterUntil{until})
+	}
+	if search := req.FormValue("search"); search != "" {
+		filters = append(filters, filterSubstring{[]byte(search)})
+	}
+	if strRegexp := req.FormValue("regexp"); strRegexp != "" {
+		re, err := regexp.Compile(strRegexp)
+		if err != nil {
+			httphelper.ValidationError(w, "regexp", "regexp is invalid: "+err.Error())
+			return
+		}
+		filters = append(filters, filterRegexp{re})
+	}
+	if fieldVals := req.Form["field"]; len(fieldVals) > 0 {
+		fields := make(map[string]string, len(fieldVals))
+		for _, val := range fieldVals {
+			kv := strings.SplitN(val, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				httphelper.ValidationError(w, "field", "field must be of the form key=value")
+				return
+			}
+			fields[kv[0]] = kv[1]
+		}
+		filters = append(filters, filterFields{fields})
+	}
+	withFields := req.FormValue("parse_fields") == "true"
 
 	w.WriteHeader(200)
 
 	var msgc <-chan *rfc5424.Message
+	var flush <-chan time.Time
 	if follow {
-		msgc = a.agg.ReadLastNAndSubscribe(channelID, lines, filters, ctx.Done())
-		go flushLoop(w.(http.Flusher), 50*time.Millisecond, ctx.Done())
+		msgc = a.agg.ReadLastNAndSubscribe(channelID, lines, after, filters, ctx.Done())
+		// flush from this goroutine as the ResponseWriter is not safe
+		// for concurrent use
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		flush = ticker.C
 	} else {
-		msgc = a.agg.ReadLastN(channelID, lines, filters, ctx.Done())
+		msgc = a.agg.ReadLastN(channelID, lines, after, filters, ctx.Done())
 	}
 
 	enc := json.NewEncoder(w)
 	for {
 		select {
+		case <-flush:
+			w.(http.Flusher).Flush()
 		case syslogMsg := <-msgc:
 			if syslogMsg == nil { // channel is closed / done
 				return
 			}
-			if err := enc.Encode(NewMessageFromSyslog(syslogMsg)); err != nil {
+			msg := NewMessageFromSyslog(syslogMsg)
+			if withFields {
+				msg.Fields = parseFields(syslogMsg.Msg)
+			}
+			if err := enc.Encode(msg); err != nil {
 				log15.Error("error writing msg", "err", err)
 				return
 			}
@@ -99,12 +190,65 @@ func (a *aggregatorAPI) GetLog(ctx context.Context, w http.ResponseWriter, req *
 	}
 }
 
-func flushLoop(f http.Flusher, interval time.Duration, done <-chan struct{}) {
+// ListDrains lists the drains running on the leader, which is the only
+// Aggregator that runs drains, so followers ask the leader.
+func (a *aggregatorAPI) ListDrains(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	leader := a.agg.LeaderAddr()
+	if leader == "" {
+		httphelper.JSON(w, 200, a.agg.ListDrains())
+		return
+	}
+	c, err := client.New("http://" + leader)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	drains, err := c.ListDrains()
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, drains)
+}
+
+// Replicate streams messages to a follower as RFC6587 frames. The request body
+// is a JSON object mapping channel IDs to the ID of the last message the
+// follower has of that channel.
+func (a *aggregatorAPI) Replicate(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if !a.agg.IsLeader() {
+		httphelper.Error(w, httphelper.JSONError{
+			Code:    httphelper.PreconditionFailedErrorCode,
+			Message: "replication is only available from the leader",
+		})
+		return
+	}
+	var cursors map[string]uint64
+	if err := httphelper.DecodeJSON(req, &cursors); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	ctx, cancel := withCloseNotify(ctx, w)
+	defer cancel()
+	msgc := a.agg.Replicate(cursors, ctx.Done())
+
+	w.WriteHeader(200)
+	flusher := w.(http.Flusher)
+	flusher.Flush()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-time.After(interval):
-			f.Flush()
-		case <-done:
+		case msg, ok := <-msgc:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(rfc6587.Bytes(msg)); err != nil {
+				return
+			}
+		case <-ticker.C:
+			flusher.Flush()
+		case <-ctx.Done():
 			return
 		}
 	}
@@ -112,7 +256,12 @@ func flushLoop(f http.Flusher, interval time.Duration, done <-chan struct{}) {
 
 func NewMessageFromSyslog(m *rfc5424.Message) client.Message {
 	processType, jobID := splitProcID(m.ProcID)
+	var id string
+	if msgID := messageID(m); msgID > 0 {
+		id = strconv.FormatUint(msgID, 10)
+	}
 	return client.Message{
+		ID:          id,
 		HostID:      string(m.Hostname),
 		JobID:       string(jobID),
 		Msg:         string(m.Msg),
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
@@ -33,12 +34,12 @@ func (s *LogAggregatorTestSuite) TestAPIGetLogBuffer(c *C) {
 	msg3 := newMessageForApp(appID, "worker.3", "log message 3")
 	msg4 := newMessageForApp(appID, "web.1", "log message 4")
 	msg5 := newMessageForApp(appID, ".5", "log message 5")
-	buf := s.agg.getOrInitializeBuffer(appID)
-	buf.Add(msg1)
-	buf.Add(msg2)
-	buf.Add(msg3)
-	buf.Add(msg4)
-	buf.Add(msg5)
+	ch := s.agg.getOrInitializeChannel(appID)
+	ch.add(msg1)
+	ch.add(msg2)
+	ch.add(msg3)
+	ch.add(msg4)
+	ch.add(msg5)
 
 	runtest := func(opts client.LogOpts, expected string) {
 		numLines := -1
@@ -115,6 +116,108 @@ func (s *LogAggregatorTestSuite) TestAPIGetLogBuffer(c *C) {
 	}
 }
 
+func (s *LogAggregatorTestSuite) TestAPIGetLogQuery(c *C) {
+	appID := "test-app"
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	newMessage := func(host, msgID, msg string, offset time.Duration) *rfc5424.Message {
+		return rfc5424.NewMessage(
+			&rfc5424.Header{
+				AppName:   []byte(appID),
+				Hostname:  []byte(host),
+				ProcID:    []byte("web.1"),
+				MsgID:     []byte(msgID),
+				Timestamp: start.Add(offset),
+			},
+			[]byte(msg),
+		)
+	}
+	msg1 := newMessage("host1", "ID1", "GET /foo status=200", 0)
+	msg2 := newMessage("host2", "ID2", "error: connection refused", time.Minute)
+	msg3 := newMessage("host1", "ID1", "GET /bar status=503", 2*time.Minute)
+	msg4 := newMessage("host2", "ID1", "GET /foo status=500", 3*time.Minute)
+	ch := s.agg.getOrInitializeChannel(appID)
+	ch.add(msg1)
+	ch.add(msg2)
+	ch.add(msg3)
+	ch.add(msg4)
+
+	timePtr := func(t time.Time) *time.Time { return &t }
+
+	tests := []struct {
+		opts     client.LogOpts
+		expected []*rfc5424.Message
+	}{
+		{
+			opts:     client.LogOpts{HostID: "host1"},
+			expected: []*rfc5424.Message{msg1, msg3},
+		},
+		{
+			opts:     client.LogOpts{Stream: "stderr"},
+			expected: []*rfc5424.Message{msg2},
+		},
+		{
+			opts:     client.LogOpts{Since: timePtr(start.Add(time.Minute))},
+			expected: []*rfc5424.Message{msg2, msg3, msg4},
+		},
+		{
+			opts:     client.LogOpts{Until: timePtr(start.Add(time.Minute))},
+			expected: []*rfc5424.Message{msg1, msg2},
+		},
+		{
+			opts: client.LogOpts{
+				Since: timePtr(start.Add(30 * time.Second)),
+				Until: timePtr(start.Add(150 * time.Second)),
+			},
+			expected: []*rfc5424.Message{msg2, msg3},
+		},
+		{
+			opts:     client.LogOpts{Search: "/foo"},
+			expected: []*rfc5424.Message{msg1, msg4},
+		},
+		{
+			opts:     client.LogOpts{Regexp: `status=5\d\d`},
+			expected: []*rfc5424.Message{msg3, msg4},
+		},
+		{
+			opts:     client.LogOpts{Regexp: `status=5\d\d`, HostID: "host2", Lines: intPtr(1)},
+			expected: []*rfc5424.Message{msg4},
+		},
+		{
+			opts:     client.LogOpts{After: "2"},
+			expected: []*rfc5424.Message{msg3, msg4},
+		},
+		{
+			opts:     client.LogOpts{After: "1", HostID: "host1"},
+			expected: []*rfc5424.Message{msg3},
+		},
+		{
+			opts:     client.LogOpts{After: "1", Lines: intPtr(1)},
+			expected: []*rfc5424.Message{msg4},
+		},
+		{
+			opts:     client.LogOpts{After: "4"},
+			expected: nil,
+		},
+	}
+	for _, test := range tests {
+		c.Logf("opts: %+v", test.opts)
+		logrc, err := s.client.GetLog(appID, &test.opts)
+		c.Assert(err, IsNil)
+		expected := ""
+		for _, msg := range test.expected {
+			expected += marshalMessage(msg)
+		}
+		assertAllLogsEquals(c, logrc, expected)
+		logrc.Close()
+	}
+
+	// invalid queries are rejected
+	for _, opts := range []client.LogOpts{{Stream: "stdin"}, {Regexp: "("}, {After: "abc"}} {
+		_, err := s.client.GetLog(appID, &opts)
+		c.Assert(err, NotNil)
+	}
+}
+
 func (s *LogAggregatorTestSuite) TestAPIGetLogFollow(c *C) {
 	appID := "test-app"
 	msg1 := newMessageForApp(appID, "web.1", "log message 1")
@@ -127,9 +230,9 @@ func (s *LogAggregatorTestSuite) TestAPIGetLogFollow(c *C) {
 		err  error
 	}
 
-	buf := s.agg.getOrInitializeBuffer(appID)
-	buf.Add(msg1)
-	buf.Add(msg2)
+	ch := s.agg.getOrInitializeChannel(appID)
+	ch.add(msg1)
+	ch.add(msg2)
 
 	nlines := 1
 	logrc, err := s.client.GetLog(appID, &client.LogOpts{
@@ -139,8 +242,8 @@ func (s *LogAggregatorTestSuite) TestAPIGetLogFollow(c *C) {
 	c.Assert(err, IsNil)
 	defer logrc.Close()
 
-	buf.Add(msg3)
-	buf.Add(msg4)
+	ch.add(msg3)
+	ch.add(msg4)
 
 	// use a goroutine + channel so we can timeout the stdout read
 	lines := make(chan line)
@@ -180,6 +283,76 @@ func (s *LogAggregatorTestSuite) TestAPIGetLogFollow(c *C) {
 	}
 }
 
+func (s *LogAggregatorTestSuite) TestAPIGetLogFields(c *C) {
+	appID := "test-app"
+	msg1 := newMessageForApp(appID, "web.1", `{"level":"error","msg":"failed"}`)
+	msg2 := newMessageForApp(appID, "web.1", "level=info msg=started")
+	msg3 := newMessageForApp(appID, "web.1", "level=error msg=crashed code=1")
+	msg4 := newMessageForApp(appID, "web.1", "plain text")
+	ch := s.agg.getOrInitializeChannel(appID)
+	for _, msg := range []*rfc5424.Message{msg1, msg2, msg3, msg4} {
+		ch.add(msg)
+	}
+
+	readMessages := func(opts *client.LogOpts) []client.Message {
+		logrc, err := s.client.GetLog(appID, opts)
+		c.Assert(err, IsNil)
+		defer logrc.Close()
+		var msgs []client.Message
+		dec := json.NewDecoder(logrc)
+		for {
+			var msg client.Message
+			if err := dec.Decode(&msg); err == io.EOF {
+				return msgs
+			} else {
+				c.Assert(err, IsNil)
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	// fields are only returned when requested
+	msgs := readMessages(nil)
+	c.Assert(msgs, HasLen, 4)
+	for _, msg := range msgs {
+		c.Assert(msg.Fields, IsNil)
+	}
+	msgs = readMessages(&client.LogOpts{ParseFields: true})
+	c.Assert(msgs, HasLen, 4)
+	c.Assert(msgs[0].Fields, DeepEquals, map[string]string{"level": "error", "msg": "failed"})
+	c.Assert(msgs[1].Fields, DeepEquals, map[string]string{"level": "info", "msg": "started"})
+	c.Assert(msgs[3].Fields, IsNil)
+
+	msgs = readMessages(&client.LogOpts{FieldFilters: map[string]string{"level": "error"}})
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[0].Msg, Equals, string(msg1.Msg))
+	c.Assert(msgs[1].Msg, Equals, string(msg3.Msg))
+
+	msgs = readMessages(&client.LogOpts{FieldFilters: map[string]string{"level": "error", "code": "1"}})
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(msgs[0].Msg, Equals, string(msg3.Msg))
+
+	_, err := s.client.GetLog(appID, &client.LogOpts{FieldFilters: map[string]string{"": "error"}})
+	c.Assert(err, NotNil)
+}
+
+func (s *LogAggregatorTestSuite) TestAPIGetLogLastEventID(c *C) {
+	appID := "test-app"
+	msg1 := newMessageForApp(appID, "web.1", "log message 1")
+	msg2 := newMessageForApp(appID, "web.2", "log message 2")
+	ch := s.agg.getOrInitializeChannel(appID)
+	ch.add(msg1)
+	ch.add(msg2)
+
+	req, err := http.NewRequest("GET", s.api.URL+"/log/"+appID, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	assertAllLogsEquals(c, res.Body, marshalMessage(msg2))
+}
+
 func (s *LogAggregatorTestSuite) TestNewMessageFromSyslog(c *C) {
 	timestamp, err := time.Parse(time.RFC3339Nano, "2009-11-10T23:00:00.123450789Z")
 	c.Assert(err, IsNil)
@@ -206,6 +379,7 @@ func (s *LogAggregatorTestSuite) TestMessageMarshalJSON(c *C) {
 	c.Assert(err, IsNil)
 
 	m := client.Message{
+		ID:          "42",
 		HostID:      "my.flynn.local",
 		JobID:       "deadbeef1234",
 		Msg:         "a log message",
@@ -214,7 +388,7 @@ func (s *LogAggregatorTestSuite) TestMessageMarshalJSON(c *C) {
 		Stream:      "stderr",
 		Timestamp:   timestamp,
 	}
-	expected := `{"host_id":"my.flynn.local","job_id":"deadbeef1234","msg":"a log message","process_type":"web","source":"app","stream":"stderr","timestamp":"2009-11-10T23:00:00.123450789Z"}`
+	expected := `{"id":"42","host_id":"my.flynn.local","job_id":"deadbeef1234","msg":"a log message","process_type":"web","source":"app","stream":"stderr","timestamp":"2009-11-10T23:00:00.123450789Z"}`
 
 	b, err := json.Marshal(m)
 	c.Assert(err, IsNil)
@@ -6,9 +6,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
+	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/httpclient"
 )
 
@@ -17,6 +19,7 @@ var ErrNotFound = errors.New("logaggregator: resource not found")
 
 type Client interface {
 	GetLog(channelID string, options *LogOpts) (io.ReadCloser, error)
+	ListDrains() ([]*ct.LogDrain, error)
 }
 
 type client struct {
@@ -57,9 +60,29 @@ func NewWithHTTP(uri string, httpClient *http.Client) (Client, error) {
 // Each line returned will be a JSON serialized Message.
 //
 // If lines is above zero, the number of lines returned will be capped at that
-// value. Otherwise, all available logs are returned. If follow is true, new log
-// lines are streamed after the buffered log.
+// value. Otherwise, as many of the most recent logs as the log aggregator serves
+// in a single request are returned. If follow is true, new log
+// lines are streamed after the buffered log, and if the stream is interrupted,
+// for example because the log aggregator it was read from went away, it is
+// transparently resumed after the last message read.
 func (c *client) GetLog(channelID string, options *LogOpts) (io.ReadCloser, error) {
+	body, err := c.getLog(channelID, options)
+	if err != nil || options == nil || !options.Follow {
+		return body, err
+	}
+	opts := *options
+	return NewFollowReader(body, opts.After, func(after string) (io.ReadCloser, error) {
+		// messages up to the last one read are skipped using After, so
+		// the line limit of the original request no longer applies
+		if after != "" {
+			opts.After = after
+			opts.Lines = nil
+		}
+		return c.getLog(channelID, &opts)
+	}), nil
+}
+
+func (c *client) getLog(channelID string, options *LogOpts) (io.ReadCloser, error) {
 	path := fmt.Sprintf("/log/%s", channelID)
 	query := url.Values{}
 	if options != nil {
@@ -76,6 +99,33 @@ func (c *client) GetLog(channelID string, options *LogOpts) (io.ReadCloser, erro
 		if opts.ProcessType != nil {
 			query.Set("process_type", *opts.ProcessType)
 		}
+		if opts.HostID != "" {
+			query.Set("host_id", opts.HostID)
+		}
+		if opts.Stream != "" {
+			query.Set("stream", opts.Stream)
+		}
+		if opts.Since != nil {
+			query.Set("since", opts.Since.Format(time.RFC3339Nano))
+		}
+		if opts.Until != nil {
+			query.Set("until", opts.Until.Format(time.RFC3339Nano))
+		}
+		if opts.Search != "" {
+			query.Set("search", opts.Search)
+		}
+		if opts.Regexp != "" {
+			query.Set("regexp", opts.Regexp)
+		}
+		if opts.After != "" {
+			query.Set("after", opts.After)
+		}
+		if opts.ParseFields {
+			query.Set("parse_fields", "true")
+		}
+		for _, k := range sortedKeys(opts.FieldFilters) {
+			query.Add("field", k+"="+opts.FieldFilters[k])
+		}
 	}
 	if encodedQuery := query.Encode(); encodedQuery != "" {
 		path = fmt.Sprintf("%s?%s", path, encodedQuery)
@@ -87,15 +137,59 @@ func (c *client) GetLog(channelID string, options *LogOpts) (io.ReadCloser, erro
 	return res.Body, nil
 }
 
+// ListDrains returns the log drains the aggregator is currently forwarding
+// logs to, along with their delivery stats.
+func (c *client) ListDrains() ([]*ct.LogDrain, error) {
+	var drains []*ct.LogDrain
+	return drains, c.Get("/drains", &drains)
+}
+
 type LogOpts struct {
 	Follow      bool
 	JobID       string
 	Lines       *int
 	ProcessType *string
+
+	// HostID restricts the log to messages emitted on the given host.
+	HostID string
+	// Stream restricts the log to messages from the given stream, either
+	// "stdout" or "stderr".
+	Stream string
+	// Since and Until restrict the log to messages emitted in the given time
+	// range, inclusive.
+	Since *time.Time
+	Until *time.Time
+	// Search restricts the log to messages containing the given substring.
+	Search string
+	// Regexp restricts the log to messages matching the given regular
+	// expression (using Go's RE2 syntax).
+	Regexp string
+	// After restricts the log to messages following the message with the
+	// given ID.
+	After string
+	// ParseFields causes the Fields of each returned message to be parsed
+	// from messages which are JSON objects or logfmt key=value pairs.
+	ParseFields bool
+	// FieldFilters restricts the log to messages with parsed fields having
+	// the given values.
+	FieldFilters map[string]string
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // Message represents a single log message.
 type Message struct {
+	// ID identifies this log message. IDs are assigned in increasing order
+	// within each log channel, so they can be passed as LogOpts.After to
+	// resume reading a log.
+	ID string `json:"id,omitempty"`
 	// Hostname is the host that the job was running on when this log message was
 	// emitted.
 	HostID string `json:"host_id,omitempty"`
@@ -103,6 +197,9 @@ type Message struct {
 	JobID string `json:"job_id,omitempty"`
 	// Msg is the actual content of this log message.
 	Msg string `json:"msg,omitempty"`
+	// Fields are the fields of a structured (JSON or logfmt) message, only
+	// set if requested with LogOpts.ParseFields.
+	Fields map[string]string `json:"fields,omitempty"`
 	// ProcessType is the type of process that emitted this log message.
 	ProcessType string `json:"process_type,omitempty"`
 	// Source is the source of this log message, such as "app" or "router".
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	followMinBackoff = 100 * time.Millisecond
+	followMaxBackoff = 5 * time.Second
+
+	// followRetryTimeout is how long reconnecting is retried before the
+	// error is returned to the reader.
+	followRetryTimeout = 30 * time.Second
+)
+
+// followReader reads a followed log stream, reconnecting whenever the stream
+// is interrupted and resuming after the last complete message read.
+type followReader struct {
+	connect func(after string) (io.ReadCloser, error)
+	after   string // the ID of the last message read
+
+	buf     *bufio.Reader
+	pending []byte // the rest of the current line
+
+	mu     sync.Mutex // protects body and closed
+	body   io.ReadCloser
+	closed bool
+}
+
+// NewFollowReader returns a ReadCloser which reads the followed log stream
+// body, a JSON serialized Message per line. Whenever the stream is interrupted,
+// it is replaced by calling connect with the ID of the last message read (or
+// with after if no message with an ID has been read), so that reading resumes
+// without missing or repeating messages.
+func NewFollowReader(body io.ReadCloser, after string, connect func(after string) (io.ReadCloser, error)) io.ReadCloser {
+	return &followReader{
+		connect: connect,
+		after:   after,
+		buf:     bufio.NewReader(body),
+		body:    body,
+	}
+}
+
+// Read reads whole lines from the stream, so that a line interrupted by a
+// disconnection is never returned and is instead read again after resuming.
+func (r *followReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		line, err := r.buf.ReadBytes('\n')
+		if err != nil {
+			if err := r.reconnect(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(line, &msg); err == nil && msg.ID != "" {
+			r.after = msg.ID
+		}
+		r.pending = line
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// reconnect replaces the stream with a new one starting after the last
+// message read, retrying with backoff for up to followRetryTimeout.
+func (r *followReader) reconnect() error {
+	r.mu.Lock()
+	r.body.Close()
+	r.mu.Unlock()
+
+	backoff := followMinBackoff
+	deadline := time.Now().Add(followRetryTimeout)
+	for {
+		if r.isClosed() {
+			return io.EOF
+		}
+		body, err := r.connect(r.after)
+		if err == nil {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.closed {
+				body.Close()
+				return io.EOF
+			}
+			r.body = body
+			r.buf.Reset(body)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > followMaxBackoff {
+			backoff = followMaxBackoff
+		}
+	}
+}
+
+func (r *followReader) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// Close closes the stream, causing any blocked Read to return io.EOF.
+func (r *followReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.body.Close()
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+	"github.com/flynn/flynn/pkg/syslog/rfc6587"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	// drainQueueSize is the number of messages buffered per drain. Once it
+	// is full, new messages are dropped until the drain catches up, so a
+	// slow or unreachable drain never holds up log ingestion.
+	drainQueueSize = 10000
+
+	// drainBatchSize is the maximum number of messages sent to a drain at
+	// once.
+	drainBatchSize = 500
+
+	// drainMaxAttempts is the number of times delivery of a batch is
+	// attempted before it is discarded.
+	drainMaxAttempts = 5
+
+	drainMinBackoff = 100 * time.Millisecond
+	drainMaxBackoff = 30 * time.Second
+	drainTimeout    = 10 * time.Second
+)
+
+// drainSender delivers batches of messages to a drain endpoint.
+type drainSender interface {
+	// send delivers msgs, returning an error if any of them may not have
+	// been delivered. The same batch is passed to send again when it is
+	// retried, so endpoints may see duplicate messages after failures.
+	send(msgs []*rfc5424.Message) error
+	close()
+}
+
+// drain forwards the messages of an app to an external endpoint.
+type drain struct {
+	ct.LogDrain
+
+	sender drainSender
+	// flushInterval is how long to wait for a batch to fill up before
+	// sending it.
+	flushInterval time.Duration
+
+	queue chan *rfc5424.Message
+	stop  chan struct{}
+	done  chan struct{}
+
+	statsMtx sync.Mutex
+	stats    ct.LogDrainStats
+}
+
+func newDrain(d *ct.LogDrain) (*drain, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	res := &drain{
+		LogDrain: *d,
+		queue:    make(chan *rfc5424.Message, drainQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	res.Stats = nil
+	switch u.Scheme {
+	case "syslog":
+		res.sender = &syslogSender{addr: u.Host}
+	case "syslog+tls":
+		host, _, _ := net.SplitHostPort(u.Host)
+		res.sender = &syslogSender{addr: u.Host, tlsConfig: &tls.Config{ServerName: host}}
+	case "http", "https":
+		res.sender = &httpSender{url: d.URL, client: &http.Client{Timeout: drainTimeout}}
+		res.flushInterval = time.Second
+	default:
+		return nil, fmt.Errorf("unsupported drain URL scheme %q", u.Scheme)
+	}
+	return res, nil
+}
+
+func (d *drain) start() {
+	go d.run()
+}
+
+// close stops the drain and waits for it to exit. Queued messages are
+// discarded.
+func (d *drain) close() {
+	close(d.stop)
+	<-d.done
+}
+
+// enqueue queues msg for delivery without blocking, dropping it if the queue
+// is full.
+func (d *drain) enqueue(msg *rfc5424.Message) {
+	select {
+	case d.queue <- msg:
+	default:
+		d.statsMtx.Lock()
+		d.stats.Dropped++
+		d.statsMtx.Unlock()
+	}
+}
+
+func (d *drain) run() {
+	defer close(d.done)
+	defer d.sender.close()
+
+	batch := make([]*rfc5424.Message, 0, drainBatchSize)
+	for {
+		select {
+		case msg := <-d.queue:
+			batch = append(batch, msg)
+		case <-d.stop:
+			return
+		}
+		if !d.fill(&batch) {
+			return
+		}
+		if !d.deliver(batch) {
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// fill adds queued messages to batch until it is full or flushInterval has
+// elapsed. It returns false if the drain was stopped.
+func (d *drain) fill(batch *[]*rfc5424.Message) bool {
+	var timeout <-chan time.Time
+	if d.flushInterval > 0 {
+		timer := time.NewTimer(d.flushInterval)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(*batch) < drainBatchSize {
+		if timeout == nil {
+			// don't wait for more messages, just take what is queued
+			select {
+			case msg := <-d.queue:
+				*batch = append(*batch, msg)
+				continue
+			default:
+				return true
+			}
+		}
+		select {
+		case msg := <-d.queue:
+			*batch = append(*batch, msg)
+		case <-timeout:
+			return true
+		case <-d.stop:
+			return false
+		}
+	}
+	return true
+}
+
+// deliver sends batch, retrying with exponential backoff. It returns false if
+// the drain was stopped.
+func (d *drain) deliver(batch []*rfc5424.Message) bool {
+	backoff := drainMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := d.sender.send(batch)
+		d.statsMtx.Lock()
+		if err == nil {
+			d.stats.Delivered += uint64(len(batch))
+			d.statsMtx.Unlock()
+			return true
+		}
+		now := time.Now()
+		d.stats.LastError = err.Error()
+		d.stats.LastErrorAt = &now
+		if attempt == drainMaxAttempts {
+			d.stats.Failed += uint64(len(batch))
+			d.statsMtx.Unlock()
+			log15.Error("discarding messages after failed drain delivery", "drain", d.ID, "app", d.AppID, "count", len(batch), "err", err)
+			return true
+		}
+		d.stats.Retries++
+		d.statsMtx.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-d.stop:
+			return false
+		}
+		if backoff *= 2; backoff > drainMaxBackoff {
+			backoff = drainMaxBackoff
+		}
+	}
+}
+
+// info returns the drain's configuration along with a snapshot of its stats.
+func (d *drain) info() *ct.LogDrain {
+	d.statsMtx.Lock()
+	stats := d.stats
+	d.statsMtx.Unlock()
+	stats.Queued = len(d.queue)
+
+	info := d.LogDrain
+	info.Stats = &stats
+	return &info
+}
+
+// syslogSender sends RFC6587-framed messages over a TCP connection, optionally
+// secured with TLS. The connection is re-established after any error.
+type syslogSender struct {
+	addr      string
+	tlsConfig *tls.Config
+	conn      net.Conn
+}
+
+func (s *syslogSender) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: drainTimeout}
+	if s.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	}
+	return dialer.Dial("tcp", s.addr)
+}
+
+func (s *syslogSender) send(msgs []*rfc5424.Message) error {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(drainTimeout))
+	w := bufio.NewWriter(s.conn)
+	for _, msg := range msgs {
+		w.Write(rfc6587.Bytes(msg))
+	}
+	if err := w.Flush(); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *syslogSender) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// httpSender POSTs batches of messages to a URL as a JSON array of
+// client.Messages.
+type httpSender struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSender) send(msgs []*rfc5424.Message) error {
+	batch := make([]client.Message, len(msgs))
+	for i, msg := range msgs {
+		batch[i] = NewMessageFromSyslog(msg)
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpSender) close() {}
+
+// drainLister lists the drains of all apps, it is implemented by the
+// controller client.
+type drainLister interface {
+	AllLogDrainList() ([]*ct.LogDrain, error)
+}
+
+// SyncDrains polls lister for the configured drains every interval and starts
+// and stops drains to match, until the Aggregator is shut down. Drains only
+// run on the leader, since that is where logs are received.
+func (a *Aggregator) SyncDrains(lister drainLister, interval time.Duration) {
+	for {
+		if !a.IsLeader() {
+			a.SetDrains(nil)
+		} else if drains, err := lister.AllLogDrainList(); err != nil {
+			log15.Error("error listing log drains", "err", err)
+		} else {
+			a.SetDrains(drains)
+		}
+		select {
+		case <-time.After(interval):
+		case <-a.shutdown:
+			return
+		}
+	}
+}
+
+// SetDrains makes the Aggregator forward logs to exactly the given drains,
+// starting new drains and stopping ones which are no longer present.
+func (a *Aggregator) SetDrains(drains []*ct.LogDrain) {
+	var stopped []*drain
+	// stopped drains may be in the middle of a delivery, so wait for them
+	// without holding the lock to avoid blocking forwardToDrains.
+	defer func() {
+		for _, d := range stopped {
+			d.close()
+		}
+	}()
+
+	a.dmu.Lock()
+	defer a.dmu.Unlock()
+
+	wanted := make(map[string]*ct.LogDrain, len(drains))
+	for _, d := range drains {
+		wanted[d.ID] = d
+	}
+	for id, d := range a.drains {
+		if w, ok := wanted[id]; !ok || w.URL != d.URL || w.AppID != d.AppID {
+			stopped = append(stopped, d)
+			delete(a.drains, id)
+		}
+	}
+	for id, w := range wanted {
+		if _, ok := a.drains[id]; ok {
+			continue
+		}
+		d, err := newDrain(w)
+		if err != nil {
+			log15.Error("error creating log drain", "drain", id, "err", err)
+			continue
+		}
+		d.start()
+		a.drains[id] = d
+	}
+
+	a.appDrains = make(map[string][]*drain)
+	for _, d := range a.drains {
+		a.appDrains[d.AppID] = append(a.appDrains[d.AppID], d)
+	}
+}
+
+// ListDrains returns the running drains along with their delivery stats.
+func (a *Aggregator) ListDrains() []*ct.LogDrain {
+	a.dmu.RLock()
+	defer a.dmu.RUnlock()
+
+	drains := make([]*ct.LogDrain, 0, len(a.drains))
+	for _, d := range a.drains {
+		drains = append(drains, d.info())
+	}
+	return drains
+}
+
+// forwardToDrains queues msg for delivery to the drains of its app.
+func (a *Aggregator) forwardToDrains(msg *rfc5424.Message) {
+	a.dmu.RLock()
+	defer a.dmu.RUnlock()
+
+	for _, d := range a.appDrains[string(msg.AppName)] {
+		d.enqueue(msg)
+	}
+}
+
+func (a *Aggregator) closeDrains() {
+	a.SetDrains(nil)
+}
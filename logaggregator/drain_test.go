@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+	"github.com/flynn/flynn/pkg/syslog/rfc6587"
+)
+
+type DrainTestSuite struct {
+	agg *Aggregator
+}
+
+var _ = Suite(&DrainTestSuite{})
+
+func (s *DrainTestSuite) SetUpTest(c *C) {
+	s.agg = NewAggregator("127.0.0.1:0")
+	c.Assert(s.agg.Start(), IsNil)
+}
+
+func (s *DrainTestSuite) TearDownTest(c *C) {
+	s.agg.Shutdown()
+}
+
+// waitForStats waits until the stats of the drain with id satisfy f.
+func (s *DrainTestSuite) waitForStats(c *C, id string, f func(*ct.LogDrainStats) bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		for _, d := range s.agg.ListDrains() {
+			if d.ID == id && f(d.Stats) {
+				return
+			}
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for drain %s stats, got %+v", id, s.agg.ListDrains())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *DrainTestSuite) TestSyslogDrain(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	received := make(chan *rfc5424.Message)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		sc.Split(rfc6587.Split)
+		for sc.Scan() {
+			msg, err := rfc5424.Parse(append([]byte{}, sc.Bytes()...))
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+
+	s.agg.SetDrains([]*ct.LogDrain{{ID: "drain1", AppID: "app", URL: "syslog://" + l.Addr().String()}})
+	s.agg.forwardToDrains(newMessageForApp("app", "web.1", "message 1"))
+	s.agg.forwardToDrains(newMessageForApp("other-app", "web.1", "not drained"))
+	s.agg.forwardToDrains(newMessageForApp("app", "web.2", "message 2"))
+
+	for _, expected := range []string{"message 1", "message 2"} {
+		select {
+		case msg := <-received:
+			c.Assert(string(msg.Msg), Equals, expected)
+			c.Assert(string(msg.AppName), Equals, "app")
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timeout waiting for %q", expected)
+		}
+	}
+	s.waitForStats(c, "drain1", func(stats *ct.LogDrainStats) bool { return stats.Delivered == 2 })
+
+	// removing the drain stops forwarding
+	s.agg.SetDrains(nil)
+	c.Assert(s.agg.ListDrains(), HasLen, 0)
+}
+
+func (s *DrainTestSuite) TestHTTPDrain(c *C) {
+	var mtx sync.Mutex
+	var received []client.Message
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		// fail the first request to exercise retries
+		if fail {
+			fail = false
+			w.WriteHeader(503)
+			return
+		}
+		c.Assert(req.Header.Get("Content-Type"), Equals, "application/json")
+		var batch []client.Message
+		c.Assert(json.NewDecoder(req.Body).Decode(&batch), IsNil)
+		received = append(received, batch...)
+	}))
+	defer srv.Close()
+
+	s.agg.SetDrains([]*ct.LogDrain{{ID: "drain1", AppID: "app", URL: srv.URL}})
+	for i := 0; i < 3; i++ {
+		s.agg.forwardToDrains(newMessageForApp("app", "web.1", fmt.Sprintf("message %d", i)))
+	}
+
+	s.waitForStats(c, "drain1", func(stats *ct.LogDrainStats) bool { return stats.Delivered == 3 })
+	drains := s.agg.ListDrains()
+	c.Assert(drains, HasLen, 1)
+	c.Assert(drains[0].Stats.Retries, Equals, uint64(1))
+	c.Assert(drains[0].Stats.LastError, Equals, "unexpected status 503")
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	c.Assert(received, HasLen, 3)
+	for i, msg := range received {
+		c.Assert(msg.Msg, Equals, fmt.Sprintf("message %d", i))
+		c.Assert(msg.ProcessType, Equals, "web")
+	}
+}
+
+func (s *DrainTestSuite) TestFailedDelivery(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer srv.Close()
+
+	s.agg.SetDrains([]*ct.LogDrain{{ID: "drain1", AppID: "app", URL: srv.URL}})
+	s.agg.forwardToDrains(newMessageForApp("app", "web.1", "message"))
+
+	s.waitForStats(c, "drain1", func(stats *ct.LogDrainStats) bool { return stats.Failed == 1 })
+	drains := s.agg.ListDrains()
+	c.Assert(drains[0].Stats.Retries, Equals, uint64(drainMaxAttempts-1))
+	c.Assert(drains[0].Stats.Delivered, Equals, uint64(0))
+	c.Assert(drains[0].Stats.LastErrorAt, NotNil)
+}
+
+func (s *DrainTestSuite) TestDropWhenQueueFull(c *C) {
+	// the drain is not started so nothing is taken off the queue
+	d, err := newDrain(&ct.LogDrain{ID: "drain1", AppID: "app", URL: "syslog://127.0.0.1:0"})
+	c.Assert(err, IsNil)
+	msg := newMessageForApp("app", "web.1", "message")
+	for i := 0; i < drainQueueSize+10; i++ {
+		d.enqueue(msg)
+	}
+	stats := d.info().Stats
+	c.Assert(stats.Queued, Equals, drainQueueSize)
+	c.Assert(stats.Dropped, Equals, uint64(10))
+}
+
+func (s *DrainTestSuite) TestInvalidDrainURL(c *C) {
+	_, err := newDrain(&ct.LogDrain{ID: "drain1", AppID: "app", URL: "ftp://example.com"})
+	c.Assert(err, NotNil)
+
+	s.agg.SetDrains([]*ct.LogDrain{{ID: "drain1", AppID: "app", URL: "ftp://example.com"}})
+	c.Assert(s.agg.ListDrains(), HasLen, 0)
+}
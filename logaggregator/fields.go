@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// parseFields parses a structured log message into fields. Messages which are
+// a JSON object have a field for each member, with values other than strings
+// given in their JSON encoding. Otherwise, messages consisting entirely of
+// logfmt key=value pairs have a field for each pair. Any other message has no
+// fields, and nil is returned.
+func parseFields(msg []byte) map[string]string {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] == '{' {
+		return parseJSONFields(msg)
+	}
+	return parseLogfmtFields(msg)
+}
+
+func parseJSONFields(msg []byte) map[string]string {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &obj); err != nil || len(obj) == 0 {
+		return nil
+	}
+	fields := make(map[string]string, len(obj))
+	for k, v := range obj {
+		if len(v) > 0 && v[0] == '"' {
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return nil
+			}
+			fields[k] = s
+			continue
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, v); err != nil {
+			return nil
+		}
+		fields[k] = buf.String()
+	}
+	return fields
+}
+
+// parseLogfmtFields parses key=value pairs separated by spaces, where values
+// may be double quoted to include spaces. Bare keys are not accepted so that
+// plain text lines aren't mistaken for logfmt.
+func parseLogfmtFields(msg []byte) map[string]string {
+	var fields map[string]string
+	for i := 0; i < len(msg); {
+		if msg[i] == ' ' {
+			i++
+			continue
+		}
+
+		// key
+		start := i
+		for i < len(msg) && msg[i] > ' ' && msg[i] != '=' && msg[i] != '"' {
+			i++
+		}
+		if i == start || i == len(msg) || msg[i] != '=' {
+			return nil
+		}
+		key := string(msg[start:i])
+		i++ // skip '='
+
+		// value
+		var value string
+		if i < len(msg) && msg[i] == '"' {
+			start = i
+			for i++; i < len(msg) && msg[i] != '"'; i++ {
+				if msg[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(msg) {
+				return nil
+			}
+			i++ // skip closing quote
+			v, err := strconv.Unquote(string(msg[start:i]))
+			if err != nil {
+				return nil
+			}
+			value = v
+		} else {
+			start = i
+			for i < len(msg) && msg[i] > ' ' && msg[i] != '"' {
+				i++
+			}
+			value = string(msg[start:i])
+		}
+		if i < len(msg) && msg[i] != ' ' {
+			return nil
+		}
+
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[key] = value
+	}
+	return fields
+}
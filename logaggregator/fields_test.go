@@ -0,0 +1,35 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+func (s *LogAggregatorTestSuite) TestParseFields(c *C) {
+	for _, test := range []struct {
+		msg      string
+		expected map[string]string
+	}{
+		{
+			msg:      `{"level":"error","status":500,"ok":false,"user":{"id":1},"tags":["a", "b"],"none":null}`,
+			expected: map[string]string{"level": "error", "status": "500", "ok": "false", "user": `{"id":1}`, "tags": `["a","b"]`, "none": "null"},
+		},
+		{
+			msg:      `  {"msg":"padded"}` + "\n",
+			expected: map[string]string{"msg": "padded"},
+		},
+		{
+			msg:      `at=info method=GET path="/foo bar" status=200 empty= quoted="say \"hi\""`,
+			expected: map[string]string{"at": "info", "method": "GET", "path": "/foo bar", "status": "200", "empty": "", "quoted": `say "hi"`},
+		},
+		{msg: "a plain text message"},
+		{msg: "error: x=1"},
+		{msg: `key="unterminated`},
+		{msg: `key="a"b`},
+		{msg: `=value`},
+		{msg: `{"not": "an object"`},
+		{msg: `{}`},
+		{msg: ""},
+	} {
+		c.Assert(parseFields([]byte(test.msg)), DeepEquals, test.expected, Commentf("msg: %q", test.msg))
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"regexp"
+	"time"
 
 	"github.com/flynn/flynn/pkg/syslog/rfc5424"
 )
@@ -28,6 +30,72 @@ func (f filterProcessType) Match(m *rfc5424.Message) bool {
 	return bytes.Equal(f.processType, procType)
 }
 
+type filterHostID struct {
+	hostID []byte
+}
+
+func (f filterHostID) Match(m *rfc5424.Message) bool {
+	return bytes.Equal(f.hostID, m.Hostname)
+}
+
+type filterStream struct {
+	stream string
+}
+
+func (f filterStream) Match(m *rfc5424.Message) bool {
+	return streamFromMessage(m) == f.stream
+}
+
+// filterSince matches messages emitted at or after since.
+type filterSince struct {
+	since time.Time
+}
+
+func (f filterSince) Match(m *rfc5424.Message) bool {
+	return !m.Timestamp.Before(f.since)
+}
+
+// filterUntil matches messages emitted at or before until.
+type filterUntil struct {
+	until time.Time
+}
+
+func (f filterUntil) Match(m *rfc5424.Message) bool {
+	return !m.Timestamp.After(f.until)
+}
+
+type filterSubstring struct {
+	substring []byte
+}
+
+func (f filterSubstring) Match(m *rfc5424.Message) bool {
+	return bytes.Contains(m.Msg, f.substring)
+}
+
+type filterRegexp struct {
+	re *regexp.Regexp
+}
+
+func (f filterRegexp) Match(m *rfc5424.Message) bool {
+	return f.re.Match(m.Msg)
+}
+
+// filterFields matches messages with parsed fields (see parseFields) having
+// all of the given values.
+type filterFields struct {
+	fields map[string]string
+}
+
+func (f filterFields) Match(m *rfc5424.Message) bool {
+	fields := parseFields(m.Msg)
+	for k, v := range f.fields {
+		if value, ok := fields[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
 func allFiltersMatch(msg *rfc5424.Message, filters []filter) bool {
 	for _, filter := range filters {
 		if !filter.Match(msg) {
@@ -3,13 +3,19 @@ package main
 import (
 	"bufio"
 	"flag"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/flynn/flynn/controller/client"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/logaggregator/ring"
+	"github.com/flynn/flynn/logaggregator/store"
 	"github.com/flynn/flynn/pkg/shutdown"
 	"github.com/flynn/flynn/pkg/syslog/rfc5424"
 	"github.com/flynn/flynn/pkg/syslog/rfc6587"
@@ -28,24 +34,51 @@ func main() {
 
 	logAddr := flag.String("logaddr", ":3000", "syslog input listen address")
 	apiAddr := flag.String("apiaddr", ":"+apiPort, "api listen address")
+	dataDir := flag.String("datadir", "", "directory to persist logs in (logs are only kept in memory if empty)")
+	maxSize := flag.Int64("maxsize", store.DefaultOptions.MaxSize, "maximum bytes of logs to keep on disk per channel (0 for no limit)")
+	maxAge := flag.Duration("maxage", store.DefaultOptions.MaxAge, "maximum age of logs to keep on disk (0 for no limit)")
 	flag.Parse()
 
 	a := NewAggregator(*logAddr)
+	a.DataDir = *dataDir
+	a.StoreOptions.MaxSize = *maxSize
+	a.StoreOptions.MaxAge = *maxAge
+	// don't accept logs until discoverd has elected a leader, otherwise
+	// every instance would act as leader until the first leader event
+	a.awaitElection()
 	if err := a.Start(); err != nil {
 		shutdown.Fatal(err)
 	}
 	shutdown.BeforeExit(a.Shutdown)
 
+	if key := os.Getenv("CONTROLLER_KEY"); key != "" {
+		cc, err := controller.NewClient("", key)
+		if err != nil {
+			shutdown.Fatal(err)
+		}
+		go a.SyncDrains(cc, 10*time.Second)
+	} else {
+		log15.Info("CONTROLLER_KEY not set, log drains are disabled")
+	}
+
 	listener, err := reuseport.NewReusablePortListener("tcp4", *apiAddr)
 	if err != nil {
 		shutdown.Fatal(err)
 	}
 
-	hb, err := discoverd.AddServiceAndRegister("flynn-logaggregator", *logAddr)
+	_, port, err := net.SplitHostPort(*apiAddr)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	hb, err := discoverd.AddServiceAndRegisterInstance("flynn-logaggregator", &discoverd.Instance{
+		Addr: *logAddr,
+		Meta: map[string]string{instanceMetaAPIPort: port},
+	})
 	if err != nil {
 		shutdown.Fatal(err)
 	}
 	shutdown.BeforeExit(func() { hb.Close() })
+	go a.WatchLeader(discoverd.NewService("flynn-logaggregator"), hb.Addr())
 
 	shutdown.Fatal(http.Serve(listener, apiHandler(a)))
 }
@@ -55,11 +88,27 @@ type Aggregator struct {
 	// Addr is the address (host:port) to listen on for incoming syslog messages.
 	Addr string
 
-	bmu        sync.Mutex // protects buffers
-	buffers    map[string]*ring.Buffer
+	// DataDir is the directory in which each channel's logs are persisted. If
+	// empty, logs are only kept in memory.
+	DataDir string
+
+	// StoreOptions controls segmenting and retention of persisted logs.
+	StoreOptions store.Options
+
+	bmu        sync.Mutex // protects channels
+	channels   map[string]*channel
+	hub        *replicationHub
 	listener   net.Listener
 	producerwg sync.WaitGroup
 
+	rmu        sync.RWMutex // protects the following:
+	leaderAddr string
+	electing   bool // no leader has been elected yet
+
+	dmu       sync.RWMutex // protects the following:
+	drains    map[string]*drain
+	appDrains map[string][]*drain
+
 	once     sync.Once // protects the following:
 	shutdown chan struct{}
 }
@@ -67,14 +116,26 @@ type Aggregator struct {
 // NewAggregator creates a new unstarted Aggregator that will listen on addr.
 func NewAggregator(addr string) *Aggregator {
 	return &Aggregator{
-		Addr:     addr,
-		buffers:  make(map[string]*ring.Buffer),
-		shutdown: make(chan struct{}),
+		Addr:         addr,
+		StoreOptions: store.DefaultOptions,
+		channels:     make(map[string]*channel),
+		hub:          newReplicationHub(),
+		drains:       make(map[string]*drain),
+		appDrains:    make(map[string][]*drain),
+		shutdown:     make(chan struct{}),
 	}
 }
 
-// Start starts the Aggregator on Addr.
+// Start loads any persisted logs from DataDir and starts the Aggregator on
+// Addr.
 func (a *Aggregator) Start() error {
+	if a.DataDir != "" {
+		if err := a.openChannels(); err != nil {
+			return err
+		}
+		go a.pruneLoop(time.Minute)
+	}
+
 	var err error
 	a.listener, err = net.Listen("tcp", a.Addr)
 	if err != nil {
@@ -90,6 +151,53 @@ func (a *Aggregator) Start() error {
 	return nil
 }
 
+// openChannels opens the persisted log of every channel in DataDir.
+func (a *Aggregator) openChannels() error {
+	if err := os.MkdirAll(a.DataDir, 0755); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(a.DataDir)
+	if err != nil {
+		return err
+	}
+	a.bmu.Lock()
+	defer a.bmu.Unlock()
+	for _, info := range infos {
+		if !info.IsDir() || !validChannelID(info.Name()) {
+			continue
+		}
+		l, err := store.Open(filepath.Join(a.DataDir, info.Name()), a.StoreOptions)
+		if err != nil {
+			return err
+		}
+		a.channels[info.Name()] = newChannel(l, a.hub)
+	}
+	return nil
+}
+
+// pruneLoop applies the retention policy to all persisted logs every interval
+// until the Aggregator is shut down. Logs are also pruned whenever they start a
+// new segment, so this mainly expires logs of channels which have gone quiet.
+func (a *Aggregator) pruneLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for id, ch := range a.getChannels() {
+				if ch.log == nil {
+					continue
+				}
+				if err := ch.log.Prune(time.Now()); err != nil {
+					log15.Error("error pruning logs", "channel", id, "err", err)
+				}
+			}
+		case <-a.shutdown:
+			return
+		}
+	}
+}
+
 // Shutdown shuts down the Aggregator gracefully by closing its listener,
 // and waiting for already-received logs to be processed.
 func (a *Aggregator) Shutdown() {
@@ -97,16 +205,23 @@ func (a *Aggregator) Shutdown() {
 		close(a.shutdown)
 		a.listener.Close()
 		a.producerwg.Wait()
+		a.closeDrains()
+
+		for _, ch := range a.getChannels() {
+			ch.close()
+		}
 	})
 }
 
-// ReadLastN reads up to N logs from the log buffer with id and sends them over
-// a channel. If n is less than 0, or if there are fewer than n logs buffered,
-// all buffered logs are returned. If a signal is sent on done, the returned
-// channel is closed and the goroutine exits.
+// ReadLastN reads up to N logs from the log channel with id and sends them over
+// a channel. At most maxReadLines logs are sent, which is also the number sent
+// if n is less than 0. If after is not zero, only logs with an ID greater
+// than after are returned. If a signal is sent on done, the returned channel is
+// closed and the goroutine exits.
 func (a *Aggregator) ReadLastN(
 	id string,
 	n int,
+	after uint64,
 	filters []filter,
 	done <-chan struct{},
 ) <-chan *rfc5424.Message {
@@ -115,13 +230,8 @@ func (a *Aggregator) ReadLastN(
 		defer close(msgc)
 
 		var messages []*rfc5424.Message
-		if len(filters) == 0 {
-			messages = a.readLastN(id, n)
-		} else {
-			messages = filterMessages(a.readLastN(id, -1), filters)
-			if n > 0 && len(messages) > n {
-				messages = messages[len(messages)-n:]
-			}
+		if ch := a.getChannel(id); ch != nil {
+			messages = ch.read(n, after, filters)
 		}
 		for _, syslogMsg := range messages {
 			select {
@@ -134,47 +244,30 @@ func (a *Aggregator) ReadLastN(
 	return msgc
 }
 
-// readLastN reads up to N logs from the log buffer with id. If n is less than
-// 0, or if there are fewer than n logs buffered, all buffered logs are
-// returned.
+// readLastN reads up to N logs from the log channel with id. If n is less than
+// 0, up to maxReadLines logs are returned.
 func (a *Aggregator) readLastN(id string, n int) []*rfc5424.Message {
-	buf := a.getBuffer(id)
-	if buf == nil {
+	ch := a.getChannel(id)
+	if ch == nil {
 		return nil
 	}
-	if n >= 0 {
-		return buf.ReadLastN(n)
-	}
-	return buf.ReadAll()
+	return ch.read(n, 0, nil)
 }
 
-// ReadLastNAndSubscribe is like ReadLastN, except that after sending buffered
+// ReadLastNAndSubscribe is like ReadLastN, except that after sending stored
 // log lines, it also streams new lines as they arrive.
 func (a *Aggregator) ReadLastNAndSubscribe(
 	id string,
 	n int,
+	after uint64,
 	filters []filter,
 	done <-chan struct{},
 ) <-chan *rfc5424.Message {
 	msgc := make(chan *rfc5424.Message)
 	go func() {
-		buf := a.getOrInitializeBuffer(id)
-
-		var messages []*rfc5424.Message
-		var subc <-chan *rfc5424.Message
-		var cancel func()
+		ch := a.getOrInitializeChannel(id)
 
-		if (len(filters) > 0 && n != 0) || n < 0 {
-			messages, subc, cancel = buf.ReadAllAndSubscribe()
-		} else {
-			messages, subc, cancel = buf.ReadLastNAndSubscribe(n)
-		}
-		if len(filters) > 0 {
-			messages = filterMessages(messages, filters)
-			if n > 0 && len(messages) > n {
-				messages = messages[len(messages)-n:]
-			}
-		}
+		messages, subc, cancel := ch.readAndSubscribe(n, after, filters)
 		defer cancel()
 		defer close(msgc)
 
@@ -210,6 +303,27 @@ func (a *Aggregator) ReadLastNAndSubscribe(
 	return msgc
 }
 
+// maxReadLines is the maximum number of logs returned by a single read, so that
+// requests for all logs, or for the logs matching a filter, do not read the
+// whole store into memory.
+var maxReadLines = 10 * ring.DefaultBufferCapacity
+
+// limitLines returns the number of logs to return for a request for n logs.
+func limitLines(n int) int {
+	if n < 0 || n > maxReadLines {
+		return maxReadLines
+	}
+	return n
+}
+
+// lastN returns the last n messages, or all of them if n is less than 0.
+func lastN(messages []*rfc5424.Message, n int) []*rfc5424.Message {
+	if n >= 0 && len(messages) > n {
+		return messages[len(messages)-n:]
+	}
+	return messages
+}
+
 func (a *Aggregator) accept() {
 	defer a.listener.Close()
 
@@ -235,29 +349,61 @@ func (a *Aggregator) accept() {
 // testing hook:
 var afterMessage func()
 
-func (a *Aggregator) getBuffer(id string) *ring.Buffer {
+func (a *Aggregator) getChannel(id string) *channel {
 	a.bmu.Lock()
 	defer a.bmu.Unlock()
 
-	buf, _ := a.buffers[id]
-	return buf
+	ch, _ := a.channels[id]
+	return ch
 }
 
-func (a *Aggregator) getOrInitializeBuffer(id string) *ring.Buffer {
+func (a *Aggregator) getChannels() map[string]*channel {
 	a.bmu.Lock()
 	defer a.bmu.Unlock()
 
-	if buf, ok := a.buffers[id]; ok {
-		return buf
+	channels := make(map[string]*channel, len(a.channels))
+	for id, ch := range a.channels {
+		channels[id] = ch
 	}
-	buf := ring.NewBuffer()
-	a.buffers[id] = buf
-	return buf
+	return channels
+}
+
+func (a *Aggregator) getOrInitializeChannel(id string) *channel {
+	a.bmu.Lock()
+	defer a.bmu.Unlock()
+
+	if ch, ok := a.channels[id]; ok {
+		return ch
+	}
+	var l *store.Log
+	if a.DataDir != "" && validChannelID(id) {
+		var err error
+		l, err = store.Open(filepath.Join(a.DataDir, id), a.StoreOptions)
+		if err != nil {
+			// keep the channel in memory rather than losing its logs entirely
+			log15.Error("error opening log store", "channel", id, "err", err)
+		}
+	}
+	ch := newChannel(l, a.hub)
+	a.channels[id] = ch
+	return ch
+}
+
+// validChannelID reports whether id can safely be used as a directory name.
+func validChannelID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, "/\x00")
 }
 
 func (a *Aggregator) readLogsFromConn(conn net.Conn) {
 	defer conn.Close()
 
+	// only the leader accepts logs, so that messages are assigned IDs in
+	// one place. Hangs up on hosts which haven't yet noticed a leader
+	// change, so they reconnect to the leader.
+	if !a.IsLeader() {
+		return
+	}
+
 	connDone := make(chan struct{})
 	defer close(connDone)
 
@@ -282,9 +428,188 @@ func (a *Aggregator) readLogsFromConn(conn net.Conn) {
 			log15.Error("rfc5424 parse error", "err", err)
 			continue
 		}
-		a.getOrInitializeBuffer(string(msg.AppName)).Add(msg)
+		a.getOrInitializeChannel(string(msg.AppName)).add(msg)
+		a.forwardToDrains(msg)
 		if afterMessage != nil {
 			afterMessage()
 		}
 	}
 }
+
+// channel holds the logs of a single channel. Recent messages are kept in a
+// ring buffer, and if the Aggregator has a DataDir, all messages are also
+// persisted to a store.Log so that older messages can be read and messages
+// survive restarts.
+type channel struct {
+	mu     sync.Mutex // serializes adds with reads that also subscribe
+	buf    *ring.Buffer
+	log    *store.Log
+	hub    *replicationHub
+	lastID uint64 // the ID of the most recently added message
+}
+
+func newChannel(l *store.Log, hub *replicationHub) *channel {
+	ch := &channel{buf: ring.NewBuffer(), log: l, hub: hub}
+	if l != nil {
+		msgs, err := l.ReadLastN(1)
+		if err != nil {
+			log15.Error("error reading persisted logs", "err", err)
+		} else if len(msgs) > 0 {
+			ch.lastID = messageID(msgs[0])
+		}
+	}
+	return ch
+}
+
+// add assigns msg the next ID of the channel and adds it.
+func (ch *channel) add(msg *rfc5424.Message) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.lastID++
+	setMessageID(msg, ch.lastID)
+	ch._add(msg)
+}
+
+// addReplicated adds msg, which has already been assigned an ID by the
+// leader, unless the channel already has it.
+func (ch *channel) addReplicated(msg *rfc5424.Message) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	id := messageID(msg)
+	if id <= ch.lastID {
+		return
+	}
+	ch.lastID = id
+	ch._add(msg)
+}
+
+// _add expects ch.mu to already be locked
+func (ch *channel) _add(msg *rfc5424.Message) {
+	if ch.log != nil {
+		if err := ch.log.Append(msg); err != nil {
+			log15.Error("error persisting log message", "channel", string(msg.AppName), "err", err)
+		}
+	}
+	ch.buf.Add(msg)
+	// publish while still locked so followers see messages in ID order
+	if ch.hub != nil {
+		ch.hub.publish(msg)
+	}
+}
+
+func (ch *channel) lastMessageID() uint64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.lastID
+}
+
+// snapshot returns the buffered messages along with the ID of the last message
+// added to the channel.
+func (ch *channel) snapshot() ([]*rfc5424.Message, uint64) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.buf.ReadAll(), ch.lastID
+}
+
+// read returns up to n of the most recent messages with an ID greater than
+// after which match filters, oldest first. At most maxReadLines messages are
+// returned, which is also the number returned if n is less than 0.
+func (ch *channel) read(n int, after uint64, filters []filter) []*rfc5424.Message {
+	buffered, last := ch.snapshot()
+	return ch.readUntil(buffered, last, limitLines(n), after, filters)
+}
+
+// readAndSubscribe is like read, except that it also subscribes to the
+// messages added after the ones returned.
+func (ch *channel) readAndSubscribe(n int, after uint64, filters []filter) ([]*rfc5424.Message, <-chan *rfc5424.Message, func()) {
+	ch.mu.Lock()
+	buffered, last := ch.buf.ReadAll(), ch.lastID
+	msgc, cancel := ch.buf.Subscribe()
+	ch.mu.Unlock()
+
+	return ch.readUntil(buffered, last, limitLines(n), after, filters), msgc, cancel
+}
+
+// streamAfter calls fn with each message with an ID greater than after, oldest
+// first, up to the last message added when it is called, until fn returns
+// false. Stored messages are read one segment at a time, so that streaming
+// the whole store doesn't load it into memory. It returns false if fn did.
+func (ch *channel) streamAfter(after uint64, fn func(*rfc5424.Message) bool) bool {
+	buffered, last := ch.snapshot()
+	// only go to disk if the buffer does not hold everything asked for
+	if ch.log != nil && (len(buffered) == 0 || messageID(buffered[0]) > after+1) {
+		stopped := false
+		err := ch.log.ReadForward(func(msg *rfc5424.Message) bool {
+			id := messageID(msg)
+			if id <= after {
+				return true
+			}
+			if id > last {
+				return false
+			}
+			if !fn(msg) {
+				stopped = true
+				return false
+			}
+			after = id
+			return true
+		})
+		if err != nil {
+			log15.Error("error reading persisted logs", "err", err)
+		}
+		if stopped {
+			return false
+		}
+	}
+	for _, msg := range messagesAfter(buffered, after) {
+		if !fn(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// readUntil returns up to n of the messages with an ID greater than after and
+// no greater than last which match filters, oldest first. buffered must be the
+// contents of the buffer when last was added.
+//
+// ch.mu is not held while the store is read, since that may take a while and
+// would otherwise block adds. Messages added since last are skipped so that
+// they are not returned in addition to being sent to subscribers.
+func (ch *channel) readUntil(buffered []*rfc5424.Message, last uint64, n int, after uint64, filters []filter) []*rfc5424.Message {
+	messages := lastN(filterMessages(messagesAfter(buffered, after), filters), n)
+	// only go to disk if the buffer does not hold everything asked for
+	if ch.log == nil || len(messages) == n || len(buffered) > 0 && messageID(buffered[0]) <= after+1 {
+		return messages
+	}
+	var stored []*rfc5424.Message
+	err := ch.log.ReadReverse(func(msg *rfc5424.Message) bool {
+		id := messageID(msg)
+		if id <= after {
+			return false
+		}
+		if id <= last && allFiltersMatch(msg, filters) {
+			stored = append(stored, msg)
+		}
+		return len(stored) < n
+	})
+	if err != nil {
+		log15.Error("error reading persisted logs", "err", err)
+		return messages
+	}
+	for i, j := 0, len(stored)-1; i < j; i, j = i+1, j-1 {
+		stored[i], stored[j] = stored[j], stored[i]
+	}
+	return stored
+}
+
+func (ch *channel) close() {
+	if ch.log == nil {
+		return
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.log.Close()
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"net"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/logaggregator/ring"
 	"github.com/flynn/flynn/pkg/syslog/rfc5424"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
@@ -134,7 +136,7 @@ func (s *LogAggregatorTestSuite) TestAggregatorBuffersMessages(c *C) {
 
 	for _, test := range tests {
 		c.Logf("test: %+v", test)
-		msgc := s.agg.ReadLastN("app", test.lines, test.filters, make(chan struct{}))
+		msgc := s.agg.ReadLastN("app", test.lines, 0, test.filters, make(chan struct{}))
 		msgs := readAllMsgs(msgc)
 		c.Assert(msgs, HasLen, test.expectedLen)
 		for i, procID := range test.expectedProcIDs {
@@ -152,7 +154,7 @@ func (s *LogAggregatorTestSuite) TestAggregatorReadLastNAndSubscribe(c *C) {
 		}
 		defer func() { afterMessage = nil }()
 
-		delete(s.agg.buffers, "app") // reset the buffer
+		delete(s.agg.channels, "app") // reset the buffer
 		conn, err := net.Dial("tcp", s.agg.Addr)
 		c.Assert(err, IsNil)
 		defer conn.Close()
@@ -168,7 +170,7 @@ func (s *LogAggregatorTestSuite) TestAggregatorReadLastNAndSubscribe(c *C) {
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		msgc := s.agg.ReadLastNAndSubscribe("app", lines, filters, ctx.Done())
+		msgc := s.agg.ReadLastNAndSubscribe("app", lines, 0, filters, ctx.Done())
 		timeout := time.After(5 * time.Second)
 
 		for _, expectedMsg := range expectedBefore {
@@ -301,3 +303,130 @@ func (s *LogAggregatorTestSuite) TestAggregatorReadLastNAndSubscribe(c *C) {
 }
 
 // TODO(bgentry): tests specifically for rfc6587Split()
+
+func (s *LogAggregatorTestSuite) TestAggregatorPersistsMessages(c *C) {
+	dir := c.MkDir()
+	agg := NewAggregator("127.0.0.1:0")
+	agg.DataDir = dir
+	c.Assert(agg.Start(), IsNil)
+
+	messageReceived := make(chan struct{})
+	afterMessage = func() {
+		messageReceived <- struct{}{}
+	}
+	defer func() { afterMessage = nil }()
+
+	conn, err := net.Dial("tcp", agg.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(sampleLogLine1))
+	c.Assert(err, IsNil)
+	_, err = conn.Write([]byte(sampleLogLine2))
+	c.Assert(err, IsNil)
+	for i := 0; i < 2; i++ {
+		<-messageReceived
+	}
+	conn.Close()
+	agg.Shutdown()
+
+	// a new Aggregator using the same directory should serve the messages
+	agg = NewAggregator("127.0.0.1:0")
+	agg.DataDir = dir
+	c.Assert(agg.Start(), IsNil)
+	defer agg.Shutdown()
+
+	// fill the ring buffer so that older messages can only come from disk
+	ch := agg.getOrInitializeChannel("app")
+	for i := 0; i < ch.buf.Capacity(); i++ {
+		ch.add(rfc5424.NewMessage(&rfc5424.Header{AppName: []byte("app"), ProcID: []byte("web.3")}, []byte("filler")))
+	}
+
+	msgs := agg.readLastN("app", -1)
+	c.Assert(msgs, HasLen, ch.buf.Capacity()+2)
+	c.Assert(string(msgs[0].ProcID), Equals, "web.1")
+	c.Assert(string(msgs[1].ProcID), Equals, "web.2")
+
+	msgs = agg.readLastN("app", ch.buf.Capacity()+1)
+	c.Assert(msgs, HasLen, ch.buf.Capacity()+1)
+	c.Assert(string(msgs[0].ProcID), Equals, "web.2")
+}
+
+func (s *LogAggregatorTestSuite) TestAggregatorLimitsReads(c *C) {
+	defer func(n int) { maxReadLines = n }(maxReadLines)
+	maxReadLines = 5
+
+	agg := NewAggregator("127.0.0.1:0")
+	agg.DataDir = c.MkDir()
+	c.Assert(agg.Start(), IsNil)
+	defer agg.Shutdown()
+
+	ch := agg.getOrInitializeChannel("app")
+	for i := 0; i < 10; i++ {
+		ch.add(rfc5424.NewMessage(&rfc5424.Header{AppName: []byte("app"), ProcID: []byte("web.1")}, []byte(strconv.Itoa(i))))
+	}
+	assertMessages := func(msgs []*rfc5424.Message, first, n int) {
+		c.Assert(msgs, HasLen, n)
+		for i, msg := range msgs {
+			c.Assert(string(msg.Msg), Equals, strconv.Itoa(first+i))
+		}
+	}
+
+	assertMessages(ch.read(-1, 0, nil), 5, 5)
+	assertMessages(ch.read(100, 0, nil), 5, 5)
+	assertMessages(ch.read(3, 0, nil), 7, 3)
+	assertMessages(ch.read(-1, 0, []filter{filterSubstring{[]byte("1")}}), 1, 1)
+
+	// messages added while the store is being read are left to subscribers
+	ch.buf = ring.NewBuffer()
+	buffered, last := ch.snapshot()
+	ch.add(rfc5424.NewMessage(&rfc5424.Header{AppName: []byte("app"), ProcID: []byte("web.1")}, []byte("10")))
+	assertMessages(ch.readUntil(buffered, last, limitLines(-1), 2, nil), 5, 5)
+	assertMessages(ch.read(-1, 2, nil), 6, 5)
+}
+
+func (s *LogAggregatorTestSuite) TestChannelStreamAfter(c *C) {
+	agg := NewAggregator("127.0.0.1:0")
+	agg.DataDir = c.MkDir()
+	c.Assert(agg.Start(), IsNil)
+	defer agg.Shutdown()
+
+	// overflow the ring buffer so that the oldest messages are only on disk
+	ch := agg.getOrInitializeChannel("app")
+	total := ch.buf.Capacity() + 10
+	for i := 0; i < total; i++ {
+		ch.add(rfc5424.NewMessage(&rfc5424.Header{AppName: []byte("app"), ProcID: []byte("web.1")}, []byte(strconv.Itoa(i))))
+	}
+
+	stream := func(after uint64, n int) ([]uint64, bool) {
+		var ids []uint64
+		ok := ch.streamAfter(after, func(msg *rfc5424.Message) bool {
+			ids = append(ids, messageID(msg))
+			return len(ids) < n
+		})
+		return ids, ok
+	}
+	assertIDs := func(ids []uint64, first uint64, n int) {
+		c.Assert(ids, HasLen, n)
+		for i, id := range ids {
+			c.Assert(id, Equals, first+uint64(i))
+		}
+	}
+
+	ids, ok := stream(0, total+1)
+	c.Assert(ok, Equals, true)
+	assertIDs(ids, 1, total)
+
+	ids, ok = stream(3, total+1)
+	c.Assert(ok, Equals, true)
+	assertIDs(ids, 4, total-3)
+
+	// stopping part way through the store stops the stream
+	ids, ok = stream(3, 5)
+	c.Assert(ok, Equals, false)
+	assertIDs(ids, 4, 5)
+
+	// messages only in the buffer are not read from disk
+	ids, ok = stream(uint64(total-2), total+1)
+	c.Assert(ok, Equals, true)
+	assertIDs(ids, uint64(total-1), 2)
+}
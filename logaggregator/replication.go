@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+	"github.com/flynn/flynn/pkg/syslog/rfc6587"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+)
+
+// Aggregators are run as a group of instances registered with discoverd, one
+// of which is elected leader. Only the leader accepts logs from hosts (logmux
+// writes to the leader) and runs drains. Each message the leader receives is
+// given an ID one greater than the previous message in its channel, and every
+// follower streams messages from the leader, applying them in ID order, so
+// that any instance can serve reads and take over when the leader goes away.
+//
+// Replication is asynchronous, so messages the leader received but had not yet
+// sent to any follower are lost if it fails.
+
+// instanceMetaAPIPort is the key of the instance metadata holding the port
+// the API of an Aggregator listens on, which is where followers replicate
+// from.
+const instanceMetaAPIPort = "API_PORT"
+
+// replicationBufferSize is the number of messages buffered for each follower.
+// If a follower falls further behind than this, its replication stream is
+// closed and it catches up from the stored logs when it reconnects.
+const replicationBufferSize = 10000
+
+// sdIDPrefix starts the structured data element holding a message's ID.
+var sdIDPrefix = []byte(`[flynn id="`)
+
+// messageID returns the ID assigned to msg by an Aggregator, or zero if it
+// doesn't have one.
+func messageID(msg *rfc5424.Message) uint64 {
+	sd := msg.StructuredData
+	if !bytes.HasPrefix(sd, sdIDPrefix) {
+		return 0
+	}
+	sd = sd[len(sdIDPrefix):]
+	end := bytes.IndexByte(sd, '"')
+	if end < 0 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(sd[:end]), 10, 64)
+	return id
+}
+
+// setMessageID stores id in the structured data of msg, replacing any
+// previously assigned ID.
+func setMessageID(msg *rfc5424.Message, id uint64) {
+	sd := msg.StructuredData
+	if bytes.HasPrefix(sd, sdIDPrefix) {
+		if end := bytes.IndexByte(sd, ']'); end >= 0 {
+			sd = sd[end+1:]
+		}
+	}
+	msg.StructuredData = append([]byte(fmt.Sprintf(`[flynn id="%d"]`, id)), sd...)
+}
+
+// messagesAfter returns the messages with an ID greater than after. If after
+// is zero, all messages are returned, including those without an ID.
+func messagesAfter(messages []*rfc5424.Message, after uint64) []*rfc5424.Message {
+	if after == 0 {
+		return messages
+	}
+	for i, msg := range messages {
+		if messageID(msg) > after {
+			return messages[i:]
+		}
+	}
+	return nil
+}
+
+// replicationHub fans out the messages added to every channel to followers.
+type replicationHub struct {
+	mu   sync.Mutex
+	subs map[chan *rfc5424.Message]struct{}
+}
+
+func newReplicationHub() *replicationHub {
+	return &replicationHub{subs: make(map[chan *rfc5424.Message]struct{})}
+}
+
+// publish sends msg to all subscribers without blocking. Subscribers which
+// have fallen too far behind are closed instead, as they can no longer be sent
+// every message.
+func (h *replicationHub) publish(msg *rfc5424.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for msgc := range h.subs {
+		select {
+		case msgc <- msg:
+		default:
+			delete(h.subs, msgc)
+			close(msgc)
+		}
+	}
+}
+
+// subscribe returns a channel that receives all subsequently published
+// messages, and a func to cancel the subscription. The channel is closed if
+// the subscriber falls more than replicationBufferSize messages behind.
+func (h *replicationHub) subscribe() (<-chan *rfc5424.Message, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	msgc := make(chan *rfc5424.Message, replicationBufferSize)
+	h.subs[msgc] = struct{}{}
+	return msgc, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[msgc]; ok {
+			delete(h.subs, msgc)
+			close(msgc)
+		}
+	}
+}
+
+// Replicate streams the messages of every channel with an ID greater than the
+// channel's entry in cursors, followed by new messages as they arrive. Messages
+// of each channel are sent in ID order. The returned channel is closed if done
+// is closed or the follower falls too far behind.
+func (a *Aggregator) Replicate(cursors map[string]uint64, done <-chan struct{}) <-chan *rfc5424.Message {
+	msgc := make(chan *rfc5424.Message)
+	go func() {
+		defer close(msgc)
+
+		// subscribe before reading stored messages so that nothing is
+		// missed in between, duplicates are skipped below.
+		subc, cancel := a.hub.subscribe()
+		defer cancel()
+
+		sent := make(map[string]uint64, len(cursors))
+		for id, cursor := range cursors {
+			sent[id] = cursor
+		}
+		send := func(id string, msg *rfc5424.Message) bool {
+			msgID := messageID(msg)
+			if msgID <= sent[id] {
+				return true
+			}
+			select {
+			case msgc <- msg:
+				sent[id] = msgID
+				return true
+			case <-done:
+				return false
+			}
+		}
+
+		for id, ch := range a.getChannels() {
+			if !ch.streamAfter(sent[id], func(msg *rfc5424.Message) bool { return send(id, msg) }) {
+				return
+			}
+		}
+		for {
+			select {
+			case msg, ok := <-subc:
+				if !ok {
+					return
+				}
+				if !send(string(msg.AppName), msg) {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return msgc
+}
+
+// cursors returns the ID of the last message of every channel.
+func (a *Aggregator) cursors() map[string]uint64 {
+	channels := a.getChannels()
+	cursors := make(map[string]uint64, len(channels))
+	for id, ch := range channels {
+		cursors[id] = ch.lastMessageID()
+	}
+	return cursors
+}
+
+// IsLeader reports whether the Aggregator is currently the leader. An
+// Aggregator which is not watching a leader is always the leader, and one
+// which is awaiting an election is never the leader.
+func (a *Aggregator) IsLeader() bool {
+	a.rmu.RLock()
+	defer a.rmu.RUnlock()
+	return !a.electing && a.leaderAddr == ""
+}
+
+// LeaderAddr returns the API address of the leader, or an empty string if the
+// Aggregator is itself the leader or no leader has been elected yet.
+func (a *Aggregator) LeaderAddr() string {
+	a.rmu.RLock()
+	defer a.rmu.RUnlock()
+	return a.leaderAddr
+}
+
+// awaitElection makes the Aggregator refuse logs and replication requests
+// until WatchLeader receives the first leader.
+func (a *Aggregator) awaitElection() {
+	a.rmu.Lock()
+	defer a.rmu.Unlock()
+	a.electing = true
+}
+
+func (a *Aggregator) setLeaderAddr(addr string) {
+	a.rmu.Lock()
+	defer a.rmu.Unlock()
+	a.leaderAddr = addr
+	a.electing = false
+}
+
+// WatchLeader follows leadership changes of the discoverd service srv, which
+// the Aggregator is registered with as self, until the Aggregator is shut
+// down. While another instance is leader, the Aggregator replicates from it.
+func (a *Aggregator) WatchLeader(srv discoverd.Service, self string) {
+	for {
+		leaders := make(chan *discoverd.Instance)
+		stream, err := srv.Leaders(leaders)
+		if err != nil {
+			log15.Error("error watching for leader", "err", err)
+		} else {
+			a.followLeaders(leaders, self)
+			stream.Close()
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-a.shutdown:
+			return
+		}
+	}
+}
+
+// followLeaders handles each leader received on leaders until it is closed or
+// the Aggregator is shut down.
+func (a *Aggregator) followLeaders(leaders <-chan *discoverd.Instance, self string) {
+	var stop, stopped chan struct{}
+	stopReplication := func() {
+		if stop != nil {
+			close(stop)
+			<-stopped
+			stop = nil
+		}
+	}
+	defer stopReplication()
+
+	for {
+		select {
+		case leader, ok := <-leaders:
+			if !ok {
+				return
+			}
+			stopReplication()
+			if leader.Addr == self {
+				log15.Info("became leader")
+				a.setLeaderAddr("")
+				continue
+			}
+			port, ok := leader.Meta[instanceMetaAPIPort]
+			if !ok {
+				log15.Error("leader did not register its API port", "leader", leader.Addr)
+				continue
+			}
+			addr := net.JoinHostPort(leader.Host(), port)
+			log15.Info("following leader", "leader", addr)
+			a.setLeaderAddr(addr)
+			stop, stopped = make(chan struct{}), make(chan struct{})
+			go func(stop, stopped chan struct{}) {
+				defer close(stopped)
+				a.replicationLoop(addr, stop)
+			}(stop, stopped)
+		case <-a.shutdown:
+			return
+		}
+	}
+}
+
+// replicationLoop replicates from the leader at addr, reconnecting after any
+// error, until stop is closed.
+func (a *Aggregator) replicationLoop(addr string, stop <-chan struct{}) {
+	for {
+		err := a.replicateFrom(addr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log15.Error("replication error", "leader", addr, "err", err)
+		select {
+		case <-time.After(time.Second):
+		case <-stop:
+			return
+		}
+	}
+}
+
+var errReplicationClosed = errors.New("replication stream closed")
+
+// replicateFrom streams messages newer than those already held by the
+// Aggregator from the leader whose API listens on addr, and adds them to
+// their channels. It returns an error when the stream ends or stop is closed.
+func (a *Aggregator) replicateFrom(addr string, stop <-chan struct{}) error {
+	data, err := json.Marshal(a.cursors())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/replicate", addr), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Cancel = stop
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	s := bufio.NewScanner(res.Body)
+	s.Split(rfc6587.Split)
+	for s.Scan() {
+		msgBytes := s.Bytes()
+		// slice in msgBytes could get modified on next Scan(), need to copy it
+		msgCopy := make([]byte, len(msgBytes))
+		copy(msgCopy, msgBytes)
+
+		msg, err := rfc5424.Parse(msgCopy)
+		if err != nil {
+			return err
+		}
+		a.getOrInitializeChannel(string(msg.AppName)).addReplicated(msg)
+		if afterReplicated != nil {
+			afterReplicated()
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return errReplicationClosed
+}
+
+// testing hook:
+var afterReplicated func()
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+)
+
+type ReplicationTestSuite struct {
+	leader    *Aggregator
+	leaderAPI *httptest.Server
+	follower  *Aggregator
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+var _ = Suite(&ReplicationTestSuite{})
+
+func (s *ReplicationTestSuite) SetUpTest(c *C) {
+	s.leader = NewAggregator("127.0.0.1:0")
+	c.Assert(s.leader.Start(), IsNil)
+	s.leaderAPI = httptest.NewServer(apiHandler(s.leader))
+
+	s.follower = NewAggregator("127.0.0.1:0")
+	c.Assert(s.follower.Start(), IsNil)
+}
+
+func (s *ReplicationTestSuite) TearDownTest(c *C) {
+	s.stopReplication()
+	s.leaderAPI.Close()
+	s.leader.Shutdown()
+	s.follower.Shutdown()
+}
+
+func (s *ReplicationTestSuite) startReplication() {
+	addr := strings.TrimPrefix(s.leaderAPI.URL, "http://")
+	s.follower.setLeaderAddr(addr)
+	s.stop, s.stopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		s.follower.replicationLoop(addr, s.stop)
+	}()
+}
+
+func (s *ReplicationTestSuite) stopReplication() {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.stopped
+		s.stop = nil
+	}
+}
+
+func addMessages(agg *Aggregator, appID string, start, n int) {
+	ch := agg.getOrInitializeChannel(appID)
+	for i := start; i < start+n; i++ {
+		ch.add(newMessageForApp(appID, "web.1", fmt.Sprintf("message %d", i)))
+	}
+}
+
+// waitForMessages waits until the channel with id has n messages, and checks
+// that their IDs count up from one.
+func waitForMessages(c *C, agg *Aggregator, id string, n int) []*rfc5424.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		if msgs := agg.readLastN(id, -1); len(msgs) == n {
+			for i, msg := range msgs {
+				c.Assert(messageID(msg), Equals, uint64(i+1))
+			}
+			return msgs
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for %d messages in %s, got %d", n, id, len(agg.readLastN(id, -1)))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *ReplicationTestSuite) TestMessageIDs(c *C) {
+	msg := newMessageForApp("app", "web.1", "message")
+	c.Assert(messageID(msg), Equals, uint64(0))
+	setMessageID(msg, 10)
+	c.Assert(string(msg.StructuredData), Equals, `[flynn id="10"]`)
+	c.Assert(messageID(msg), Equals, uint64(10))
+
+	// the ID survives encoding and parsing
+	parsed, err := rfc5424.Parse(msg.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(messageID(parsed), Equals, uint64(10))
+	c.Assert(string(parsed.Msg), Equals, "message")
+
+	// setting the ID again replaces it
+	setMessageID(msg, 11)
+	c.Assert(string(msg.StructuredData), Equals, `[flynn id="11"]`)
+
+	addMessages(s.leader, "app", 0, 3)
+	addMessages(s.leader, "other-app", 0, 2)
+	waitForMessages(c, s.leader, "app", 3)
+	waitForMessages(c, s.leader, "other-app", 2)
+	c.Assert(NewMessageFromSyslog(s.leader.readLastN("app", 1)[0]).ID, Equals, "3")
+}
+
+func (s *ReplicationTestSuite) TestReplication(c *C) {
+	// messages sent before replication starts are caught up on
+	addMessages(s.leader, "app", 0, 5)
+	s.startReplication()
+	waitForMessages(c, s.follower, "app", 5)
+
+	// followed by new messages of existing and new channels
+	addMessages(s.leader, "app", 5, 5)
+	addMessages(s.leader, "other-app", 0, 3)
+	msgs := waitForMessages(c, s.follower, "app", 10)
+	c.Assert(string(msgs[9].Msg), Equals, "message 9")
+	waitForMessages(c, s.follower, "other-app", 3)
+
+	// reconnecting only sends messages the follower doesn't have
+	s.stopReplication()
+	addMessages(s.leader, "app", 10, 2)
+	s.startReplication()
+	waitForMessages(c, s.follower, "app", 12)
+
+	// after taking over as leader, the follower continues assigning IDs
+	// where the old leader left off
+	s.stopReplication()
+	s.follower.setLeaderAddr("")
+	addMessages(s.follower, "app", 12, 1)
+	msgs = waitForMessages(c, s.follower, "app", 13)
+	c.Assert(string(msgs[12].Msg), Equals, "message 12")
+}
+
+func (s *ReplicationTestSuite) TestReplicationPersisted(c *C) {
+	dir := c.MkDir()
+	s.follower.Shutdown()
+	s.follower = NewAggregator("127.0.0.1:0")
+	s.follower.DataDir = dir
+	c.Assert(s.follower.Start(), IsNil)
+
+	addMessages(s.leader, "app", 0, 5)
+	s.startReplication()
+	waitForMessages(c, s.follower, "app", 5)
+	s.stopReplication()
+	s.follower.Shutdown()
+
+	// a restarted follower resumes from its persisted messages
+	s.follower = NewAggregator("127.0.0.1:0")
+	s.follower.DataDir = dir
+	c.Assert(s.follower.Start(), IsNil)
+	c.Assert(s.follower.cursors(), DeepEquals, map[string]uint64{"app": 5})
+
+	addMessages(s.leader, "app", 5, 2)
+	s.startReplication()
+	waitForMessages(c, s.follower, "app", 7)
+}
+
+func (s *ReplicationTestSuite) TestReplicateOnlyFromLeader(c *C) {
+	followerAPI := httptest.NewServer(apiHandler(s.follower))
+	defer followerAPI.Close()
+	s.follower.setLeaderAddr(strings.TrimPrefix(s.leaderAPI.URL, "http://"))
+
+	res, err := http.Post(followerAPI.URL+"/replicate", "application/json", strings.NewReader("{}"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 412)
+}
+
+func (s *ReplicationTestSuite) TestFollowerRefusesLogs(c *C) {
+	s.follower.setLeaderAddr(strings.TrimPrefix(s.leaderAPI.URL, "http://"))
+
+	conn, err := net.Dial("tcp", s.follower.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bufio.NewReader(conn).ReadByte()
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *ReplicationTestSuite) TestRefuseLogsUntilElected(c *C) {
+	agg := NewAggregator("127.0.0.1:0")
+	agg.awaitElection()
+	c.Assert(agg.Start(), IsNil)
+	defer agg.Shutdown()
+	c.Assert(agg.IsLeader(), Equals, false)
+	c.Assert(agg.LeaderAddr(), Equals, "")
+
+	api := httptest.NewServer(apiHandler(agg))
+	defer api.Close()
+	res, err := http.Post(api.URL+"/replicate", "application/json", strings.NewReader("{}"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 412)
+
+	conn, err := net.Dial("tcp", agg.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bufio.NewReader(conn).ReadByte()
+	c.Assert(err, Equals, io.EOF)
+
+	// once elected, logs are accepted
+	agg.setLeaderAddr("")
+	c.Assert(agg.IsLeader(), Equals, true)
+	conn, err = net.Dial("tcp", agg.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(sampleLogLine1))
+	c.Assert(err, IsNil)
+	waitForMessages(c, agg, "app", 1)
+}
+
+// switchHandler serves requests with a handler which can be changed.
+type switchHandler struct {
+	mtx     sync.RWMutex
+	handler http.Handler
+}
+
+func (h *switchHandler) set(handler http.Handler) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.handler = handler
+}
+
+func (h *switchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mtx.RLock()
+	handler := h.handler
+	h.mtx.RUnlock()
+	handler.ServeHTTP(w, req)
+}
+
+func (s *ReplicationTestSuite) TestClientFailover(c *C) {
+	h := &switchHandler{handler: apiHandler(s.leader)}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	s.startReplication()
+
+	addMessages(s.leader, "app", 0, 2)
+	waitForMessages(c, s.follower, "app", 2)
+
+	lc, err := client.New(srv.URL)
+	c.Assert(err, IsNil)
+	logrc, err := lc.GetLog("app", &client.LogOpts{Follow: true, Lines: intPtr(1)})
+	c.Assert(err, IsNil)
+	defer logrc.Close()
+
+	lines := make(chan string)
+	go func() {
+		buf := bufio.NewReader(logrc)
+		for {
+			line, err := buf.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	expect := func(msgs ...*rfc5424.Message) {
+		for _, msg := range msgs {
+			select {
+			case line := <-lines:
+				c.Assert(line, Equals, marshalMessage(msg))
+			case <-time.After(5 * time.Second):
+				c.Fatalf("timeout waiting for %q", msg.Msg)
+			}
+		}
+	}
+	expect(s.leader.readLastN("app", 1)...)
+
+	// the leader goes away after the follower received a message which
+	// the client hasn't seen yet
+	addMessages(s.leader, "app", 2, 1)
+	expect(s.leader.readLastN("app", 1)...)
+	addMessages(s.leader, "app", 3, 1)
+	waitForMessages(c, s.follower, "app", 4)
+	s.stopReplication()
+	s.follower.setLeaderAddr("")
+	h.set(apiHandler(s.follower))
+	srv.CloseClientConnections()
+
+	// the client resumes from the follower without missing or repeating
+	// messages
+	addMessages(s.follower, "app", 4, 1)
+	expect(s.follower.readLastN("app", 2)...)
+}
@@ -0,0 +1,377 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+	"github.com/flynn/flynn/pkg/syslog/rfc6587"
+)
+
+// Options controls how a Log is split into segments and how long segments are
+// retained.
+type Options struct {
+	// SegmentSize is the size in bytes after which the active segment is
+	// closed and a new one is started.
+	SegmentSize int64
+
+	// MaxSize is the maximum combined size in bytes of all segments. Once
+	// exceeded, the oldest segments are removed. Zero means no limit.
+	MaxSize int64
+
+	// MaxAge is the maximum time since a segment was last written to before
+	// it is removed. Zero means no limit.
+	MaxAge time.Duration
+}
+
+var DefaultOptions = Options{
+	SegmentSize: 8 << 20,
+	MaxSize:     256 << 20,
+	MaxAge:      7 * 24 * time.Hour,
+}
+
+const segmentExt = ".log"
+
+// Log is an append-only, segmented on-disk store of rfc5424.Messages. Each
+// segment is a file containing RFC6587-framed messages, named after the offset
+// of its first message. Only the newest segment is ever written to, and
+// retention is applied by removing whole segments, oldest first.
+type Log struct {
+	dir  string
+	opts Options
+
+	mu       sync.Mutex // protects all of the following:
+	segments []*segment // oldest first, the last one is active
+	active   *os.File
+	next     uint64 // offset of the next appended message
+}
+
+type segment struct {
+	base    uint64
+	size    int64
+	modTime time.Time
+}
+
+func (s *segment) name() string {
+	return fmt.Sprintf("%020d%s", s.base, segmentExt)
+}
+
+// Open opens the Log stored in dir, creating dir if it does not exist. A
+// partially written message at the end of the active segment, as left behind
+// by a crash, is truncated.
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultOptions.SegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, opts: opts}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{base: base, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Sort(segmentsByBase(l.segments))
+
+	if len(l.segments) == 0 {
+		if err := l.roll(); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	active := l.segments[len(l.segments)-1]
+	f, err := os.OpenFile(l.path(active), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	count, size := scanSegment(f)
+	if size != active.size {
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+		active.size = size
+	}
+	if _, err := f.Seek(size, os.SEEK_SET); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.active = f
+	l.next = active.base + count
+
+	if err := l.prune(time.Now()); err != nil {
+		l.active.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// scanSegment counts the complete messages at the start of r, returning the
+// count and the number of bytes they occupy. Scanning stops at the first
+// framing error, since that can only be a torn write at the end of the
+// segment.
+func scanSegment(r io.Reader) (count uint64, size int64) {
+	s := newScanner(r)
+	for s.Scan() {
+		msgLen := len(s.Bytes())
+		count++
+		size += int64(len(strconv.Itoa(msgLen)) + 1 + msgLen)
+	}
+	return count, size
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Split(rfc6587.Split)
+	return s
+}
+
+func (l *Log) path(s *segment) string {
+	return filepath.Join(l.dir, s.name())
+}
+
+// roll closes the active segment and starts a new one. It expects l.mu to
+// already be locked.
+func (l *Log) roll() error {
+	s := &segment{base: l.next, modTime: time.Now()}
+	f, err := os.OpenFile(l.path(s), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if l.active != nil {
+		l.active.Close()
+	}
+	l.active = f
+	l.segments = append(l.segments, s)
+	return nil
+}
+
+// Append writes msg to the end of the Log.
+func (l *Log) Append(msg *rfc5424.Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data := rfc6587.Bytes(msg)
+	active := l.segments[len(l.segments)-1]
+	if active.size > 0 && active.size+int64(len(data)) > l.opts.SegmentSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+		if err := l.prune(time.Now()); err != nil {
+			return err
+		}
+		active = l.segments[len(l.segments)-1]
+	}
+
+	if _, err := l.active.Write(data); err != nil {
+		// drop any partial write so the segment stays readable
+		l.active.Truncate(active.size)
+		l.active.Seek(active.size, os.SEEK_SET)
+		return err
+	}
+	active.size += int64(len(data))
+	active.modTime = time.Now()
+	l.next++
+	return nil
+}
+
+// ReadLastN returns the most recent n messages in the Log, oldest first. If n
+// is less than 0, or if there are fewer than n messages stored, all stored
+// messages are returned.
+func (l *Log) ReadLastN(n int) ([]*rfc5424.Message, error) {
+	var messages []*rfc5424.Message
+	if n == 0 {
+		return messages, nil
+	}
+	err := l.ReadReverse(func(msg *rfc5424.Message) bool {
+		messages = append(messages, msg)
+		return n < 0 || len(messages) < n
+	})
+	if err != nil {
+		return nil, err
+	}
+	reverse(messages)
+	return messages, nil
+}
+
+// ReadFrom returns the stored messages from the most recent one for which
+// start returns true onwards, oldest first. Segments are read from newest to
+// oldest, so only as much of the Log as is needed is read. If start does not
+// return true for any message, all stored messages are returned.
+func (l *Log) ReadFrom(start func(*rfc5424.Message) bool) ([]*rfc5424.Message, error) {
+	var messages []*rfc5424.Message
+	err := l.ReadReverse(func(msg *rfc5424.Message) bool {
+		messages = append(messages, msg)
+		return !start(msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	reverse(messages)
+	return messages, nil
+}
+
+// ReadReverse calls fn with each stored message, newest first, until fn
+// returns false. Only the messages stored when ReadReverse is called are read,
+// and l.mu is not held while reading so that appends are not blocked.
+func (l *Log) ReadReverse(fn func(*rfc5424.Message) bool) error {
+	segments := l.snapshot()
+	for i := len(segments) - 1; i >= 0; i-- {
+		msgs, err := l.readSegment(segments[i])
+		if os.IsNotExist(err) {
+			// the segment has been pruned since the snapshot was taken,
+			// and so have all older segments
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for j := len(msgs) - 1; j >= 0; j-- {
+			if !fn(msgs[j]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// ReadForward calls fn with each stored message, oldest first, until fn
+// returns false. Like ReadReverse, only the messages stored when ReadForward is
+// called are read and l.mu is not held while reading. Only one segment is held
+// in memory at a time, and segments pruned before they are reached are
+// skipped.
+func (l *Log) ReadForward(fn func(*rfc5424.Message) bool) error {
+	for _, seg := range l.snapshot() {
+		msgs, err := l.readSegment(seg)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if !fn(msg) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// snapshot returns a copy of the segments, oldest first.
+func (l *Log) snapshot() []segment {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments := make([]segment, len(l.segments))
+	for i, s := range l.segments {
+		segments[i] = *s
+	}
+	return segments
+}
+
+// readSegment reads the messages within the first seg.size bytes of seg, so
+// it does not need l.mu to be locked.
+func (l *Log) readSegment(seg segment) ([]*rfc5424.Message, error) {
+	f, err := os.Open(l.path(&seg))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var messages []*rfc5424.Message
+	s := newScanner(io.LimitReader(f, seg.size))
+	for s.Scan() {
+		// the scanner reuses its buffer, so each message needs its own copy
+		msgBytes := make([]byte, len(s.Bytes()))
+		copy(msgBytes, s.Bytes())
+		msg, err := rfc5424.Parse(msgBytes)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func reverse(messages []*rfc5424.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+// Size returns the combined size in bytes of all segments.
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var size int64
+	for _, s := range l.segments {
+		size += s.size
+	}
+	return size
+}
+
+// Prune removes segments which have exceeded the Log's MaxSize or MaxAge as
+// of now. The active segment is never removed.
+func (l *Log) Prune(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.prune(now)
+}
+
+// prune expects l.mu to already be locked
+func (l *Log) prune(now time.Time) error {
+	var size int64
+	for _, s := range l.segments {
+		size += s.size
+	}
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		expired := l.opts.MaxAge > 0 && now.Sub(oldest.modTime) > l.opts.MaxAge
+		oversize := l.opts.MaxSize > 0 && size > l.opts.MaxSize
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(l.path(oldest)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= oldest.size
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// Close closes the active segment. The Log must not be used afterwards.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active.Close()
+}
+
+type segmentsByBase []*segment
+
+func (s segmentsByBase) Len() int           { return len(s) }
+func (s segmentsByBase) Less(i, j int) bool { return s[i].base < s[j].base }
+func (s segmentsByBase) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
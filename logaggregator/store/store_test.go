@@ -0,0 +1,208 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func newMessage(i int) *rfc5424.Message {
+	return rfc5424.NewMessage(&rfc5424.Header{AppName: []byte("app"), ProcID: []byte("web.1")}, []byte(strconv.Itoa(i)))
+}
+
+func appendN(c *C, l *Log, start, n int) {
+	for i := start; i < start+n; i++ {
+		c.Assert(l.Append(newMessage(i)), IsNil)
+	}
+}
+
+func assertMessages(c *C, msgs []*rfc5424.Message, first, n int) {
+	c.Assert(msgs, HasLen, n)
+	for i, msg := range msgs {
+		c.Assert(string(msg.Msg), Equals, strconv.Itoa(first+i))
+	}
+}
+
+func (S) TestReadLastN(c *C) {
+	l, err := Open(c.MkDir(), Options{SegmentSize: 512})
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	msgs, err := l.ReadLastN(-1)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 0)
+
+	appendN(c, l, 0, 100)
+	c.Assert(len(l.segments) > 1, Equals, true)
+
+	msgs, err = l.ReadLastN(-1)
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 0, 100)
+
+	msgs, err = l.ReadLastN(25)
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 75, 25)
+
+	msgs, err = l.ReadLastN(0)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 0)
+
+	msgs, err = l.ReadLastN(1000)
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 0, 100)
+}
+
+func (S) TestReadFrom(c *C) {
+	l, err := Open(c.MkDir(), Options{SegmentSize: 512})
+	c.Assert(err, IsNil)
+	defer l.Close()
+	appendN(c, l, 0, 100)
+
+	from := func(i int) func(*rfc5424.Message) bool {
+		return func(msg *rfc5424.Message) bool { return string(msg.Msg) == strconv.Itoa(i) }
+	}
+	msgs, err := l.ReadFrom(from(10))
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 10, 90)
+
+	msgs, err = l.ReadFrom(from(99))
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 99, 1)
+
+	msgs, err = l.ReadFrom(from(1000))
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 0, 100)
+}
+
+func (S) TestReadForward(c *C) {
+	l, err := Open(c.MkDir(), Options{SegmentSize: 512})
+	c.Assert(err, IsNil)
+	defer l.Close()
+	appendN(c, l, 0, 100)
+	c.Assert(len(l.segments) > 1, Equals, true)
+
+	readN := func(n int) []*rfc5424.Message {
+		var msgs []*rfc5424.Message
+		c.Assert(l.ReadForward(func(msg *rfc5424.Message) bool {
+			msgs = append(msgs, msg)
+			return len(msgs) < n
+		}), IsNil)
+		return msgs
+	}
+	assertMessages(c, readN(1000), 0, 100)
+	assertMessages(c, readN(30), 0, 30)
+	assertMessages(c, readN(1), 0, 1)
+}
+
+func (S) TestAppendDuringRead(c *C) {
+	l, err := Open(c.MkDir(), Options{SegmentSize: 512})
+	c.Assert(err, IsNil)
+	defer l.Close()
+	appendN(c, l, 0, 100)
+
+	// appends made while a read is in progress are neither blocked by it
+	// nor seen by it
+	var read []*rfc5424.Message
+	err = l.ReadReverse(func(msg *rfc5424.Message) bool {
+		if len(read) == 0 {
+			done := make(chan error)
+			go func() { done <- l.Append(newMessage(100)) }()
+			select {
+			case err := <-done:
+				c.Assert(err, IsNil)
+			case <-time.After(5 * time.Second):
+				c.Fatal("timed out waiting for append")
+			}
+		}
+		read = append(read, msg)
+		return true
+	})
+	c.Assert(err, IsNil)
+	reverse(read)
+	assertMessages(c, read, 0, 100)
+
+	msgs, err := l.ReadLastN(1)
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 100, 1)
+}
+
+func (S) TestReopen(c *C) {
+	dir := c.MkDir()
+	l, err := Open(dir, Options{SegmentSize: 512})
+	c.Assert(err, IsNil)
+	appendN(c, l, 0, 50)
+	c.Assert(l.Close(), IsNil)
+
+	l, err = Open(dir, Options{SegmentSize: 512})
+	c.Assert(err, IsNil)
+	appendN(c, l, 50, 50)
+	msgs, err := l.ReadLastN(-1)
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 0, 100)
+	c.Assert(l.next, Equals, uint64(100))
+	c.Assert(l.Close(), IsNil)
+}
+
+func (S) TestTornWrite(c *C) {
+	dir := c.MkDir()
+	l, err := Open(dir, Options{})
+	c.Assert(err, IsNil)
+	appendN(c, l, 0, 3)
+	path := l.path(l.segments[0])
+	c.Assert(l.Close(), IsNil)
+
+	// simulate a crash part way through writing a message
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("60 <40>1 2012-11-30T07:12:53+00:00 host app"))
+	c.Assert(err, IsNil)
+	f.Close()
+
+	l, err = Open(dir, Options{})
+	c.Assert(err, IsNil)
+	defer l.Close()
+	appendN(c, l, 3, 1)
+	msgs, err := l.ReadLastN(-1)
+	c.Assert(err, IsNil)
+	assertMessages(c, msgs, 0, 4)
+}
+
+func (S) TestRetention(c *C) {
+	dir := c.MkDir()
+	l, err := Open(dir, Options{SegmentSize: 512, MaxSize: 2048})
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	appendN(c, l, 0, 200)
+	c.Assert(l.Size() <= 2048+512, Equals, true)
+	msgs, err := l.ReadLastN(-1)
+	c.Assert(err, IsNil)
+	c.Assert(len(msgs) < 200, Equals, true)
+	assertMessages(c, msgs, 200-len(msgs), len(msgs))
+
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, len(l.segments))
+
+	// age out everything but the active segment
+	l.opts.MaxAge = time.Hour
+	c.Assert(l.Prune(time.Now().Add(2*time.Hour)), IsNil)
+	c.Assert(l.segments, HasLen, 1)
+	files, err = ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Assert(filepath.Join(dir, files[0].Name()), Equals, l.path(l.segments[0]))
+}
@@ -194,3 +194,27 @@ func (c *Client) RemoveJob(hostID, jobID string) error {
 func (c *Client) StreamHostEvents(output chan<- *host.HostEvent) (stream.Stream, error) {
 	return c.c.Stream("GET", "/cluster/events", nil, output)
 }
+
+// UpdateHostMeta merges meta into the metadata of the given host. Keys with
+// empty values are removed.
+func (c *Client) UpdateHostMeta(hostID string, meta map[string]string) error {
+	return c.c.Post(fmt.Sprintf("/cluster/hosts/%s/meta", hostID), meta, nil)
+}
+
+// CordonHost marks the given host as unschedulable, it continues to run its
+// existing jobs but will not be picked for new ones.
+func (c *Client) CordonHost(hostID string) error {
+	return c.UpdateHostMeta(hostID, map[string]string{host.HostMetaCordon: "true"})
+}
+
+// UncordonHost makes the given host schedulable again.
+func (c *Client) UncordonHost(hostID string) error {
+	return c.UpdateHostMeta(hostID, map[string]string{host.HostMetaCordon: "", host.HostMetaDrain: ""})
+}
+
+// DrainHost cordons the given host and requests that the scheduler moves its
+// non-omni jobs to other hosts. It returns immediately, the host's
+// host.HostMetaDrain metadata is set to "done" once the drain has finished.
+func (c *Client) DrainHost(hostID string) error {
+	return c.c.Post(fmt.Sprintf("/cluster/hosts/%s/drain", hostID), nil, nil)
+}
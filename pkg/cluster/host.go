@@ -54,8 +54,24 @@ type Host interface {
 	// (this is used by other hosts in service of the PullSnapshot request).
 	SendSnapshot(snapID string, assumeHaves []json.RawMessage) (io.ReadCloser, error)
 
+	// Requests the host stream a snapshot to the given URL (typically a
+	// blobstore path), providing an off-host copy of the snapshot.
+	ExportSnapshot(snapID string, url string) error
+
+	// Requests the host restore a snapshot previously exported to url onto
+	// one of its volumes.  Returns the info for the new snapshot.
+	ImportSnapshot(volumeID string, url string) (*volume.Info, error)
+
+	// Sets the policy the host uses to periodically snapshot a volume.
+	// A nil policy removes any existing policy.
+	SetSnapshotPolicy(volumeID string, policy *volume.SnapshotPolicy) error
+
 	// PullImages pulls images from a TUF repository using the local TUF file in tufDB
 	PullImages(repository, driver, root string, tufDB io.Reader, ch chan<- *layer.PullInfo) (stream.Stream, error)
+
+	// LogStats returns counters of the log lines the host has dropped
+	// rather than sending them to the log aggregator.
+	LogStats() (*host.LogStats, error)
 }
 
 type hostClient struct {
@@ -148,8 +164,32 @@ func (c *hostClient) SendSnapshot(snapID string, assumeHaves []json.RawMessage)
 	return res.Body, nil
 }
 
+func (c *hostClient) ExportSnapshot(snapID string, url string) error {
+	return c.c.Post(fmt.Sprintf("/storage/volumes/%s/export", snapID), volume.SnapshotTransfer{URL: url}, nil)
+}
+
+func (c *hostClient) ImportSnapshot(volumeID string, url string) (*volume.Info, error) {
+	var res volume.Info
+	err := c.c.Post(fmt.Sprintf("/storage/volumes/%s/import", volumeID), volume.SnapshotTransfer{URL: url}, &res)
+	return &res, err
+}
+
+func (c *hostClient) SetSnapshotPolicy(volumeID string, policy *volume.SnapshotPolicy) error {
+	path := fmt.Sprintf("/storage/volumes/%s/snapshot_policy", volumeID)
+	if policy == nil {
+		return c.c.Delete(path)
+	}
+	return c.c.Put(path, policy, nil)
+}
+
 func (c *hostClient) PullImages(repository, driver, root string, tufDB io.Reader, ch chan<- *layer.PullInfo) (stream.Stream, error) {
 	header := http.Header{"Content-Type": {"application/octet-stream"}}
 	path := fmt.Sprintf("/host/pull-images?repository=%s&driver=%s&root=%s", repository, driver, root)
 	return c.c.StreamWithHeader("POST", path, header, tufDB, ch)
 }
+
+func (c *hostClient) LogStats() (*host.LogStats, error) {
+	var res host.LogStats
+	err := c.c.Get("/host/log-stats", &res)
+	return &res, err
+}
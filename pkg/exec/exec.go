@@ -168,10 +168,11 @@ func (c *Cmd) Start() error {
 		if err != nil {
 			return err
 		}
-		if len(hosts) == 0 {
+		h := schedutil.PickHost(hosts)
+		if h == nil {
 			return errors.New("exec: no hosts found")
 		}
-		c.HostID = schedutil.PickHost(hosts).ID
+		c.HostID = h.ID
 	}
 
 	// Use the pre-defined host.Job configuration if provided;
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 )
 
 type Resource struct {
@@ -28,3 +29,21 @@ func Provision(uri string, config []byte) (*Resource, error) {
 	}
 	return resource, nil
 }
+
+// Deprovision asks the provider at uri to remove the resource with the given
+// ID, which is the ID returned by Provision.
+func Deprovision(uri, id string) error {
+	req, err := http.NewRequest("DELETE", uri+"?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("resource: unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
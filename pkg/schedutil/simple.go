@@ -13,7 +13,16 @@ func (p HostSlice) Len() int           { return len(p) }
 func (p HostSlice) Less(i, j int) bool { return len(p[i].Jobs) < len(p[j].Jobs) }
 func (p HostSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// PickHost returns a random host from those running the fewest jobs, ignoring
+// cordoned hosts. It returns nil if there are no schedulable hosts.
 func PickHost(hosts HostSlice) *host.Host {
+	schedulable := make(HostSlice, 0, len(hosts))
+	for _, h := range hosts {
+		if !h.Cordoned() {
+			schedulable = append(schedulable, h)
+		}
+	}
+	hosts = schedulable
 	if len(hosts) == 0 {
 		return nil
 	}
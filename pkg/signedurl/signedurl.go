@@ -0,0 +1,168 @@
+// Package signedurl signs URLs with an HMAC so that they grant access to a
+// single path, using a limited set of methods, until they expire. URLs may also
+// be signed with a key derived for a path prefix and a set of methods, which
+// lets a component sign its own URLs under that prefix using those methods
+// without holding the key itself.
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The query parameters added to signed URLs.
+const (
+	expiresParam   = "expires"
+	methodsParam   = "methods"
+	signatureParam = "signature"
+	prefixParam    = "prefix"
+
+	// prefixMethodsParam is the methods of the prefix key a URL was signed
+	// with, which the methods of the URL must be a subset of.
+	prefixMethodsParam = "prefix_methods"
+)
+
+var (
+	ErrMissingSignature = errors.New("signedurl: missing signature")
+	ErrInvalidSignature = errors.New("signedurl: invalid signature")
+	ErrExpired          = errors.New("signedurl: expired")
+	ErrMethodNotAllowed = errors.New("signedurl: method not allowed")
+	ErrOutsidePrefix    = errors.New("signedurl: path is outside prefix")
+)
+
+// Sign returns rawurl with a signature which allows requests to its path using
+// any of methods until expires. Other query parameters are not signed, so
+// they may be changed by the holder of the URL.
+func Sign(key []byte, rawurl string, methods []string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	ms := upper(methods)
+	q := u.Query()
+	q.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(methodsParam, strings.Join(ms, ","))
+	q.Set(signatureParam, signature(key, u.Path, q.Get(methodsParam), q.Get(expiresParam)))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// PrefixKey derives a key from key which SignPrefix can use to sign URLs whose
+// paths are prefix or are under it, allowing any of keyMethods.
+func PrefixKey(key []byte, prefix string, keyMethods []string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(prefixParam + "\n" + joinMethods(keyMethods) + "\n" + strings.TrimSuffix(prefix, "/")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SignPrefix is like Sign, but signs with prefixKey, a key returned by
+// PrefixKey for prefix and keyMethods. The path of rawurl must be within
+// prefix, and methods must be a subset of keyMethods.
+func SignPrefix(prefixKey, prefix string, keyMethods []string, rawurl string, methods []string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if !withinPrefix(u.Path, prefix) {
+		return "", ErrOutsidePrefix
+	}
+	if !subset(upper(methods), upper(keyMethods)) {
+		return "", ErrMethodNotAllowed
+	}
+	q := u.Query()
+	q.Set(prefixParam, prefix)
+	q.Set(prefixMethodsParam, joinMethods(keyMethods))
+	u.RawQuery = q.Encode()
+	return Sign([]byte(prefixKey), u.String(), methods, expires)
+}
+
+// Verify checks that req has a valid signature which allows its method and
+// has not expired at now. A signature which allows GET also allows HEAD.
+func Verify(key []byte, req *http.Request, now time.Time) error {
+	q := req.URL.Query()
+	sig := q.Get(signatureParam)
+	if sig == "" {
+		return ErrMissingSignature
+	}
+	methods := q.Get(methodsParam)
+	if _, ok := q[prefixParam]; ok {
+		prefix := q.Get(prefixParam)
+		keyMethods := strings.Split(q.Get(prefixMethodsParam), ",")
+		if !withinPrefix(req.URL.Path, prefix) || !subset(strings.Split(methods, ","), keyMethods) {
+			return ErrInvalidSignature
+		}
+		key = []byte(PrefixKey(key, prefix, keyMethods))
+	}
+	expires := q.Get(expiresParam)
+	if !hmac.Equal([]byte(sig), []byte(signature(key, req.URL.Path, methods, expires))) {
+		return ErrInvalidSignature
+	}
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.Unix() > t {
+		return ErrExpired
+	}
+	for _, m := range strings.Split(methods, ",") {
+		if m == req.Method || m == "GET" && req.Method == "HEAD" {
+			return nil
+		}
+	}
+	return ErrMethodNotAllowed
+}
+
+func signature(key []byte, path, methods, expires string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(methods + "\n" + expires + "\n" + path))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// withinPrefix reports whether p is prefix or a path under it. Paths which
+// are not clean are rejected, as they may resolve to a path outside prefix.
+func withinPrefix(p, prefix string) bool {
+	if path.Clean(p) != p {
+		return false
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func upper(methods []string) []string {
+	ms := make([]string, len(methods))
+	for i, m := range methods {
+		ms[i] = strings.ToUpper(m)
+	}
+	return ms
+}
+
+// joinMethods returns methods in a canonical form, so that the same set of
+// methods always derives the same prefix key.
+func joinMethods(methods []string) string {
+	ms := upper(methods)
+	sort.Strings(ms)
+	return strings.Join(ms, ",")
+}
+
+// subset reports whether every method in methods is in of.
+func subset(methods, of []string) bool {
+outer:
+	for _, m := range methods {
+		for _, o := range of {
+			if m == o {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package signedurl_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/pkg/signedurl"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+var key = []byte("secret")
+
+func request(c *C, method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	c.Assert(err, IsNil)
+	return req
+}
+
+func (S) TestVerify(c *C) {
+	now := time.Now()
+	u, err := signedurl.Sign(key, "http://blobstore.discoverd/foo.tgz?upload=1", []string{"get", "PUT"}, now.Add(time.Hour))
+	c.Assert(err, IsNil)
+
+	for _, method := range []string{"GET", "HEAD", "PUT"} {
+		c.Assert(signedurl.Verify(key, request(c, method, u), now), IsNil)
+	}
+	// unsigned query parameters may be added
+	c.Assert(signedurl.Verify(key, request(c, "PUT", u+"&offset=10"), now), IsNil)
+
+	for _, t := range []struct {
+		key    []byte
+		method string
+		url    string
+		now    time.Time
+		err    error
+	}{
+		{key, "DELETE", u, now, signedurl.ErrMethodNotAllowed},
+		{key, "GET", u, now.Add(2 * time.Hour), signedurl.ErrExpired},
+		{[]byte("other"), "GET", u, now, signedurl.ErrInvalidSignature},
+		{key, "GET", "http://blobstore.discoverd/foo.tgz", now, signedurl.ErrMissingSignature},
+		{key, "GET", "http://blobstore.discoverd/bar.tgz?" + request(c, "GET", u).URL.RawQuery, now, signedurl.ErrInvalidSignature},
+	} {
+		c.Assert(signedurl.Verify(t.key, request(c, t.method, t.url), t.now), Equals, t.err)
+	}
+}
+
+func (S) TestSignPrefix(c *C) {
+	now := time.Now()
+	keyMethods := []string{"PUT", "DELETE"}
+	prefixKey := signedurl.PrefixKey(key, "/backups/", keyMethods)
+	c.Assert(prefixKey, Equals, signedurl.PrefixKey(key, "/backups", []string{"delete", "put"}))
+
+	u, err := signedurl.SignPrefix(prefixKey, "/backups/", keyMethods, "http://blobstore.discoverd/backups/foo", []string{"PUT"}, now.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(signedurl.Verify(key, request(c, "PUT", u), now), IsNil)
+	c.Assert(signedurl.Verify(key, request(c, "DELETE", u), now), Equals, signedurl.ErrMethodNotAllowed)
+
+	_, err = signedurl.SignPrefix(prefixKey, "/backups/", keyMethods, "http://blobstore.discoverd/backupsfoo", []string{"PUT"}, now.Add(time.Hour))
+	c.Assert(err, Equals, signedurl.ErrOutsidePrefix)
+	_, err = signedurl.SignPrefix(prefixKey, "/backups/", keyMethods, "http://blobstore.discoverd/backups/foo", []string{"GET"}, now.Add(time.Hour))
+	c.Assert(err, Equals, signedurl.ErrMethodNotAllowed)
+
+	// the key's methods can't be widened to sign other methods with it
+	wide, err := signedurl.SignPrefix(prefixKey, "/backups/", []string{"GET", "PUT", "DELETE"}, "http://blobstore.discoverd/backups/foo", []string{"GET"}, now.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(signedurl.Verify(key, request(c, "GET", wide), now), Equals, signedurl.ErrInvalidSignature)
+	sneaky := strings.Replace(u, "methods=PUT", "methods=GET", 1)
+	c.Assert(signedurl.Verify(key, request(c, "GET", sneaky), now), Equals, signedurl.ErrInvalidSignature)
+
+	// the prefix can't be changed, and the signature can't be moved outside it
+	query := request(c, "PUT", u).URL.RawQuery
+	for _, t := range []string{
+		"http://blobstore.discoverd/other/foo?" + strings.Replace(query, "prefix=%2Fbackups", "prefix=%2Fother", 1),
+		"http://blobstore.discoverd/backups/../foo?" + query,
+		"http://blobstore.discoverd/foo?" + query,
+	} {
+		c.Assert(signedurl.Verify(key, request(c, "PUT", t), now), Equals, signedurl.ErrInvalidSignature)
+	}
+
+	// a prefix key can't be used to sign URLs directly
+	u, err = signedurl.Sign([]byte(prefixKey), "http://blobstore.discoverd/backups/foo", []string{"PUT"}, now.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(signedurl.Verify(key, request(c, "PUT", u), now), Equals, signedurl.ErrInvalidSignature)
+}
@@ -28,9 +28,9 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
-	"github.com/flynn/flynn/appliance/postgresql/state"
-	"github.com/flynn/flynn/appliance/postgresql/xlog"
 	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/sirenia/state"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
 )
 
 type commandFunc func([]string)
@@ -46,13 +46,14 @@ const opLag = 1 * time.Millisecond
 
 type Simulator struct {
 	singleton bool
+	xlog      xlog.XLog
 	nextPeer  int
 
 	allIdents map[string]*discoverd.Instance
 
 	out       io.Writer
 	log       log15.Logger
-	postgres  *postgresSimulator
+	database  *databaseSimulator
 	discoverd *discoverdSimulator
 	peer      *simPeer
 	restCh    chan struct{}
@@ -63,12 +64,15 @@ type Simulator struct {
 	commandsByName map[string]*command
 }
 
-func New(singleton bool, out io.Writer, logOut io.Writer) *Simulator {
+// New returns a simulator of a peer of a cluster of databases whose
+// transaction log positions are implemented by x.
+func New(singleton bool, x xlog.XLog, out io.Writer, logOut io.Writer) *Simulator {
 	if logOut == nil {
 		logOut = out
 	}
 	s := &Simulator{
 		singleton: singleton,
+		xlog:      x,
 		allIdents: make(map[string]*discoverd.Instance),
 		out:       out,
 		log:       log15.New(),
@@ -76,7 +80,7 @@ func New(singleton bool, out io.Writer, logOut io.Writer) *Simulator {
 		retryCh:   make(chan struct{}, 1),
 	}
 	s.discoverd = newDiscoverdSimulator(s.log.New("component", "discoverd"))
-	s.postgres = newPostgresSimulator(s.discoverd, s.log.New("component", "pg"))
+	s.database = newDatabaseSimulator(s.discoverd, x, s.log.New("component", "database"))
 	s.peer = s.createSimPeer()
 	s.initCommands()
 	s.log.SetHandler(log15.StreamHandler(logOut, log15.LogfmtFormat()))
@@ -87,11 +91,12 @@ func (s *Simulator) initCommands() {
 	s.commands = []*command{
 		{"addpeer", "simulate a new peer joining the discoverd cluster", "[NAME]", s.AddPeer, true},
 		{"bootstrap", "simulate initial setup", "PRIMARY [SYNC]", s.Bootstrap, true},
-		{"catchUp", "simulate peer's postgres catching up to primary", "", s.CatchUp, false},
+		{"catchUp", "simulate peer's database catching up to primary", "", s.CatchUp, false},
 		{"depose", "simulate a takeover from the current config", "", s.Depose, true},
 		{"rebuild", "simulate rebuilding a deposed peer", "NAME", s.Rebuild, true},
 		{"echo", "emit the string to stdout", "STR", s.Echo, false},
 		{"freeze", "freeze cluster", "", s.Freeze, true},
+		{"freezePeer", "freeze cluster through the peer", "[REASON]", s.FreezePeer, true},
 		{"help", "show help output", "", s.Help, false},
 		{"ident", "print the identity of the peer being tested", "", s.Ident, false},
 		{"lspeers", "list simulated peers", "", s.LsPeers, false},
@@ -99,7 +104,9 @@ func (s *Simulator) initCommands() {
 		{"rmpeer", "simulate a peer being removed from the discoverd cluster", "ID", s.RmPeer, true},
 		{"setClusterState", "simulate a write to the cluster state stored in discoverd", "STATE", s.SetClusterState, true},
 		{"startPeer", "start the peer state machine", "", s.StartPeer, true},
+		{"takeover", "request a takeover by the peer", "[WAL]", s.Takeover, true},
 		{"unfreeze", "unfreeze the cluster", "", s.Unfreeze, true},
+		{"unfreezePeer", "unfreeze the cluster through the peer", "", s.UnfreezePeer, true},
 		{"discoverd", "print simulated discoverd state", "", s.Discoverd, false},
 		{"exit", "exit the simulator", "", s.Exit, false},
 	}
@@ -128,20 +135,20 @@ type simPeer struct {
 	Self      *discoverd.Instance
 	Peer      *state.Peer
 	Discoverd *discoverdSimulatorClient
-	Postgres  *postgresSimulatorClient
+	Database  *databaseSimulatorClient
 }
 
 func (s *Simulator) createSimPeer() *simPeer {
 	ident := s.newPeerIdent("")
 	dd := s.discoverd.NewClient(ident)
-	pg := s.postgres.NewClient(ident)
-	p := state.NewPeer(ident, s.singleton, dd, pg, s.log.New("component", "peer"))
+	db := s.database.NewClient(ident)
+	p := state.NewPeer(ident, s.singleton, dd, db, s.log.New("component", "peer"))
 	p.SetDebugChannels(s.restCh, s.retryCh)
 
 	return &simPeer{
 		Self:      ident,
 		Discoverd: dd,
-		Postgres:  pg,
+		Database:  db,
 		Peer:      p,
 	}
 }
@@ -201,7 +208,7 @@ func (s *Simulator) StartPeer(args []string) {
 	s.discoverd.PeerJoined(s.peer.Self)
 	go s.peer.Peer.Run()
 	s.peer.Discoverd.startSimulation()
-	s.peer.Postgres.startSimulation()
+	s.peer.Database.startSimulation()
 	s.started = true
 }
 
@@ -318,7 +325,7 @@ func (s *Simulator) Bootstrap(args []string) {
 
 	cs.State = &state.State{
 		Generation: 1,
-		InitWAL:    xlog.Zero,
+		InitWAL:    s.xlog.Zero(),
 	}
 	if primaryName != "" {
 		for _, p := range peers {
@@ -353,7 +360,7 @@ func (s *Simulator) Bootstrap(args []string) {
 }
 
 func (s *Simulator) CatchUp(args []string) {
-	s.peer.Postgres.catchUp()
+	s.peer.Database.catchUp()
 }
 
 func (s *Simulator) Depose(args []string) {
@@ -367,7 +374,7 @@ func (s *Simulator) Depose(args []string) {
 		return
 	}
 
-	newWAL, err := xlog.Increment(cs.State.InitWAL, 10)
+	newWAL, err := s.xlog.Increment(cs.State.InitWAL, 10)
 	if err != nil {
 		panic(err)
 	}
@@ -439,19 +446,57 @@ func (s *Simulator) Unfreeze(args []string) {
 	s.jsonDump(cs)
 }
 
+func (s *Simulator) FreezePeer(args []string) {
+	if !s.started {
+		s.log.Error("peer is not started")
+		return
+	}
+	reason := "frozen by peer"
+	if len(args) > 0 && args[0] != "" {
+		reason = args[0]
+	}
+	if err := s.peer.Peer.Freeze(reason); err != nil {
+		s.log.Error("error freezing cluster", "err", err)
+	}
+}
+
+func (s *Simulator) UnfreezePeer(args []string) {
+	if !s.started {
+		s.log.Error("peer is not started")
+		return
+	}
+	if err := s.peer.Peer.Unfreeze(); err != nil {
+		s.log.Error("error unfreezing cluster", "err", err)
+	}
+}
+
+func (s *Simulator) Takeover(args []string) {
+	if !s.started {
+		s.log.Error("peer is not started")
+		return
+	}
+	minWAL := s.xlog.Zero()
+	if len(args) > 0 && args[0] != "" {
+		minWAL = xlog.Position(args[0])
+	}
+	if err := s.peer.Peer.Takeover(minWAL); err != nil {
+		s.log.Error("error taking over", "err", err)
+	}
+}
+
 func (s *Simulator) LsPeers(args []string) {
 	s.jsonDump(s.discoverd.Peers())
 }
 
 type PeerSimInfo struct {
 	Peer     *state.PeerInfo `json:"peer"`
-	Postgres *PostgresInfo   `json:"postgres"`
+	Database *DatabaseInfo   `json:"database"`
 }
 
 func (s *Simulator) Peer(args []string) {
 	s.jsonDump(PeerSimInfo{
 		Peer:     s.peer.Peer.Info(),
-		Postgres: s.peer.Postgres.Info(),
+		Database: s.peer.Database.Info(),
 	})
 }
 
@@ -631,113 +676,119 @@ func (d *discoverdSimulatorClient) startSimulation() {
 	d.Unlock()
 }
 
-type postgresSimulator struct {
-	log log15.Logger
-	ds  *discoverdSimulator
+// databaseSimulator simulates databases whose transaction log positions are
+// implemented by xlog.
+type databaseSimulator struct {
+	log  log15.Logger
+	ds   *discoverdSimulator
+	xlog xlog.XLog
 }
 
-func newPostgresSimulator(ds *discoverdSimulator, log log15.Logger) *postgresSimulator {
-	return &postgresSimulator{ds: ds, log: log}
+func newDatabaseSimulator(ds *discoverdSimulator, x xlog.XLog, log log15.Logger) *databaseSimulator {
+	return &databaseSimulator{ds: ds, xlog: x, log: log}
 }
 
-func (p *postgresSimulator) NewClient(inst *discoverd.Instance) *postgresSimulatorClient {
-	c := &postgresSimulatorClient{
+func (p *databaseSimulator) NewClient(inst *discoverd.Instance) *databaseSimulatorClient {
+	c := &databaseSimulatorClient{
 		p:      p,
 		inst:   inst,
-		events: make(chan state.PostgresEvent),
+		events: make(chan state.DatabaseEvent),
 	}
-	c.XLog = xlog.Zero
+	c.info.XLog = p.xlog.Zero()
 	return c
 }
 
-type postgresSimulatorClient struct {
-	p      *postgresSimulator
+type databaseSimulatorClient struct {
+	p      *databaseSimulator
 	inst   *discoverd.Instance
-	events chan state.PostgresEvent
+	events chan state.DatabaseEvent
+	info   DatabaseInfo
+}
 
-	PostgresInfo
+type DatabaseInfo struct {
+	Config      *state.Config `json:"config"`
+	Online      bool          `json:"online"`
+	XLog        xlog.Position `json:"xlog"`
+	XLogWaiting xlog.Position `json:"xlog_waiting,omitempty"`
 }
 
-type PostgresInfo struct {
-	Config      *state.PgConfig `json:"config"`
-	Online      bool            `json:"online"`
-	XLog        xlog.Position   `json:"xlog"`
-	XLogWaiting xlog.Position   `json:"xlog_waiting,omitempty"`
+func (p *databaseSimulatorClient) Info() *DatabaseInfo {
+	return &p.info
 }
 
-func (p *postgresSimulatorClient) Info() *PostgresInfo {
-	return &p.PostgresInfo
+func (p *databaseSimulatorClient) startSimulation() {
+	p.events <- state.DatabaseEvent{}
 }
 
-func (p *postgresSimulatorClient) startSimulation() {
-	p.events <- state.PostgresEvent{}
+func (p *databaseSimulatorClient) XLog() xlog.XLog {
+	return p.p.xlog
 }
 
-func (p *postgresSimulatorClient) XLogPosition() (xlog.Position, error) {
+func (p *databaseSimulatorClient) XLogPosition() (xlog.Position, error) {
 	time.Sleep(opLag)
-	if !p.Online {
-		return "", fmt.Errorf("postgres is offline")
+	if !p.info.Online {
+		return "", fmt.Errorf("database is offline")
 	}
-	return p.XLog, nil
+	return p.info.XLog, nil
 }
 
-func (p *postgresSimulatorClient) Reconfigure(conf *state.PgConfig) error {
+func (p *databaseSimulatorClient) Reconfigure(conf *state.Config) error {
 	s := p.p.ds.ClusterState()
 	if s.State == nil && conf.Role != state.RoleNone {
-		panic("attempted to configure postgres with no cluster state")
+		panic("attempted to configure database with no cluster state")
 	}
 
-	p.XLogWaiting = ""
-	p.p.log.Info("reconfiguring postgres")
+	p.info.XLogWaiting = ""
+	p.p.log.Info("reconfiguring database")
 	time.Sleep(opLag)
-	p.Config = conf
+	p.info.Config = conf
 	p.updateXlog(s)
 
 	return nil
 }
 
-func (p *postgresSimulatorClient) Start() error {
-	if p.Config == nil {
+func (p *databaseSimulatorClient) Start() error {
+	if p.info.Config == nil {
 		panic("cannot call Start before configured")
 	}
-	if p.Online {
+	if p.info.Online {
 		panic("cannot call Start while running")
 	}
-	if p.XLogWaiting != "" {
-		panic(fmt.Sprintf("unexpected xlog_waiting %q", p.XLogWaiting))
+	if p.info.XLogWaiting != "" {
+		panic(fmt.Sprintf("unexpected xlog_waiting %q", p.info.XLogWaiting))
 	}
 
-	p.p.log.Info("starting postgres")
+	p.p.log.Info("starting database")
 	time.Sleep(opLag)
-	p.Online = true
+	p.info.Online = true
 	p.updateXlog(p.p.ds.ClusterState())
 
 	return nil
 }
 
-func (p *postgresSimulatorClient) Stop() error {
-	if !p.Online {
+func (p *databaseSimulatorClient) Stop() error {
+	if !p.info.Online {
 		panic("cannot call Stop while stopped")
 	}
 
-	p.p.log.Info("stopping postgres")
+	p.p.log.Info("stopping database")
 	time.Sleep(opLag)
-	p.Online = false
+	p.info.Online = false
 
 	return nil
 }
 
-func (p *postgresSimulatorClient) Ready() <-chan state.PostgresEvent {
+func (p *databaseSimulatorClient) Ready() <-chan state.DatabaseEvent {
 	return p.events
 }
 
 // Given the current state, figure out our current role and update our xlog
-// position accordingly. This is used when we assume a new role or when postgres
+// position accordingly. This is used when we assume a new role or when the database
 // comes online in order to simulate client writes to the primary, synchronous
 // replication (and catch-up) on the sync, and asynchronous replication on the
 // other peers.
-func (p *postgresSimulatorClient) updateXlog(ds *state.DiscoverdState) {
-	if ds.State == nil || !p.Online || p.Config == nil {
+func (p *databaseSimulatorClient) updateXlog(ds *state.DiscoverdState) {
+	if ds.State == nil || !p.info.Online || p.info.Config == nil {
 		return
 	}
 	s := ds.State
@@ -748,7 +799,7 @@ func (p *postgresSimulatorClient) updateXlog(ds *state.DiscoverdState) {
 		role = state.RolePrimary
 	case s.Sync.ID == p.inst.ID:
 		role = state.RoleSync
-	case p.Config.Role == state.RoleAsync:
+	case p.info.Config.Role == state.RoleAsync:
 		role = state.RoleAsync
 	default:
 		role = state.RoleNone
@@ -765,13 +816,13 @@ func (p *postgresSimulatorClient) updateXlog(ds *state.DiscoverdState) {
 	// instantly connected and caught up, and we start taking writes immediately
 	// and bump the transaction log position.
 	if role == state.RolePrimary {
-		if cmp, err := xlog.Compare(s.InitWAL, p.XLog); err != nil {
+		if cmp, err := p.p.xlog.Compare(s.InitWAL, p.info.XLog); err != nil {
 			panic(err)
 		} else if cmp > 0 {
 			panic("primary is behind the generation's initial xlog")
 		}
 		var err error
-		p.XLog, err = xlog.Increment(p.XLog, 10)
+		p.info.XLog, err = p.p.xlog.Increment(p.info.XLog, 10)
 		if err != nil {
 			panic(err)
 		}
@@ -783,22 +834,22 @@ func (p *postgresSimulatorClient) updateXlog(ds *state.DiscoverdState) {
 	if role != state.RoleSync {
 		panic("unexpected role")
 	}
-	if cmp, err := xlog.Compare(s.InitWAL, p.XLog); err != nil {
+	if cmp, err := p.p.xlog.Compare(s.InitWAL, p.info.XLog); err != nil {
 		panic(err)
 	} else if cmp < 0 {
 		panic("sync is ahead of primary")
 	}
-	p.XLogWaiting = s.InitWAL
+	p.info.XLogWaiting = s.InitWAL
 }
 
-func (p *postgresSimulatorClient) catchUp() {
-	if p.XLogWaiting == "" {
+func (p *databaseSimulatorClient) catchUp() {
+	if p.info.XLogWaiting == "" {
 		p.p.log.Error("catchUp when not sync or not currently waiting")
 	}
 	var err error
-	p.XLog, err = xlog.Increment(p.XLogWaiting, 10)
+	p.info.XLog, err = p.p.xlog.Increment(p.info.XLogWaiting, 10)
 	if err != nil {
 		panic(err)
 	}
-	p.XLogWaiting = ""
+	p.info.XLogWaiting = ""
 }
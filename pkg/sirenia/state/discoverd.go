@@ -1,4 +1,4 @@
-package main
+package state
 
 import (
 	"encoding/json"
@@ -7,45 +7,48 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
-	"github.com/flynn/flynn/appliance/postgresql/state"
 	"github.com/flynn/flynn/discoverd/client"
 )
 
-type Discoverd struct {
+// discoverdService implements Discoverd by storing the cluster state in the
+// service metadata of a discoverd service and setting the primary as its
+// leader.
+type discoverdService struct {
 	service discoverd.Service
-	events  chan *state.DiscoverdEvent
+	events  chan *DiscoverdEvent
 	runOnce sync.Once
 	log     log15.Logger
 }
 
-func NewDiscoverd(s discoverd.Service, log log15.Logger) state.Discoverd {
-	return &Discoverd{
+// NewDiscoverd returns a Discoverd for the peers registered in the service s.
+func NewDiscoverd(s discoverd.Service, log log15.Logger) Discoverd {
+	return &discoverdService{
 		service: s,
-		events:  make(chan *state.DiscoverdEvent),
+		events:  make(chan *DiscoverdEvent),
 		log:     log,
 	}
 }
 
-func (d *Discoverd) SetState(state *state.DiscoverdState) error {
-	data, err := json.Marshal(state.State)
+func (d *discoverdService) SetState(ds *DiscoverdState) error {
+	data, err := json.Marshal(ds.State)
 	if err != nil {
 		return err
 	}
-	meta := &discoverd.ServiceMeta{Index: state.Index, Data: data}
+	meta := &discoverd.ServiceMeta{Index: ds.Index, Data: data}
 	if err := d.service.SetMeta(meta); err != nil {
 		return err
 	}
-	state.Index = meta.Index
-	if state.State.Primary != nil {
-		if err := d.service.SetLeader(state.State.Primary.ID); err != nil {
-			d.log.Error("error setting discoverd leader", "id", state.State.Primary.ID, "err", err)
+	ds.Index = meta.Index
+	if ds.State.Primary != nil {
+		if err := d.service.SetLeader(ds.State.Primary.ID); err != nil {
+			d.log.Error("error setting discoverd leader", "id", ds.State.Primary.ID, "err", err)
 			// TODO(titanous): can we do anything about this?
 		}
 	}
 	return nil
 }
 
-func (d *Discoverd) receiveEvents() {
+func (d *discoverdService) receiveEvents() {
 	log := d.log.New("fn", "receiveEvents")
 	log.Info("starting event handler")
 
@@ -69,7 +72,7 @@ func (d *Discoverd) receiveEvents() {
 		}
 	}
 
-	dstate := &state.DiscoverdState{}
+	dstate := &DiscoverdState{}
 	initialized := false
 	var sentIndex uint64
 	var sentPeers instSlice
@@ -82,8 +85,8 @@ func (d *Discoverd) receiveEvents() {
 			copy(sentPeers, peers)
 			sentIndex = dstate.Index
 			initialized = true
-			d.events <- &state.DiscoverdEvent{
-				Kind:  state.DiscoverdEventInit,
+			d.events <- &DiscoverdEvent{
+				Kind:  DiscoverdEventInit,
 				Peers: sentPeers,
 				State: dstate,
 			}
@@ -92,16 +95,16 @@ func (d *Discoverd) receiveEvents() {
 
 		if dstate.Index > sentIndex {
 			sentIndex = dstate.Index
-			d.events <- &state.DiscoverdEvent{
-				Kind:  state.DiscoverdEventState,
+			d.events <- &DiscoverdEvent{
+				Kind:  DiscoverdEventState,
 				State: dstate,
 			}
 		}
 		if !sentPeers.Equal(peers) {
 			sentPeers = make(instSlice, len(peers))
 			copy(sentPeers, peers)
-			d.events <- &state.DiscoverdEvent{
-				Kind:  state.DiscoverdEventPeers,
+			d.events <- &DiscoverdEvent{
+				Kind:  DiscoverdEventPeers,
 				Peers: sentPeers,
 			}
 		}
@@ -131,9 +134,9 @@ func (d *Discoverd) receiveEvents() {
 				if e.ServiceMeta.Index <= dstate.Index {
 					continue
 				}
-				dstate = &state.DiscoverdState{
+				dstate = &DiscoverdState{
 					Index: e.ServiceMeta.Index,
-					State: &state.State{},
+					State: &State{},
 				}
 				if len(e.ServiceMeta.Data) > 0 {
 					if err := json.Unmarshal(e.ServiceMeta.Data, dstate.State); err != nil {
@@ -159,7 +162,7 @@ func (d *Discoverd) receiveEvents() {
 	}
 }
 
-func (d *Discoverd) Events() <-chan *state.DiscoverdEvent {
+func (d *discoverdService) Events() <-chan *DiscoverdEvent {
 	d.runOnce.Do(func() { go d.receiveEvents() })
 	return d.events
 }
@@ -11,6 +11,11 @@
 // Copyright (c) 2015, Prime Directive, Inc.
 //
 
+// Package state implements the cluster state machine of a replicated database
+// with a primary, a synchronous standby and a chain of asynchronous standbys.
+// Peers coordinate through discoverd, and the database itself is configured
+// through a Database driver, so that it can be reused by any appliance with
+// the same replication model.
 package state
 
 import (
@@ -20,8 +25,8 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
-	"github.com/flynn/flynn/appliance/postgresql/xlog"
 	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
 )
 
 type State struct {
@@ -114,13 +119,13 @@ func (r *Role) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-type PgConfig struct {
+type Config struct {
 	Role       Role                `json:"role"`
 	Upstream   *discoverd.Instance `json:"upstream"`
 	Downstream *discoverd.Instance `json:"downstream"`
 }
 
-func (x *PgConfig) Equal(y *PgConfig) bool {
+func (x *Config) Equal(y *Config) bool {
 	if x == nil || y == nil {
 		return x == y
 	}
@@ -136,15 +141,27 @@ func (x *PgConfig) Equal(y *PgConfig) bool {
 	return x.Role == y.Role && peersEqual(x.Upstream, y.Upstream) && peersEqual(x.Downstream, y.Downstream)
 }
 
-type Postgres interface {
+// Database is the driver of a replicated database which a Peer configures
+// according to its role in the cluster.
+type Database interface {
+	// XLog returns the implementation of the database's transaction log
+	// positions.
+	XLog() xlog.XLog
+
+	// XLogPosition returns the current transaction log position, which is
+	// the replayed position when running as a standby.
 	XLogPosition() (xlog.Position, error)
-	Reconfigure(*PgConfig) error
+
+	// Reconfigure sets the role and replication peers of the database,
+	// which is applied immediately if it is running and otherwise when it
+	// is started.
+	Reconfigure(*Config) error
 	Start() error
 	Stop() error
 
 	// Ready returns a channel that returns a single event when the interface
 	// is ready.
-	Ready() <-chan PostgresEvent
+	Ready() <-chan DatabaseEvent
 }
 
 type Discoverd interface {
@@ -152,7 +169,9 @@ type Discoverd interface {
 	Events() <-chan *DiscoverdEvent
 }
 
-type PostgresEvent struct {
+// DatabaseEvent is sent when the database is ready, Online is whether it is
+// running and Setup is whether it had already been initialized.
+type DatabaseEvent struct {
 	Online bool
 	Setup  bool
 }
@@ -177,11 +196,11 @@ type DiscoverdEvent struct {
 }
 
 type PeerInfo struct {
-	ID             string                `json:"id"`
-	Role           Role                  `json:"role"`
-	PgRetryPending *time.Time            `json:"pg_retry_pending,omitempty"`
-	State          *State                `json:"state"`
-	Peers          []*discoverd.Instance `json:"peers"`
+	ID           string                `json:"id"`
+	Role         Role                  `json:"role"`
+	RetryPending *time.Time            `json:"retry_pending,omitempty"`
+	State        *State                `json:"state"`
+	Peers        []*discoverd.Instance `json:"peers"`
 }
 
 type Peer struct {
@@ -192,7 +211,7 @@ type Peer struct {
 	// External Interfaces
 	log       log15.Logger
 	discoverd Discoverd
-	postgres  Postgres
+	db        Database
 
 	// Dynamic state
 	info          atomic.Value // *PeerInfo, replaced after each change
@@ -200,28 +219,30 @@ type Peer struct {
 	updatingState *State       // new state object
 	stateIndex    uint64       // last received cluster state index
 
-	pgOnline   *bool               // nil for unknown
-	pgSetup    bool                // whether db existed at start
-	pgApplied  *PgConfig           // last configuration applied
-	pgUpstream *discoverd.Instance // upstream replication target
+	dbOnline   *bool               // nil for unknown
+	dbSetup    bool                // whether db existed at start
+	dbApplied  *Config             // last configuration applied
+	dbUpstream *discoverd.Instance // upstream replication target
 
 	evalStateCh chan struct{}
 	applyConfCh chan struct{}
+	opCh        chan *peerOp
 	restCh      chan struct{}
 	workDoneCh  chan struct{}
 	retryCh     chan struct{}
 	stopCh      chan struct{}
 }
 
-func NewPeer(self *discoverd.Instance, singleton bool, d Discoverd, pg Postgres, log log15.Logger) *Peer {
+func NewPeer(self *discoverd.Instance, singleton bool, d Discoverd, db Database, log log15.Logger) *Peer {
 	p := &Peer{
 		self:        self,
 		singleton:   singleton,
-		postgres:    pg,
+		db:          db,
 		discoverd:   d,
 		log:         log,
 		evalStateCh: make(chan struct{}, 1),
 		applyConfCh: make(chan struct{}, 1),
+		opCh:        make(chan *peerOp),
 		stopCh:      make(chan struct{}),
 	}
 	p.info.Store(&PeerInfo{ID: self.ID})
@@ -235,12 +256,12 @@ func (p *Peer) SetDebugChannels(restCh, retryCh chan struct{}) {
 
 func (p *Peer) Run() {
 	discoverdCh := p.discoverd.Events()
-	postgresCh := p.postgres.Ready()
+	dbCh := p.db.Ready()
 	for {
 		select {
 		// try to run any pending configuration first
 		case <-p.applyConfCh:
-			p.pgApplyConfig()
+			p.dbApplyConfig()
 			continue
 		case <-p.stopCh:
 			return
@@ -250,14 +271,17 @@ func (p *Peer) Run() {
 		case e := <-discoverdCh:
 			p.handleDiscoverdEvent(e)
 			continue
-		case e := <-postgresCh:
-			p.handlePgInit(e)
+		case e := <-dbCh:
+			p.handleDatabaseInit(e)
 			continue
 		case <-p.evalStateCh:
 			p.evalClusterState()
 			continue
 		case <-p.applyConfCh:
-			p.pgApplyConfig()
+			p.dbApplyConfig()
+			continue
+		case op := <-p.opCh:
+			p.runOp(op)
 			continue
 		case <-p.stopCh:
 			return
@@ -268,12 +292,14 @@ func (p *Peer) Run() {
 		select {
 		case e := <-discoverdCh:
 			p.handleDiscoverdEvent(e)
-		case e := <-postgresCh:
-			p.handlePgInit(e)
+		case e := <-dbCh:
+			p.handleDatabaseInit(e)
 		case <-p.evalStateCh:
 			p.evalClusterState()
 		case <-p.applyConfCh:
-			p.pgApplyConfig()
+			p.dbApplyConfig()
+		case op := <-p.opCh:
+			p.runOp(op)
 		case <-p.workDoneCh:
 			// There is no work to do, we are now at rest
 			p.rest()
@@ -288,6 +314,72 @@ func (p *Peer) Close() error {
 	return nil
 }
 
+var (
+	ErrPeerStopped    = errors.New("peer is stopped")
+	ErrNoClusterState = errors.New("cluster has not been set up")
+	ErrNotSync        = errors.New("peer is not the sync")
+	ErrNoAsync        = errors.New("no async peers present")
+)
+
+// peerOp is an operation requested through one of the exported methods of
+// Peer, it is run by the Run loop so that it doesn't race with state changes.
+type peerOp struct {
+	fn   func() error
+	done chan error
+}
+
+func (p *Peer) do(fn func() error) error {
+	op := &peerOp{fn: fn, done: make(chan error, 1)}
+	select {
+	case p.opCh <- op:
+	case <-p.stopCh:
+		return ErrPeerStopped
+	}
+	return <-op.done
+}
+
+func (p *Peer) runOp(op *peerOp) {
+	p.moving()
+	op.done <- op.fn()
+}
+
+// Freeze freezes the cluster so that no changes are made to the cluster state
+// until it is unfrozen, for example while performing maintenance.
+func (p *Peer) Freeze(reason string) error {
+	return p.do(func() error {
+		return p.startUpdateFreeze(NewFreezeDetails(reason))
+	})
+}
+
+// Unfreeze unfreezes the cluster, allowing pending changes to be made.
+func (p *Peer) Unfreeze() error {
+	return p.do(func() error {
+		return p.startUpdateFreeze(nil)
+	})
+}
+
+// Takeover makes the sync peer take over as primary while the primary is still
+// present, so that the primary can be taken down for maintenance. The sync
+// must have replayed the WAL of the primary up to minWAL. As with a takeover
+// after the primary fails, the previous primary is deposed and the first async
+// becomes the new sync.
+func (p *Peer) Takeover(minWAL xlog.Position) error {
+	return p.do(func() error {
+		info := p.Info()
+		if info.State == nil {
+			return ErrNoClusterState
+		}
+		if info.Role != RoleSync {
+			return ErrNotSync
+		}
+		newState := p.takeoverState()
+		if newState == nil {
+			return ErrNoAsync
+		}
+		return p.startTakeoverWithPeer("takeover requested", minWAL, newState)
+	})
+}
+
 func (p *Peer) Info() *PeerInfo {
 	return p.info.Load().(*PeerInfo)
 }
@@ -314,20 +406,20 @@ func (p *Peer) setRole(role Role) {
 	p.setInfo(info)
 }
 
-func (p *Peer) setPgRetryPending(t *time.Time) {
+func (p *Peer) setRetryPending(t *time.Time) {
 	info := *p.Info()
-	info.PgRetryPending = t
+	info.RetryPending = t
 	p.setInfo(info)
 }
 
-func (p *Peer) handlePgInit(e PostgresEvent) {
-	p.log.Info("postgres init", "online", e.Online, "setup", e.Setup)
-	if p.pgOnline != nil {
-		panic("received postgres init event after already initialized")
+func (p *Peer) handleDatabaseInit(e DatabaseEvent) {
+	p.log.Info("database init", "online", e.Online, "setup", e.Setup)
+	if p.dbOnline != nil {
+		panic("received database init event after already initialized")
 	}
 
-	p.pgOnline = &e.Online
-	p.pgSetup = e.Setup
+	p.dbOnline = &e.Online
+	p.dbSetup = e.Setup
 
 	if p.Info().Peers != nil {
 		p.evalClusterState()
@@ -352,7 +444,7 @@ func (p *Peer) handleDiscoverdInit(e *DiscoverdEvent) {
 	}
 	p.setPeers(e.Peers)
 	p.decodeState(e)
-	if p.pgOnline != nil {
+	if p.dbOnline != nil {
 		p.evalClusterState()
 	}
 }
@@ -470,7 +562,7 @@ func (p *Peer) evalClusterState() {
 			return
 		}
 
-		if !p.pgSetup &&
+		if !p.dbSetup &&
 			info.Peers[0].ID == p.self.ID &&
 			(p.singleton || len(info.Peers) > 1) {
 			p.startInitialSetup()
@@ -520,7 +612,7 @@ func (p *Peer) evalClusterState() {
 			p.assumeUnassigned()
 		} else {
 			upstream := p.upstream(whichAsync)
-			if upstream.ID != p.pgUpstream.ID {
+			if upstream.ID != p.dbUpstream.ID {
 				p.assumeAsync(whichAsync)
 			}
 		}
@@ -537,6 +629,11 @@ func (p *Peer) evalClusterState() {
 		return
 	}
 
+	// Deposed peers have nothing to do until they are rebuilt.
+	if p.Info().Role == RoleDeposed {
+		return
+	}
+
 	if p.Info().Role != RolePrimary {
 		panic(fmt.Sprintf("unexpected role %v", p.Info().Role))
 	}
@@ -621,7 +718,7 @@ func (p *Peer) startInitialSetup() {
 	p.updatingState = &State{
 		Generation: 1,
 		Primary:    p.self,
-		InitWAL:    xlog.Zero,
+		InitWAL:    p.db.XLog().Zero(),
 	}
 	if p.singleton {
 		p.updatingState.Singleton = true
@@ -651,21 +748,21 @@ func (p *Peer) startInitialSetup() {
 func (p *Peer) assumeUnassigned() {
 	p.log.Info("assuming unassigned role", "role", "unassigned", "fn", "assumeUnassigned")
 	p.setRole(RoleUnassigned)
-	p.pgUpstream = nil
+	p.dbUpstream = nil
 	p.triggerApplyConfig()
 }
 
 func (p *Peer) assumeDeposed() {
 	p.log.Info("assuming deposed role", "role", "deposed", "fn", "assumeDeposed")
 	p.setRole(RoleDeposed)
-	p.pgUpstream = nil
+	p.dbUpstream = nil
 	p.triggerApplyConfig()
 }
 
 func (p *Peer) assumePrimary() {
 	p.log.Info("assuming primary role", "role", "primary", "fn", "assumePrimary")
 	p.setRole(RolePrimary)
-	p.pgUpstream = nil
+	p.dbUpstream = nil
 
 	// It simplifies things to say that evalClusterState() only deals with one
 	// change at a time. Now that we've handled the change to become primary,
@@ -676,10 +773,10 @@ func (p *Peer) assumePrimary() {
 	// not present. The first call to evalClusterState() will get us here, and
 	// we call it again to check for the presence of the synchronous peer.
 	//
-	// We invoke pgApplyConfig() after evalClusterState(), though it may well
+	// We invoke dbApplyConfig() after evalClusterState(), though it may well
 	// turn out that evalClusterState() kicked off an operation that will
-	// change the desired postgres configuration. In that case, we'll end up
-	// calling pgApplyConfig() again.
+	// change the desired database configuration. In that case, we'll end up
+	// calling dbApplyConfig() again.
 	p.evalClusterState()
 	p.triggerApplyConfig()
 }
@@ -691,7 +788,7 @@ func (p *Peer) assumeSync() {
 	p.log.Info("assuming sync role", "role", "sync", "fn", "assumeSync")
 
 	p.setRole(RoleSync)
-	p.pgUpstream = p.Info().State.Primary
+	p.dbUpstream = p.Info().State.Primary
 	// See assumePrimary()
 	p.evalClusterState()
 	p.triggerApplyConfig()
@@ -704,7 +801,7 @@ func (p *Peer) assumeAsync(i int) {
 	p.log.Info("assuming async role", "role", "async", "fn", "assumeAsync")
 
 	p.setRole(RoleAsync)
-	p.pgUpstream = p.upstream(i)
+	p.dbUpstream = p.upstream(i)
 
 	// See assumePrimary(). We don't need to check the cluster state here
 	// because there's never more than one thing to do when becoming the async
@@ -745,6 +842,19 @@ func (p *Peer) evalInitClusterState() {
 func (p *Peer) startTakeover(reason string, minWAL xlog.Position) bool {
 	log := p.log.New("fn", "startTakeover", "reason", reason, "min_wal", minWAL)
 
+	newState := p.takeoverState()
+	if newState == nil {
+		log.Warn("would takeover but no async peers present")
+		return false
+	}
+
+	p.startTakeoverWithPeer(reason, minWAL, newState)
+	return true
+}
+
+// takeoverState returns the peers of the next generation if we take over as
+// primary, or nil if there is no async peer present to become the sync.
+func (p *Peer) takeoverState() *State {
 	// Select the first present async peer to be the next sync
 	var newSync *discoverd.Instance
 	for _, a := range p.Info().State.Async {
@@ -754,11 +864,10 @@ func (p *Peer) startTakeover(reason string, minWAL xlog.Position) bool {
 		}
 	}
 	if newSync == nil {
-		log.Warn("would takeover but no async peers present")
-		return false
+		return nil
 	}
 
-	log.Debug("preparing for new generation")
+	p.log.Debug("preparing for new generation", "fn", "takeoverState")
 	newAsync := make([]*discoverd.Instance, 0, len(p.Info().State.Async))
 	for _, a := range p.Info().State.Async {
 		if a.ID != newSync.ID && p.peerIsPresent(a) {
@@ -771,17 +880,16 @@ func (p *Peer) startTakeover(reason string, minWAL xlog.Position) bool {
 		newDeposed = append(newDeposed, p.Info().State.Primary)
 	}
 
-	p.startTakeoverWithPeer(reason, minWAL, &State{
+	return &State{
 		Sync:    newSync,
 		Async:   newAsync,
 		Deposed: newDeposed,
-	})
-	return true
+	}
 }
 
 var (
 	ErrClusterFrozen   = errors.New("cluster is frozen")
-	ErrPostgresOffline = errors.New("postgres is offline")
+	ErrDatabaseOffline = errors.New("database is offline")
 	ErrPeerNotCaughtUp = errors.New("peer is not caught up")
 )
 
@@ -807,8 +915,8 @@ func (p *Peer) startTakeoverWithPeer(reason string, minWAL xlog.Position, newSta
 		p.updatingState = nil
 
 		switch err {
-		case ErrPostgresOffline:
-			// If postgres is offline, it's because we haven't started yet, so
+		case ErrDatabaseOffline:
+			// If the database is offline, it's because we haven't started yet, so
 			// trigger another state evaluation after we start it.
 			log.Error("failed to declare new generation, trying later", "err", err)
 			p.triggerEval()
@@ -817,7 +925,7 @@ func (p *Peer) startTakeoverWithPeer(reason string, minWAL xlog.Position, newSta
 		default:
 			// In the event of an error, back off a bit and check state again in
 			// a second. There are several transient failure modes that will resolve
-			// themselves (e.g. postgres synchronous replication not yet caught up).
+			// themselves (e.g. synchronous replication not yet caught up).
 			log.Error("failed to declare new generation, backing off", "err", err)
 			p.evalLater(1 * time.Second)
 		}
@@ -828,21 +936,21 @@ func (p *Peer) startTakeoverWithPeer(reason string, minWAL xlog.Position, newSta
 	}
 
 	// In order to declare a new generation, we'll need to fetch our current
-	// transaction log position, which requires that postres be online. In most
+	// transaction log position, which requires that the database be online. In most
 	// cases, it will be, since we only declare a new generation as a primary or
 	// a caught-up sync. During initial startup, however, we may find out
 	// simultaneously that we're the primary or sync AND that the other is gone,
 	// so we may attempt to declare a new generation before we've started
-	// postgres. In this case, this step will fail, but we'll just skip the
-	// takeover attempt until postgres is running.
-	if !*p.pgOnline {
-		return ErrPostgresOffline
+	// the database. In this case, this step will fail, but we'll just skip the
+	// takeover attempt until the database is running.
+	if !*p.dbOnline {
+		return ErrDatabaseOffline
 	}
-	wal, err := p.postgres.XLogPosition()
+	wal, err := p.db.XLogPosition()
 	if err != nil {
 		return err
 	}
-	if x, err := xlog.Compare(wal, minWAL); err != nil || x < 0 {
+	if x, err := p.db.XLog().Compare(wal, minWAL); err != nil || x < 0 {
 		if err == nil {
 			log.Warn("would attempt takeover but not caught up with primary yet", "found_wal", wal)
 			err = ErrPeerNotCaughtUp
@@ -896,7 +1004,7 @@ func (p *Peer) startTransitionToNormalMode() {
 	}
 
 	log.Debug("transitioning to normal mode")
-	p.startTakeoverWithPeer("transitioning to normal mode", xlog.Zero, &State{
+	p.startTakeoverWithPeer("transitioning to normal mode", p.db.XLog().Zero(), &State{
 		Sync:  newSync,
 		Async: newAsync,
 	})
@@ -928,21 +1036,53 @@ func (p *Peer) startUpdateAsyncs(newAsync []*discoverd.Instance) {
 	p.triggerEval()
 }
 
-// Reconfigure postgres based on the current configuration. During
+// startUpdateFreeze freezes or unfreezes the cluster by updating the cluster
+// state, which any peer may do.
+func (p *Peer) startUpdateFreeze(freeze *FreezeDetails) error {
+	if p.updatingState != nil {
+		panic("startUpdateFreeze with existing update state")
+	}
+	log := p.log.New("fn", "startUpdateFreeze", "freeze", freeze != nil)
+
+	state := p.Info().State
+	if state == nil {
+		return ErrNoClusterState
+	}
+	if (state.Freeze != nil) == (freeze != nil) {
+		log.Info("cluster freeze unchanged")
+		return nil
+	}
+
+	p.updatingState = state.Clone()
+	p.updatingState.Freeze = freeze
+	log.Info("updating cluster freeze")
+	err := p.putClusterState()
+	if err != nil {
+		log.Error("failed to update cluster state", "err", err)
+	} else {
+		p.setState(p.updatingState)
+	}
+	p.updatingState = nil
+
+	p.triggerEval()
+	return err
+}
+
+// Reconfigure the database based on the current configuration. During
 // reconfiguration, new requests to reconfigure will be ignored, and incoming
 // cluster state changes will be recorded but otherwise ignored. When
 // reconfiguration completes, if the desired configuration has changed, we'll
 // take another lap to apply the updated configuration.
-func (p *Peer) pgApplyConfig() (err error) {
+func (p *Peer) dbApplyConfig() (err error) {
 	p.moving()
-	log := p.log.New("fn", "pgApplyConfig")
+	log := p.log.New("fn", "dbApplyConfig")
 
-	if p.pgOnline == nil {
-		panic("pgApplyConfig with postgres in unknown state")
+	if p.dbOnline == nil {
+		panic("dbApplyConfig with database in unknown state")
 	}
 
-	config := p.pgConfig()
-	if p.pgApplied != nil && p.pgApplied.Equal(config) {
+	config := p.dbConfig()
+	if p.dbApplied != nil && p.dbApplied.Equal(config) {
 		log.Info("skipping config apply, no changes")
 		return nil
 	}
@@ -958,30 +1098,30 @@ func (p *Peer) pgApplyConfig() (err error) {
 		// there's no reason to believe any other peer is in a better position
 		// to deal with this, and we don't want to flap unnecessarily. So just
 		// log an error and try again shortly.
-		log.Error("error applying pg config", "err", err)
+		log.Error("error applying database config", "err", err)
 		t := TimeNow()
-		p.setPgRetryPending(&t)
+		p.setRetryPending(&t)
 		p.applyConfigLater(1 * time.Second)
 	}()
 
-	log.Info("reconfiguring postgres")
-	if err := p.postgres.Reconfigure(config); err != nil {
+	log.Info("reconfiguring database")
+	if err := p.db.Reconfigure(config); err != nil {
 		return err
 	}
 
 	if config.Role != RoleNone {
-		if *p.pgOnline {
+		if *p.dbOnline {
 			log.Debug("skipping start, already online")
 		} else {
-			log.Debug("starting postgres")
-			if err := p.postgres.Start(); err != nil {
+			log.Debug("starting database")
+			if err := p.db.Start(); err != nil {
 				return err
 			}
 		}
 	} else {
-		if *p.pgOnline {
-			log.Debug("stopping postgres")
-			if err := p.postgres.Stop(); err != nil {
+		if *p.dbOnline {
+			log.Debug("stopping database")
+			if err := p.db.Stop(); err != nil {
 				return err
 			}
 		} else {
@@ -989,11 +1129,11 @@ func (p *Peer) pgApplyConfig() (err error) {
 		}
 	}
 
-	log.Info("applied pg config")
-	p.setPgRetryPending(nil)
-	p.pgApplied = config
+	log.Info("applied database config")
+	p.setRetryPending(nil)
+	p.dbApplied = config
 	online := config.Role != RoleNone
-	p.pgOnline = &online
+	p.dbOnline = &online
 
 	// Try applying the configuration again in case anything's
 	// changed. If not, this will be a no-op.
@@ -1001,15 +1141,15 @@ func (p *Peer) pgApplyConfig() (err error) {
 	return nil
 }
 
-func (p *Peer) pgConfig() *PgConfig {
+func (p *Peer) dbConfig() *Config {
 	role := p.Info().Role
 	switch role {
 	case RolePrimary:
-		return &PgConfig{Role: role, Downstream: p.Info().State.Sync}
+		return &Config{Role: role, Downstream: p.Info().State.Sync}
 	case RoleSync, RoleAsync:
-		return &PgConfig{Role: role, Upstream: p.pgUpstream}
+		return &Config{Role: role, Upstream: p.dbUpstream}
 	case RoleUnassigned, RoleDeposed:
-		return &PgConfig{Role: RoleNone}
+		return &Config{Role: RoleNone}
 	default:
 		panic(fmt.Sprintf("unexpected role %v", role))
 	}
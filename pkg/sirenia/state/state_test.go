@@ -20,15 +20,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/kylelemons/godebug/pretty"
-	"github.com/flynn/flynn/appliance/postgresql/simulator"
-	"github.com/flynn/flynn/appliance/postgresql/state"
-	"github.com/flynn/flynn/appliance/postgresql/xlog"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/iotool"
+	"github.com/flynn/flynn/pkg/sirenia/simulator"
+	"github.com/flynn/flynn/pkg/sirenia/state"
+	"github.com/flynn/flynn/pkg/sirenia/xlog"
 )
 
 type step struct {
@@ -44,6 +45,10 @@ func init() {
 }
 
 func runSteps(t *testing.T, singleton bool, steps []step) {
+	runStepsWithXLog(t, fakeXLog{}, singleton, steps)
+}
+
+func runStepsWithXLog(t *testing.T, x xlog.XLog, singleton bool, steps []step) {
 	logOut := &bytes.Buffer{}
 	logOut.WriteByte('\n')
 	logW := &iotool.SafeWriter{W: logOut}
@@ -53,7 +58,7 @@ func runSteps(t *testing.T, singleton bool, steps []step) {
 	}()
 
 	dataOut := &bytes.Buffer{}
-	sim := simulator.New(singleton, dataOut, logW)
+	sim := simulator.New(singleton, x, dataOut, logW)
 	defer sim.Close()
 
 	for _, step := range steps {
@@ -95,10 +100,162 @@ func md5sum(data string) string {
 
 var node1ID = node(1, 1).ID
 
-var pgOffline = &simulator.PostgresInfo{
+var dbOffline = &simulator.DatabaseInfo{
 	Online: false,
-	Config: &state.PgConfig{Role: state.RoleNone},
-	XLog:   xlog.Zero,
+	Config: &state.Config{Role: state.RoleNone},
+	XLog:   xlogZero,
+}
+
+// fakeXLog is a transaction log whose positions have the "filepart/offset"
+// hexadecimal format of postgres positions, which the expected states are
+// written in.
+type fakeXLog struct{}
+
+const xlogZero xlog.Position = "0/00000000"
+
+func (fakeXLog) Zero() xlog.Position {
+	return xlogZero
+}
+
+func (fakeXLog) Increment(pos xlog.Position, increment int) (xlog.Position, error) {
+	file, offset, err := parseFakeXLog(pos)
+	if err != nil {
+		return "", err
+	}
+	return xlog.Position(fmt.Sprintf("%X/%08X", file, offset+uint64(increment))), nil
+}
+
+func (fakeXLog) Compare(xlog1, xlog2 xlog.Position) (int, error) {
+	file1, offset1, err := parseFakeXLog(xlog1)
+	if err != nil {
+		return 0, err
+	}
+	file2, offset2, err := parseFakeXLog(xlog2)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case file1 < file2 || file1 == file2 && offset1 < offset2:
+		return -1, nil
+	case file1 > file2 || file1 == file2 && offset1 > offset2:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+func parseFakeXLog(pos xlog.Position) (file, offset uint64, err error) {
+	if _, err := fmt.Sscanf(string(pos), "%X/%X", &file, &offset); err != nil {
+		return 0, 0, fmt.Errorf("malformed xlog position %q", pos)
+	}
+	return file, offset, nil
+}
+
+// counterXLog is a transaction log whose positions are decimal integers.
+type counterXLog struct{}
+
+func (counterXLog) Zero() xlog.Position {
+	return "0"
+}
+
+func (counterXLog) Increment(pos xlog.Position, increment int) (xlog.Position, error) {
+	n, err := strconv.Atoi(string(pos))
+	if err != nil {
+		return "", err
+	}
+	return xlog.Position(strconv.Itoa(n + increment)), nil
+}
+
+func (counterXLog) Compare(xlog1, xlog2 xlog.Position) (int, error) {
+	n1, err := strconv.Atoi(string(xlog1))
+	if err != nil {
+		return 0, err
+	}
+	n2, err := strconv.Atoi(string(xlog2))
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case n1 < n2:
+		return -1, nil
+	case n1 > n2:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+// tests the flow of async -> sync -> primary with a database that has a
+// different transaction log format to postgres
+func TestCustomXLog(t *testing.T) {
+	peers := []*discoverd.Instance{node(2, 1), node(3, 2), node(1, 3)}
+	gen2 := &state.State{
+		Generation: 2,
+		InitWAL:    "10",
+		Primary:    node(3, 2),
+		Sync:       node(1, 3),
+		Async:      []*discoverd.Instance{node(2, 1)},
+		Deposed:    []*discoverd.Instance{},
+	}
+
+	runStepsWithXLog(t, counterXLog{}, false, []step{
+		{Cmd: "addpeer"},
+		{Cmd: "addpeer"},
+		{Cmd: "addpeer node1"},
+		{Cmd: "bootstrap node2 node3"},
+		{Cmd: "startPeer"},
+		{Cmd: "depose"},
+		{Cmd: "rebuild node2"},
+		{
+			Cmd: "peer",
+			Check: &simulator.PeerSimInfo{
+				Peer: &state.PeerInfo{
+					ID:    node1ID,
+					Role:  state.RoleSync,
+					Peers: peers,
+					State: gen2,
+				},
+				Database: &simulator.DatabaseInfo{
+					Config: &state.Config{
+						Role:     state.RoleSync,
+						Upstream: node(3, 2),
+					},
+					Online:      true,
+					XLog:        "0",
+					XLogWaiting: "10",
+				},
+			},
+		},
+
+		// the sync takes over once it has caught up with the primary
+		{Cmd: "catchup"},
+		{Cmd: "rmpeer node3"},
+		{
+			Cmd: "peer",
+			Check: &simulator.PeerSimInfo{
+				Peer: &state.PeerInfo{
+					ID:    node1ID,
+					Role:  state.RolePrimary,
+					Peers: []*discoverd.Instance{node(2, 1), node(1, 3)},
+					State: &state.State{
+						Generation: 3,
+						InitWAL:    "20",
+						Primary:    node(1, 3),
+						Sync:       node(2, 1),
+						Deposed:    []*discoverd.Instance{node(3, 2)},
+					},
+				},
+				Database: &simulator.DatabaseInfo{
+					Config: &state.Config{
+						Role:       state.RolePrimary,
+						Downstream: node(2, 1),
+					},
+					Online: true,
+					XLog:   "30",
+				},
+			},
+		},
+	})
 }
 
 // tests the basic flow of unassigned -> async -> sync -> primary
@@ -108,7 +265,7 @@ func TestBasic(t *testing.T) {
 		Primary:    node(2, 1),
 		Sync:       node(3, 2),
 		Async:      []*discoverd.Instance{node(1, 3)},
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
 	peers := []*discoverd.Instance{node(2, 1), node(3, 2), node(1, 3)}
 
@@ -128,25 +285,25 @@ func TestBasic(t *testing.T) {
 		Deposed:    []*discoverd.Instance{},
 	}
 
-	pgSync := &simulator.PostgresInfo{
-		Config: &state.PgConfig{
+	dbSync := &simulator.DatabaseInfo{
+		Config: &state.Config{
 			Role:     state.RoleSync,
 			Upstream: node(3, 2),
 		},
 		Online:      true,
-		XLog:        xlog.Zero,
+		XLog:        xlogZero,
 		XLogWaiting: "0/0000000A",
 	}
-	pgPrimary := &simulator.PostgresInfo{
-		Config: &state.PgConfig{
+	dbPrimary := &simulator.DatabaseInfo{
+		Config: &state.Config{
 			Role:       state.RolePrimary,
 			Downstream: node(2, 1),
 		},
 		Online: true,
 		XLog:   "0/0000001E",
 	}
-	pgPrimary2 := &simulator.PostgresInfo{
-		Config: &state.PgConfig{
+	dbPrimary2 := &simulator.DatabaseInfo{
+		Config: &state.Config{
 			Role:       state.RolePrimary,
 			Downstream: node(3, 4),
 		},
@@ -195,7 +352,7 @@ func TestBasic(t *testing.T) {
 			Cmd: "peer",
 			Check: &simulator.PeerSimInfo{
 				Peer:     &state.PeerInfo{ID: node1ID},
-				Postgres: &simulator.PostgresInfo{XLog: xlog.Zero},
+				Database: &simulator.DatabaseInfo{XLog: xlogZero},
 			},
 		},
 
@@ -211,13 +368,13 @@ func TestBasic(t *testing.T) {
 					Peers: peers,
 					State: gen1,
 				},
-				Postgres: &simulator.PostgresInfo{
-					Config: &state.PgConfig{
+				Database: &simulator.DatabaseInfo{
+					Config: &state.Config{
 						Role:     state.RoleAsync,
 						Upstream: node(3, 2),
 					},
 					Online: true,
-					XLog:   xlog.Zero,
+					XLog:   xlogZero,
 				},
 			},
 		},
@@ -234,7 +391,7 @@ func TestBasic(t *testing.T) {
 					Peers: peers,
 					State: gen2_0,
 				},
-				Postgres: pgSync,
+				Database: dbSync,
 			},
 		},
 
@@ -250,7 +407,7 @@ func TestBasic(t *testing.T) {
 					Peers: peers,
 					State: gen2_1,
 				},
-				Postgres: pgSync,
+				Database: dbSync,
 			},
 		},
 
@@ -267,7 +424,7 @@ func TestBasic(t *testing.T) {
 					Peers: []*discoverd.Instance{node(2, 1), node(1, 3)},
 					State: gen2_1,
 				},
-				Postgres: pgSync,
+				Database: dbSync,
 			},
 		},
 		{Cmd: "addpeer node3"},
@@ -280,7 +437,7 @@ func TestBasic(t *testing.T) {
 					Peers: []*discoverd.Instance{node(2, 1), node(1, 3), node(3, 4)},
 					State: gen2_1,
 				},
-				Postgres: pgSync,
+				Database: dbSync,
 			},
 		},
 
@@ -304,7 +461,7 @@ func TestBasic(t *testing.T) {
 						Deposed:    []*discoverd.Instance{node(3, 2)},
 					},
 				},
-				Postgres: pgPrimary,
+				Database: dbPrimary,
 			},
 		},
 		{Cmd: "rebuild node3"},
@@ -324,7 +481,7 @@ func TestBasic(t *testing.T) {
 						Async:      []*discoverd.Instance{node(3, 4)},
 					},
 				},
-				Postgres: pgPrimary,
+				Database: dbPrimary,
 			},
 		},
 
@@ -345,7 +502,7 @@ func TestBasic(t *testing.T) {
 						Sync:       node(3, 4),
 					},
 				},
-				Postgres: pgPrimary2,
+				Database: dbPrimary2,
 			},
 		},
 		{Cmd: "addpeer node2"},
@@ -364,7 +521,7 @@ func TestBasic(t *testing.T) {
 						Async:      []*discoverd.Instance{node(2, 5)},
 					},
 				},
-				Postgres: pgPrimary2,
+				Database: dbPrimary2,
 			},
 		},
 
@@ -386,7 +543,7 @@ func TestBasic(t *testing.T) {
 						Async:      []*discoverd.Instance{node(2, 5), node(4, 6)},
 					},
 				},
-				Postgres: pgPrimary2,
+				Database: dbPrimary2,
 			},
 		},
 
@@ -408,7 +565,7 @@ func TestBasic(t *testing.T) {
 						Async:      []*discoverd.Instance{node(2, 5)},
 					},
 				},
-				Postgres: pgPrimary2,
+				Database: dbPrimary2,
 			},
 		},
 
@@ -430,9 +587,9 @@ func TestBasic(t *testing.T) {
 						Deposed:    []*discoverd.Instance{node(1, 3)},
 					},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: false,
-					Config: &state.PgConfig{Role: state.RoleNone},
+					Config: &state.Config{Role: state.RoleNone},
 					XLog:   "0/00000028",
 				},
 			},
@@ -455,7 +612,7 @@ func TestClusterSetupDelay(t *testing.T) {
 					Role:  state.RoleUnassigned,
 					Peers: []*discoverd.Instance{node(1, 1)},
 				},
-				Postgres: pgOffline,
+				Database: dbOffline,
 			},
 		},
 
@@ -472,12 +629,12 @@ func TestClusterSetupDelay(t *testing.T) {
 						Generation: 1,
 						Primary:    node(1, 1),
 						Sync:       node(2, 2),
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(2, 2),
 					},
@@ -508,12 +665,12 @@ func TestClusterSetupImmediate(t *testing.T) {
 						Generation: 1,
 						Primary:    node(1, 1),
 						Sync:       node(2, 2),
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(2, 2),
 					},
@@ -539,7 +696,7 @@ func TestClusterSetupSingleton(t *testing.T) {
 					State: &state.State{
 						Generation: 1,
 						Primary:    node(1, 1),
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 						Singleton:  true,
 						Freeze: &state.FreezeDetails{
 							Reason:   "cluster started in singleton mode",
@@ -547,9 +704,9 @@ func TestClusterSetupSingleton(t *testing.T) {
 						},
 					},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{Role: state.RolePrimary},
+					Config: &state.Config{Role: state.RolePrimary},
 					XLog:   "0/0000000A",
 				},
 			},
@@ -573,7 +730,7 @@ func TestSetupPassive(t *testing.T) {
 					Role:  state.RoleUnassigned,
 					Peers: []*discoverd.Instance{node(2, 1), node(1, 2)},
 				},
-				Postgres: pgOffline,
+				Database: dbOffline,
 			},
 		},
 
@@ -590,17 +747,17 @@ func TestSetupPassive(t *testing.T) {
 						Generation: 1,
 						Primary:    node(2, 1),
 						Sync:       node(1, 2),
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleSync,
 						Upstream: node(2, 1),
 					},
-					XLog:        xlog.Zero,
-					XLogWaiting: xlog.Zero,
+					XLog:        xlogZero,
+					XLogWaiting: xlogZero,
 				},
 			},
 		},
@@ -613,16 +770,16 @@ func TestNoFlap(t *testing.T) {
 		Generation: 1,
 		Primary:    node(2, 1),
 		Sync:       node(1, 2),
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
-	gen1pg := &simulator.PostgresInfo{
+	gen1db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{
+		Config: &state.Config{
 			Role:     state.RoleSync,
 			Upstream: node(2, 1),
 		},
-		XLog:        xlog.Zero,
-		XLogWaiting: xlog.Zero,
+		XLog:        xlogZero,
+		XLogWaiting: xlogZero,
 	}
 
 	gen2_0 := &state.State{
@@ -630,17 +787,17 @@ func TestNoFlap(t *testing.T) {
 		Primary:    node(1, 2),
 		Sync:       node(3, 3),
 		Deposed:    []*discoverd.Instance{node(2, 1)},
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
 	gen2_1 := &state.State{
 		Generation: 2,
 		Primary:    node(1, 2),
 		Sync:       node(3, 3),
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
-	gen2pg := &simulator.PostgresInfo{
+	gen2db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{
+		Config: &state.Config{
 			Role:       state.RolePrimary,
 			Downstream: node(3, 3),
 		},
@@ -664,7 +821,7 @@ func TestNoFlap(t *testing.T) {
 					Peers: []*discoverd.Instance{node(2, 1), node(1, 2)},
 					State: gen1,
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 		{Cmd: "rmpeer node2"},
@@ -677,7 +834,7 @@ func TestNoFlap(t *testing.T) {
 					Peers: []*discoverd.Instance{node(1, 2)},
 					State: gen1,
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 
@@ -692,7 +849,7 @@ func TestNoFlap(t *testing.T) {
 					Peers: []*discoverd.Instance{node(1, 2), node(3, 3)},
 					State: gen2_0,
 				},
-				Postgres: gen2pg,
+				Database: gen2db,
 			},
 		},
 		{Cmd: "rebuild node2"},
@@ -705,7 +862,7 @@ func TestNoFlap(t *testing.T) {
 					Peers: []*discoverd.Instance{node(1, 2), node(3, 3)},
 					State: gen2_1,
 				},
-				Postgres: gen2pg,
+				Database: gen2db,
 			},
 		},
 
@@ -721,7 +878,7 @@ func TestNoFlap(t *testing.T) {
 					Peers: []*discoverd.Instance{node(1, 2)},
 					State: gen2_1,
 				},
-				Postgres: gen2pg,
+				Database: gen2db,
 			},
 		},
 	})
@@ -732,13 +889,13 @@ func TestSingleton(t *testing.T) {
 	gen1 := &state.State{
 		Generation: 1,
 		Primary:    node(1, 1),
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 		Freeze:     state.NewFreezeDetails("singleton"),
 		Singleton:  true,
 	}
-	gen1pg := &simulator.PostgresInfo{
+	gen1db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{Role: state.RolePrimary},
+		Config: &state.Config{Role: state.RolePrimary},
 		XLog:   "0/0000000A",
 	}
 
@@ -749,7 +906,7 @@ func TestSingleton(t *testing.T) {
 			Peers: []*discoverd.Instance{node(1, 1)},
 			State: gen1,
 		},
-		Postgres: gen1pg,
+		Database: gen1db,
 	}
 
 	runSteps(t, true, []step{
@@ -771,7 +928,7 @@ func TestSingleton(t *testing.T) {
 					Peers: []*discoverd.Instance{node(1, 1), node(2, 2)},
 					State: gen1,
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 		{Cmd: "rmpeer node2"},
@@ -784,7 +941,7 @@ func TestSingletonSecond(t *testing.T) {
 	gen1 := &state.State{
 		Generation: 1,
 		Primary:    node(2, 1),
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 		Freeze:     state.NewFreezeDetails("singleton"),
 		Singleton:  true,
 	}
@@ -805,7 +962,7 @@ func TestSingletonSecond(t *testing.T) {
 					State: gen1,
 					Peers: []*discoverd.Instance{node(2, 1), node(1, 2)},
 				},
-				Postgres: pgOffline,
+				Database: dbOffline,
 			},
 		},
 
@@ -821,7 +978,7 @@ func TestSingletonSecond(t *testing.T) {
 					State: gen1,
 					Peers: []*discoverd.Instance{node(1, 2)},
 				},
-				Postgres: pgOffline,
+				Database: dbOffline,
 			},
 		},
 	})
@@ -832,7 +989,7 @@ func TestSingletonUpgradeToNormal(t *testing.T) {
 	gen1 := &state.State{
 		Generation: 1,
 		Primary:    node(1, 1),
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 		Freeze:     state.NewFreezeDetails("singleton"),
 		Singleton:  true,
 	}
@@ -851,9 +1008,9 @@ func TestSingletonUpgradeToNormal(t *testing.T) {
 					State: gen1,
 					Peers: []*discoverd.Instance{node(1, 1)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{Role: state.RolePrimary},
+					Config: &state.Config{Role: state.RolePrimary},
 					XLog:   "0/0000000A",
 				},
 			},
@@ -871,14 +1028,14 @@ func TestSingletonUpgradeToNormal(t *testing.T) {
 					State: &state.State{
 						Generation: 1,
 						Primary:    node(1, 1),
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 						Singleton:  true,
 					},
 					Peers: []*discoverd.Instance{node(1, 1)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{Role: state.RolePrimary},
+					Config: &state.Config{Role: state.RolePrimary},
 					XLog:   "0/0000000A",
 				},
 			},
@@ -901,9 +1058,9 @@ func TestSingletonUpgradeToNormal(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(2, 2)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(2, 2),
 					},
@@ -931,9 +1088,9 @@ func TestSingletonUpgradeToNormal(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(3, 3),
 					},
@@ -957,9 +1114,9 @@ func TestSingletonUpgradeToNormal(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3), node(2, 4)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(3, 3),
 					},
@@ -1004,7 +1161,7 @@ func TestStartDeposed(t *testing.T) {
 					State: gen2,
 					Peers: peers,
 				},
-				Postgres: pgOffline,
+				Database: dbOffline,
 			},
 		},
 	})
@@ -1017,12 +1174,12 @@ func TestStartPrimary(t *testing.T) {
 		Primary:    node(1, 1),
 		Sync:       node(2, 2),
 		Async:      []*discoverd.Instance{node(3, 3)},
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
 	gen1peers := []*discoverd.Instance{node(1, 1), node(2, 2), node(3, 3)}
-	gen3pg := &simulator.PostgresInfo{
+	gen3db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{
+		Config: &state.Config{
 			Role:       state.RolePrimary,
 			Downstream: node(3, 3),
 		},
@@ -1056,9 +1213,9 @@ func TestStartPrimary(t *testing.T) {
 					State: gen1,
 					Peers: gen1peers,
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(2, 2),
 					},
@@ -1084,7 +1241,7 @@ func TestStartPrimary(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3)},
 				},
-				Postgres: gen3pg,
+				Database: gen3db,
 			},
 		},
 		{Cmd: "addpeer node2"},
@@ -1103,7 +1260,7 @@ func TestStartPrimary(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3), node(2, 4)},
 				},
-				Postgres: gen3pg,
+				Database: gen3db,
 			},
 		},
 	})
@@ -1127,7 +1284,7 @@ func TestStartPrimaryAsync(t *testing.T) {
 						Primary:    node(1, 1),
 						Sync:       node(2, 2),
 						Async:      []*discoverd.Instance{node(3, 3)},
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 				},
 				Peers: []*discoverd.Instance{node(1, 1), node(2, 2), node(3, 3)},
@@ -1149,9 +1306,9 @@ func TestStartPrimaryAsync(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(3, 3),
 					},
@@ -1169,21 +1326,21 @@ func TestStartSync(t *testing.T) {
 		Primary:    node(3, 3),
 		Sync:       node(1, 1),
 		Async:      []*discoverd.Instance{node(2, 2)},
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
 	gen1peers := []*discoverd.Instance{node(1, 1), node(2, 2), node(3, 3)}
 
-	gen2pg := &simulator.PostgresInfo{
+	gen2db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{
+		Config: &state.Config{
 			Role:       state.RolePrimary,
 			Downstream: node(2, 2),
 		},
 		XLog: "0/00000014",
 	}
-	gen3pg := &simulator.PostgresInfo{
+	gen3db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{
+		Config: &state.Config{
 			Role:       state.RolePrimary,
 			Downstream: node(3, 3),
 		},
@@ -1216,14 +1373,14 @@ func TestStartSync(t *testing.T) {
 					State: gen1,
 					Peers: gen1peers,
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleSync,
 						Upstream: node(3, 3),
 					},
-					XLog:        xlog.Zero,
-					XLogWaiting: xlog.Zero,
+					XLog:        xlogZero,
+					XLogWaiting: xlogZero,
 				},
 			},
 		},
@@ -1247,7 +1404,7 @@ func TestStartSync(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(2, 2)},
 				},
-				Postgres: gen2pg,
+				Database: gen2db,
 			},
 		},
 		{Cmd: "rebuild node3"},
@@ -1267,7 +1424,7 @@ func TestStartSync(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(2, 2), node(3, 3)},
 				},
-				Postgres: gen2pg,
+				Database: gen2db,
 			},
 		},
 
@@ -1288,7 +1445,7 @@ func TestStartSync(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3)},
 				},
-				Postgres: gen3pg,
+				Database: gen3db,
 			},
 		},
 		{Cmd: "addpeer node2"},
@@ -1307,7 +1464,7 @@ func TestStartSync(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3), node(2, 4)},
 				},
-				Postgres: gen3pg,
+				Database: gen3db,
 			},
 		},
 	})
@@ -1331,7 +1488,7 @@ func TestStartSyncAsync(t *testing.T) {
 						Primary:    node(2, 1),
 						Sync:       node(1, 3),
 						Async:      []*discoverd.Instance{node(3, 2)},
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 				},
 				Peers: []*discoverd.Instance{node(2, 1), node(3, 2), node(1, 3)},
@@ -1350,13 +1507,13 @@ func TestStartSyncAsync(t *testing.T) {
 						Primary:    node(1, 3),
 						Sync:       node(3, 2),
 						Deposed:    []*discoverd.Instance{node(2, 1)},
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(3, 2), node(1, 3)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(3, 2),
 					},
@@ -1385,18 +1542,18 @@ func TestStartSyncAlone(t *testing.T) {
 						Generation: 1,
 						Primary:    node(2, 1),
 						Sync:       node(1, 2),
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(1, 2)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleSync,
 						Upstream: node(2, 1),
 					},
-					XLog:        xlog.Zero,
-					XLogWaiting: xlog.Zero,
+					XLog:        xlogZero,
+					XLogWaiting: xlogZero,
 				},
 			},
 		},
@@ -1410,14 +1567,14 @@ func TestStartUnassigned(t *testing.T) {
 		Generation: 1,
 		Primary:    node(2, 1),
 		Sync:       node(3, 2),
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
 	gen1_1 := &state.State{
 		Generation: 1,
 		Primary:    node(2, 1),
 		Sync:       node(3, 3),
 		Async:      peers[:1],
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
 
 	runSteps(t, false, []step{
@@ -1434,7 +1591,7 @@ func TestStartUnassigned(t *testing.T) {
 					State: gen1,
 					Peers: peers[:1],
 				},
-				Postgres: pgOffline,
+				Database: dbOffline,
 			},
 		},
 
@@ -1451,7 +1608,7 @@ func TestStartUnassigned(t *testing.T) {
 					State: gen1,
 					Peers: peers[:3],
 				},
-				Postgres: pgOffline,
+				Database: dbOffline,
 			},
 		},
 		{Cmd: "setClusterState", JSON: gen1_1},
@@ -1464,13 +1621,13 @@ func TestStartUnassigned(t *testing.T) {
 					State: gen1_1,
 					Peers: peers[:3],
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleAsync,
 						Upstream: node(3, 3),
 					},
-					XLog: xlog.Zero,
+					XLog: xlogZero,
 				},
 			},
 		},
@@ -1496,13 +1653,13 @@ func TestStartUnassigned(t *testing.T) {
 					},
 					Peers: peers,
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleSync,
 						Upstream: node(3, 3),
 					},
-					XLog:        xlog.Zero,
+					XLog:        xlogZero,
 					XLogWaiting: "0/0000000A",
 				},
 			},
@@ -1525,9 +1682,9 @@ func TestStartUnassigned(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(4, 4)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(4, 4),
 					},
@@ -1561,13 +1718,13 @@ func TestMultiAsync(t *testing.T) {
 						Primary:    node(1, 1),
 						Sync:       node(2, 2),
 						Async:      peers[2:],
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: peers,
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(2, 2),
 					},
@@ -1594,9 +1751,9 @@ func TestMultiAsync(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3), node(4, 4)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(3, 3),
 					},
@@ -1622,9 +1779,9 @@ func TestMultiAsync(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(4, 4)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(4, 4),
 					},
@@ -1645,30 +1802,30 @@ func TestFreezePrimary(t *testing.T) {
 		Primary:    node(1, 1),
 		Sync:       node(2, 2),
 		Async:      peers[2:],
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 	}
 	gen1frozen := &state.State{
 		Generation: 1,
 		Primary:    node(1, 1),
 		Sync:       node(2, 2),
 		Async:      peers[2:],
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 		Freeze: &state.FreezeDetails{
 			FrozenAt: fakeTime,
 			Reason:   "frozen by simulator",
 		},
 	}
-	gen1pg := &simulator.PostgresInfo{
+	gen1db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{
+		Config: &state.Config{
 			Role:       state.RolePrimary,
 			Downstream: node(2, 2),
 		},
 		XLog: "0/0000000A",
 	}
-	gen2pg := &simulator.PostgresInfo{
+	gen2db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{
+		Config: &state.Config{
 			Role:       state.RolePrimary,
 			Downstream: node(3, 3),
 		},
@@ -1691,7 +1848,7 @@ func TestFreezePrimary(t *testing.T) {
 					State: gen1,
 					Peers: peers,
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 		{Cmd: "freeze"},
@@ -1704,7 +1861,7 @@ func TestFreezePrimary(t *testing.T) {
 					State: gen1frozen,
 					Peers: []*discoverd.Instance{node(1, 1), node(2, 2), node(3, 3)},
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 
@@ -1720,7 +1877,7 @@ func TestFreezePrimary(t *testing.T) {
 					State: gen1frozen,
 					Peers: []*discoverd.Instance{node(1, 1), node(2, 2), node(3, 3), node(4, 4)},
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 
@@ -1736,7 +1893,7 @@ func TestFreezePrimary(t *testing.T) {
 					State: gen1frozen,
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3), node(4, 4)},
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 
@@ -1758,7 +1915,7 @@ func TestFreezePrimary(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3), node(4, 4)},
 				},
-				Postgres: gen2pg,
+				Database: gen2db,
 			},
 		},
 
@@ -1785,7 +1942,7 @@ func TestFreezePrimary(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3)},
 				},
-				Postgres: gen2pg,
+				Database: gen2db,
 			},
 		},
 
@@ -1806,7 +1963,7 @@ func TestFreezePrimary(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 1), node(3, 3)},
 				},
-				Postgres: gen2pg,
+				Database: gen2db,
 			},
 		},
 	})
@@ -1820,15 +1977,15 @@ func TestFreezeSync(t *testing.T) {
 		Primary:    node(2, 1),
 		Sync:       node(1, 2),
 		Async:      []*discoverd.Instance{node(3, 3)},
-		InitWAL:    xlog.Zero,
+		InitWAL:    xlogZero,
 		Freeze: &state.FreezeDetails{
 			FrozenAt: fakeTime,
 			Reason:   "frozen by simulator",
 		},
 	}
-	gen1pg := &simulator.PostgresInfo{
+	gen1db := &simulator.DatabaseInfo{
 		Online: true,
-		Config: &state.PgConfig{
+		Config: &state.Config{
 			Role:     state.RoleSync,
 			Upstream: node(2, 1),
 		},
@@ -1854,7 +2011,7 @@ func TestFreezeSync(t *testing.T) {
 					State: gen1,
 					Peers: []*discoverd.Instance{node(2, 1), node(1, 2), node(3, 3)},
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 
@@ -1871,7 +2028,7 @@ func TestFreezeSync(t *testing.T) {
 					State: gen1,
 					Peers: []*discoverd.Instance{node(1, 2), node(3, 3)},
 				},
-				Postgres: gen1pg,
+				Database: gen1db,
 			},
 		},
 
@@ -1893,9 +2050,9 @@ func TestFreezeSync(t *testing.T) {
 					},
 					Peers: []*discoverd.Instance{node(1, 2), node(3, 3)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:       state.RolePrimary,
 						Downstream: node(3, 3),
 					},
@@ -1929,17 +2086,17 @@ func TestAsyncChangeUpstream(t *testing.T) {
 						Primary:    node(2, 1),
 						Sync:       node(3, 2),
 						Async:      []*discoverd.Instance{node(4, 3), node(5, 4), node(1, 5)},
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(2, 1), node(3, 2), node(4, 3), node(5, 4), node(1, 5)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleAsync,
 						Upstream: node(5, 4),
 					},
-					XLog: xlog.Zero,
+					XLog: xlogZero,
 				},
 			},
 		},
@@ -1958,17 +2115,17 @@ func TestAsyncChangeUpstream(t *testing.T) {
 						Primary:    node(2, 1),
 						Sync:       node(3, 2),
 						Async:      []*discoverd.Instance{node(4, 3), node(1, 5)},
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(2, 1), node(3, 2), node(4, 3), node(1, 5)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleAsync,
 						Upstream: node(4, 3),
 					},
-					XLog: xlog.Zero,
+					XLog: xlogZero,
 				},
 			},
 		},
@@ -1987,17 +2144,17 @@ func TestAsyncChangeUpstream(t *testing.T) {
 						Primary:    node(2, 1),
 						Sync:       node(3, 2),
 						Async:      []*discoverd.Instance{node(1, 5)},
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(2, 1), node(3, 2), node(1, 5)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleAsync,
 						Upstream: node(3, 2),
 					},
-					XLog: xlog.Zero,
+					XLog: xlogZero,
 				},
 			},
 		},
@@ -2026,17 +2183,17 @@ func TestRemovedAsync(t *testing.T) {
 						Primary:    node(2, 1),
 						Sync:       node(3, 2),
 						Async:      []*discoverd.Instance{node(1, 3)},
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(2, 1), node(3, 2), node(1, 3)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleAsync,
 						Upstream: node(3, 2),
 					},
-					XLog: xlog.Zero,
+					XLog: xlogZero,
 				},
 			},
 		},
@@ -2054,16 +2211,16 @@ func TestRemovedAsync(t *testing.T) {
 						Generation: 1,
 						Primary:    node(2, 1),
 						Sync:       node(3, 2),
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(2, 1), node(3, 2), node(1, 3)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: false,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role: state.RoleNone,
 					},
-					XLog: xlog.Zero,
+					XLog: xlogZero,
 				},
 			},
 		},
@@ -2091,18 +2248,18 @@ func TestRemovedSync(t *testing.T) {
 						Primary:    node(2, 1),
 						Sync:       node(1, 2),
 						Async:      []*discoverd.Instance{node(3, 3)},
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(2, 1), node(1, 2), node(3, 3)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: true,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role:     state.RoleSync,
 						Upstream: node(2, 1),
 					},
-					XLog:        xlog.Zero,
-					XLogWaiting: xlog.Zero,
+					XLog:        xlogZero,
+					XLogWaiting: xlogZero,
 				},
 			},
 		},
@@ -2120,18 +2277,213 @@ func TestRemovedSync(t *testing.T) {
 						Generation: 2,
 						Primary:    node(2, 1),
 						Sync:       node(3, 3),
-						InitWAL:    xlog.Zero,
+						InitWAL:    xlogZero,
 					},
 					Peers: []*discoverd.Instance{node(2, 1), node(1, 2), node(3, 3)},
 				},
-				Postgres: &simulator.PostgresInfo{
+				Database: &simulator.DatabaseInfo{
 					Online: false,
-					Config: &state.PgConfig{
+					Config: &state.Config{
 						Role: state.RoleNone,
 					},
-					XLog: xlog.Zero,
+					XLog: xlogZero,
 				},
 			},
 		},
 	})
 }
+
+// Test freezing and unfreezing the cluster through the peer API
+func TestFreezePeer(t *testing.T) {
+	peers := []*discoverd.Instance{node(1, 1), node(2, 2), node(3, 3)}
+
+	gen1frozen := &state.State{
+		Generation: 1,
+		Primary:    node(1, 1),
+		Sync:       node(2, 2),
+		Async:      peers[2:],
+		InitWAL:    xlogZero,
+		Freeze: &state.FreezeDetails{
+			FrozenAt: fakeTime,
+			Reason:   "maintenance",
+		},
+	}
+	gen1db := &simulator.DatabaseInfo{
+		Online: true,
+		Config: &state.Config{
+			Role:       state.RolePrimary,
+			Downstream: node(2, 2),
+		},
+		XLog: "0/0000000A",
+	}
+
+	runSteps(t, false, []step{
+		{Cmd: "echo test: start cluster and freeze it"},
+		{Cmd: "addpeer node1"},
+		{Cmd: "addpeer"},
+		{Cmd: "addpeer"},
+		{Cmd: "startPeer"},
+		{Cmd: "freezePeer maintenance"},
+		{
+			Cmd: "discoverd",
+			Check: &simulator.DiscoverdInfo{
+				State: &state.DiscoverdState{Index: 2, State: gen1frozen},
+				Peers: peers,
+			},
+		},
+
+		// Freezing again doesn't change the state
+		{Cmd: "freezePeer"},
+		{
+			Cmd: "peer",
+			Check: &simulator.PeerSimInfo{
+				Peer: &state.PeerInfo{
+					ID:    node1ID,
+					Role:  state.RolePrimary,
+					State: gen1frozen,
+					Peers: peers,
+				},
+				Database: gen1db,
+			},
+		},
+
+		// Remove the sync, and make sure that the takeover happens once the
+		// cluster is unfrozen
+		{Cmd: "echo test: unfreeze with missing sync"},
+		{Cmd: "rmpeer node2"},
+		{
+			Cmd: "peer",
+			Check: &simulator.PeerSimInfo{
+				Peer: &state.PeerInfo{
+					ID:    node1ID,
+					Role:  state.RolePrimary,
+					State: gen1frozen,
+					Peers: []*discoverd.Instance{node(1, 1), node(3, 3)},
+				},
+				Database: gen1db,
+			},
+		},
+		{Cmd: "unfreezePeer"},
+		{
+			Cmd: "peer",
+			Check: &simulator.PeerSimInfo{
+				Peer: &state.PeerInfo{
+					ID:   node1ID,
+					Role: state.RolePrimary,
+					State: &state.State{
+						Generation: 2,
+						Primary:    node(1, 1),
+						Sync:       node(3, 3),
+						Async:      []*discoverd.Instance{},
+						InitWAL:    "0/0000000A",
+					},
+					Peers: []*discoverd.Instance{node(1, 1), node(3, 3)},
+				},
+				Database: &simulator.DatabaseInfo{
+					Online: true,
+					Config: &state.Config{
+						Role:       state.RolePrimary,
+						Downstream: node(3, 3),
+					},
+					XLog: "0/00000014",
+				},
+			},
+		},
+	})
+}
+
+// Test a requested takeover by the sync while the primary is present
+func TestTakeover(t *testing.T) {
+	gen1 := &state.State{
+		Generation: 1,
+		Primary:    node(3, 3),
+		Sync:       node(1, 1),
+		Async:      []*discoverd.Instance{node(2, 2)},
+		InitWAL:    xlogZero,
+	}
+	peers := []*discoverd.Instance{node(1, 1), node(2, 2), node(3, 3)}
+
+	runSteps(t, false, []step{
+		{Cmd: "echo test: start cluster as sync"},
+		{Cmd: "addpeer node1"},
+		{Cmd: "addpeer"},
+		{Cmd: "addpeer"},
+		{Cmd: "bootstrap node3"},
+		{Cmd: "startpeer"},
+		{Cmd: "catchUp"},
+
+		// A takeover requires the sync to have caught up to the given WAL
+		{Cmd: "echo test: takeover before catching up"},
+		{Cmd: "takeover 0/000000FF retrylater"},
+		{
+			Cmd: "peer",
+			Check: &simulator.PeerSimInfo{
+				Peer: &state.PeerInfo{
+					ID:    node1ID,
+					Role:  state.RoleSync,
+					State: gen1,
+					Peers: peers,
+				},
+				Database: &simulator.DatabaseInfo{
+					Online: true,
+					Config: &state.Config{
+						Role:     state.RoleSync,
+						Upstream: node(3, 3),
+					},
+					XLog: "0/0000000A",
+				},
+			},
+		},
+
+		// Take over and depose the primary, even though it is present
+		{Cmd: "echo test: takeover"},
+		{Cmd: "takeover 0/0000000A"},
+		{
+			Cmd: "peer",
+			Check: &simulator.PeerSimInfo{
+				Peer: &state.PeerInfo{
+					ID:   node1ID,
+					Role: state.RolePrimary,
+					State: &state.State{
+						Generation: 2,
+						Primary:    node(1, 1),
+						Sync:       node(2, 2),
+						Async:      []*discoverd.Instance{},
+						Deposed:    []*discoverd.Instance{node(3, 3)},
+						InitWAL:    "0/0000000A",
+					},
+					Peers: peers,
+				},
+				Database: &simulator.DatabaseInfo{
+					Online: true,
+					Config: &state.Config{
+						Role:       state.RolePrimary,
+						Downstream: node(2, 2),
+					},
+					XLog: "0/00000014",
+				},
+			},
+		},
+
+		// Only the sync can take over
+		{Cmd: "echo test: takeover as primary"},
+		{Cmd: "takeover"},
+		{
+			Cmd: "discoverd",
+			Check: &simulator.DiscoverdInfo{
+				State: &state.DiscoverdState{
+					Index: 2,
+					State: &state.State{
+						Generation: 2,
+						Primary:    node(1, 1),
+						Sync:       node(2, 2),
+						Async:      []*discoverd.Instance{},
+						Deposed:    []*discoverd.Instance{node(3, 3)},
+						InitWAL:    "0/0000000A",
+					},
+				},
+				Peers: peers,
+			},
+		},
+	})
+}
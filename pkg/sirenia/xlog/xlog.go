@@ -0,0 +1,20 @@
+// Package xlog defines the transaction log positions which the cluster state
+// machine uses to determine whether a standby has caught up with the primary.
+package xlog
+
+// Position is a position in the transaction log of a database, its format is
+// defined by the XLog implementation of the database.
+type Position string
+
+// XLog operates on the transaction log positions of a database.
+type XLog interface {
+	// Zero returns the position of an empty transaction log.
+	Zero() Position
+
+	// Increment returns the position increment units after pos.
+	Increment(pos Position, increment int) (Position, error)
+
+	// Compare compares two positions returning -1 if xlog1 < xlog2, 0 if
+	// xlog1 == xlog2, and 1 if xlog1 > xlog2.
+	Compare(xlog1, xlog2 Position) (int, error)
+}
@@ -144,8 +144,9 @@ func parseNextField(buf []byte, cursor *int) ([]byte, error) {
 	return res, nil
 }
 
+// STRUCTURED-DATA = NILVALUE / 1*SD-ELEMENT
 func parseStructuredData(buf []byte, cursor *int, msg *Message) error {
-	if len(buf) < *cursor {
+	if len(buf) <= *cursor {
 		return &ParseError{*cursor, "missing structured data field"}
 	}
 	if buf[*cursor] == '-' {
@@ -158,7 +159,49 @@ func parseStructuredData(buf []byte, cursor *int, msg *Message) error {
 		*cursor++
 		return nil
 	}
-	return &ParseError{*cursor, "structured data is unsupported"}
+	if buf[*cursor] != '[' {
+		return &ParseError{*cursor, "invalid structured data"}
+	}
+
+	start := *cursor
+	for *cursor < len(buf) && buf[*cursor] == '[' {
+		if err := parseSDElement(buf, cursor); err != nil {
+			return err
+		}
+	}
+	msg.StructuredData = buf[start:*cursor]
+
+	if *cursor < len(buf) {
+		if buf[*cursor] != ' ' {
+			return &ParseError{*cursor, "invalid structured data"}
+		}
+		*cursor++
+	}
+	return nil
+}
+
+// parseSDElement advances cursor past the SD-ELEMENT starting at cursor,
+// taking care to skip over brackets in quoted and escaped PARAM-VALUEs.
+//
+// SD-ELEMENT = "[" SD-ID *(SP SD-PARAM) "]"
+func parseSDElement(buf []byte, cursor *int) error {
+	quoted := false
+	for i := *cursor + 1; i < len(buf); i++ {
+		switch buf[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ']':
+			if !quoted {
+				*cursor = i + 1
+				return nil
+			}
+		}
+	}
+	return &ParseError{*cursor, "unterminated structured data element"}
 }
 
 func indexByteAfter(buf []byte, c byte, after int) int {
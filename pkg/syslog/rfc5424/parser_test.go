@@ -44,6 +44,35 @@ func (s *S) TestParse(c *C) {
 				},
 			},
 		},
+
+		// structured data
+		{
+			msg: fmt.Sprintf(`<1>1 %s - - - - [id1 a="1"][id2 b="x\"] \]"] message body`, tss),
+			want: &Message{
+				Header: Header{
+					Facility:  0,
+					Severity:  1,
+					Version:   1,
+					Timestamp: ts,
+				},
+				StructuredData: []byte(`[id1 a="1"][id2 b="x\"] \]"]`),
+				Msg:            []byte("message body"),
+			},
+		},
+
+		// structured data without a message
+		{
+			msg: fmt.Sprintf(`<1>1 %s - - - - [id1 a="1"]`, tss),
+			want: &Message{
+				Header: Header{
+					Facility:  0,
+					Severity:  1,
+					Version:   1,
+					Timestamp: ts,
+				},
+				StructuredData: []byte(`[id1 a="1"]`),
+			},
+		},
 	}
 
 	for _, test := range table {
@@ -55,3 +84,16 @@ func (s *S) TestParse(c *C) {
 		c.Assert(msg, DeepEquals, test.want)
 	}
 }
+
+func (s *S) TestParseInvalidStructuredData(c *C) {
+	tss := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, sd := range []string{
+		`id1`,
+		`[id1 a="1"`,
+		`[id1 a="]"`,
+		`[id1 a="1"]message`,
+	} {
+		_, err := Parse([]byte(fmt.Sprintf("<1>1 %s - - - - %s", tss, sd)))
+		c.Assert(err, NotNil, Commentf("structured data %q", sd))
+	}
+}
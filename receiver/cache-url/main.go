@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+)
+
+// main prints a signed blobstore URL of the repo cache with the cache key
+// given as the first argument, which gitreceived uses to read and write the
+// cache. It is valid for long enough for the push, including the build, to
+// finish.
+func main() {
+	cacheKey := strings.TrimSpace(os.Args[1])
+
+	client, err := controller.NewClient("", os.Getenv("CONTROLLER_AUTH_KEY"))
+	if err != nil {
+		log.Fatalln("Unable to connect to controller:", err)
+	}
+	url, err := client.SignBlobstoreURL(
+		fmt.Sprintf("http://blobstore.discoverd/cache/%s.tar", cacheKey),
+		[]string{"GET", "PUT"},
+		time.Now().Add(2*time.Hour),
+	)
+	if err != nil {
+		log.Fatalln("Error signing cache URL:", err)
+	}
+
+	fmt.Println(url)
+}
@@ -36,6 +36,10 @@ var typesPattern = regexp.MustCompile("types.* -> (.+)\n")
 
 const blobstoreURL = "http://blobstore.discoverd"
 
+// buildURLExpiry is how long the blobstore URLs given to slugbuilder are
+// valid for, which limits how long a build can take.
+const buildURLExpiry = 2 * time.Hour
+
 func main() {
 	client, err := controller.NewClient("", os.Getenv("CONTROLLER_AUTH_KEY"))
 	if err != nil {
@@ -61,7 +65,24 @@ func main() {
 
 	var output bytes.Buffer
 	slugURL := fmt.Sprintf("%s/%s.tgz", blobstoreURL, random.UUID())
-	cmd := exec.Command(exec.DockerImage(os.Getenv("SLUGBUILDER_IMAGE_URI")), slugURL)
+	// slugbuilder is given URLs which only allow it to upload the slug and
+	// read and write the build cache
+	expires := time.Now().Add(buildURLExpiry)
+	uploadMethods := []string{"PUT", "POST", "HEAD", "DELETE"}
+	signedSlugURL, err := client.SignBlobstoreURL(slugURL, uploadMethods, expires)
+	if err != nil {
+		log.Fatalln("Error signing slug URL:", err)
+	}
+	cacheURL, err := client.SignBlobstoreURL(
+		fmt.Sprintf("%s/%s-cache.tgz", blobstoreURL, app.ID),
+		append([]string{"GET"}, uploadMethods...),
+		expires,
+	)
+	if err != nil {
+		log.Fatalln("Error signing build cache URL:", err)
+	}
+
+	cmd := exec.Command(exec.DockerImage(os.Getenv("SLUGBUILDER_IMAGE_URI")), signedSlugURL)
 	cmd.Stdout = io.MultiWriter(os.Stdout, &output)
 	cmd.Stderr = os.Stderr
 	if len(prevRelease.Env) > 0 {
@@ -74,7 +95,10 @@ func main() {
 		cmd.Stdin = os.Stdin
 	}
 	cmd.Env = make(map[string]string)
-	cmd.Env["BUILD_CACHE_URL"] = fmt.Sprintf("%s/%s-cache.tgz", blobstoreURL, app.ID)
+	cmd.Env["BUILD_CACHE_URL"] = cacheURL
+	// upload the slug and cache in parts so that a failed request doesn't
+	// restart the whole upload
+	cmd.Env["RESUMABLE_UPLOADS"] = "true"
 	if buildpackURL, ok := prevRelease.Env["BUILDPACK_URL"]; ok {
 		cmd.Env["BUILDPACK_URL"] = buildpackURL
 	}
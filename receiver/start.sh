@@ -1,3 +1,3 @@
 #!/bin/sh
 
-exec /bin/gitreceived --auth-checker /bin/flynn-key-check --receiver /bin/flynn-receiver --cache-key-hook /bin/flynn-cache-key
+exec /bin/gitreceived --auth-checker /bin/flynn-key-check --receiver /bin/flynn-receiver --cache-key-hook /bin/flynn-cache-key --cache-url-hook /bin/flynn-cache-url
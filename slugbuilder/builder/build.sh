@@ -52,6 +52,71 @@ run_unprivileged() {
   setuidgid nobody $@
 }
 
+upload_part_size=$((16 * 1024 * 1024))
+upload_attempts=5
+
+# upload_file PUTs a file to a URL. If RESUMABLE_UPLOADS is set, the URL must
+# be a blobstore, and the file is uploaded in parts which are retried from the
+# last part the blobstore received if a request fails.
+upload_file() {
+  local file=$1
+  local url=$2
+
+  if [[ -z "${RESUMABLE_UPLOADS}" ]]; then
+    curl -0 -s -o /dev/null -X PUT -T "${file}" "${url}"
+    return
+  fi
+
+  # the URL may already have a query, e.g. a blobstore signature
+  local sep="?"
+  if [[ "${url}" == *\?* ]]; then
+    sep="&"
+  fi
+
+  local id=$(curl --silent --fail --request POST "${url}${sep}uploads" | sed -e 's/.*"id": *"\([0-9a-f]*\)".*/\1/')
+  if [[ -z "${id}" ]]; then
+    return 1
+  fi
+  local upload="${url}${sep}upload=${id}"
+  local size=$(stat --format %s "${file}")
+  local offset=0
+  local failures=0
+  local part=$(mktemp)
+
+  while (( offset < size )); do
+    dd if="${file}" of="${part}" bs=${upload_part_size} skip=$((offset / upload_part_size)) count=1 &>/dev/null
+    local digest=$(sha512sum "${part}" | cut -d " " -f 1)
+    if curl --silent --fail --output /dev/null \
+      --request PUT \
+      --header "Content-SHA512: ${digest}" \
+      --upload-file "${part}" \
+      "${upload}&offset=${offset}"; then
+      offset=$((offset + $(stat --format %s "${part}")))
+      failures=0
+    else
+      failures=$((failures + 1))
+      if (( failures >= upload_attempts )); then
+        rm -f "${part}"
+        curl --silent --output /dev/null --request DELETE "${upload}" || true
+        return 1
+      fi
+      sleep ${failures}
+      # resume from the last part which was received
+      local received=$(curl --silent --fail --head "${upload}" | tr -d "\r" | awk -F ": " 'tolower($1) == "upload-offset" { print $2 }')
+      if [[ -n "${received}" ]]; then
+        offset=${received}
+      fi
+    fi
+  done
+  rm -f "${part}"
+
+  local digest=$(sha512sum "${file}" | cut -d " " -f 1)
+  curl --silent --fail --output /dev/null \
+    --request POST \
+    --header "Content-SHA512: ${digest}" \
+    "${upload}"
+}
+
 cd ${app_dir}
 
 ## Load source from STDIN
@@ -186,20 +251,32 @@ if [[ "${slug_file}" != "-" ]]; then
   echo_title "Compiled slug size is ${slug_size}"
 
   if [[ ${put_url} ]]; then
-    curl -0 -s -o /dev/null -X PUT -T ${slug_file} "${put_url}"
+    upload_file "${slug_file}" "${put_url}"
   fi
 fi
 
 if [[ -n "${BUILD_CACHE_URL}" ]]; then
-  tar \
-    --create \
-    --directory "${cache_root}" \
-    --use-compress-program=pigz \
-    . \
-  | curl \
-    --silent \
-    --output /dev/null \
-    --request PUT \
-    --upload-file - \
-    "${BUILD_CACHE_URL}"
+  if [[ -n "${RESUMABLE_UPLOADS}" ]]; then
+    cache_file=$(mktemp)
+    tar \
+      --create \
+      --directory "${cache_root}" \
+      --use-compress-program=pigz \
+      --file "${cache_file}" \
+      .
+    upload_file "${cache_file}" "${BUILD_CACHE_URL}"
+    rm -f "${cache_file}"
+  else
+    tar \
+      --create \
+      --directory "${cache_root}" \
+      --use-compress-program=pigz \
+      . \
+    | curl \
+      --silent \
+      --output /dev/null \
+      --request PUT \
+      --upload-file - \
+      "${BUILD_CACHE_URL}"
+  fi
 fi
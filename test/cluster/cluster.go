@@ -264,6 +264,10 @@ func (c *Cluster) RemoveHost(id string) error {
 	case "libvirt-lxc":
 		// manually kill containers after stopping flynn-host due to https://github.com/flynn/flynn/issues/1177
 		cmd = "sudo start-stop-daemon --stop --pidfile /var/run/flynn-host.pid --retry 15 && (virsh -c lxc:/// list --name | xargs -L 1 virsh -c lxc:/// destroy || true)"
+	case "native":
+		// flynn-host stops its containers (see containerBackend.Cleanup)
+		// before exiting cleanly, so there is nothing left to kill
+		cmd = "sudo start-stop-daemon --stop --pidfile /var/run/flynn-host.pid --retry 15"
 	}
 	if err := inst.Run(cmd, nil); err != nil {
 		return err
@@ -343,6 +347,7 @@ func (c *Cluster) startFlynnHost(inst *Instance, peerInstances []*Instance) erro
 		IP:        inst.IP,
 		Peers:     strings.Join(peers, ","),
 		EtcdProxy: !inst.initial,
+		Backend:   c.bc.Backend,
 	}
 	tmpl.Execute(&script, data)
 	c.logf("Starting flynn-host on %s [id: %s]\n", inst.IP, inst.ID)
@@ -484,10 +489,15 @@ type hostScriptData struct {
 	IP        string
 	Peers     string
 	EtcdProxy bool
+	Backend   string
 }
 
 var flynnHostScripts = map[string]*template.Template{
-	"libvirt-lxc": template.Must(template.New("flynn-host-libvirt").Parse(`
+	"libvirt-lxc": flynnHostScript,
+	"native":      flynnHostScript,
+}
+
+var flynnHostScript = template.Must(template.New("flynn-host").Parse(`
 if [[ -f /usr/local/bin/debug-info.sh ]]; then
   /usr/local/bin/debug-info.sh &>/tmp/debug-info.log &
 fi
@@ -510,10 +520,9 @@ sudo start-stop-daemon \
   --manifest /etc/flynn-host.json \
   --external {{ .IP }} \
   --force \
-  --backend libvirt-lxc \
+  --backend {{ .Backend }} \
   &>/tmp/flynn-host.log
-`[1:])),
-}
+`[1:]))
 
 type bootstrapMsg struct {
 	Id    string          `json:"id"`
@@ -532,6 +532,7 @@ loop:
 	expected := map[string]map[string]int{release.ID: {
 		"web":       2,
 		"deployer":  2,
+		"gc":        1,
 		"scheduler": testCluster.Size(),
 	}}
 	t.Assert(actual, c.DeepEquals, expected)